@@ -56,6 +56,13 @@ type FlushManager interface {
 	// Unregister unregisters a flusher with the flush manager.
 	Unregister(flusher flushingMetricList) error
 
+	// FlushAll flushes every registered flusher immediately instead of when
+	// it is next due and returns once they have flushed. The flushers only
+	// flush the data they would flush at the current time, so data that is
+	// still buffered, such as the aggregations of windows that have yet to
+	// close, is not flushed. Only the leader flushes data.
+	FlushAll() error
+
 	// Close closes the flush manager.
 	Close() error
 }
@@ -82,6 +89,10 @@ type roleBasedFlushManager interface {
 	// Prepare prepares for a flush.
 	Prepare(buckets []*flushBucket) (flushTask, time.Duration)
 
+	// PrepareFlushAll prepares a flush of every flusher regardless of when
+	// they are next due, it returns nil if the manager does not flush data.
+	PrepareFlushAll(buckets []*flushBucket) flushTask
+
 	// OnBucketAdded is called when a new bucket is added.
 	OnBucketAdded(bucketIdx int, bucket *flushBucket)
 
@@ -99,6 +110,7 @@ var (
 	errFlushManagerAlreadyOpenOrClosed = errors.New("flush manager is already open or closed")
 	errFlushManagerNotOpenOrClosed     = errors.New("flush manager is not open or closed")
 	errFlushManagerOpen                = errors.New("flush manager is open")
+	errFlushManagerNotLeader           = errors.New("flush manager is not the leader")
 )
 
 type flushManagerState int
@@ -131,6 +143,10 @@ type flushManager struct {
 	followerMgr   roleBasedFlushManager
 	nowFn         clock.NowFn
 	sleepFn       sleepFn
+
+	// runLock serializes running flush tasks since the flushers do not
+	// support flushing concurrently.
+	runLock sync.Mutex
 }
 
 // NewFlushManager creates a new flush manager.
@@ -227,6 +243,30 @@ func (mgr *flushManager) Unregister(flusher flushingMetricList) error {
 	return bucket.Remove(flusher)
 }
 
+func (mgr *flushManager) FlushAll() error {
+	mgr.RLock()
+	if mgr.state != flushManagerOpen {
+		mgr.RUnlock()
+		return errFlushManagerNotOpenOrClosed
+	}
+	// NB: check the election state directly rather than the state the flush
+	// goroutine last observed, which lags behind until its next check.
+	roleMgr := mgr.followerMgr
+	if mgr.checkElectionState() == LeaderState {
+		roleMgr = mgr.leaderMgr
+	}
+	flushTask := roleMgr.PrepareFlushAll(mgr.buckets)
+	mgr.RUnlock()
+
+	if flushTask == nil {
+		return errFlushManagerNotLeader
+	}
+	mgr.runLock.Lock()
+	flushTask.Run()
+	mgr.runLock.Unlock()
+	return nil
+}
+
 func (mgr *flushManager) Status() FlushStatus {
 	mgr.RLock()
 	electionState := mgr.electionState
@@ -341,7 +381,9 @@ func (mgr *flushManager) flush() {
 		flushTask, waitFor := mgr.flushManagerWithLock().Prepare(mgr.buckets)
 		mgr.RUnlock()
 		if flushTask != nil {
+			mgr.runLock.Lock()
 			flushTask.Run()
+			mgr.runLock.Unlock()
 		}
 		if waitFor > 0 {
 			mgr.sleepFn(waitFor)
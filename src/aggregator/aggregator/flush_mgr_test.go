@@ -601,6 +601,48 @@ func TestFlushManagerFlush(t *testing.T) {
 	close(signalCh)
 }
 
+func TestFlushManagerFlushAllNotOpen(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mgr, _ := testFlushManager(t, ctrl)
+	require.Equal(t, errFlushManagerNotOpenOrClosed, mgr.FlushAll())
+}
+
+func TestFlushManagerFlushAll(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	electionState := FollowerState
+	electionManager := NewMockElectionManager(ctrl)
+	electionManager.EXPECT().
+		ElectionState().
+		DoAndReturn(func() ElectionState { return electionState }).
+		AnyTimes()
+
+	flushTask := NewMockflushTask(ctrl)
+	flushTask.EXPECT().Run()
+	leaderMgr := NewMockroleBasedFlushManager(ctrl)
+	leaderMgr.EXPECT().PrepareFlushAll(gomock.Any()).Return(flushTask)
+	followerMgr := NewMockroleBasedFlushManager(ctrl)
+	followerMgr.EXPECT().PrepareFlushAll(gomock.Any()).Return(nil)
+
+	mgr, _ := testFlushManager(t, ctrl)
+	mgr.electionMgr = electionManager
+	mgr.leaderMgr = leaderMgr
+	mgr.followerMgr = followerMgr
+	mgr.state = flushManagerOpen
+
+	// Followers have nothing to flush.
+	require.Equal(t, errFlushManagerNotLeader, mgr.FlushAll())
+
+	// The leader flushes even before the flush goroutine observes that the
+	// instance has been elected.
+	electionState = LeaderState
+	require.NoError(t, mgr.FlushAll())
+	require.Equal(t, FollowerState, mgr.electionState)
+}
+
 func TestFlushManagerComputeFlushIntervalOffsetJitterEnabled(t *testing.T) {
 	now := time.Unix(1234, 0)
 	nowFn := func() time.Time { return now }
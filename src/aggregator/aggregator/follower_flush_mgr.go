@@ -205,6 +205,10 @@ func (mgr *followerFlushManager) Prepare(buckets []*flushBucket) (flushTask, tim
 	return mgr.flushTask, 0
 }
 
+// NB: the follower only discards the data the leader has flushed, so there is
+// nothing for it to flush.
+func (mgr *followerFlushManager) PrepareFlushAll([]*flushBucket) flushTask { return nil }
+
 // NB(xichen): The follower flush manager flushes data based on the flush times
 // stored in kv and does not need to take extra actions when a new bucket is added.
 func (mgr *followerFlushManager) OnBucketAdded(int, *flushBucket) {}
@@ -48,6 +48,7 @@ func newLeaderFlusherMetrics(scope tally.Scope) leaderFlusherMetrics {
 
 type leaderFlushManagerMetrics struct {
 	queueSize tally.Gauge
+	flushAll  tally.Timer
 	standard  leaderFlusherMetrics
 	forwarded leaderFlusherMetrics
 	timed     leaderFlusherMetrics
@@ -59,6 +60,7 @@ func newLeaderFlushManagerMetrics(scope tally.Scope) leaderFlushManagerMetrics {
 	timedScope := scope.Tagged(map[string]string{"flusher-type": "timed"})
 	return leaderFlushManagerMetrics{
 		queueSize: scope.Gauge("queue-size"),
+		flushAll:  scope.Timer("flush-all"),
 		standard:  newLeaderFlusherMetrics(standardScope),
 		forwarded: newLeaderFlusherMetrics(forwardedScope),
 		timed:     newLeaderFlusherMetrics(timedScope),
@@ -184,6 +186,20 @@ func (mgr *leaderFlushManager) Prepare(buckets []*flushBucket) (flushTask, time.
 	return mgr.flushTask, waitFor
 }
 
+// PrepareFlushAll prepares a flush of the flushers of every bucket, the next
+// scheduled flushes of the buckets are unchanged.
+func (mgr *leaderFlushManager) PrepareFlushAll(buckets []*flushBucket) flushTask {
+	var flushers []flushingMetricList
+	for _, bucket := range buckets {
+		flushers = append(flushers, bucket.flushers...)
+	}
+	return &leaderFlushTask{
+		mgr:      mgr,
+		duration: mgr.metrics.flushAll,
+		flushers: flushers,
+	}
+}
+
 // NB(xichen): if the current instance is a leader, we need to update the flush
 // times heap for the flush goroutine to pick it up.
 func (mgr *leaderFlushManager) OnBucketAdded(
@@ -430,6 +430,34 @@ func TestLeaderFlushManagerOnBucketAdded(t *testing.T) {
 	validateFlushMetadataHeap(t, expectedFlushTimes, mgr.flushTimes)
 }
 
+func TestLeaderFlushManagerPrepareFlushAll(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	flushers1 := []flushingMetricList{NewMockflushingMetricList(ctrl)}
+	flushers2 := []flushingMetricList{
+		NewMockflushingMetricList(ctrl),
+		NewMockflushingMetricList(ctrl),
+	}
+	buckets := []*flushBucket{
+		&flushBucket{interval: time.Second, flushers: flushers1},
+		&flushBucket{interval: time.Minute, flushers: flushers2},
+	}
+
+	doneCh := make(chan struct{})
+	opts := NewFlushManagerOptions()
+	mgr := newLeaderFlushManager(doneCh, opts).(*leaderFlushManager)
+	mgr.Init(buckets)
+	earliest := mgr.flushTimes.Min()
+
+	flushTask := mgr.PrepareFlushAll(buckets).(*leaderFlushTask)
+	require.Equal(t, append(flushers1, flushers2...), flushTask.flushers)
+
+	// The scheduled flushes are unchanged.
+	require.Equal(t, 2, mgr.flushTimes.Len())
+	require.Equal(t, earliest, mgr.flushTimes.Min())
+}
+
 func TestCloneFlushTimesByShard(t *testing.T) {
 	cloned := cloneFlushTimesByShard(testFlushTimes2.ByShard)
 	actual := &schema.ShardSetFlushTimes{ByShard: cloned}
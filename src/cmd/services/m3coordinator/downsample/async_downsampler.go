@@ -92,3 +92,12 @@ func (d *asyncDownsampler) NewMetricsAppender() (MetricsAppender, error) {
 	}
 	return d.downsampler.NewMetricsAppender()
 }
+
+func (d *asyncDownsampler) Flush() error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.err != nil {
+		return d.err
+	}
+	return d.downsampler.Flush()
+}
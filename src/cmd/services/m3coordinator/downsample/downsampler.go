@@ -21,21 +21,50 @@
 package downsample
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/query/models"
 )
 
 // Downsampler is a downsampler.
 type Downsampler interface {
 	NewMetricsAppender() (MetricsAppender, error)
+	// Flush writes the aggregated datapoints of every aggregation window
+	// that has closed to storage now instead of when the aggregator next
+	// flushes them, and returns once they are written. A window closes once
+	// it ends and any buffer it keeps for late samples has passed, windows
+	// that are still open are not flushed since their aggregates are
+	// incomplete. The downsampler keeps aggregating as usual after a flush.
+	// It returns an error if any of the flushed datapoints fail to be
+	// written.
+	Flush() error
 }
 
 // MetricsAppender is a metrics appender that can build a samples
 // appender, only valid to use with a single caller at a time.
 type MetricsAppender interface {
 	AddTag(name, value []byte)
-	SamplesAppender(opts SampleAppenderOptions) (SamplesAppender, error)
+	// AddTags adds each of the tags, it is equivalent to calling AddTag for
+	// each of them but avoids a call per tag for metrics with many tags.
+	AddTags(tags []models.Tag)
+	SamplesAppender(opts SampleAppenderOptions) (SamplesAppenderResult, error)
 	Reset()
-	Finalize()
+	// Finalize releases the resources of the appender, returning any error
+	// encountered doing so.
+	Finalize() error
+}
+
+// SamplesAppenderResult is the result of building a samples appender for
+// a metric, including which of the rules matched the metric.
+type SamplesAppenderResult struct {
+	SamplesAppender SamplesAppender
+	// MappingRulesMatched is true if the metric matched any mapping rules,
+	// or any override mapping rules were provided.
+	MappingRulesMatched bool
+	// NumRollups is the number of rollup metrics the metric contributes to.
+	NumRollups int
 }
 
 // SampleAppenderOptions defines the options being used when constructing
@@ -50,6 +79,13 @@ type SampleAppenderOptions struct {
 // for an ID.
 type SamplesAppenderOverrideRules struct {
 	MappingRules []MappingRule
+
+	// Aggregations, if set, replaces the aggregation types of the mapping
+	// rules the samples are aggregated with. With Override set it replaces
+	// the aggregations of each of the MappingRules, otherwise it replaces
+	// those of the default and matched mapping rules of the ID. Rollup rules
+	// and matched pipelines with operations keep their own aggregations.
+	Aggregations []aggregation.Type
 }
 
 // SamplesAppender is a downsampling samples appender,
@@ -57,8 +93,26 @@ type SamplesAppenderOverrideRules struct {
 type SamplesAppender interface {
 	AppendCounterSample(value int64) error
 	AppendGaugeSample(value float64) error
+	// AppendGaugeSampleWithAnnotation appends a gauge sample with the
+	// annotation of its datapoint. Aggregated metrics do not retain the
+	// annotations of their samples so the annotation is currently dropped.
+	AppendGaugeSampleWithAnnotation(value float64, annotation []byte) error
+	AppendTimerSample(value float64) error
 	AppendCounterTimedSample(t time.Time, value int64) error
 	AppendGaugeTimedSample(t time.Time, value float64) error
+	// AppendGaugeSamples appends a gauge sample for each of the values in
+	// a single call, stopping at the first value that fails to be appended.
+	// It returns the number of values appended before the one that failed.
+	AppendGaugeSamples(values []float64) (int, error)
+	// AppendGaugeTimedSamples appends a timed gauge sample for each of the
+	// samples in a single call the same way as AppendGaugeSamples.
+	AppendGaugeTimedSamples(samples []TimedSample) (int, error)
+}
+
+// TimedSample is the value of a sample and the time it is aggregated at.
+type TimedSample struct {
+	Time  time.Time
+	Value float64
 }
 
 type downsampler struct {
@@ -74,9 +128,23 @@ func (d *downsampler) NewMetricsAppender() (MetricsAppender, error) {
 		tagEncoder:             d.agg.pools.tagEncoderPool.Get(),
 		matcher:                d.agg.matcher,
 		metricTagsIteratorPool: d.agg.pools.metricTagsIteratorPool,
+		windowOffset:           d.agg.windowOffset,
 	}), nil
 }
 
+func (d *downsampler) Flush() error {
+	writeErrors := d.agg.flushHandler.numWriteErrors()
+	if err := d.agg.flushManager.FlushAll(); err != nil {
+		return err
+	}
+	// NB: flushes are serialized and each waits for the writes of the
+	// datapoints it flushes, so any new errors are from this flush.
+	if n := d.agg.flushHandler.numWriteErrors() - writeErrors; n > 0 {
+		return fmt.Errorf("failed to write %d flushed aggregated datapoints", n)
+	}
+	return nil
+}
+
 func newMetricsAppender(opts metricsAppenderOptions) *metricsAppender {
 	return &metricsAppender{
 		metricsAppenderOptions: opts,
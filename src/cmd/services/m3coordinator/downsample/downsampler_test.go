@@ -22,6 +22,8 @@ package downsample
 
 import (
 	"bytes"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -163,6 +165,152 @@ func TestDownsamplerAggregationWithOverrideRules(t *testing.T) {
 	testDownsamplerAggregation(t, testDownsampler)
 }
 
+func TestDownsamplerAggregationWithOverrideAggregations(t *testing.T) {
+	testDownsampler := newTestDownsampler(t, testDownsamplerOptions{
+		sampleAppenderOpts: &SampleAppenderOptions{
+			Override: true,
+			OverrideRules: SamplesAppenderOverrideRules{
+				MappingRules: []MappingRule{
+					{
+						Aggregations: []aggregation.Type{aggregation.Mean},
+						Policies: []policy.StoragePolicy{
+							policy.MustParseStoragePolicy("4s:1d"),
+						},
+					},
+				},
+				Aggregations: []aggregation.Type{aggregation.Max},
+			},
+		},
+		expectedAdjusted: map[string]float64{
+			"gauge0":   6.0,
+			"counter0": 3.0,
+		},
+		autoMappingRules: []MappingRule{
+			{
+				Aggregations: []aggregation.Type{testAggregationType},
+				Policies:     testAggregationStoragePolicies,
+			},
+		},
+	})
+
+	// Test expected output
+	testDownsamplerAggregation(t, testDownsampler)
+}
+
+func TestDownsamplerAggregationWithMatchedRulesOverrideAggregations(t *testing.T) {
+	testDownsampler := newTestDownsampler(t, testDownsamplerOptions{
+		sampleAppenderOpts: &SampleAppenderOptions{
+			OverrideRules: SamplesAppenderOverrideRules{
+				Aggregations: []aggregation.Type{aggregation.Max},
+			},
+		},
+		expectedAdjusted: map[string]float64{
+			"gauge0":   6.0,
+			"counter0": 3.0,
+		},
+		autoMappingRules: []MappingRule{
+			{
+				Aggregations: []aggregation.Type{testAggregationType},
+				Policies:     testAggregationStoragePolicies,
+			},
+		},
+	})
+
+	// Test expected output
+	testDownsamplerAggregation(t, testDownsampler)
+}
+
+func TestDownsamplerFlush(t *testing.T) {
+	var (
+		nowLock sync.Mutex
+		now     = time.Now().Truncate(time.Minute)
+	)
+	nowFn := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	testDownsampler := newTestDownsampler(t, testDownsamplerOptions{
+		clockOpts: clock.NewOptions().SetNowFn(nowFn),
+		autoMappingRules: []MappingRule{
+			{
+				Aggregations: []aggregation.Type{testAggregationType},
+				Policies:     testAggregationStoragePolicies,
+			},
+		},
+	})
+	downsampler := testDownsampler.downsampler
+
+	appender, err := downsampler.NewMetricsAppender()
+	require.NoError(t, err)
+	defer appender.Finalize()
+
+	tags := map[string]string{"__name__": "gauge0", "app": "testapp"}
+	for name, value := range tags {
+		appender.AddTag([]byte(name), []byte(value))
+	}
+	samplesAppenderResult, err := appender.SamplesAppender(SampleAppenderOptions{})
+	require.NoError(t, err)
+	for _, sample := range []float64{4, 5, 6} {
+		err := samplesAppenderResult.SamplesAppender.AppendGaugeSample(sample)
+		require.NoError(t, err)
+	}
+
+	// The window is still open so there is nothing to flush.
+	require.NoError(t, downsampler.Flush())
+	require.Equal(t, 0, len(testDownsampler.storage.Writes()))
+
+	// Once the window closes the flush writes its aggregate right away.
+	nowLock.Lock()
+	now = now.Add(testAggregationStoragePolicies[0].Resolution().Window)
+	nowLock.Unlock()
+	require.NoError(t, downsampler.Flush())
+
+	writes := testDownsampler.storage.Writes()
+	require.Equal(t, 1, len(writes))
+	assert.Equal(t, tags, tagsToStringMap(writes[0].Tags))
+	require.Equal(t, 1, len(writes[0].Datapoints))
+	assert.Equal(t, float64(15), writes[0].Datapoints[0].Value)
+}
+
+func TestDownsamplerFlushWriteError(t *testing.T) {
+	var (
+		nowLock sync.Mutex
+		now     = time.Now().Truncate(time.Minute)
+	)
+	nowFn := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	testDownsampler := newTestDownsampler(t, testDownsamplerOptions{
+		clockOpts: clock.NewOptions().SetNowFn(nowFn),
+		autoMappingRules: []MappingRule{
+			{
+				Aggregations: []aggregation.Type{testAggregationType},
+				Policies:     testAggregationStoragePolicies,
+			},
+		},
+	})
+	testDownsampler.storage.SetWriteResult(errors.New("write error"))
+	downsampler := testDownsampler.downsampler
+
+	appender, err := downsampler.NewMetricsAppender()
+	require.NoError(t, err)
+	defer appender.Finalize()
+
+	appender.AddTag([]byte("__name__"), []byte("gauge0"))
+	samplesAppenderResult, err := appender.SamplesAppender(SampleAppenderOptions{})
+	require.NoError(t, err)
+	require.NoError(t, samplesAppenderResult.SamplesAppender.AppendGaugeSample(1))
+
+	nowLock.Lock()
+	now = now.Add(testAggregationStoragePolicies[0].Resolution().Window)
+	nowLock.Unlock()
+	require.Error(t, downsampler.Flush())
+	require.Equal(t, 1, len(testDownsampler.storage.Writes()))
+}
+
 func testDownsamplerAggregation(
 	t *testing.T,
 	testDownsampler testDownsampler,
@@ -213,9 +361,11 @@ func testDownsamplerAggregation(
 			appender.AddTag([]byte(name), []byte(value))
 		}
 
-		samplesAppender, err := appender.SamplesAppender(opts)
+		samplesAppenderResult, err := appender.SamplesAppender(opts)
 		require.NoError(t, err)
 
+		samplesAppender := samplesAppenderResult.SamplesAppender
+
 		for _, sample := range metric.samples {
 			if testOpts.timedSamples {
 				err = samplesAppender.AppendCounterTimedSample(time.Now(), sample)
@@ -231,9 +381,11 @@ func testDownsamplerAggregation(
 			appender.AddTag([]byte(name), []byte(value))
 		}
 
-		samplesAppender, err := appender.SamplesAppender(opts)
+		samplesAppenderResult, err := appender.SamplesAppender(opts)
 		require.NoError(t, err)
 
+		samplesAppender := samplesAppenderResult.SamplesAppender
+
 		for _, sample := range metric.samples {
 			if testOpts.timedSamples {
 				err = samplesAppender.AppendGaugeTimedSample(time.Now(), sample)
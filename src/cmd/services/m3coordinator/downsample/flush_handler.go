@@ -24,9 +24,9 @@ import (
 	"bytes"
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/m3db/m3/src/aggregator/aggregator/handler"
 	"github.com/m3db/m3/src/aggregator/aggregator/handler/writer"
 	"github.com/m3db/m3/src/metrics/metric/aggregated"
 	"github.com/m3db/m3/src/query/models"
@@ -61,6 +61,10 @@ type downsamplerFlushHandler struct {
 	instrumentOpts         instrument.Options
 	metrics                downsamplerFlushHandlerMetrics
 	tagOptions             models.TagOptions
+	windowOffset           time.Duration
+	// writeErrors is the number of aggregated datapoints that failed to be
+	// written, see numWriteErrors.
+	writeErrors int64
 }
 
 type downsamplerFlushHandlerMetrics struct {
@@ -82,8 +86,9 @@ func newDownsamplerFlushHandler(
 	metricTagsIteratorPool serialize.MetricTagsIteratorPool,
 	workerPool xsync.WorkerPool,
 	tagOptions models.TagOptions,
+	windowOffset time.Duration,
 	instrumentOpts instrument.Options,
-) handler.Handler {
+) *downsamplerFlushHandler {
 	scope := instrumentOpts.MetricsScope().SubScope("downsampler-flush-handler")
 	return &downsamplerFlushHandler{
 		storage:                storage,
@@ -92,6 +97,7 @@ func newDownsamplerFlushHandler(
 		instrumentOpts:         instrumentOpts,
 		metrics:                newDownsamplerFlushHandlerMetrics(scope),
 		tagOptions:             tagOptions,
+		windowOffset:           windowOffset,
 	}
 }
 
@@ -108,6 +114,12 @@ func (h *downsamplerFlushHandler) NewWriter(
 func (h *downsamplerFlushHandler) Close() {
 }
 
+// numWriteErrors returns the number of aggregated datapoints that have
+// failed to be written since the handler was created.
+func (h *downsamplerFlushHandler) numWriteErrors() int64 {
+	return atomic.LoadInt64(&h.writeErrors)
+}
+
 type downsamplerFlushHandlerWriter struct {
 	tagOptions models.TagOptions
 	wg         sync.WaitGroup
@@ -163,13 +175,14 @@ func (w *downsamplerFlushHandlerWriter) Write(
 		if err != nil {
 			logger.Errorf("downsampler flush error preparing write: %v", err)
 			w.handler.metrics.flushErrors.Inc(1)
+			atomic.AddInt64(&w.handler.writeErrors, 1)
 			return
 		}
 
 		err = w.handler.storage.Write(w.ctx, &storage.WriteQuery{
 			Tags: tags,
 			Datapoints: ts.Datapoints{ts.Datapoint{
-				Timestamp: time.Unix(0, mp.TimeNanos),
+				Timestamp: time.Unix(0, mp.TimeNanos).Add(w.handler.windowOffset),
 				Value:     mp.Value,
 			}},
 			Unit: convert.UnitForM3DB(mp.StoragePolicy.Resolution().Precision),
@@ -182,6 +195,7 @@ func (w *downsamplerFlushHandlerWriter) Write(
 		if err != nil {
 			logger.Errorf("downsampler flush error failed write: %v", err)
 			w.handler.metrics.flushErrors.Inc(1)
+			atomic.AddInt64(&w.handler.writeErrors, 1)
 			return
 		}
 
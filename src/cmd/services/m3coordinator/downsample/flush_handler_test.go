@@ -23,6 +23,7 @@ package downsample
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/m3db/m3/src/metrics/metric/aggregated"
 	"github.com/m3db/m3/src/metrics/metric/id"
@@ -53,7 +54,7 @@ func TestDownsamplerFlushHandlerCopiesTags(t *testing.T) {
 	instrumentOpts := instrument.NewOptions()
 
 	handler := newDownsamplerFlushHandler(store, pool,
-		workers, models.NewTagOptions(), instrumentOpts)
+		workers, models.NewTagOptions(), 0, instrumentOpts)
 	writer, err := handler.NewWriter(tally.NoopScope)
 	require.NoError(t, err)
 
@@ -104,3 +105,44 @@ func TestDownsamplerFlushHandlerCopiesTags(t *testing.T) {
 	assert.False(t, xtest.ByteSlicesBackedBySameData(tagName, tag.Name))
 	assert.False(t, xtest.ByteSlicesBackedBySameData(tagValue, tag.Value))
 }
+
+func TestDownsamplerFlushHandlerWindowOffset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	store := mock.NewMockStorage()
+	pool := serialize.NewMockMetricTagsIteratorPool(ctrl)
+
+	workers := xsync.NewWorkerPool(1)
+	workers.Init()
+
+	handler := newDownsamplerFlushHandler(store, pool,
+		workers, models.NewTagOptions(), 30*time.Second, instrument.NewOptions())
+	writer, err := handler.NewWriter(tally.NoopScope)
+	require.NoError(t, err)
+
+	iter := serialize.NewMockMetricTagsIterator(ctrl)
+	iter.EXPECT().Reset(gomock.Any())
+	iter.EXPECT().NumTags().Return(0)
+	iter.EXPECT().Next().Return(false)
+	iter.EXPECT().Err().Return(nil)
+	iter.EXPECT().Close()
+	pool.EXPECT().Get().Return(iter)
+
+	// The window ending at one minute on the clock of the aggregator ends
+	// at a minute and a half once shifted by the offset.
+	err = writer.Write(aggregated.ChunkedMetricWithStoragePolicy{
+		ChunkedMetric: aggregated.ChunkedMetric{
+			ChunkedID: id.ChunkedID{Data: []byte("foo")},
+			TimeNanos: time.Minute.Nanoseconds(),
+			Value:     42,
+		},
+		StoragePolicy: policy.MustParseStoragePolicy("1m:1d"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, writer.Flush())
+
+	writes := store.Writes()
+	require.Equal(t, 1, len(writes))
+	require.Equal(t, time.Unix(90, 0), writes[0].Datapoints[0].Timestamp)
+}
@@ -26,8 +26,10 @@ import (
 	"time"
 
 	"github.com/m3db/m3/src/aggregator/aggregator"
+	"github.com/m3db/m3/src/metrics/aggregation"
 	"github.com/m3db/m3/src/metrics/matcher"
 	"github.com/m3db/m3/src/metrics/metadata"
+	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/x/serialize"
 	"github.com/m3db/m3x/clock"
 )
@@ -46,24 +48,29 @@ type metricsAppenderOptions struct {
 	tagEncoder             serialize.TagEncoder
 	matcher                matcher.Matcher
 	metricTagsIteratorPool serialize.MetricTagsIteratorPool
+	windowOffset           time.Duration
 }
 
 func (a *metricsAppender) AddTag(name, value []byte) {
 	a.tags.append(name, value)
 }
 
-func (a *metricsAppender) SamplesAppender(opts SampleAppenderOptions) (SamplesAppender, error) {
+func (a *metricsAppender) AddTags(tags []models.Tag) {
+	a.tags.appendTags(tags)
+}
+
+func (a *metricsAppender) SamplesAppender(opts SampleAppenderOptions) (SamplesAppenderResult, error) {
 	// Sort tags
 	sort.Sort(a.tags)
 
 	// Encode tags and compute a temporary (unowned) ID
 	a.tagEncoder.Reset()
 	if err := a.tagEncoder.Encode(a.tags); err != nil {
-		return nil, err
+		return SamplesAppenderResult{}, err
 	}
 	data, ok := a.tagEncoder.Data()
 	if !ok {
-		return nil, fmt.Errorf("unable to encode tags: names=%v, values=%v",
+		return SamplesAppenderResult{}, fmt.Errorf("unable to encode tags: names=%v, values=%v",
 			a.tags.names, a.tags.values)
 	}
 
@@ -80,50 +87,99 @@ func (a *metricsAppender) SamplesAppender(opts SampleAppenderOptions) (SamplesAp
 	matchResult := a.matcher.ForwardMatch(id, fromNanos, toNanos)
 	id.Close()
 
+	aggregations := opts.OverrideRules.Aggregations
+	var result SamplesAppenderResult
 	if opts.Override {
+		result.MappingRulesMatched = len(opts.OverrideRules.MappingRules) > 0
 		for _, rule := range opts.OverrideRules.MappingRules {
+			if len(aggregations) > 0 {
+				rule.Aggregations = aggregations
+			}
 			stagedMetadatas, err := rule.StagedMetadatas()
 			if err != nil {
-				return nil, err
+				return SamplesAppenderResult{}, err
 			}
 			a.multiSamplesAppender.addSamplesAppender(samplesAppender{
 				agg:             a.agg,
 				unownedID:       unownedID,
 				stagedMetadatas: stagedMetadatas,
+				windowOffset:    a.windowOffset,
 			})
 		}
 	} else {
+		var aggID aggregation.ID
+		if len(aggregations) > 0 {
+			var err error
+			aggID, err = aggregation.CompressTypes(aggregations...)
+			if err != nil {
+				return SamplesAppenderResult{}, err
+			}
+		}
+
 		// Always aggregate any default staged metadats
 		for _, stagedMetadatas := range a.defaultStagedMetadatas {
+			if len(aggregations) > 0 {
+				stagedMetadatas = stagedMetadatasWithAggregationID(stagedMetadatas, aggID)
+			}
 			a.multiSamplesAppender.addSamplesAppender(samplesAppender{
 				agg:             a.agg,
 				unownedID:       unownedID,
 				stagedMetadatas: stagedMetadatas,
+				windowOffset:    a.windowOffset,
 			})
 		}
 
 		stagedMetadatas := matchResult.ForExistingIDAt(nowNanos)
 		if !stagedMetadatas.IsDefault() && len(stagedMetadatas) != 0 {
+			result.MappingRulesMatched = true
+			if len(aggregations) > 0 {
+				stagedMetadatas = stagedMetadatasWithAggregationID(stagedMetadatas, aggID)
+			}
 			// Only sample if going to actually aggregate
 			a.multiSamplesAppender.addSamplesAppender(samplesAppender{
 				agg:             a.agg,
 				unownedID:       unownedID,
 				stagedMetadatas: stagedMetadatas,
+				windowOffset:    a.windowOffset,
 			})
 		}
 
 		numRollups := matchResult.NumNewRollupIDs()
+		result.NumRollups = numRollups
 		for i := 0; i < numRollups; i++ {
 			rollup := matchResult.ForNewRollupIDsAt(i, nowNanos)
 			a.multiSamplesAppender.addSamplesAppender(samplesAppender{
 				agg:             a.agg,
 				unownedID:       rollup.ID,
 				stagedMetadatas: rollup.Metadatas,
+				windowOffset:    a.windowOffset,
 			})
 		}
 	}
 
-	return a.multiSamplesAppender, nil
+	result.SamplesAppender = a.multiSamplesAppender
+	return result, nil
+}
+
+// stagedMetadatasWithAggregationID returns a copy of the staged metadatas
+// with the aggregation ID of every pipeline without operations replaced.
+func stagedMetadatasWithAggregationID(
+	stagedMetadatas metadata.StagedMetadatas,
+	aggID aggregation.ID,
+) metadata.StagedMetadatas {
+	result := make(metadata.StagedMetadatas, 0, len(stagedMetadatas))
+	for _, stagedMetadata := range stagedMetadatas {
+		pipelines := make(metadata.PipelineMetadatas, 0, len(stagedMetadata.Pipelines))
+		for _, pipeline := range stagedMetadata.Pipelines {
+			if pipeline.Pipeline.IsEmpty() {
+				pipeline.AggregationID = aggID
+			}
+			pipelines = append(pipelines, pipeline)
+		}
+		stagedMetadata.Pipelines = pipelines
+		result = append(result, stagedMetadata)
+	}
+	return result
 }
 
 func (a *metricsAppender) Reset() {
@@ -131,7 +187,8 @@ func (a *metricsAppender) Reset() {
 	a.tags.values = a.tags.values[:0]
 }
 
-func (a *metricsAppender) Finalize() {
+func (a *metricsAppender) Finalize() error {
 	a.tagEncoder.Finalize()
 	a.tagEncoder = nil
+	return nil
 }
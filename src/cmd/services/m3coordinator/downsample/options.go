@@ -28,7 +28,6 @@ import (
 	"time"
 
 	"github.com/m3db/m3/src/aggregator/aggregator"
-	"github.com/m3db/m3/src/aggregator/aggregator/handler"
 	"github.com/m3db/m3/src/aggregator/client"
 	"github.com/m3db/m3/src/cluster/kv"
 	"github.com/m3db/m3/src/cluster/kv/mem"
@@ -92,6 +91,18 @@ var (
 	errNoTagDecoderPoolOptions = errors.New("dynamic downsampling enabled with tag decoder pool options not set")
 )
 
+// bufferForPastTimedMetricFn returns the buffer for past timed metrics that
+// keeps windows open for at least the late sample grace period.
+func bufferForPastTimedMetricFn(gracePeriod time.Duration) aggregator.BufferForPastTimedMetricFn {
+	return func(r time.Duration) time.Duration {
+		value := defaultBufferForPastTimedMetricFn(r)
+		if gracePeriod > value {
+			return gracePeriod
+		}
+		return value
+	}
+}
+
 // DownsamplerOptions is a set of required downsampler options.
 type DownsamplerOptions struct {
 	Storage                 storage.Storage
@@ -167,10 +178,13 @@ func (o DownsamplerOptions) validate() error {
 
 type agg struct {
 	aggregator             aggregator.Aggregator
+	flushManager           aggregator.FlushManager
+	flushHandler           *downsamplerFlushHandler
 	defaultStagedMetadatas []metadata.StagedMetadatas
 	clockOpts              clock.Options
 	matcher                matcher.Matcher
 	pools                  aggPools
+	windowOffset           time.Duration
 }
 
 // Configuration configurates a downsampler.
@@ -186,6 +200,26 @@ type Configuration struct {
 
 	// Pool of gauge elements.
 	GaugeElemPool pool.ObjectPoolConfiguration `yaml:"gaugeElemPool"`
+
+	// LateSampleGracePeriod is how long after its timestamp a sample can
+	// arrive and still be aggregated into the window of its timestamp rather
+	// than the window it arrives in. Each aggregation window is held open
+	// for the larger of the grace period and its default buffer, so memory
+	// used by the aggregator grows with the grace period since more windows
+	// are retained per series at once, this matters most for low resolution
+	// namespaces whose default buffer is small relative to the grace period.
+	LateSampleGracePeriod time.Duration `yaml:"lateSampleGracePeriod" validate:"min=0"`
+
+	// WindowOffset offsets the aggregation windows from their default
+	// alignment to multiples of their resolution since the Unix epoch, which
+	// for resolutions that divide a day aligns them to the boundaries of UTC
+	// minutes, hours and so on. For instance an offset of 30s aligns one
+	// minute windows to half past each minute. Aggregated datapoints are
+	// timestamped at the end of their window as usual. As without an offset
+	// the first window after startup and the last window before shutdown
+	// only hold the samples received while running, so their aggregates
+	// cover part of the window.
+	WindowOffset time.Duration `yaml:"windowOffset" validate:"min=0"`
 }
 
 // NewDownsampler returns a new downsampler.
@@ -271,13 +305,25 @@ func (cfg Configuration) newAggregator(o DownsamplerOptions) (agg, error) {
 		return agg{}, err
 	}
 
+	// Windows are aligned to multiples of their resolution on the clock of
+	// the aggregator, shifting its clock back by the window offset aligns
+	// windows to the offset instead. Aggregated datapoints are shifted forward
+	// by the offset when flushed to restore their actual timestamps.
+	aggClockOpts := clockOpts
+	if offset := cfg.WindowOffset; offset > 0 {
+		nowFn := clockOpts.NowFn()
+		aggClockOpts = clockOpts.SetNowFn(func() time.Time {
+			return nowFn().Add(-offset)
+		})
+	}
+
 	flushManager, flushHandler := o.newAggregatorFlushManagerAndHandler(serviceID,
-		placementManager, flushTimesManager, electionManager, instrumentOpts,
-		storageFlushConcurrency, pools)
+		placementManager, flushTimesManager, electionManager, aggClockOpts,
+		instrumentOpts, storageFlushConcurrency, cfg.WindowOffset, pools)
 
 	// Finally construct all options
 	aggregatorOpts := aggregator.NewOptions().
-		SetClockOptions(clockOpts).
+		SetClockOptions(aggClockOpts).
 		SetInstrumentOptions(instrumentOpts).
 		SetMetricPrefix(nil).
 		SetCounterPrefix(nil).
@@ -289,7 +335,7 @@ func (cfg Configuration) newAggregator(o DownsamplerOptions) (agg, error) {
 		SetElectionManager(electionManager).
 		SetFlushManager(flushManager).
 		SetFlushHandler(flushHandler).
-		SetBufferForPastTimedMetricFn(defaultBufferForPastTimedMetricFn).
+		SetBufferForPastTimedMetricFn(bufferForPastTimedMetricFn(cfg.LateSampleGracePeriod)).
 		SetBufferForFutureTimedMetric(defaultBufferFutureTimedMetric)
 
 	if cfg.AggregationTypes != nil {
@@ -374,9 +420,12 @@ func (cfg Configuration) newAggregator(o DownsamplerOptions) (agg, error) {
 
 	return agg{
 		aggregator:             aggregatorInstance,
+		flushManager:           flushManager,
+		flushHandler:           flushHandler,
 		defaultStagedMetadatas: defaultStagedMetadatas,
 		matcher:                matcher,
 		pools:                  pools,
+		windowOffset:           cfg.WindowOffset,
 	}, nil
 }
 
@@ -542,11 +591,14 @@ func (o DownsamplerOptions) newAggregatorFlushManagerAndHandler(
 	placementManager aggregator.PlacementManager,
 	flushTimesManager aggregator.FlushTimesManager,
 	electionManager aggregator.ElectionManager,
+	clockOpts clock.Options,
 	instrumentOpts instrument.Options,
 	storageFlushConcurrency int,
+	windowOffset time.Duration,
 	pools aggPools,
-) (aggregator.FlushManager, handler.Handler) {
+) (aggregator.FlushManager, *downsamplerFlushHandler) {
 	flushManagerOpts := aggregator.NewFlushManagerOptions().
+		SetClockOptions(clockOpts).
 		SetPlacementManager(placementManager).
 		SetFlushTimesManager(flushTimesManager).
 		SetElectionManager(electionManager).
@@ -556,7 +608,7 @@ func (o DownsamplerOptions) newAggregatorFlushManagerAndHandler(
 	flushWorkers := xsync.NewWorkerPool(storageFlushConcurrency)
 	flushWorkers.Init()
 	handler := newDownsamplerFlushHandler(o.Storage, pools.metricTagsIteratorPool,
-		flushWorkers, o.TagOptions, instrumentOpts)
+		flushWorkers, o.TagOptions, windowOffset, instrumentOpts)
 
 	return flushManager, handler
 }
@@ -35,6 +35,7 @@ type samplesAppender struct {
 	agg             aggregator.Aggregator
 	unownedID       []byte
 	stagedMetadatas metadata.StagedMetadatas
+	windowOffset    time.Duration
 }
 
 func (a samplesAppender) AppendCounterSample(value int64) error {
@@ -55,11 +56,38 @@ func (a samplesAppender) AppendGaugeSample(value float64) error {
 	return a.agg.AddUntimed(sample, a.stagedMetadatas)
 }
 
+func (a samplesAppender) AppendGaugeSamples(values []float64) (int, error) {
+	sample := unaggregated.MetricUnion{
+		Type: metric.GaugeType,
+		ID:   a.unownedID,
+	}
+	for i, value := range values {
+		sample.GaugeVal = value
+		if err := a.agg.AddUntimed(sample, a.stagedMetadatas); err != nil {
+			return i, err
+		}
+	}
+	return len(values), nil
+}
+
+func (a samplesAppender) AppendGaugeSampleWithAnnotation(value float64, _ []byte) error {
+	return a.AppendGaugeSample(value)
+}
+
+func (a samplesAppender) AppendTimerSample(value float64) error {
+	sample := unaggregated.MetricUnion{
+		Type:          metric.TimerType,
+		ID:            a.unownedID,
+		BatchTimerVal: []float64{value},
+	}
+	return a.agg.AddUntimed(sample, a.stagedMetadatas)
+}
+
 func (a *samplesAppender) AppendCounterTimedSample(t time.Time, value int64) error {
 	return a.appendTimedSample(aggregated.Metric{
 		Type:      metric.CounterType,
 		ID:        a.unownedID,
-		TimeNanos: t.UnixNano(),
+		TimeNanos: t.Add(-a.windowOffset).UnixNano(),
 		Value:     float64(value),
 	})
 }
@@ -68,11 +96,22 @@ func (a *samplesAppender) AppendGaugeTimedSample(t time.Time, value float64) err
 	return a.appendTimedSample(aggregated.Metric{
 		Type:      metric.GaugeType,
 		ID:        a.unownedID,
-		TimeNanos: t.UnixNano(),
+		TimeNanos: t.Add(-a.windowOffset).UnixNano(),
 		Value:     value,
 	})
 }
 
+func (a *samplesAppender) AppendGaugeTimedSamples(samples []TimedSample) (int, error) {
+	for i, sample := range samples {
+		if err := a.AppendGaugeTimedSample(sample.Time, sample.Value); err != nil {
+			return i, err
+		}
+	}
+	return len(samples), nil
+}
+
+// appendTimedSample appends a sample with a timestamp, which is shifted by
+// the window offset into the time of the aggregator, see WindowOffset.
 func (a *samplesAppender) appendTimedSample(sample aggregated.Metric) error {
 	var multiErr xerrors.MultiError
 	for _, meta := range a.stagedMetadatas {
@@ -127,6 +166,39 @@ func (a *multiSamplesAppender) AppendGaugeSample(value float64) error {
 	return multiErr.FinalError()
 }
 
+// AppendGaugeSamples appends the values to every appender, the number of
+// values appended is the least appended to any one appender.
+func (a *multiSamplesAppender) AppendGaugeSamples(values []float64) (int, error) {
+	var (
+		appended = len(values)
+		multiErr xerrors.MultiError
+	)
+	for _, appender := range a.appenders {
+		n, err := appender.AppendGaugeSamples(values)
+		if n < appended {
+			appended = n
+		}
+		multiErr = multiErr.Add(err)
+	}
+	return appended, multiErr.FinalError()
+}
+
+func (a *multiSamplesAppender) AppendGaugeSampleWithAnnotation(value float64, annotation []byte) error {
+	var multiErr xerrors.MultiError
+	for _, appender := range a.appenders {
+		multiErr = multiErr.Add(appender.AppendGaugeSampleWithAnnotation(value, annotation))
+	}
+	return multiErr.FinalError()
+}
+
+func (a *multiSamplesAppender) AppendTimerSample(value float64) error {
+	var multiErr xerrors.MultiError
+	for _, appender := range a.appenders {
+		multiErr = multiErr.Add(appender.AppendTimerSample(value))
+	}
+	return multiErr.FinalError()
+}
+
 func (a *multiSamplesAppender) AppendCounterTimedSample(t time.Time, value int64) error {
 	var multiErr xerrors.MultiError
 	for _, appender := range a.appenders {
@@ -142,3 +214,20 @@ func (a *multiSamplesAppender) AppendGaugeTimedSample(t time.Time, value float64
 	}
 	return multiErr.FinalError()
 }
+
+// AppendGaugeTimedSamples appends the samples to every appender, the number
+// of samples appended is the least appended to any one appender.
+func (a *multiSamplesAppender) AppendGaugeTimedSamples(samples []TimedSample) (int, error) {
+	var (
+		appended = len(samples)
+		multiErr xerrors.MultiError
+	)
+	for _, appender := range a.appenders {
+		n, err := appender.AppendGaugeTimedSamples(samples)
+		if n < appended {
+			appended = n
+		}
+		multiErr = multiErr.Add(err)
+	}
+	return appended, multiErr.FinalError()
+}
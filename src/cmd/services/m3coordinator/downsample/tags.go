@@ -24,6 +24,7 @@ import (
 	"bytes"
 	"sort"
 
+	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3x/ident"
 )
 
@@ -58,6 +59,21 @@ func (t *tags) append(name, value []byte) {
 	t.values = append(t.values, value)
 }
 
+func (t *tags) appendTags(tags []models.Tag) {
+	if n := len(t.names) + len(tags); n > cap(t.names) {
+		names := make([][]byte, len(t.names), n)
+		copy(names, t.names)
+		t.names = names
+		values := make([][]byte, len(t.values), n)
+		copy(values, t.values)
+		t.values = values
+	}
+	for _, tag := range tags {
+		t.names = append(t.names, tag.Name)
+		t.values = append(t.values, tag.Value)
+	}
+}
+
 func (t *tags) Len() int {
 	return len(t.names)
 }
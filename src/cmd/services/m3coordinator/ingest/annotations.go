@@ -0,0 +1,211 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/m3db/m3/src/query/models"
+
+	"github.com/cespare/xxhash"
+)
+
+const (
+	defaultAnnotationSamplingMaxTrackedSeries = 1 << 16
+)
+
+// AnnotationSamplingMode determines how often the annotation of a write is
+// stored alongside its datapoints.
+type AnnotationSamplingMode uint
+
+const (
+	// AnnotationSamplingNone stores the annotation of every write.
+	AnnotationSamplingNone AnnotationSamplingMode = iota
+	// AnnotationSamplingEveryN stores the annotation of every Nth write of
+	// a series, the first write of a series is always stored.
+	AnnotationSamplingEveryN
+	// AnnotationSamplingOnChange stores the annotation of a write only when
+	// it differs from the last annotation seen for the series.
+	AnnotationSamplingOnChange
+)
+
+var (
+	validAnnotationSamplingModes = []AnnotationSamplingMode{
+		AnnotationSamplingNone,
+		AnnotationSamplingEveryN,
+		AnnotationSamplingOnChange,
+	}
+)
+
+func (m AnnotationSamplingMode) String() string {
+	switch m {
+	case AnnotationSamplingNone:
+		return "none"
+	case AnnotationSamplingEveryN:
+		return "every_n"
+	case AnnotationSamplingOnChange:
+		return "on_change"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals an annotation sampling mode.
+func (m *AnnotationSamplingMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*m = AnnotationSamplingNone
+		return nil
+	}
+
+	for _, valid := range validAnnotationSamplingModes {
+		if str == valid.String() {
+			*m = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid AnnotationSamplingMode '%s' valid types are: %v",
+		str, validAnnotationSamplingModes)
+}
+
+// AnnotationSamplingOptions configures sampling of the annotations stored
+// with written datapoints.
+type AnnotationSamplingOptions struct {
+	// Mode is the sampling mode, defaults to storing every annotation.
+	Mode AnnotationSamplingMode
+
+	// EveryN is the interval at which annotations are stored when sampling
+	// every Nth write, values less than two store every annotation.
+	EveryN int
+
+	// MaxTrackedSeries bounds the number of series whose sampling state is
+	// kept, the state of all series is discarded once the bound is reached
+	// which causes the next annotation of each series to be stored.
+	// Defaults to 65536 if not set.
+	MaxTrackedSeries int
+}
+
+type annotationSamplerState struct {
+	writes         int
+	lastAnnotation uint64
+}
+
+// annotationSampler decides which annotations are stored, the decision is
+// made once per write so a stored annotation applies to every datapoint of
+// the write.
+type annotationSampler struct {
+	sync.Mutex
+
+	opts             AnnotationSamplingOptions
+	maxTrackedSeries int
+	series           map[uint64]*annotationSamplerState
+}
+
+func newAnnotationSampler(opts AnnotationSamplingOptions) *annotationSampler {
+	maxTrackedSeries := opts.MaxTrackedSeries
+	if maxTrackedSeries <= 0 {
+		maxTrackedSeries = defaultAnnotationSamplingMaxTrackedSeries
+	}
+
+	return &annotationSampler{
+		opts:             opts,
+		maxTrackedSeries: maxTrackedSeries,
+		series:           make(map[uint64]*annotationSamplerState),
+	}
+}
+
+// sample returns the annotation to store with a write of the series, which
+// is nil if the annotation should be dropped.
+func (s *annotationSampler) sample(tags models.Tags, annotation []byte) []byte {
+	if len(annotation) == 0 {
+		return nil
+	}
+
+	switch s.opts.Mode {
+	case AnnotationSamplingEveryN:
+		if s.opts.EveryN < 2 {
+			return annotation
+		}
+	case AnnotationSamplingOnChange:
+	default:
+		return annotation
+	}
+
+	var (
+		id             = tags.HashedID()
+		annotationHash = xxhash.Sum64(annotation)
+		store          bool
+	)
+
+	s.Lock()
+	state, ok := s.series[id]
+	if !ok {
+		if len(s.series) >= s.maxTrackedSeries {
+			s.series = make(map[uint64]*annotationSamplerState)
+		}
+
+		state = &annotationSamplerState{}
+		s.series[id] = state
+	}
+
+	switch s.opts.Mode {
+	case AnnotationSamplingEveryN:
+		store = state.writes%s.opts.EveryN == 0
+	case AnnotationSamplingOnChange:
+		store = !ok || state.lastAnnotation != annotationHash
+	}
+
+	state.writes++
+	state.lastAnnotation = annotationHash
+	s.Unlock()
+
+	if !store {
+		return nil
+	}
+
+	return annotation
+}
+
+// sampleAnnotation returns the annotation to store with a write of the
+// series after sampling and records whether it was stored or dropped.
+func (d *downsamplerAndWriter) sampleAnnotation(
+	tags models.Tags,
+	annotation []byte,
+) []byte {
+	if len(annotation) == 0 {
+		return nil
+	}
+
+	sampled := d.annotationSampler.sample(tags, annotation)
+	if sampled == nil {
+		d.metrics.annotationsDropped.Inc(1)
+	} else {
+		d.metrics.annotationsStored.Inc(1)
+	}
+
+	return sampled
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testAnnotatedDatapoints = ts.Datapoints{
+	{Timestamp: time.Unix(0, 0), Value: 0, Annotation: []byte("exemplar")},
+	{Timestamp: time.Unix(0, 1), Value: 1},
+}
+
+// expectAnnotatedStorageWrites expects a storage write for each datapoint
+// and returns the annotation written with each datapoint by value.
+func expectAnnotatedStorageWrites(
+	session *client.MockSession,
+	datapoints ts.Datapoints,
+) map[float64]string {
+	var (
+		lock        sync.Mutex
+		annotations = make(map[float64]string)
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_, _ ident.ID, _ ident.TagIterator, _ time.Time, value float64,
+			_ xtime.Unit, annotation []byte,
+		) error {
+			lock.Lock()
+			annotations[value] = string(annotation)
+			lock.Unlock()
+			return nil
+		}).
+		Times(len(datapoints))
+	return annotations
+}
+
+func sampleAnnotations(s *annotationSampler, annotations []string) []string {
+	var stored []string
+	for _, annotation := range annotations {
+		if sampled := s.sample(testTags1, []byte(annotation)); sampled != nil {
+			stored = append(stored, string(sampled))
+		}
+	}
+	return stored
+}
+
+func TestAnnotationSamplerNone(t *testing.T) {
+	s := newAnnotationSampler(AnnotationSamplingOptions{})
+	stored := sampleAnnotations(s, []string{"a", "a", "a"})
+	require.Equal(t, []string{"a", "a", "a"}, stored)
+	require.Nil(t, s.sample(testTags1, nil))
+}
+
+func TestAnnotationSamplerEveryN(t *testing.T) {
+	s := newAnnotationSampler(AnnotationSamplingOptions{
+		Mode:   AnnotationSamplingEveryN,
+		EveryN: 3,
+	})
+	stored := sampleAnnotations(s, []string{"a", "b", "c", "d", "e", "f", "g"})
+	require.Equal(t, []string{"a", "d", "g"}, stored)
+
+	// Series are sampled independently.
+	require.NotNil(t, s.sample(testTags2, []byte("a")))
+}
+
+func TestAnnotationSamplerOnChange(t *testing.T) {
+	s := newAnnotationSampler(AnnotationSamplingOptions{
+		Mode: AnnotationSamplingOnChange,
+	})
+	stored := sampleAnnotations(s, []string{"a", "a", "b", "b", "a"})
+	require.Equal(t, []string{"a", "b", "a"}, stored)
+}
+
+func TestAnnotationSamplerMaxTrackedSeries(t *testing.T) {
+	s := newAnnotationSampler(AnnotationSamplingOptions{
+		Mode:             AnnotationSamplingOnChange,
+		MaxTrackedSeries: 1,
+	})
+	require.NotNil(t, s.sample(testTags1, []byte("a")))
+	require.Nil(t, s.sample(testTags1, []byte("a")))
+
+	// Tracking a second series discards the state of the first.
+	require.NotNil(t, s.sample(testTags2, []byte("a")))
+	require.NotNil(t, s.sample(testTags1, []byte("a")))
+}
+
+func TestAnnotationSamplingModeUnmarshalYAML(t *testing.T) {
+	for _, mode := range validAnnotationSamplingModes {
+		var cfg AnnotationSamplingConfiguration
+		str := "mode: " + mode.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, mode, cfg.Mode)
+	}
+
+	var cfg AnnotationSamplingConfiguration
+	require.Error(t, yaml.Unmarshal([]byte("mode: bad\n"), &cfg))
+}
+
+func TestDownsampleAndWriteDatapointAnnotations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().AddTag(gomock.Any(), gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	mockSamplesAppender.EXPECT().AppendGaugeSampleWithAnnotation(0.0, []byte("exemplar"))
+	mockSamplesAppender.EXPECT().AppendGaugeSample(1.0)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	annotations := expectAnnotatedStorageWrites(session, testAnnotatedDatapoints)
+
+	// The annotation of the write applies to datapoints without their own.
+	err := downAndWrite.Write(context.Background(), testTags1, testAnnotatedDatapoints,
+		xtime.Second, WriteOptions{Annotation: []byte("write")})
+	require.NoError(t, err)
+	require.Equal(t, map[float64]string{0: "exemplar", 1: "write"}, annotations)
+}
+
+func TestDownsampleAndWriteBatchDatapointAnnotations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+
+	annotations := expectAnnotatedStorageWrites(session, testAnnotatedDatapoints)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testAnnotatedDatapoints},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[float64]string{0: "exemplar", 1: ""}, annotations)
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/ts"
+)
+
+// AppenderErrorBehavior determines how a batch write handles a series that
+// the downsampler appender fails to accept, such as when the aggregator is
+// out of capacity.
+type AppenderErrorBehavior uint
+
+const (
+	// AppenderErrorAbort stops writing the rest of the batch to the
+	// downsampler.
+	AppenderErrorAbort AppenderErrorBehavior = iota
+	// AppenderErrorSkip skips the failing series and carries on with the
+	// rest of the batch.
+	AppenderErrorSkip
+	// AppenderErrorRestart finalizes the appender to flush the samples
+	// appended so far and retries the failing series once with a new
+	// appender, skipping the series if it fails again.
+	AppenderErrorRestart
+)
+
+var (
+	validAppenderErrorBehaviors = []AppenderErrorBehavior{
+		AppenderErrorAbort,
+		AppenderErrorSkip,
+		AppenderErrorRestart,
+	}
+)
+
+func (b AppenderErrorBehavior) String() string {
+	switch b {
+	case AppenderErrorAbort:
+		return "abort"
+	case AppenderErrorSkip:
+		return "skip"
+	case AppenderErrorRestart:
+		return "restart"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals an appender error behavior.
+func (b *AppenderErrorBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = AppenderErrorAbort
+		return nil
+	}
+
+	for _, valid := range validAppenderErrorBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid AppenderErrorBehavior '%s' valid types are: %v",
+		str, validAppenderErrorBehaviors)
+}
+
+// newMetricsAppender creates a new metrics appender from the downsampler,
+// blocking until the number of appenders in use across all calls on the
+// writer is below the configured limit or the context is done. Every
+// appender successfully returned must be followed by a call to
+// finalizeMetricsAppender once the caller is done with it, including when
+// appending to it fails.
+func (d *downsamplerAndWriter) newMetricsAppender(
+	ctx context.Context,
+) (downsample.MetricsAppender, error) {
+	if d.appenderPermits != nil {
+		select {
+		case d.appenderPermits <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	appender, err := d.downsampler.NewMetricsAppender()
+	if err != nil {
+		if d.appenderPermits != nil {
+			<-d.appenderPermits
+		}
+		return nil, err
+	}
+
+	atomic.AddInt64(&d.appendersInUse, 1)
+	return appender, nil
+}
+
+// finalizeMetricsAppender finalizes an appender returned by
+// newMetricsAppender, flushing the samples appended to it and releasing its
+// resources, and returns its permit.
+func (d *downsamplerAndWriter) finalizeMetricsAppender(
+	appender downsample.MetricsAppender,
+) error {
+	err := appender.Finalize()
+	atomic.AddInt64(&d.appendersInUse, -1)
+	if d.appenderPermits != nil {
+		<-d.appenderPermits
+	}
+	return err
+}
+
+func (d *downsamplerAndWriter) AppenderUsage() (int, int) {
+	return int(atomic.LoadInt64(&d.appendersInUse)), d.opts.MaxConcurrentAppenders
+}
+
+// sampleKind is the append method of the samples appender a datapoint is
+// appended with.
+type sampleKind uint
+
+const (
+	timerSample sampleKind = iota
+	counterTimedSample
+	counterSample
+	gaugeTimedSample
+	gaugeAnnotatedSample
+	gaugeSample
+)
+
+// sampleKind returns the append method of the samples appender that the
+// datapoint is appended with given its metric type. Samples are aggregated
+// into the window they arrive in, except for samples that arrive late by no
+// more than the late sample grace period which are aggregated into the
+// window of their timestamp instead. Timer samples are always aggregated
+// into the window they arrive in since the aggregator does not accept timed
+// timer samples.
+func (d *downsamplerAndWriter) sampleKind(
+	dp ts.Datapoint,
+	metricType MetricType,
+	now time.Time,
+) sampleKind {
+	timed := false
+	if gracePeriod := d.opts.LateSampleGracePeriod; gracePeriod > 0 {
+		age := now.Sub(dp.Timestamp)
+		timed = age > 0 && age <= gracePeriod
+	}
+
+	switch {
+	case metricType == MetricTypeTimer:
+		return timerSample
+	case metricType == MetricTypeCounter && timed:
+		return counterTimedSample
+	case metricType == MetricTypeCounter:
+		return counterSample
+	case timed:
+		return gaugeTimedSample
+	case dp.Annotation != nil:
+		return gaugeAnnotatedSample
+	default:
+		return gaugeSample
+	}
+}
+
+// appendSample appends the datapoint to the samples appender using the
+// append method of the metric type, see sampleKind.
+func (d *downsamplerAndWriter) appendSample(
+	samplesAppender downsample.SamplesAppender,
+	dp ts.Datapoint,
+	metricType MetricType,
+	now time.Time,
+) error {
+	switch d.sampleKind(dp, metricType, now) {
+	case timerSample:
+		return samplesAppender.AppendTimerSample(dp.Value)
+	case counterTimedSample:
+		return samplesAppender.AppendCounterTimedSample(dp.Timestamp, int64(dp.Value))
+	case counterSample:
+		return samplesAppender.AppendCounterSample(int64(dp.Value))
+	case gaugeTimedSample:
+		return samplesAppender.AppendGaugeTimedSample(dp.Timestamp, dp.Value)
+	case gaugeAnnotatedSample:
+		return samplesAppender.AppendGaugeSampleWithAnnotation(dp.Value, dp.Annotation)
+	default:
+		return samplesAppender.AppendGaugeSample(dp.Value)
+	}
+}
+
+// sampleBuffers hold the values of a run of gauge samples appended in bulk.
+type sampleBuffers struct {
+	values []float64
+	timed  []downsample.TimedSample
+}
+
+var sampleBuffersPool = sync.Pool{
+	New: func() interface{} {
+		return &sampleBuffers{}
+	},
+}
+
+// appendSamples appends the datapoints to the samples appender the same way
+// as appendSample, except that runs of consecutive gauge samples are
+// appended with a single call. The datapoints are appended as the metric
+// type unless types sets the metric type of each datapoint. It returns the
+// number of datapoints appended before the first that failed.
+func (d *downsamplerAndWriter) appendSamples(
+	samplesAppender downsample.SamplesAppender,
+	datapoints ts.Datapoints,
+	metricType MetricType,
+	types []MetricType,
+	now time.Time,
+) (int, error) {
+	datapointType := func(i int) MetricType {
+		if i < len(types) {
+			return types[i]
+		}
+		return metricType
+	}
+	datapointKind := func(i int) sampleKind {
+		return d.sampleKind(datapoints[i], datapointType(i), now)
+	}
+
+	var buffers *sampleBuffers
+	defer func() {
+		if buffers != nil {
+			buffers.values = buffers.values[:0]
+			buffers.timed = buffers.timed[:0]
+			sampleBuffersPool.Put(buffers)
+		}
+	}()
+
+	for i := 0; i < len(datapoints); {
+		kind := datapointKind(i)
+		end := i + 1
+		if kind == gaugeSample || kind == gaugeTimedSample {
+			for end < len(datapoints) && datapointKind(end) == kind {
+				end++
+			}
+		}
+
+		if end-i == 1 {
+			err := d.appendSample(samplesAppender, datapoints[i], datapointType(i), now)
+			if err != nil {
+				return i, err
+			}
+			i = end
+			continue
+		}
+
+		if buffers == nil {
+			buffers = sampleBuffersPool.Get().(*sampleBuffers)
+		}
+
+		var (
+			appended int
+			err      error
+		)
+		if kind == gaugeSample {
+			buffers.values = buffers.values[:0]
+			for _, dp := range datapoints[i:end] {
+				buffers.values = append(buffers.values, dp.Value)
+			}
+			appended, err = samplesAppender.AppendGaugeSamples(buffers.values)
+		} else {
+			buffers.timed = buffers.timed[:0]
+			for _, dp := range datapoints[i:end] {
+				buffers.timed = append(buffers.timed, downsample.TimedSample{
+					Time:  dp.Timestamp,
+					Value: dp.Value,
+				})
+			}
+			appended, err = samplesAppender.AppendGaugeTimedSamples(buffers.timed)
+		}
+		if err != nil {
+			return i + appended, err
+		}
+		i = end
+	}
+
+	return len(datapoints), nil
+}
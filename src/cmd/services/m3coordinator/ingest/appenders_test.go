@@ -0,0 +1,407 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestDownsampleAndWriteMaxConcurrentAppendersBlocks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		MaxConcurrentAppenders: 1,
+	})
+
+	mockMetricsAppender := downsample.NewMockMetricsAppender(ctrl)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	appender, err := downAndWrite.newMetricsAppender(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, appender)
+
+	inUse, limit := downAndWrite.AppenderUsage()
+	require.Equal(t, 1, inUse)
+	require.Equal(t, 1, limit)
+
+	// The only appender is in use so the write should block until the
+	// context is done without ever creating another appender.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = downAndWrite.Write(ctx, testTags1, testDatapoints1, xtime.Second, defaultOverride)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	mockMetricsAppender.EXPECT().Finalize()
+	require.NoError(t, downAndWrite.finalizeMetricsAppender(appender))
+	inUse, _ = downAndWrite.AppenderUsage()
+	require.Equal(t, 0, inUse)
+}
+
+func TestDownsampleAndWriteAppenderUsageUnbounded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, defaultOverride)
+	require.NoError(t, err)
+
+	inUse, limit := downAndWrite.AppenderUsage()
+	require.Equal(t, 0, inUse)
+	require.Equal(t, 0, limit)
+}
+
+func TestDownsampleAndWriteBatchAppenderErrors(t *testing.T) {
+	errCapacity := errors.New("aggregator out of capacity")
+
+	testCases := []struct {
+		behavior         AppenderErrorBehavior
+		expectedAppended []float64
+		expectedAppender int
+		expectError      bool
+	}{
+		{
+			behavior:         AppenderErrorAbort,
+			expectedAppended: []float64{0},
+			expectedAppender: 1,
+			expectError:      true,
+		},
+		{
+			// The rest of the first series is skipped.
+			behavior:         AppenderErrorSkip,
+			expectedAppended: []float64{0, 3, 4, 5},
+			expectedAppender: 1,
+			expectError:      true,
+		},
+		{
+			// The first series resumes at the datapoint that failed.
+			behavior:         AppenderErrorRestart,
+			expectedAppended: []float64{0, 1, 2, 3, 4, 5},
+			expectedAppender: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.behavior.String(), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+				AppenderErrors: tc.behavior,
+			})
+			downAndWrite.store = nil
+
+			var (
+				appended            []float64
+				failed              bool
+				mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+				mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+			)
+			appendValue := func(value float64) error {
+				// Fail the second datapoint of the batch once.
+				if value == 1 && !failed {
+					failed = true
+					return errCapacity
+				}
+				appended = append(appended, value)
+				return nil
+			}
+			mockSamplesAppender.EXPECT().AppendGaugeSample(gomock.Any()).
+				DoAndReturn(appendValue).AnyTimes()
+			mockSamplesAppender.EXPECT().AppendGaugeSamples(gomock.Any()).DoAndReturn(
+				func(values []float64) (int, error) {
+					for i, value := range values {
+						if err := appendValue(value); err != nil {
+							return i, err
+						}
+					}
+					return len(values), nil
+				}).AnyTimes()
+			mockMetricsAppender.EXPECT().Reset().AnyTimes()
+			mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+			mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+				Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).AnyTimes()
+			mockMetricsAppender.EXPECT().Finalize().AnyTimes()
+			downsampler.EXPECT().NewMetricsAppender().
+				Return(mockMetricsAppender, nil).Times(tc.expectedAppender)
+
+			err := downAndWrite.WriteBatch(context.Background(), newTestIter(testEntries), nil)
+			if tc.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedAppended, appended)
+
+			inUse, _ := downAndWrite.AppenderUsage()
+			require.Equal(t, 0, inUse)
+		})
+	}
+}
+
+func TestDownsampleAndWriteAppendErrorFinalizesAppender(t *testing.T) {
+	errCapacity := errors.New("aggregator out of capacity")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().AddTag(gomock.Any(), gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().Reset().AnyTimes()
+	mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).
+		Times(2)
+	// Fail the second sample of both the write and the batch.
+	mockSamplesAppender.EXPECT().AppendGaugeSamples([]float64{0, 1, 2}).
+		Return(1, errCapacity).Times(2)
+	// The appender must be finalized on the error path of both.
+	mockMetricsAppender.EXPECT().Finalize().Times(2)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil).Times(2)
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, defaultOverride)
+	require.Equal(t, errCapacity, err)
+
+	err = downAndWrite.WriteBatch(context.Background(), newTestIter(testEntries), nil)
+	require.Error(t, err)
+
+	inUse, _ := downAndWrite.AppenderUsage()
+	require.Equal(t, 0, inUse)
+}
+
+func TestAppenderErrorBehaviorUnmarshalYAML(t *testing.T) {
+	for _, behavior := range validAppenderErrorBehaviors {
+		var cfg Configuration
+		str := "appenderErrors: " + behavior.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, behavior, cfg.AppenderErrors)
+	}
+
+	var cfg Configuration
+	require.Error(t, yaml.Unmarshal([]byte("appenderErrors: bad\n"), &cfg))
+}
+
+func TestAppendSampleLateGracePeriod(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now                 = time.Now()
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		downAndWrite        = &downsamplerAndWriter{
+			opts: Options{LateSampleGracePeriod: time.Minute},
+		}
+	)
+
+	late := now.Add(-30 * time.Second)
+	mockSamplesAppender.EXPECT().AppendGaugeTimedSample(late, 1.0)
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: late, Value: 1}, MetricTypeGauge, now))
+
+	// Samples beyond the grace period or in the future are untimed.
+	mockSamplesAppender.EXPECT().AppendGaugeSample(2.0)
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: now.Add(-2 * time.Minute), Value: 2}, MetricTypeGauge, now))
+	mockSamplesAppender.EXPECT().AppendGaugeSample(3.0)
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: now.Add(time.Second), Value: 3}, MetricTypeGauge, now))
+
+	downAndWrite.opts.LateSampleGracePeriod = 0
+	mockSamplesAppender.EXPECT().AppendGaugeSample(4.0)
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: late, Value: 4}, MetricTypeGauge, now))
+}
+
+func TestAppendSampleTimer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now                 = time.Now()
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		downAndWrite        = &downsamplerAndWriter{
+			opts: Options{LateSampleGracePeriod: time.Minute},
+		}
+	)
+
+	// Timer samples are untimed even within the grace period.
+	mockSamplesAppender.EXPECT().AppendTimerSample(1.5)
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: now.Add(-30 * time.Second), Value: 1.5}, MetricTypeTimer, now))
+}
+
+func TestAppendSampleCounter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now                 = time.Now()
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		downAndWrite        = &downsamplerAndWriter{
+			opts: Options{LateSampleGracePeriod: time.Minute},
+		}
+	)
+
+	late := now.Add(-30 * time.Second)
+	mockSamplesAppender.EXPECT().AppendCounterTimedSample(late, int64(1))
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: late, Value: 1}, MetricTypeCounter, now))
+
+	mockSamplesAppender.EXPECT().AppendCounterSample(int64(2))
+	require.NoError(t, downAndWrite.appendSample(mockSamplesAppender,
+		ts.Datapoint{Timestamp: now, Value: 2}, MetricTypeCounter, now))
+}
+
+func TestAppendSamplesRuns(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now                 = time.Now()
+		late                = now.Add(-30 * time.Second)
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		downAndWrite        = &downsamplerAndWriter{
+			opts: Options{LateSampleGracePeriod: time.Minute},
+		}
+	)
+
+	// Runs of untimed and timed gauge samples are appended with a single
+	// call, every other sample is appended on its own.
+	gomock.InOrder(
+		mockSamplesAppender.EXPECT().AppendGaugeSamples([]float64{0, 1, 2}).Return(3, nil),
+		mockSamplesAppender.EXPECT().AppendGaugeSampleWithAnnotation(3.0, []byte("exemplar")),
+		mockSamplesAppender.EXPECT().AppendGaugeTimedSamples([]downsample.TimedSample{
+			{Time: late, Value: 4},
+			{Time: late, Value: 5},
+		}).Return(2, nil),
+		mockSamplesAppender.EXPECT().AppendGaugeSample(6.0),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(7)),
+		mockSamplesAppender.EXPECT().AppendGaugeSamples([]float64{8, 9}).Return(2, nil),
+	)
+
+	datapoints := ts.Datapoints{
+		{Timestamp: now, Value: 0},
+		{Timestamp: now, Value: 1},
+		{Timestamp: now, Value: 2},
+		{Timestamp: now, Value: 3, Annotation: []byte("exemplar")},
+		{Timestamp: late, Value: 4},
+		{Timestamp: late, Value: 5},
+		{Timestamp: now, Value: 6},
+		{Timestamp: now, Value: 7},
+		{Timestamp: now, Value: 8},
+		{Timestamp: now, Value: 9},
+	}
+	types := []MetricType{7: MetricTypeCounter}
+	appended, err := downAndWrite.appendSamples(mockSamplesAppender,
+		datapoints, MetricTypeGauge, types, now)
+	require.NoError(t, err)
+	require.Equal(t, len(datapoints), appended)
+}
+
+func TestAppendSamplesError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now                 = time.Now()
+		errCapacity         = errors.New("aggregator out of capacity")
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		downAndWrite        = &downsamplerAndWriter{}
+	)
+
+	// The count of a failed run is offset by the samples before the run.
+	gomock.InOrder(
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(0)),
+		mockSamplesAppender.EXPECT().AppendGaugeSamples([]float64{1, 2, 3}).
+			Return(1, errCapacity),
+	)
+
+	datapoints := ts.Datapoints{
+		{Timestamp: now, Value: 0},
+		{Timestamp: now, Value: 1},
+		{Timestamp: now, Value: 2},
+		{Timestamp: now, Value: 3},
+	}
+	types := []MetricType{MetricTypeCounter}
+	appended, err := downAndWrite.appendSamples(mockSamplesAppender,
+		datapoints, MetricTypeGauge, types, now)
+	require.Equal(t, errCapacity, err)
+	require.Equal(t, 2, appended)
+}
+
+func TestDownsampleAndWriteLateSampleAggregatedIntoItsWindow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		LateSampleGracePeriod: time.Minute,
+	})
+	now := time.Now()
+	downAndWrite.nowFn = func() time.Time { return now }
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+		late                = now.Add(-30 * time.Second)
+	)
+	mockMetricsAppender.
+		EXPECT().
+		SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	for _, tag := range testTags1.Tags {
+		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
+	}
+	// The late sample keeps its own timestamp so that it is aggregated into
+	// the window it belongs to rather than the window it arrived in.
+	mockSamplesAppender.EXPECT().AppendGaugeTimedSample(late, 42.0)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+	mockMetricsAppender.EXPECT().Finalize()
+
+	datapoints := ts.Datapoints{{Timestamp: late, Value: 42}}
+	expectDefaultStorageWrites(session, datapoints)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, datapoints, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+}
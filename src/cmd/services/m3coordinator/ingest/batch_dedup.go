@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+)
+
+// deduplicateBatch returns an iterator over the series of the batch with
+// exact-duplicate series collapsed into the first of them, if batch
+// deduplication is enabled. Series are duplicates if they have the same tags,
+// unit, metric type and overrides, the datapoints of duplicates are appended
+// to those of the first series in the order they appear in the batch.
+//
+// Series are keyed by the hash of their tag set, with their tag IDs compared
+// on a hash match, so that detecting duplicates costs a hash and a map lookup
+// per series. Deduplicating consumes the iterator and retains every value of
+// the batch until it is written.
+func (d *downsamplerAndWriter) deduplicateBatch(
+	iter DownsampleAndWriteIter,
+) (DownsampleAndWriteIter, error) {
+	if !d.opts.DeduplicateBatches {
+		return iter, nil
+	}
+
+	var (
+		values []IterValue
+		byHash = make(map[uint64][]int)
+	)
+	for iter.Next() {
+		var (
+			value     = iter.Current()
+			hash      = value.Tags.HashedID()
+			duplicate = false
+		)
+		for _, idx := range byHash[hash] {
+			if !duplicateSeries(values[idx], value) {
+				continue
+			}
+
+			// Copy the datapoints rather than appending to the datapoints of
+			// the first series in place, which are owned by the caller.
+			existing := values[idx].Datapoints
+			merged := make(ts.Datapoints, 0, len(existing)+len(value.Datapoints))
+			merged = append(merged, existing...)
+			values[idx].Datapoints = append(merged, value.Datapoints...)
+			d.metrics.batchDuplicateSeries.Inc(1)
+			duplicate = true
+			break
+		}
+		if duplicate {
+			continue
+		}
+
+		byHash[hash] = append(byHash[hash], len(values))
+		values = append(values, value)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return &iterValues{idx: -1, values: values}, nil
+}
+
+// duplicateSeries returns whether two series of a batch can be written as
+// one. Series with gauge statistics or per datapoint metric types are never
+// duplicates since those are tied to their own datapoints.
+func duplicateSeries(a, b IterValue) bool {
+	if len(a.GaugeStats) > 0 || len(b.GaugeStats) > 0 ||
+		len(a.DatapointTypes) > 0 || len(b.DatapointTypes) > 0 {
+		return false
+	}
+	return a.Unit == b.Unit &&
+		a.Type == b.Type &&
+		bytes.Equal(a.Tags.ID(), b.Tags.ID()) &&
+		reflect.DeepEqual(a.Overrides, b.Overrides)
+}
+
+// iterValues is a DownsampleAndWriteIter over a slice of values.
+type iterValues struct {
+	idx    int
+	values []IterValue
+}
+
+func (i *iterValues) Next() bool {
+	i.idx++
+	return i.idx < len(i.values)
+}
+
+func (i *iterValues) Current() IterValue {
+	if i.idx < 0 || i.idx >= len(i.values) {
+		return IterValue{Tags: models.EmptyTags()}
+	}
+	return i.values[i.idx]
+}
+
+func (i *iterValues) Reset() error {
+	i.idx = -1
+	return nil
+}
+
+func (i *iterValues) Error() error {
+	return nil
+}
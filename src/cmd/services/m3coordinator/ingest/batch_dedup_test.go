@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/query/storage/mock"
+	"github.com/m3db/m3/src/query/ts"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteBatchDeduplicatesSeries(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		DeduplicateBatches: true,
+	})
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags2, datapoints: testDatapoints2},
+		{tags: testTags1, datapoints: testDatapoints2},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	writes := store.Writes()
+	require.Equal(t, 2, len(writes))
+
+	byID := make(map[string]ts.Datapoints, len(writes))
+	for _, write := range writes {
+		byID[string(write.Tags.ID())] = write.Datapoints
+	}
+	merged := append(append(ts.Datapoints{}, testDatapoints1...), testDatapoints2...)
+	require.Equal(t, merged, byID[string(testTags1.ID())])
+	require.Equal(t, ts.Datapoints(testDatapoints2), byID[string(testTags2.ID())])
+}
+
+func TestDownsampleAndWriteBatchDeduplicatesOnlyExactDuplicates(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		DeduplicateBatches: true,
+	})
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags1, datapoints: testDatapoints2, metricType: MetricTypeCounter},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(store.Writes()))
+}
+
+func TestDownsampleAndWriteBatchWithoutDeduplication(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{})
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags1, datapoints: testDatapoints1},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(store.Writes()))
+}
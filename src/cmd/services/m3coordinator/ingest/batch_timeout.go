@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"time"
+)
+
+// BatchTimeoutOptions configures a deadline for batch writes that scales
+// with the number of series in the batch, the deadline is applied to the
+// context of the whole batch so that it bounds both the storage and the
+// downsampler writes.
+type BatchTimeoutOptions struct {
+	// Base is the timeout of a batch regardless of its size, batch writes
+	// have no deadline if neither Base nor PerSeries is set.
+	Base time.Duration
+
+	// PerSeries is added to the timeout for every series in the batch.
+	PerSeries time.Duration
+
+	// Max, if set, is the upper bound on the timeout of a batch.
+	Max time.Duration
+}
+
+func (o BatchTimeoutOptions) enabled() bool {
+	return o.Base > 0 || o.PerSeries > 0
+}
+
+// timeout returns the timeout of a batch with the given number of series.
+func (o BatchTimeoutOptions) timeout(numSeries int) time.Duration {
+	timeout := o.Base + time.Duration(numSeries)*o.PerSeries
+	if o.Max > 0 && timeout > o.Max {
+		timeout = o.Max
+	}
+	return timeout
+}
+
+// withBatchTimeout returns a context with the deadline derived from the
+// number of series in the batch, counting the series consumes the iterator
+// so it is reset before returning. The returned cancel func must always be
+// called.
+func (d *downsamplerAndWriter) withBatchTimeout(
+	ctx context.Context,
+	iter DownsampleAndWriteIter,
+) (context.Context, context.CancelFunc, error) {
+	if !d.opts.BatchTimeout.enabled() {
+		return ctx, func() {}, nil
+	}
+
+	numSeries := 0
+	for iter.Next() {
+		numSeries++
+	}
+	if err := iter.Reset(); err != nil {
+		return ctx, func() {}, err
+	}
+
+	timeout := d.opts.BatchTimeout.timeout(numSeries)
+	d.metrics.batchTimeout.Record(timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
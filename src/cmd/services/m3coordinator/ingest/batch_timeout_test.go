@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestBatchTimeoutOptionsTimeout(t *testing.T) {
+	require.False(t, BatchTimeoutOptions{}.enabled())
+
+	opts := BatchTimeoutOptions{Base: time.Second, PerSeries: 10 * time.Millisecond}
+	require.True(t, opts.enabled())
+	require.Equal(t, time.Second, opts.timeout(0))
+	require.Equal(t, 2*time.Second, opts.timeout(100))
+
+	opts.Max = 1500 * time.Millisecond
+	require.Equal(t, 1500*time.Millisecond, opts.timeout(100))
+}
+
+func TestDownsampleAndWriteBatchTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		BatchTimeout:      BatchTimeoutOptions{Base: time.Second, PerSeries: time.Second},
+	})
+	downAndWrite.downsampler = nil
+
+	// Counting the series for the timeout must not consume the batch.
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints2)
+
+	iter := newTestIter(testEntries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	timer, ok := scope.Snapshot().Timers()["batch.timeout+"]
+	require.True(t, ok)
+	require.Equal(t, []time.Duration{3 * time.Second}, timer.Values())
+}
+
+func TestWithBatchTimeoutSetsDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		BatchTimeout: BatchTimeoutOptions{Base: time.Minute},
+	})
+
+	ctx, cancel, err := downAndWrite.withBatchTimeout(
+		context.Background(), newTestIter(testEntries))
+	require.NoError(t, err)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.True(t, time.Until(deadline) <= time.Minute)
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package ingestbinary implements ingestion of a compact, length-prefixed
+// binary protocol for clients that control both ends of the connection and
+// want more efficient ingestion than the plaintext carbon protocol offers.
+//
+// A connection carries a stream of frames, each frame encoding a single
+// datapoint for a single series:
+//
+//	frame      = length payload
+//	length     = uvarint      ; number of bytes in payload
+//	payload    = version type timestamp value tags annotation
+//	version    = byte         ; currently always 1
+//	type       = byte         ; 1 = gauge, 2 = counter, 3 = timer
+//	timestamp  = varint       ; unix nanoseconds
+//	value      = 8 bytes      ; IEEE 754 float64, big endian
+//	tags       = uvarint *tag ; number of tags followed by the tags
+//	tag        = bytes bytes  ; tag name followed by the tag value
+//	annotation = bytes        ; empty if the datapoint has no annotation
+//	bytes      = uvarint *byte
+//
+// Frames larger than the configured maximum frame size are skipped without
+// being decoded, as are frames with an unknown version or metric type, or
+// whose payload does not match the length prefix, so that a single bad frame
+// does not tear down the rest of the connection.
+package ingestbinary
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+)
+
+const (
+	// Version is the current version of the protocol.
+	Version byte = 1
+
+	// DefaultMaxFrameSize is the default maximum size of a frame payload.
+	DefaultMaxFrameSize = 64 * 1024
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size,
+	// the frame is skipped and the next frame can be decoded.
+	ErrFrameTooLarge = errors.New("frame exceeds max frame size")
+
+	// ErrMalformedFrame is returned when a frame can not be decoded, the frame
+	// is skipped and the next frame can be decoded.
+	ErrMalformedFrame = errors.New("malformed frame")
+)
+
+// MetricType is the type of a metric.
+type MetricType byte
+
+const (
+	// MetricTypeGauge is a gauge metric.
+	MetricTypeGauge MetricType = iota + 1
+	// MetricTypeCounter is a counter metric.
+	MetricTypeCounter
+	// MetricTypeTimer is a timer metric.
+	MetricTypeTimer
+)
+
+// Validate validates the metric type.
+func (t MetricType) Validate() error {
+	if t >= MetricTypeGauge && t <= MetricTypeTimer {
+		return nil
+	}
+
+	return fmt.Errorf("invalid metric type: %d", t)
+}
+
+// Metric is a single datapoint for a series.
+type Metric struct {
+	Type       MetricType
+	Tags       []models.Tag
+	Timestamp  time.Time
+	Value      float64
+	Annotation []byte
+}
+
+// Encode appends the frame encoding the metric to the buffer.
+func Encode(buf []byte, m Metric) []byte {
+	payload := make([]byte, 0, encodedSize(m))
+	payload = append(payload, Version, byte(m.Type))
+	payload = appendVarint(payload, m.Timestamp.UnixNano())
+	payload = appendUint64(payload, math.Float64bits(m.Value))
+	payload = appendUvarint(payload, uint64(len(m.Tags)))
+	for _, tag := range m.Tags {
+		payload = appendBytes(payload, tag.Name)
+		payload = appendBytes(payload, tag.Value)
+	}
+	payload = appendBytes(payload, m.Annotation)
+
+	buf = appendUvarint(buf, uint64(len(payload)))
+	return append(buf, payload...)
+}
+
+func encodedSize(m Metric) int {
+	size := 2 + 2*binary.MaxVarintLen64 + 8
+	for _, tag := range m.Tags {
+		size += 2*binary.MaxVarintLen64 + len(tag.Name) + len(tag.Value)
+	}
+	return size + binary.MaxVarintLen64 + len(m.Annotation)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], v)
+	return append(buf, scratch[:]...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// Decoder decodes metrics from a stream of frames.
+type Decoder struct {
+	r            *bufio.Reader
+	maxFrameSize int
+	frame        []byte
+	tags         []models.Tag
+}
+
+// NewDecoder returns a new decoder that reads frames from the reader,
+// frames larger than the max frame size are skipped.
+func NewDecoder(r io.Reader, maxFrameSize int) *Decoder {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	return &Decoder{
+		r:            bufio.NewReader(r),
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// Decode decodes the next metric from the stream. It returns io.EOF once
+// the stream is exhausted, and ErrFrameTooLarge or ErrMalformedFrame if the
+// current frame had to be skipped in which case decoding can continue. The
+// tags and annotation of the returned metric are only valid until the next
+// call to Decode.
+func (d *Decoder) Decode() (Metric, error) {
+	length, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return Metric{}, err
+	}
+
+	if length > uint64(d.maxFrameSize) {
+		if _, err := io.CopyN(ioutil.Discard, d.r, int64(length)); err != nil {
+			return Metric{}, unexpectedEOF(err)
+		}
+		return Metric{}, ErrFrameTooLarge
+	}
+
+	if cap(d.frame) < int(length) {
+		d.frame = make([]byte, length)
+	}
+	d.frame = d.frame[:length]
+	if _, err := io.ReadFull(d.r, d.frame); err != nil {
+		return Metric{}, unexpectedEOF(err)
+	}
+
+	return d.decodePayload(d.frame)
+}
+
+func (d *Decoder) decodePayload(payload []byte) (Metric, error) {
+	if len(payload) < 2 || payload[0] != Version {
+		return Metric{}, ErrMalformedFrame
+	}
+
+	m := Metric{Type: MetricType(payload[1])}
+	if err := m.Type.Validate(); err != nil {
+		return Metric{}, ErrMalformedFrame
+	}
+
+	payload = payload[2:]
+	timestamp, n := binary.Varint(payload)
+	if n <= 0 {
+		return Metric{}, ErrMalformedFrame
+	}
+	m.Timestamp = time.Unix(0, timestamp)
+	payload = payload[n:]
+
+	if len(payload) < 8 {
+		return Metric{}, ErrMalformedFrame
+	}
+	m.Value = math.Float64frombits(binary.BigEndian.Uint64(payload))
+	payload = payload[8:]
+
+	numTags, n := binary.Uvarint(payload)
+	// Each tag takes at least two bytes so this bounds the allocation below.
+	if n <= 0 || numTags > uint64(len(payload)) {
+		return Metric{}, ErrMalformedFrame
+	}
+	payload = payload[n:]
+
+	d.tags = d.tags[:0]
+	for i := uint64(0); i < numTags; i++ {
+		var name, value []byte
+		name, payload, n = readBytes(payload)
+		if n <= 0 || len(name) == 0 {
+			return Metric{}, ErrMalformedFrame
+		}
+		value, payload, n = readBytes(payload)
+		if n <= 0 {
+			return Metric{}, ErrMalformedFrame
+		}
+		d.tags = append(d.tags, models.Tag{Name: name, Value: value})
+	}
+	m.Tags = d.tags
+
+	annotation, payload, n := readBytes(payload)
+	if n <= 0 || len(payload) != 0 {
+		return Metric{}, ErrMalformedFrame
+	}
+	if len(annotation) > 0 {
+		m.Annotation = annotation
+	}
+
+	return m, nil
+}
+
+// readBytes reads a length prefixed byte slice, returning the bytes, the
+// remainder of the buffer and a non-positive n if the buffer is malformed.
+func readBytes(buf []byte) ([]byte, []byte, int) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return nil, buf, -1
+	}
+
+	end := n + int(length)
+	return buf[n:end], buf[end:], n
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestbinary
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testMetric = Metric{
+	Type: MetricTypeCounter,
+	Tags: []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("empty"), Value: []byte{}},
+	},
+	Timestamp:  time.Unix(1, 123),
+	Value:      42.5,
+	Annotation: []byte("annotation"),
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	noAnnotation := testMetric
+	noAnnotation.Type = MetricTypeGauge
+	noAnnotation.Annotation = nil
+
+	var buf []byte
+	buf = Encode(buf, testMetric)
+	buf = Encode(buf, noAnnotation)
+
+	decoder := NewDecoder(bytes.NewReader(buf), 0)
+	for _, expected := range []Metric{testMetric, noAnnotation} {
+		m, err := decoder.Decode()
+		require.NoError(t, err)
+		require.Equal(t, expected.Type, m.Type)
+		require.True(t, expected.Timestamp.Equal(m.Timestamp))
+		require.Equal(t, expected.Value, m.Value)
+		require.Equal(t, expected.Annotation, m.Annotation)
+		require.Equal(t, len(expected.Tags), len(m.Tags))
+		for i, tag := range expected.Tags {
+			require.Equal(t, string(tag.Name), string(m.Tags[i].Name))
+			require.Equal(t, string(tag.Value), string(m.Tags[i].Value))
+		}
+	}
+
+	_, err := decoder.Decode()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDecodeSkipsFrameTooLarge(t *testing.T) {
+	large := testMetric
+	large.Annotation = make([]byte, 1024)
+
+	var buf []byte
+	buf = Encode(buf, large)
+	buf = Encode(buf, testMetric)
+
+	decoder := NewDecoder(bytes.NewReader(buf), 512)
+	_, err := decoder.Decode()
+	require.Equal(t, ErrFrameTooLarge, err)
+
+	m, err := decoder.Decode()
+	require.NoError(t, err)
+	require.Equal(t, testMetric.Value, m.Value)
+}
+
+func TestDecodeSkipsMalformedFrames(t *testing.T) {
+	invalidType := testMetric
+	invalidType.Type = MetricType(10)
+
+	var (
+		invalidVersion = Encode(nil, testMetric)
+		trailingBytes  = []byte{3, Version, byte(MetricTypeGauge), 0}
+	)
+	// The version is the first byte after the single byte length prefix.
+	invalidVersion[1] = 2
+
+	var buf []byte
+	buf = Encode(buf, invalidType)
+	buf = append(buf, invalidVersion...)
+	buf = append(buf, trailingBytes...)
+	buf = Encode(buf, testMetric)
+
+	decoder := NewDecoder(bytes.NewReader(buf), 0)
+	for i := 0; i < 3; i++ {
+		_, err := decoder.Decode()
+		require.Equal(t, ErrMalformedFrame, err)
+	}
+
+	m, err := decoder.Decode()
+	require.NoError(t, err)
+	require.Equal(t, testMetric.Value, m.Value)
+}
+
+func TestDecodeTruncatedFrame(t *testing.T) {
+	buf := Encode(nil, testMetric)
+
+	decoder := NewDecoder(bytes.NewReader(buf[:len(buf)-1]), 0)
+	_, err := decoder.Decode()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
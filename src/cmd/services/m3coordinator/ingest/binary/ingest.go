@@ -0,0 +1,181 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestbinary
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/log"
+	m3xserver "github.com/m3db/m3x/server"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/uber-go/tally"
+)
+
+var (
+	errIOptsMustBeSet   = errors.New("binary ingester options: instrument options must be set")
+	errTagOptsMustBeSet = errors.New("binary ingester options: tag options must be set")
+)
+
+// Options configures the ingester.
+type Options struct {
+	InstrumentOptions instrument.Options
+	TagOptions        models.TagOptions
+	// MaxFrameSize is the maximum size of a frame payload, larger frames are
+	// skipped. Defaults to DefaultMaxFrameSize if not set.
+	MaxFrameSize int
+}
+
+// Validate validates the options struct.
+func (o *Options) Validate() error {
+	if o.InstrumentOptions == nil {
+		return errIOptsMustBeSet
+	}
+
+	if o.TagOptions == nil {
+		return errTagOptsMustBeSet
+	}
+
+	return nil
+}
+
+// NewIngester returns an ingester for the binary protocol.
+func NewIngester(
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	opts Options,
+) (m3xserver.Handler, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ingester{
+		downsamplerAndWriter: downsamplerAndWriter,
+		opts:                 opts,
+		logger:               opts.InstrumentOptions.Logger(),
+		metrics: newBinaryIngesterMetrics(
+			opts.InstrumentOptions.MetricsScope()),
+	}, nil
+}
+
+type ingester struct {
+	downsamplerAndWriter ingest.DownsamplerAndWriter
+	opts                 Options
+	logger               log.Logger
+	metrics              binaryIngesterMetrics
+}
+
+// Handle decodes and writes the frames received on the connection, each
+// frame is written before the next one is decoded so the writes of a single
+// connection are applied in the order they were received.
+func (i *ingester) Handle(conn net.Conn) {
+	var (
+		// Interfaces require a context be passed, but M3DB client already has timeouts
+		// built in and allocating a new context each time is expensive so we just pass
+		// the same context always and rely on M3DB client timeouts.
+		ctx        = context.Background()
+		decoder    = NewDecoder(conn, i.opts.MaxFrameSize)
+		datapoints = make(ts.Datapoints, 1)
+	)
+
+	i.logger.Debug("handling new binary ingestion connection")
+	for {
+		metric, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrFrameTooLarge {
+			i.metrics.frameTooLarge.Inc(1)
+			continue
+		}
+		if err == ErrMalformedFrame {
+			i.metrics.malformed.Inc(1)
+			continue
+		}
+		if err != nil {
+			i.logger.Errorf("encountered error during binary ingestion when reading connection: %s", err)
+			break
+		}
+
+		var (
+			tags = models.Tags{Opts: i.opts.TagOptions, Tags: metric.Tags}
+			dp   = ts.Datapoint{Timestamp: metric.Timestamp, Value: metric.Value}
+		)
+		datapoints[0] = dp
+		writeOpts := ingest.WriteOptions{MetricType: ingestMetricType(metric.Type)}
+		if len(metric.Annotation) > 0 {
+			// Copy the annotation since the decoder reuses its buffer and the
+			// storage may retain the annotation after the write returns.
+			writeOpts.Annotation = append([]byte(nil), metric.Annotation...)
+		}
+		err = i.downsamplerAndWriter.Write(ctx, tags.Normalize(), datapoints,
+			xtime.Nanosecond, writeOpts)
+		if err != nil {
+			i.logger.Errorf("err writing binary metric, err: %s", err)
+			i.metrics.err.Inc(1)
+			continue
+		}
+
+		i.metrics.success.Inc(1)
+	}
+
+	// Don't close the connection, that is the server's responsibility.
+}
+
+// ingestMetricType returns the metric type the samples of a metric of the
+// given type are aggregated as, the decoder only returns valid types.
+func ingestMetricType(t MetricType) ingest.MetricType {
+	switch t {
+	case MetricTypeCounter:
+		return ingest.MetricTypeCounter
+	case MetricTypeTimer:
+		return ingest.MetricTypeTimer
+	default:
+		return ingest.MetricTypeGauge
+	}
+}
+
+func (i *ingester) Close() {
+	// We don't maintain any state in-between connections so there is nothing to do here.
+}
+
+func newBinaryIngesterMetrics(m tally.Scope) binaryIngesterMetrics {
+	return binaryIngesterMetrics{
+		success:       m.Counter("success"),
+		err:           m.Counter("error"),
+		malformed:     m.Counter("malformed"),
+		frameTooLarge: m.Counter("frame-too-large"),
+	}
+}
+
+type binaryIngesterMetrics struct {
+	success       tally.Counter
+	err           tally.Counter
+	malformed     tally.Counter
+	frameTooLarge tally.Counter
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestbinary
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngesterHandleConn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var buf []byte
+	for i := 0; i < 3; i++ {
+		m := testMetric
+		m.Value = float64(i)
+		buf = Encode(buf, m)
+	}
+	// Add a malformed frame in the middle of the stream.
+	buf = append(buf, 1, 0)
+	buf = Encode(buf, testMetric)
+
+	var found []float64
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Nanosecond, gomock.Any()).
+		DoAndReturn(func(
+			_ context.Context,
+			tags models.Tags,
+			dp ts.Datapoints,
+			_ xtime.Unit,
+			opts ingest.WriteOptions,
+		) error {
+			name, ok := tags.Name()
+			require.True(t, ok)
+			require.Equal(t, "requests", string(name))
+			require.True(t, testMetric.Timestamp.Equal(dp[0].Timestamp))
+			require.Equal(t, testMetric.Annotation, opts.Annotation)
+			found = append(found, dp[0].Value)
+			return nil
+		}).Times(4)
+
+	ingester, err := NewIngester(mockDownsamplerAndWriter, Options{
+		InstrumentOptions: instrument.NewOptions(),
+		TagOptions:        models.NewTagOptions(),
+	})
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(buf)})
+
+	require.Equal(t, []float64{0, 1, 2, testMetric.Value}, found)
+}
+
+func TestIngesterHandleConnMetricTypes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var buf []byte
+	for _, metricType := range []MetricType{MetricTypeCounter, MetricTypeTimer, MetricTypeGauge} {
+		m := testMetric
+		m.Type = metricType
+		buf = Encode(buf, m)
+	}
+
+	var found []ingest.MetricType
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Nanosecond, gomock.Any()).
+		DoAndReturn(func(
+			_ context.Context,
+			_ models.Tags,
+			_ ts.Datapoints,
+			_ xtime.Unit,
+			opts ingest.WriteOptions,
+		) error {
+			found = append(found, opts.MetricType)
+			return nil
+		}).Times(3)
+
+	ingester, err := NewIngester(mockDownsamplerAndWriter, Options{
+		InstrumentOptions: instrument.NewOptions(),
+		TagOptions:        models.NewTagOptions(),
+	})
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(buf)})
+
+	require.Equal(t, []ingest.MetricType{
+		ingest.MetricTypeCounter,
+		ingest.MetricTypeTimer,
+		ingest.MetricTypeGauge,
+	}, found)
+}
+
+func TestNewIngesterValidatesOptions(t *testing.T) {
+	_, err := NewIngester(nil, Options{TagOptions: models.NewTagOptions()})
+	require.Equal(t, errIOptsMustBeSet, err)
+
+	_, err = NewIngester(nil, Options{InstrumentOptions: instrument.NewOptions()})
+	require.Equal(t, errTagOptsMustBeSet, err)
+}
+
+// byteConn implements the net.Conn interface so that we can test the handler without
+// going over the network.
+type byteConn struct {
+	b *bytes.Buffer
+}
+
+func (b *byteConn) Read(buf []byte) (n int, err error) {
+	return b.b.Read(buf)
+}
+
+func (b *byteConn) Write(buf []byte) (n int, err error) {
+	panic("not_implemented")
+}
+
+func (b *byteConn) Close() error {
+	return nil
+}
+
+func (b *byteConn) LocalAddr() net.Addr {
+	panic("not_implemented")
+}
+
+func (b *byteConn) RemoteAddr() net.Addr {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetDeadline(t time.Time) error {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetReadDeadline(t time.Time) error {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetWriteDeadline(t time.Time) error {
+	panic("not_implemented")
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+
+	xtime "github.com/m3db/m3x/time"
+)
+
+const defaultBatchFlushInterval = time.Second
+
+// connBatcher accumulates the carbon lines of a connection into a batch per
+// cluster and flushes each batch through WriteBatchWithResult once it is
+// full, when the flush interval elapses or when the connection is done. The
+// latter two also flush the downsamplers of the clusters if
+// BatchFlushDownsampler is set.
+type connBatcher struct {
+	sync.Mutex
+
+	ingester *ingester
+	ctx      context.Context
+	wg       *sync.WaitGroup
+	permits  chan struct{}
+	inFlight *int64
+	batches  [][]preparedLine
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func (i *ingester) newConnBatcher(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	permits chan struct{},
+	inFlight *int64,
+) *connBatcher {
+	b := &connBatcher{
+		ingester: i,
+		ctx:      ctx,
+		wg:       wg,
+		permits:  permits,
+		inFlight: inFlight,
+		batches:  make([][]preparedLine, len(i.clusters)),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	interval := i.opts.BatchFlushInterval
+	if interval <= 0 {
+		interval = defaultBatchFlushInterval
+	}
+	go b.flushEvery(interval)
+
+	return b
+}
+
+// add adds a line to the batch of its cluster, flushing the batch if it is
+// full. The resources of the line are returned to the pool once the batch
+// is written or right away if the line is not written.
+func (b *connBatcher) add(
+	resources *lineResources,
+	timestamp time.Time,
+	value float64,
+) {
+	i := b.ingester
+	if res := i.opts.TimestampResolution; res > 0 {
+		// Only the overrides of the mapping rules and storage policies apply
+		// to the series of a batch so truncate the timestamp here instead.
+		timestamp = timestamp.Truncate(res)
+	}
+
+	line, ok := i.prepareLine(resources, timestamp, value)
+	if !ok {
+		i.putLineResources(resources)
+		return
+	}
+
+	var full []preparedLine
+	b.Lock()
+	batch := append(b.batches[line.cluster], line)
+	if len(batch) >= i.opts.BatchSize {
+		full, batch = batch, nil
+	}
+	b.batches[line.cluster] = batch
+	b.Unlock()
+
+	if full != nil {
+		b.flush(line.cluster, full, nil)
+	}
+}
+
+// close stops the periodic flushes and flushes the remaining batches.
+func (b *connBatcher) close() {
+	close(b.closed)
+	<-b.done
+	b.flushAll()
+}
+
+func (b *connBatcher) flushEvery(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-ticker.C:
+			b.flushAll()
+		}
+	}
+}
+
+func (b *connBatcher) flushAll() {
+	var (
+		written        sync.WaitGroup
+		writtenCluster []int
+	)
+	for cluster := range b.batches {
+		b.Lock()
+		batch := b.batches[cluster]
+		b.batches[cluster] = nil
+		b.Unlock()
+
+		if len(batch) > 0 {
+			b.flush(cluster, batch, &written)
+			writtenCluster = append(writtenCluster, cluster)
+		}
+	}
+
+	if !b.ingester.opts.BatchFlushDownsampler || len(writtenCluster) == 0 {
+		return
+	}
+	// Wait for the batches to be written so that the downsamplers flush the
+	// windows their lines were aggregated into.
+	written.Wait()
+	for _, cluster := range writtenCluster {
+		b.ingester.flushDownsampler(cluster)
+	}
+}
+
+// flush writes a batch of a cluster in the background, written is done once
+// the batch is written if it is set.
+func (b *connBatcher) flush(cluster int, batch []preparedLine, written *sync.WaitGroup) {
+	if b.permits != nil {
+		b.permits <- struct{}{}
+	}
+	connInFlight := atomic.AddInt64(b.inFlight, 1)
+	if b.ingester.opts.Debug {
+		b.ingester.metrics.connInFlight.RecordValue(float64(connInFlight))
+	}
+
+	b.wg.Add(1)
+	if written != nil {
+		written.Add(1)
+	}
+	b.ingester.opts.WorkerPool.Go(func() {
+		b.ingester.writeBatch(b.ctx, cluster, batch)
+
+		atomic.AddInt64(b.inFlight, -1)
+		if b.permits != nil {
+			<-b.permits
+		}
+		if written != nil {
+			written.Done()
+		}
+		b.wg.Done()
+	})
+}
+
+func (i *ingester) flushDownsampler(clusterIdx int) {
+	cluster := &i.clusters[clusterIdx]
+	if err := cluster.writer.Flush(); err != nil {
+		i.logger.Errorf("err flushing downsampler, cluster: %s, err: %s",
+			cluster.name, err)
+	}
+}
+
+func (i *ingester) writeBatch(
+	ctx context.Context,
+	clusterIdx int,
+	batch []preparedLine,
+) {
+	cluster := &i.clusters[clusterIdx]
+	result, err := cluster.writer.WriteBatchWithResult(ctx, newPreparedLinesIter(batch))
+	if err != nil {
+		i.logger.Errorf("err writing batch of %d carbon metrics, cluster: %s, err: %s",
+			len(batch), cluster.name, err)
+	}
+
+	i.metrics.success.Inc(int64(result.Succeeded))
+	i.metrics.err.Inc(int64(result.Failed))
+	cluster.metrics.success.Inc(int64(result.Succeeded))
+	cluster.metrics.err.Inc(int64(result.Failed))
+
+	// The contract is that after the DownsamplerAndWriter returns, any resources
+	// that it needed to hold onto have already been copied.
+	for _, line := range batch {
+		i.putLineResources(line.resources)
+	}
+}
+
+// preparedLinesIter is a DownsampleAndWriteIter over a batch of carbon lines.
+type preparedLinesIter struct {
+	lines []preparedLine
+	idx   int
+}
+
+func newPreparedLinesIter(lines []preparedLine) *preparedLinesIter {
+	return &preparedLinesIter{lines: lines, idx: -1}
+}
+
+func (it *preparedLinesIter) Next() bool {
+	it.idx++
+	return it.idx < len(it.lines)
+}
+
+func (it *preparedLinesIter) Current() ingest.IterValue {
+	line := it.lines[it.idx]
+	return ingest.IterValue{
+		Tags:       line.tags,
+		Datapoints: line.resources.datapoints,
+		Unit:       xtime.Second,
+		Overrides:  line.overrides,
+	}
+}
+
+func (it *preparedLinesIter) Reset() error {
+	it.idx = -1
+	return nil
+}
+
+func (it *preparedLinesIter) Error() error {
+	return nil
+}
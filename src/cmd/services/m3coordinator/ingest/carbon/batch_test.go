@@ -0,0 +1,313 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// expectBatches records the IDs of the series of each batch written.
+func expectBatches(
+	writer *ingest.MockDownsamplerAndWriter,
+	lock *sync.Mutex,
+	batches *[][]string,
+	written chan<- struct{},
+) {
+	writer.EXPECT().
+		WriteBatchWithResult(gomock.Any(), gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		iter ingest.DownsampleAndWriteIter,
+	) (ingest.WriteBatchResult, error) {
+		var batch []string
+		for iter.Next() {
+			value := iter.Current()
+			batch = append(batch, string(value.Tags.ID()))
+		}
+
+		lock.Lock()
+		*batches = append(*batches, batch)
+		lock.Unlock()
+		if written != nil {
+			written <- struct{}{}
+		}
+		return ingest.WriteBatchResult{Succeeded: len(batch)}, nil
+	}).AnyTimes()
+}
+
+func TestIngesterBatchSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, nil)
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.BatchSize = 2
+	opts.BatchFlushInterval = time.Hour
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	packet := []byte("" +
+		"foo.a 1 1\n" +
+		"foo.b 1 1\n" +
+		"foo.c 1 1\n" +
+		"foo.d 1 1\n" +
+		"foo.e 1 1\n")
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	// Full batches are written as soon as they fill up and the remainder
+	// once the connection is done.
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i][0] < batches[j][0]
+	})
+	require.Equal(t, [][]string{
+		{"foo.a", "foo.b"},
+		{"foo.c", "foo.d"},
+		{"foo.e"},
+	}, batches)
+	require.Equal(t, int64(5), scope.Snapshot().Counters()["success+"].Value())
+}
+
+func TestIngesterBatchConnInFlight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, nil)
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.BatchSize = 2
+	opts.BatchFlushInterval = time.Hour
+	opts.Debug = true
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	packet := []byte("" +
+		"foo.a 1 1\n" +
+		"foo.b 1 1\n" +
+		"foo.c 1 1\n")
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	// Every batch records the in-flight writes of the connection as it is
+	// dispatched, at most both batches.
+	var recorded int64
+	for upperBound, count := range scope.Snapshot().Histograms()["connection-in-flight+"].Values() {
+		if upperBound > 2 {
+			require.Equal(t, int64(0), count)
+		}
+		recorded += count
+	}
+	require.Equal(t, int64(2), recorded)
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestIngesterBatchFlushDownsampler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock   sync.Mutex
+		events []string
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		WriteBatchWithResult(gomock.Any(), gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		iter ingest.DownsampleAndWriteIter,
+	) (ingest.WriteBatchResult, error) {
+		var batch []string
+		for iter.Next() {
+			batch = append(batch, string(iter.Current().Tags.ID()))
+		}
+
+		lock.Lock()
+		events = append(events, strings.Join(batch, ","))
+		lock.Unlock()
+		return ingest.WriteBatchResult{Succeeded: len(batch)}, nil
+	}).Times(2)
+	mockDownsamplerAndWriter.EXPECT().
+		Flush().DoAndReturn(func() error {
+		lock.Lock()
+		events = append(events, "flush")
+		lock.Unlock()
+		return nil
+	})
+
+	opts := testOptions
+	opts.BatchSize = 2
+	opts.BatchFlushInterval = time.Hour
+	opts.BatchFlushDownsampler = true
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	packet := []byte("" +
+		"foo.a 1 1\n" +
+		"foo.b 1 1\n" +
+		"foo.c 1 1\n")
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	// Full batches do not flush the downsampler, so the full batch may still
+	// be written after the flush, the remainder written once the connection
+	// is done does flush it once it is written.
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, events, 3)
+	require.Contains(t, events, "foo.a,foo.b")
+	require.True(t, indexOf(events, "foo.c") < indexOf(events, "flush"))
+}
+
+func TestIngesterBatchFlushInterval(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+		written = make(chan struct{}, 2)
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, written)
+
+	opts := testOptions
+	opts.BatchSize = 1000
+	opts.BatchFlushInterval = 10 * time.Millisecond
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		ingester.Handle(&byteConn{b: r})
+		close(done)
+	}()
+
+	// The batch is written once the flush interval elapses even though it
+	// is neither full nor is the connection done.
+	_, err = w.Write([]byte("foo.a 1 1\nfoo.b 1 1\n"))
+	require.NoError(t, err)
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "batch not written after flush interval")
+	}
+
+	_, err = w.Write([]byte("foo.c 1 1\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	<-done
+
+	require.Equal(t, [][]string{
+		{"foo.a", "foo.b"},
+		{"foo.c"},
+	}, batches)
+}
+
+func TestNewIngesterInvalidBatchOptions(t *testing.T) {
+	opts := testOptions
+	opts.BatchSize = -1
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidBatchSize, err)
+
+	opts.BatchSize = 1
+	opts.BatchFlushInterval = -time.Second
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidBatchFlushInterval, err)
+}
+
+func TestIngesterShutdownFlushesBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, nil)
+
+	opts := testOptions
+	opts.BatchSize = 1000
+	opts.BatchFlushInterval = time.Hour
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		ingester.Handle(server)
+		close(done)
+	}()
+
+	// The pipe is synchronous so the lines have been read once the write
+	// returns, but the connection remains open.
+	_, err = client.Write([]byte("foo.a 1 1\nfoo.b 1 1\n"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, ingester.Shutdown(ctx))
+	<-done
+
+	lock.Lock()
+	require.Equal(t, [][]string{{"foo.a", "foo.b"}}, batches)
+	lock.Unlock()
+
+	// Connections accepted after the shutdown are not handled.
+	server, client = net.Pipe()
+	defer client.Close()
+	ingester.Handle(server)
+}
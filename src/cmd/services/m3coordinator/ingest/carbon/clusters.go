@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+
+	"github.com/cespare/xxhash"
+	"github.com/uber-go/tally"
+)
+
+var (
+	errClusterNameMustBeSet   = errors.New("carbon ingester options: cluster name must be set")
+	errClusterWriterMustBeSet = errors.New("carbon ingester options: cluster writer must be set")
+)
+
+// ClusterWriter is a named writer that a share of the carbon series are
+// routed to when splitting ingestion across multiple clusters.
+type ClusterWriter struct {
+	Name   string
+	Writer ingest.DownsamplerAndWriter
+}
+
+// ClusterSelectFn returns the index of the cluster that a series with the
+// given carbon name is written to, it must return the same index for the same
+// name and number of clusters so that a series always stays on one cluster.
+type ClusterSelectFn func(name []byte, numClusters int) int
+
+// HashClusterSelect selects a cluster using a jump consistent hash of the
+// carbon name, which only moves a minimal share of the series when clusters
+// are appended.
+func HashClusterSelect(name []byte, numClusters int) int {
+	return jumpHash(xxhash.Sum64(name), numClusters)
+}
+
+// jumpHash implements the jump consistent hash from "A Fast, Minimal Memory,
+// Consistent Hash Algorithm" by Lamping and Veach.
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func validateClusters(clusters []ClusterWriter) error {
+	seen := make(map[string]struct{}, len(clusters))
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return errClusterNameMustBeSet
+		}
+		if cluster.Writer == nil {
+			return errClusterWriterMustBeSet
+		}
+		if _, ok := seen[cluster.Name]; ok {
+			return fmt.Errorf("carbon ingester options: duplicate cluster name: %s", cluster.Name)
+		}
+		seen[cluster.Name] = struct{}{}
+	}
+	return nil
+}
+
+type clusterTarget struct {
+	name    string
+	writer  ingest.DownsamplerAndWriter
+	metrics clusterMetrics
+}
+
+type clusterMetrics struct {
+	success tally.Counter
+	err     tally.Counter
+}
+
+func newClusterTargets(
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	clusters []ClusterWriter,
+	scope tally.Scope,
+) []clusterTarget {
+	if len(clusters) == 0 {
+		// Without multiple clusters all series go to the single writer, the
+		// top level success and error metrics already cover it.
+		noop := tally.NoopScope
+		return []clusterTarget{{
+			writer: downsamplerAndWriter,
+			metrics: clusterMetrics{
+				success: noop.Counter("success"),
+				err:     noop.Counter("error"),
+			},
+		}}
+	}
+
+	targets := make([]clusterTarget, 0, len(clusters))
+	for _, cluster := range clusters {
+		clusterScope := scope.SubScope("cluster").Tagged(map[string]string{
+			"cluster": cluster.Name,
+		})
+		targets = append(targets, clusterTarget{
+			name:   cluster.Name,
+			writer: cluster.Writer,
+			metrics: clusterMetrics{
+				success: clusterScope.Counter("success"),
+				err:     clusterScope.Counter("error"),
+			},
+		})
+	}
+	return targets
+}
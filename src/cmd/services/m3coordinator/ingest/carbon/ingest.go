@@ -25,9 +25,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"regexp"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
@@ -56,13 +59,29 @@ const (
 )
 
 var (
-	// Used for parsing carbon names into tags.
-	carbonSeparatorByte  = byte('.')
-	carbonSeparatorBytes = []byte{carbonSeparatorByte}
+	// Used for parsing carbon names into tags unless Options.Separator is set.
+	carbonSeparatorByte = byte('.')
+
+	// Used for parsing the tags of names in the graphite tag format, i.e.
+	// foo.bar;dc=sjc;env=prod.
+	carbonTagSeparatorByte  = byte(';')
+	carbonTagSeparatorBytes = []byte{carbonTagSeparatorByte}
+	carbonTagValueByte      = byte('=')
 
 	errCannotGenerateTagsFromEmptyName = errors.New("cannot generate tags from empty name")
 	errIOptsMustBeSet                  = errors.New("carbon ingester options: instrument options must be st")
 	errWorkerPoolMustBeSet             = errors.New("carbon ingester options: worker pool must be set")
+	errInvalidEmptyNameBehavior        = errors.New("carbon ingester options: invalid empty name behavior")
+	errInvalidNonFiniteValueBehavior   = errors.New("carbon ingester options: invalid non-finite value behavior")
+	errInvalidTCPBufferSize            = errors.New("carbon ingester options: tcp buffer sizes must not be negative")
+	errInvalidTimestampResolution      = errors.New("carbon ingester options: timestamp resolution must not be negative")
+	errInvalidMaxLineLength            = errors.New("carbon ingester options: max line length must not be negative")
+	errInvalidMaxDatagramSize          = errors.New("carbon ingester options: max datagram size must not be negative")
+	errInvalidBatchSize                = errors.New("carbon ingester options: batch size must not be negative")
+	errInvalidBatchFlushInterval       = errors.New("carbon ingester options: batch flush interval must not be negative")
+	errInvalidRateLimit                = errors.New("carbon ingester options: rate limit rates and burst must not be negative")
+	errInvalidRateLimitBehavior        = errors.New("carbon ingester options: invalid rate limit behavior")
+	errInvalidSeparator                = errors.New("carbon ingester options: separator must not be whitespace or a tag separator")
 )
 
 // Options configures the ingester.
@@ -70,6 +89,113 @@ type Options struct {
 	Debug             bool
 	InstrumentOptions instrument.Options
 	WorkerPool        xsync.PooledWorkerPool
+
+	// MaxConcurrencyPerConnection bounds the number of lines from a single
+	// connection that can be written concurrently so that one busy connection
+	// cannot take up the entire worker pool. Reading from the connection is
+	// paused while the limit is reached. Zero means unbounded.
+	MaxConcurrencyPerConnection int
+
+	// EmptyNames determines how lines with an empty or whitespace only
+	// metric name are handled, such lines are dropped if not set.
+	EmptyNames config.CarbonEmptyNameBehavior
+
+	// NonFiniteValues determines how lines with a NaN or infinite value are
+	// handled, such lines are written as is if not set.
+	NonFiniteValues config.CarbonNonFiniteValueBehavior
+
+	// TCPReadBufferSize and TCPWriteBufferSize set the OS buffer sizes of
+	// accepted TCP connections, the OS defaults are kept if not set.
+	TCPReadBufferSize  int
+	TCPWriteBufferSize int
+
+	// TCPNoDelay, if set, sets whether Nagle's algorithm is disabled on
+	// accepted TCP connections, it is disabled by default.
+	TCPNoDelay *bool
+
+	// Clusters, if set, splits the carbon series across multiple clusters
+	// instead of writing them all to the writer the ingester is created with.
+	Clusters []ClusterWriter
+
+	// ClusterSelect selects the cluster each series is written to, series
+	// are routed with HashClusterSelect if not set.
+	ClusterSelect ClusterSelectFn
+
+	// TimestampResolution, if set, is the resolution the timestamps of
+	// carbon datapoints are truncated to, see ingest.WriteOptions.
+	TimestampResolution time.Duration
+
+	// MaxLineLength is the maximum length in bytes of a line, longer lines
+	// are skipped without being buffered. The default of the carbon scanner
+	// is used if not set.
+	MaxLineLength int
+
+	// MaxDatagramSize is the maximum size in bytes of the datagrams read by
+	// HandlePacketConn, the final line of a longer datagram is truncated and
+	// skipped. Defaults to 64KiB, the maximum size of a UDP datagram.
+	MaxDatagramSize int
+
+	// BatchSize, if set, accumulates the lines of each connection into
+	// batches of up to this many metrics per cluster that are written with
+	// WriteBatchWithResult instead of writing every line on its own. With
+	// MaxConcurrencyPerConnection set it bounds the number of concurrent
+	// batch writes instead.
+	BatchSize int
+
+	// BatchFlushInterval is the interval at which batches are written even
+	// if they are not full, defaults to one second.
+	BatchFlushInterval time.Duration
+
+	// BatchFlushDownsampler flushes the downsampler of each cluster that
+	// batches were written to once they are written at each flush interval
+	// and when the connection is done, so that the aggregations of windows
+	// that have closed are in storage by then. Batches that filled up and
+	// are still being written are only covered by the next flush. Flushing
+	// the downsampler flushes the aggregations of every series, not only
+	// those of the connection.
+	BatchFlushDownsampler bool
+
+	// TagNames names the tags generated from the segments of matching metric
+	// names instead of naming them after their position, see
+	// config.CarbonIngesterTagNameRuleConfiguration.
+	TagNames []config.CarbonIngesterTagNameRuleConfiguration
+
+	// Normalizer, if set, normalizes metric names before they are matched
+	// against the rules, otherwise names are used as is and names with
+	// duplicate separators are dropped as malformed, see NewNormalizer.
+	Normalizer Normalizer
+
+	// NameFilter drops metrics by their normalized name before tags are
+	// generated from them, see config.CarbonIngesterNameFilterConfiguration.
+	NameFilter config.CarbonIngesterNameFilterConfiguration
+
+	// RateLimit limits the rate at which the lines of each connection, and
+	// optionally of all connections combined, are written, see
+	// config.CarbonIngesterRateLimitConfiguration.
+	RateLimit config.CarbonIngesterRateLimitConfiguration
+
+	// NameTag, if set, adds a __name__ tag whose value is the full path of
+	// the metric name to the tags generated from the name, so that series
+	// can be queried by their full name as well as by their segments. The
+	// tags of every series then use the quoted ID scheme, as those of names
+	// in the graphite tag format do, so enabling it changes the series IDs.
+	NameTag bool
+
+	// SourceFromRemoteAddr, if set, identifies the remote host of each
+	// connection as the source of its writes, see ingest.NewContextWithSource.
+	// The writes of HandlePacketConn have no source since its datagrams may
+	// each come from a different host.
+	SourceFromRemoteAddr bool
+
+	// Separator is the character that separates the segments of metric
+	// names that tags are generated from, defaults to '.'. The Normalizer
+	// should be created with the same separator.
+	Separator byte
+
+	// AllowImplicitTimestamp, if set, accepts plaintext lines that omit the
+	// timestamp or whose timestamp is -1 and timestamps them with the time
+	// they are read at, such lines are dropped as malformed if not set.
+	AllowImplicitTimestamp bool
 }
 
 // CarbonIngesterRules contains the carbon ingestion rules.
@@ -87,7 +213,90 @@ func (o *Options) Validate() error {
 		return errWorkerPoolMustBeSet
 	}
 
-	return nil
+	switch o.EmptyNames {
+	case "", config.CarbonEmptyNameDrop, config.CarbonEmptyNameRejectConnection:
+	default:
+		return errInvalidEmptyNameBehavior
+	}
+
+	switch o.NonFiniteValues {
+	case "", config.CarbonNonFiniteValuePass, config.CarbonNonFiniteValueDrop,
+		config.CarbonNonFiniteValueZero:
+	default:
+		return errInvalidNonFiniteValueBehavior
+	}
+
+	if o.TCPReadBufferSize < 0 || o.TCPWriteBufferSize < 0 {
+		return errInvalidTCPBufferSize
+	}
+
+	if o.TimestampResolution < 0 {
+		return errInvalidTimestampResolution
+	}
+
+	if o.MaxLineLength < 0 {
+		return errInvalidMaxLineLength
+	}
+
+	if o.MaxDatagramSize < 0 {
+		return errInvalidMaxDatagramSize
+	}
+
+	if o.BatchSize < 0 {
+		return errInvalidBatchSize
+	}
+
+	if o.BatchFlushInterval < 0 {
+		return errInvalidBatchFlushInterval
+	}
+
+	if o.RateLimit.PerConnection < 0 || o.RateLimit.Global < 0 || o.RateLimit.Burst < 0 {
+		return errInvalidRateLimit
+	}
+
+	switch o.RateLimit.Behavior {
+	case "", config.CarbonRateLimitDrop, config.CarbonRateLimitThrottle:
+	default:
+		return errInvalidRateLimitBehavior
+	}
+
+	switch o.Separator {
+	case carbonTagSeparatorByte, carbonTagValueByte, ' ', '\t', '\r', '\n':
+		return errInvalidSeparator
+	}
+
+	return validateClusters(o.Clusters)
+}
+
+// parseOpts returns the options plaintext lines are parsed with.
+func (o *Options) parseOpts() carbon.ParseOptions {
+	return carbon.ParseOptions{AllowImplicitTimestamp: o.AllowImplicitTimestamp}
+}
+
+// separator returns the separator of the segments of metric names.
+func (o *Options) separator() byte {
+	if o.Separator == 0 {
+		return carbonSeparatorByte
+	}
+	return o.Separator
+}
+
+// Ingester is a handler of carbon ingestion connections that can be shut
+// down gracefully.
+type Ingester interface {
+	m3xserver.Handler
+
+	// Shutdown stops handling new connections and interrupts the reads of the
+	// connections being handled, it then waits for their handlers to write
+	// the lines they have read, including any buffered batch, or for the
+	// context to be done in which case the context error is returned.
+	Shutdown(ctx context.Context) error
+
+	// HandlePacketConn reads metrics in the plaintext protocol from the
+	// datagrams of a packet connection, such as a UDP socket, each of which
+	// may contain one or more newline delimited lines. It blocks until the
+	// connection is closed or the ingester is shut down.
+	HandlePacketConn(conn net.PacketConn)
 }
 
 // NewIngester returns an ingester for carbon metrics.
@@ -95,7 +304,28 @@ func NewIngester(
 	downsamplerAndWriter ingest.DownsamplerAndWriter,
 	rules CarbonIngesterRules,
 	opts Options,
-) (m3xserver.Handler, error) {
+) (Ingester, error) {
+	return newIngester(downsamplerAndWriter, rules, opts, false)
+}
+
+// NewPickleIngester returns an ingester for carbon metrics sent with the
+// pickle protocol used by carbon-relay and carbon-c-relay, i.e. frames of a
+// length prefixed pickled list of (path, (timestamp, value)) tuples. The
+// metrics are written exactly as the metrics of the plaintext protocol.
+func NewPickleIngester(
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	rules CarbonIngesterRules,
+	opts Options,
+) (Ingester, error) {
+	return newIngester(downsamplerAndWriter, rules, opts, true)
+}
+
+func newIngester(
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	rules CarbonIngesterRules,
+	opts Options,
+	pickle bool,
+) (*ingester, error) {
 	err := opts.Validate()
 	if err != nil {
 		return nil, err
@@ -106,12 +336,23 @@ func NewIngester(
 	if err != nil {
 		return nil, err
 	}
+	taggedTagOpts := taggedNameTagOptions(tagOpts)
 
 	compiledRules, err := compileRules(rules)
 	if err != nil {
 		return nil, err
 	}
 
+	tagNameRules, err := compileTagNameRules(opts.TagNames)
+	if err != nil {
+		return nil, err
+	}
+
+	nameFilter, err := compileNameFilter(opts.NameFilter)
+	if err != nil {
+		return nil, err
+	}
+
 	poolOpts := pool.NewObjectPoolOptions().
 		SetInstrumentOptions(opts.InstrumentOptions).
 		SetRefillLowWatermark(0).
@@ -127,76 +368,260 @@ func NewIngester(
 		}
 	})
 
+	clusterSelect := opts.ClusterSelect
+	if clusterSelect == nil {
+		clusterSelect = HashClusterSelect
+	}
+
+	scope := opts.InstrumentOptions.MetricsScope()
 	return &ingester{
-		downsamplerAndWriter: downsamplerAndWriter,
-		opts:                 opts,
-		logger:               opts.InstrumentOptions.Logger(),
-		tagOpts:              tagOpts,
-		metrics: newCarbonIngesterMetrics(
-			opts.InstrumentOptions.MetricsScope()),
+		clusters:      newClusterTargets(downsamplerAndWriter, opts.Clusters, scope),
+		clusterSelect: clusterSelect,
+		opts:          opts,
+		pickle:        pickle,
+		logger:        opts.InstrumentOptions.Logger(),
+		tagOpts:       tagOpts,
+		taggedTagOpts: taggedTagOpts,
+		metrics:       newCarbonIngesterMetrics(scope),
 
-		rules: compiledRules,
+		rules:        compiledRules,
+		tagNameRules: tagNameRules,
+		nameFilter:   nameFilter,
+		limiter: newTokenBucket(opts.RateLimit.Global,
+			opts.RateLimit.Burst, time.Now),
 
 		lineResourcesPool: resourcePool,
+
+		conns: make(map[readDeadliner]struct{}),
 	}, nil
 }
 
 type ingester struct {
-	downsamplerAndWriter ingest.DownsamplerAndWriter
-	opts                 Options
-	logger               log.Logger
-	metrics              carbonIngesterMetrics
-	tagOpts              models.TagOptions
+	clusters      []clusterTarget
+	clusterSelect ClusterSelectFn
+	opts          Options
+	pickle        bool
+	logger        log.Logger
+	metrics       carbonIngesterMetrics
+	tagOpts       models.TagOptions
+	taggedTagOpts models.TagOptions
 
-	rules []ruleAndRegex
+	rules        []ruleAndRegex
+	tagNameRules []tagNameRule
+	nameFilter   nameFilter
+	// limiter is the rate limit shared by all connections, nil if unlimited.
+	limiter *tokenBucket
 
 	lineResourcesPool pool.ObjectPool
+
+	connsLock sync.Mutex
+	conns     map[readDeadliner]struct{}
+	closing   bool
+	handlers  sync.WaitGroup
 }
 
 func (i *ingester) Handle(conn net.Conn) {
-	var (
-		// Interfaces require a context be passed, but M3DB client already has timeouts
-		// built in and allocating a new context each time is expensive so we just pass
-		// the same context always and rely on M3DB client timeouts.
-		ctx    = context.Background()
-		wg     = sync.WaitGroup{}
-		s      = carbon.NewScanner(conn, i.opts.InstrumentOptions)
-		logger = i.opts.InstrumentOptions.Logger()
-	)
+	logger := i.opts.InstrumentOptions.Logger()
+	if !i.addConn(conn) {
+		logger.Debug("carbon ingester is shutting down, not handling new connection")
+		return
+	}
+	defer i.removeConn(conn)
 
 	logger.Debug("handling new carbon ingestion connection")
+	if tcpConn, ok := tcpConn(conn); ok {
+		if err := i.configureTCPConn(tcpConn); err != nil {
+			logger.Errorf("unable to configure carbon ingestion connection: %v", err)
+		}
+	}
+
+	w := i.newConnWriter(i.connContext(conn))
+	if i.pickle {
+		i.readPickleFrames(conn, w)
+	} else {
+		i.readLines(conn, w)
+	}
+
+	logger.Debugf("waiting for outstanding carbon ingestion writes to complete")
+	w.close()
+	logger.Debugf("all outstanding writes completed, shutting down carbon ingestion handler")
+
+	// Don't close the connection, that is the server's responsibility.
+}
+
+// readLines reads the metrics of a connection in the plaintext protocol.
+func (i *ingester) readLines(conn net.Conn, w *connWriter) {
+	s := carbon.NewScannerWithMaxLineLength(conn, i.opts.MaxLineLength, i.opts.InstrumentOptions)
+	s.ParseOptions = i.opts.parseOpts()
 	for s.Scan() {
+		i.metrics.malformed.Inc(int64(s.MalformedCount))
+		s.MalformedCount = 0
+		i.metrics.lineTooLong.Inc(int64(s.TooLongCount))
+		s.TooLongCount = 0
+
 		name, timestamp, value := s.Metric()
+		if !w.write(name, timestamp, value) {
+			break
+		}
+	}
+	i.metrics.malformed.Inc(int64(s.MalformedCount))
+	i.metrics.lineTooLong.Inc(int64(s.TooLongCount))
+
+	if err := s.Err(); err != nil && !i.isClosing() {
+		i.logger.Errorf("encountered error during carbon ingestion when scanning connection: %s", err)
+	}
+}
+
+// connWriter writes the metrics read from a connection, either one at a
+// time or in batches, independently of the protocol they were read with.
+type connWriter struct {
+	ingester *ingester
+	// Interfaces require a context be passed, but M3DB client already has timeouts
+	// built in and allocating a new context each time is expensive so we just pass
+	// the same context always and rely on M3DB client timeouts.
+	ctx      context.Context
+	wg       sync.WaitGroup
+	permits  chan struct{}
+	inFlight int64
+	batcher  *connBatcher
+	limiter  *tokenBucket
+}
+
+func (i *ingester) newConnWriter(ctx context.Context) *connWriter {
+	w := &connWriter{
+		ingester: i,
+		ctx:      ctx,
+		limiter: newTokenBucket(i.opts.RateLimit.PerConnection,
+			i.opts.RateLimit.Burst, time.Now),
+	}
+	if i.opts.MaxConcurrencyPerConnection > 0 {
+		w.permits = make(chan struct{}, i.opts.MaxConcurrencyPerConnection)
+	}
+	if i.opts.BatchSize > 0 {
+		w.batcher = i.newConnBatcher(w.ctx, &w.wg, w.permits, &w.inFlight)
+	}
+	return w
+}
 
-		resources := i.getLineResources()
-		// Copy name since scanner bytes are recycled.
+// write writes a metric of the connection, the name is copied so it can be
+// reused by the caller. It returns false if the connection should be
+// rejected.
+func (w *connWriter) write(name []byte, timestamp time.Time, value float64) bool {
+	i := w.ingester
+	if !w.admit() {
+		return true
+	}
+
+	if isEmptyName(name) {
+		i.metrics.emptyName.Inc(1)
+		if i.opts.EmptyNames == config.CarbonEmptyNameRejectConnection {
+			i.logger.Errorf("rejecting carbon ingestion connection after line with empty name")
+			return false
+		}
+		return true
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		switch i.opts.NonFiniteValues {
+		case config.CarbonNonFiniteValueDrop:
+			i.metrics.droppedNonFinite.Inc(1)
+			return true
+		case config.CarbonNonFiniteValueZero:
+			value = 0
+		}
+	}
+
+	resources := i.getLineResources()
+	if i.opts.Normalizer != nil {
+		resources.name = i.opts.Normalizer.Normalize(resources.name[:0], name)
+	} else {
 		resources.name = append(resources.name[:0], name...)
+	}
+	if !i.nameFilter.allows(resources.name) {
+		i.metrics.filtered.Inc(1)
+		i.putLineResources(resources)
+		return true
+	}
 
-		wg.Add(1)
-		i.opts.WorkerPool.Go(func() {
-			ok := i.write(ctx, resources, timestamp, value)
-			if ok {
-				i.metrics.success.Inc(1)
-			}
-			// The contract is that after the DownsamplerAndWriter returns, any resources
-			// that it needed to hold onto have already been copied.
-			i.putLineResources(resources)
-			wg.Done()
-		})
+	if w.batcher != nil {
+		w.batcher.add(resources, timestamp, value)
+		return true
+	}
 
-		i.metrics.malformed.Inc(int64(s.MalformedCount))
-		s.MalformedCount = 0
+	if w.permits != nil {
+		w.permits <- struct{}{}
+	}
+	connInFlight := atomic.AddInt64(&w.inFlight, 1)
+	if i.opts.Debug {
+		i.metrics.connInFlight.RecordValue(float64(connInFlight))
+	}
+
+	w.wg.Add(1)
+	i.opts.WorkerPool.Go(func() {
+		ok := i.write(w.ctx, resources, timestamp, value)
+		if ok {
+			i.metrics.success.Inc(1)
+		}
+		// The contract is that after the DownsamplerAndWriter returns, any resources
+		// that it needed to hold onto have already been copied.
+		i.putLineResources(resources)
+
+		atomic.AddInt64(&w.inFlight, -1)
+		if w.permits != nil {
+			<-w.permits
+		}
+		w.wg.Done()
+	})
+	return true
+}
+
+// close flushes any pending batch and waits for the writes in flight.
+func (w *connWriter) close() {
+	if w.batcher != nil {
+		w.batcher.close()
 	}
+	w.wg.Wait()
+}
 
-	if err := s.Err(); err != nil {
-		logger.Errorf("encountered error during carbon ingestion when scanning connection: %s", err)
+// connContext returns the context of the writes of a connection, it
+// identifies the remote host of the connection as the source of the writes
+// if SourceFromRemoteAddr is set.
+func (i *ingester) connContext(conn net.Conn) context.Context {
+	ctx := context.Background()
+	if !i.opts.SourceFromRemoteAddr {
+		return ctx
 	}
 
-	logger.Debugf("waiting for outstanding carbon ingestion writes to complete")
-	wg.Wait()
-	logger.Debugf("all outstanding writes completed, shutting down carbon ingestion handler")
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ctx
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return ingest.NewContextWithSource(ctx, host)
+}
 
-	// Don't close the connection, that is the server's responsibility.
+// configureTCPConn applies the TCP options to an accepted connection, keep
+// alive is configured by the server that accepts the connection.
+func (i *ingester) configureTCPConn(conn *net.TCPConn) error {
+	if noDelay := i.opts.TCPNoDelay; noDelay != nil {
+		if err := conn.SetNoDelay(*noDelay); err != nil {
+			return err
+		}
+	}
+	if size := i.opts.TCPReadBufferSize; size > 0 {
+		if err := conn.SetReadBuffer(size); err != nil {
+			return err
+		}
+	}
+	if size := i.opts.TCPWriteBufferSize; size > 0 {
+		if err := conn.SetWriteBuffer(size); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (i *ingester) write(
@@ -205,6 +630,47 @@ func (i *ingester) write(
 	timestamp time.Time,
 	value float64,
 ) bool {
+	line, ok := i.prepareLine(resources, timestamp, value)
+	if !ok {
+		return false
+	}
+
+	cluster := &i.clusters[line.cluster]
+	err := cluster.writer.Write(
+		ctx, line.tags, resources.datapoints, xtime.Second, line.overrides)
+
+	if err != nil {
+		i.logger.Errorf("err writing carbon metric: %s, cluster: %s, err: %s",
+			string(resources.name), cluster.name, err)
+		i.metrics.err.Inc(1)
+		cluster.metrics.err.Inc(1)
+		return false
+	}
+	cluster.metrics.success.Inc(1)
+
+	if i.opts.Debug {
+		i.logger.Infof("successfully wrote carbon metric: %s", string(resources.name))
+	}
+	return true
+}
+
+// preparedLine is a carbon line that matched a rule and is ready to be
+// written to its cluster.
+type preparedLine struct {
+	resources *lineResources
+	tags      models.Tags
+	overrides ingest.WriteOptions
+	cluster   int
+}
+
+// prepareLine matches a carbon line against the rules, generates its tags
+// and selects its cluster, returning false if the line should not be
+// written.
+func (i *ingester) prepareLine(
+	resources *lineResources,
+	timestamp time.Time,
+	value float64,
+) (preparedLine, bool) {
 	downsampleAndStoragePolicies := ingest.WriteOptions{
 		// Set both of these overrides to true to indicate that only the exact mapping
 		// rules and storage policies that we provide should be used and that all
@@ -212,14 +678,18 @@ func (i *ingester) write(
 		// all data to the unaggregated namespace in storage) should be ignored.
 		DownsampleOverride: true,
 		WriteOverride:      true,
+
+		TimestampResolution: i.opts.TimestampResolution,
 	}
 
+	multiplier := 1.0
 	for _, rule := range i.rules {
 		if rule.rule.Pattern == graphite.MatchAllPattern || rule.regexp.Match(resources.name) {
 			// Each rule should only have either mapping rules or storage policies so
 			// one of these should be a no-op.
 			downsampleAndStoragePolicies.DownsampleMappingRules = rule.mappingRules
 			downsampleAndStoragePolicies.WriteStoragePolicies = rule.storagePolicies
+			multiplier = rule.multiplier
 
 			if i.opts.Debug {
 				i.logger.Infof(
@@ -238,36 +708,118 @@ func (i *ingester) write(
 		if i.opts.Debug {
 			i.logger.Infof("no rules matched carbon metric: %s, skipping", string(resources.name))
 		}
-		return false
+		return preparedLine{}, false
 	}
 
-	resources.datapoints[0] = ts.Datapoint{Timestamp: timestamp, Value: value}
-	tags, err := GenerateTagsFromNameIntoSlice(resources.name, i.tagOpts, resources.tags)
+	resources.datapoints[0] = ts.Datapoint{Timestamp: timestamp, Value: value * multiplier}
+	tags, err := generateTagsFromName(resources.name, i.opts.separator(),
+		i.tagOpts, i.taggedTagOpts, resources.tags)
 	if err != nil {
 		i.logger.Errorf("err generating tags from carbon name: %s, err: %s",
 			string(resources.name), err)
 		i.metrics.malformed.Inc(1)
-		return false
+		return preparedLine{}, false
+	}
+	applyTagNameRules(i.tagNameRules, resources.name, tags)
+	if i.opts.NameTag {
+		tags = appendNameTag(resources.name, tags, i.taggedTagOpts)
 	}
 
-	err = i.downsamplerAndWriter.Write(
-		ctx, tags, resources.datapoints, xtime.Second, downsampleAndStoragePolicies)
-
+	cluster, err := i.selectCluster(resources.name)
 	if err != nil {
-		i.logger.Errorf("err writing carbon metric: %s, err: %s",
+		i.logger.Errorf("err selecting cluster for carbon metric: %s, err: %s",
 			string(resources.name), err)
 		i.metrics.err.Inc(1)
-		return false
+		return preparedLine{}, false
 	}
 
-	if i.opts.Debug {
-		i.logger.Infof("successfully wrote carbon metric: %s", string(resources.name))
+	return preparedLine{
+		resources: resources,
+		tags:      tags,
+		overrides: downsampleAndStoragePolicies,
+		cluster:   cluster,
+	}, true
+}
+
+// selectCluster returns the index of the cluster the carbon metric with the
+// name is written to.
+func (i *ingester) selectCluster(name []byte) (int, error) {
+	if len(i.clusters) == 1 {
+		return 0, nil
+	}
+
+	idx := i.clusterSelect(name, len(i.clusters))
+	if idx < 0 || idx >= len(i.clusters) {
+		return 0, fmt.Errorf("selected cluster index %d out of range for %d clusters",
+			idx, len(i.clusters))
+	}
+	return idx, nil
+}
+
+func (i *ingester) Shutdown(ctx context.Context) error {
+	i.connsLock.Lock()
+	i.closing = true
+	// Interrupting the reads rather than closing the connections lets the
+	// handlers write the lines already read before they return, closing the
+	// connections remains the responsibility of the server.
+	for conn := range i.conns {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			i.logger.Errorf("unable to interrupt carbon ingestion connection: %v", err)
+		}
+	}
+	i.connsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		i.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return true
 }
 
 func (i *ingester) Close() {
-	// We don't maintain any state in-between connections so there is nothing to do here.
+	// We don't maintain any state in-between connections so there is nothing to do here,
+	// see Shutdown for draining the connections being handled.
+}
+
+// readDeadliner is a connection, either a stream or a packet connection,
+// whose reads can be interrupted.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// addConn tracks a connection being handled, it returns false if the
+// ingester is shutting down.
+func (i *ingester) addConn(conn readDeadliner) bool {
+	i.connsLock.Lock()
+	defer i.connsLock.Unlock()
+
+	if i.closing {
+		return false
+	}
+	i.conns[conn] = struct{}{}
+	i.handlers.Add(1)
+	return true
+}
+
+func (i *ingester) removeConn(conn readDeadliner) {
+	i.connsLock.Lock()
+	delete(i.conns, conn)
+	i.connsLock.Unlock()
+	i.handlers.Done()
+}
+
+func (i *ingester) isClosing() bool {
+	i.connsLock.Lock()
+	closing := i.closing
+	i.connsLock.Unlock()
+	return closing
 }
 
 func newCarbonIngesterMetrics(m tally.Scope) carbonIngesterMetrics {
@@ -275,6 +827,16 @@ func newCarbonIngesterMetrics(m tally.Scope) carbonIngesterMetrics {
 		success:   m.Counter("success"),
 		err:       m.Counter("error"),
 		malformed: m.Counter("malformed"),
+		emptyName: m.Counter("empty-name"),
+		filtered:  m.Counter("filtered"),
+
+		rateLimited: m.Counter("rate-limited"),
+
+		lineTooLong:       m.Counter("line-too-long"),
+		droppedNonFinite:  m.Counter("dropped-non-finite"),
+		truncatedDatagram: m.Counter("truncated-datagram"),
+
+		connInFlight: m.Histogram("connection-in-flight", connInFlightBuckets),
 	}
 }
 
@@ -282,6 +844,29 @@ type carbonIngesterMetrics struct {
 	success   tally.Counter
 	err       tally.Counter
 	malformed tally.Counter
+	emptyName tally.Counter
+	filtered  tally.Counter
+
+	// rateLimited is the number of lines dropped, or throttled, for
+	// exceeding the rate limit.
+	rateLimited tally.Counter
+
+	lineTooLong       tally.Counter
+	droppedNonFinite  tally.Counter
+	truncatedDatagram tally.Counter
+
+	// connInFlight is the distribution of the number of in-flight writes of
+	// each connection, recorded by connections as they dispatch lines, or
+	// batches of lines if batching, and only reported in debug mode.
+	connInFlight tally.Histogram
+}
+
+var connInFlightBuckets = tally.MustMakeExponentialValueBuckets(1, 2, 16)
+
+// isEmptyName returns whether a carbon metric name is empty or consists of
+// only whitespace, which would otherwise generate degenerate tags.
+func isEmptyName(name []byte) bool {
+	return len(bytes.TrimSpace(name)) == 0
 }
 
 // GenerateTagsFromName accepts a carbon metric name and blows it up into a list of
@@ -291,11 +876,24 @@ type carbonIngesterMetrics struct {
 //      __g0__:foo
 //      __g1__:bar
 //      __g2__:baz
+//
+// Names in the graphite tag format, such as foo.bar;dc=sjc, additionally
+// have the tags that follow the path sorted by name, so
+//      foo.bar;env=prod;dc=sjc
+// becomes
+//      __g0__:foo
+//      __g1__:bar
+//      dc:sjc
+//      env:prod
+// Tags with an empty value are dropped and only the last of the tags that
+// share a name is kept, as graphite does. Since the graphite ID of a series
+// only consists of its path the tags of tagged names use the quoted ID
+// scheme instead if opts use the graphite ID scheme.
 func GenerateTagsFromName(
 	name []byte,
 	opts models.TagOptions,
 ) (models.Tags, error) {
-	return generateTagsFromName(name, opts, nil)
+	return generateTagsFromName(name, carbonSeparatorByte, opts, nil, nil)
 }
 
 // GenerateTagsFromNameIntoSlice does the same thing as GenerateTagsFromName except
@@ -305,19 +903,48 @@ func GenerateTagsFromNameIntoSlice(
 	opts models.TagOptions,
 	tags []models.Tag,
 ) (models.Tags, error) {
-	return generateTagsFromName(name, opts, tags)
+	return generateTagsFromName(name, carbonSeparatorByte, opts, nil, tags)
+}
+
+// taggedNameTagOptions returns the tag options of the tags generated from
+// names in the graphite tag format.
+func taggedNameTagOptions(opts models.TagOptions) models.TagOptions {
+	if opts.IDSchemeType() != models.TypeGraphite {
+		return opts
+	}
+	return opts.SetIDSchemeType(models.TypeQuoted)
 }
 
 func generateTagsFromName(
 	name []byte,
+	separator byte,
 	opts models.TagOptions,
+	taggedOpts models.TagOptions,
 	tags []models.Tag,
 ) (models.Tags, error) {
 	if len(name) == 0 {
 		return models.EmptyTags(), errCannotGenerateTagsFromEmptyName
 	}
 
-	numTags := bytes.Count(name, carbonSeparatorBytes) + 1
+	// Only the path before the first tag separator is split into positional
+	// tags since tag values may contain the separator.
+	tagged := bytes.IndexByte(name, carbonTagSeparatorByte)
+	if tagged == 0 {
+		return models.EmptyTags(), errCannotGenerateTagsFromEmptyName
+	}
+	path := name
+	if tagged > 0 {
+		path = name[:tagged]
+		if taggedOpts == nil {
+			taggedOpts = taggedNameTagOptions(opts)
+		}
+		opts = taggedOpts
+	}
+
+	numTags := bytes.Count(path, []byte{separator}) + 1
+	if tagged > 0 {
+		numTags += bytes.Count(name[tagged:], carbonTagSeparatorBytes)
+	}
 
 	if cap(tags) >= numTags {
 		tags = tags[:0]
@@ -327,16 +954,17 @@ func generateTagsFromName(
 
 	startIdx := 0
 	tagNum := 0
-	for i, charByte := range name {
-		if charByte == carbonSeparatorByte {
-			if i+1 < len(name) && name[i+1] == carbonSeparatorByte {
+	for i, charByte := range path {
+		if charByte == separator {
+			if i+1 < len(path) && path[i+1] == separator {
 				return models.EmptyTags(),
-					fmt.Errorf("carbon metric: %s has duplicate separator", string(name))
+					fmt.Errorf("carbon metric: %s has duplicate separator %q",
+						string(name), separator)
 			}
 
 			tags = append(tags, models.Tag{
 				Name:  graphite.TagName(tagNum),
-				Value: name[startIdx:i],
+				Value: path[startIdx:i],
 			})
 			startIdx = i + 1
 			tagNum++
@@ -352,16 +980,95 @@ func generateTagsFromName(
 	// append baz, however, if the input was:
 	//      foo.bar.baz.
 	// then the foor loop would have appended foo, bar, and baz already.
-	if name[len(name)-1] != carbonSeparatorByte {
+	if path[len(path)-1] != separator {
 		tags = append(tags, models.Tag{
 			Name:  graphite.TagName(tagNum),
-			Value: name[startIdx:],
+			Value: path[startIdx:],
 		})
 	}
 
+	if tagged > 0 {
+		var err error
+		tags, err = appendTagsFromTaggedName(name, name[tagged+1:], tags)
+		if err != nil {
+			return models.EmptyTags(), err
+		}
+	}
+
 	return models.Tags{Opts: opts, Tags: tags}, nil
 }
 
+// appendNameTag appends a tag whose value is the path of the carbon metric
+// name to its generated tags. The graphite ID scheme only consists of the
+// values of the positional tags so the tags use the tag options of tagged
+// names instead.
+func appendNameTag(
+	name []byte,
+	tags models.Tags,
+	taggedOpts models.TagOptions,
+) models.Tags {
+	path := name
+	if idx := bytes.IndexByte(name, carbonTagSeparatorByte); idx >= 0 {
+		path = name[:idx]
+	}
+	tags.Opts = taggedOpts
+	tags.Tags = append(tags.Tags, models.Tag{
+		Name:  taggedOpts.MetricName(),
+		Value: path,
+	})
+	return tags
+}
+
+// appendTagsFromTaggedName appends the name=value pairs of the tag portion of
+// a name in the graphite tag format to the positional tags of its path.
+func appendTagsFromTaggedName(
+	name []byte,
+	tagged []byte,
+	tags []models.Tag,
+) ([]models.Tag, error) {
+	numPathTags := len(tags)
+	for len(tagged) > 0 {
+		pair := tagged
+		if idx := bytes.IndexByte(tagged, carbonTagSeparatorByte); idx >= 0 {
+			pair, tagged = tagged[:idx], tagged[idx+1:]
+		} else {
+			tagged = nil
+		}
+		if len(pair) == 0 {
+			continue
+		}
+
+		idx := bytes.IndexByte(pair, carbonTagValueByte)
+		if idx <= 0 {
+			return nil, fmt.Errorf("carbon metric: %s has malformed tag: %s",
+				string(name), string(pair))
+		}
+		if idx == len(pair)-1 {
+			// Graphite does not permit empty tag values.
+			continue
+		}
+
+		tags = append(tags, models.Tag{Name: pair[:idx], Value: pair[idx+1:]})
+	}
+
+	// Sort the tags by name so that the ID of a series does not depend on
+	// the order its tags were sent in, the sort is stable so that the last
+	// of the tags that share a name can be kept.
+	named := tags[numPathTags:]
+	sort.SliceStable(named, func(i, j int) bool {
+		return bytes.Compare(named[i].Name, named[j].Name) < 0
+	})
+	deduped := named[:0]
+	for i, tag := range named {
+		if i+1 < len(named) && bytes.Equal(tag.Name, named[i+1].Name) {
+			continue
+		}
+		deduped = append(deduped, tag)
+	}
+
+	return tags[:numPathTags+len(deduped)], nil
+}
+
 // Compile all the carbon ingestion rules into regexp so that we can
 // perform matching. Also, generate all the mapping rules and storage
 // policies that we will need to pass to the DownsamplerAndWriter upfront
@@ -385,9 +1092,16 @@ func compileRules(rules CarbonIngesterRules) ([]ruleAndRegex, error) {
 			storagePolicies = append(storagePolicies, storagePolicy)
 		}
 
+		multiplier := rule.MultiplierOrDefault()
+		if multiplier == 0 || math.IsNaN(multiplier) || math.IsInf(multiplier, 0) {
+			return nil, fmt.Errorf("invalid multiplier: %v for carbon ingestion rule pattern: %s",
+				multiplier, rule.Pattern)
+		}
+
 		compiledRule := ruleAndRegex{
-			rule:   rule,
-			regexp: compiled,
+			rule:       rule,
+			regexp:     compiled,
+			multiplier: multiplier,
 		}
 
 		if rule.Aggregation.EnabledOrDefault() {
@@ -441,4 +1155,5 @@ type ruleAndRegex struct {
 	regexp          *regexp.Regexp
 	mappingRules    []downsample.MappingRule
 	storagePolicies []policy.StoragePolicy
+	multiplier      float64
 }
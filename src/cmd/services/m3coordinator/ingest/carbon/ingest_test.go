@@ -30,17 +30,23 @@ import (
 	"net"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/mock"
 	"github.com/m3db/m3/src/cmd/services/m3query/config"
 	"github.com/m3db/m3/src/metrics/aggregation"
 	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/query/graphite/graphite"
 	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
 	"github.com/m3db/m3/src/query/ts"
 	"github.com/m3db/m3x/instrument"
 	xsync "github.com/m3db/m3x/sync"
@@ -49,6 +55,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 const (
@@ -188,40 +195,67 @@ var (
 )
 
 func TestIngesterHandleConn(t *testing.T) {
+	var (
+		mockDownsamplerAndWriter = mock.NewMockDownsamplerAndWriter()
+		lock                     = sync.Mutex{}
+		idx                      = 0
+	)
+	mockDownsamplerAndWriter.SetWriteResultFn(func(mock.Write) error {
+		lock.Lock()
+		// Make 1 in 10 writes fail to test those paths.
+		returnErr := idx%10 == 0
+		idx++
+		lock.Unlock()
+
+		if returnErr {
+			return errors.New("some_error")
+		}
+		return nil
+	})
+
+	byteConn := &byteConn{b: bytes.NewBuffer(testPacket)}
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, testOptions)
+	require.NoError(t, err)
+	ingester.Handle(byteConn)
+
+	found := []testMetric{}
+	for _, write := range mockDownsamplerAndWriter.Writes() {
+		require.Equal(t, xtime.Second, write.Unit)
+		found = append(found, testMetric{
+			tags:      write.Tags,
+			timestamp: int(write.Datapoints[0].Timestamp.Unix()),
+			value:     write.Datapoints[0].Value,
+		})
+	}
+	assertTestMetricsAreEqual(t, testMetrics, found)
+}
+
+func TestIngesterHandleConnSplitReads(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
 
 	var (
-		lock = sync.Mutex{}
-
+		lock  = sync.Mutex{}
 		found = []testMetric{}
-		idx   = 0
 	)
 	mockDownsamplerAndWriter.EXPECT().
 		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
 		_ context.Context,
 		tags models.Tags,
 		dp ts.Datapoints,
-		unit xtime.Unit,
-		overrides ingest.WriteOptions,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
 	) interface{} {
 		lock.Lock()
 		// Clone tags because they (and their underlying bytes) are pooled.
 		found = append(found, testMetric{
 			tags: tags.Clone(), timestamp: int(dp[0].Timestamp.Unix()), value: dp[0].Value})
-
-		// Make 1 in 10 writes fail to test those paths.
-		returnErr := idx%10 == 0
-		idx++
 		lock.Unlock()
-
-		if returnErr {
-			return errors.New("some_error")
-		}
 		return nil
 	}).AnyTimes()
 
-	byteConn := &byteConn{b: bytes.NewBuffer(testPacket)}
+	// Every line is split across reads of a single byte each.
+	byteConn := &byteConn{b: iotest.OneByteReader(bytes.NewBuffer(testPacket))}
 	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, testOptions)
 	require.NoError(t, err)
 	ingester.Handle(byteConn)
@@ -229,6 +263,106 @@ func TestIngesterHandleConn(t *testing.T) {
 	assertTestMetricsAreEqual(t, testMetrics, found)
 }
 
+func TestIngesterHandleConnMaxLineLength(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  = sync.Mutex{}
+		found []string
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		_ ts.Datapoints,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		found = append(found, string(tags.ID()))
+		lock.Unlock()
+		return nil
+	}).AnyTimes()
+
+	packet := []byte("" +
+		"foo.short 1 1\n" +
+		"foo." + strings.Repeat("x", 1<<20) + " 1 1\n" +
+		"foo.after 1 1\n")
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.MaxLineLength = len("foo.short 1 1")
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	sort.Strings(found)
+	require.Equal(t, []string{"foo.after", "foo.short"}, found)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["line-too-long+"].Value())
+
+	opts.MaxLineLength = -1
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidMaxLineLength, err)
+}
+
+func TestIngesterHandleConnMaxConcurrencyPerConnection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	const maxConcurrency = 2
+	var (
+		inFlight    int64
+		maxInFlight int64
+		numWrites   int64
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).
+		DoAndReturn(func(
+			_ context.Context,
+			_ models.Tags,
+			_ ts.Datapoints,
+			_ xtime.Unit,
+			_ ingest.WriteOptions,
+		) error {
+			curr := atomic.AddInt64(&inFlight, 1)
+			for {
+				max := atomic.LoadInt64(&maxInFlight)
+				if curr <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, curr) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Microsecond)
+			atomic.AddInt64(&inFlight, -1)
+			atomic.AddInt64(&numWrites, 1)
+			return nil
+		}).AnyTimes()
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.MaxConcurrencyPerConnection = maxConcurrency
+	opts.Debug = true
+	opts.InstrumentOptions = opts.InstrumentOptions.SetMetricsScope(scope)
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testPacket)})
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testPacket)})
+
+	require.True(t, maxInFlight <= maxConcurrency)
+	require.Equal(t, int64(2*len(testMetrics)), numWrites)
+
+	// Every line records the in-flight writes of its own connection, which
+	// never exceed the per connection limit.
+	var recorded int64
+	for upperBound, count := range scope.Snapshot().Histograms()["connection-in-flight+"].Values() {
+		if upperBound > maxConcurrency {
+			require.Equal(t, int64(0), count)
+		}
+		recorded += count
+	}
+	require.True(t, recorded >= numWrites)
+}
+
 func TestIngesterHonorsPatterns(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
@@ -300,6 +434,779 @@ func TestIngesterHonorsPatterns(t *testing.T) {
 	}, found)
 }
 
+func TestIngesterAppliesRuleMultiplier(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  = sync.Mutex{}
+		found = make(map[string]float64)
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		dp ts.Datapoints,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		found[string(tags.Tags[1].Value)] = dp[0].Value
+		lock.Unlock()
+		return nil
+	}).AnyTimes()
+
+	bitsToBytes := 0.125
+	rules := CarbonIngesterRules{
+		Rules: []config.CarbonIngesterRuleConfiguration{
+			{
+				Pattern:    ".*bits.*",
+				Multiplier: &bitsToBytes,
+				Policies:   testRulesMatchAll.Rules[0].Policies,
+			},
+			testRulesMatchAll.Rules[0],
+		},
+	}
+
+	packet := []byte("" +
+		"foo.bits.bar 64 1\n" +
+		"foo.bytes.bar 64 1\n")
+	ingester, err := NewIngester(mockDownsamplerAndWriter, rules, testOptions)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	require.Equal(t, map[string]float64{"bits": 8, "bytes": 64}, found)
+}
+
+func TestIngesterRulePrecedence(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  = sync.Mutex{}
+		found = make(map[string]ingest.WriteOptions)
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		_ ts.Datapoints,
+		_ xtime.Unit,
+		writeOpts ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		found[string(tags.ID())] = writeOpts
+		lock.Unlock()
+		return nil
+	}).AnyTimes()
+
+	var (
+		sum  = aggregation.Sum
+		last = aggregation.Last
+		mean = aggregation.Mean
+	)
+	rules := CarbonIngesterRules{
+		Rules: []config.CarbonIngesterRuleConfiguration{
+			{
+				Pattern:     `^stats\.counters\.`,
+				Aggregation: config.CarbonIngesterAggregationConfiguration{Type: &sum},
+				Policies: []config.CarbonIngesterStoragePolicyConfiguration{
+					{Resolution: 10 * time.Second, Retention: 7 * 24 * time.Hour},
+				},
+			},
+			{
+				Pattern:     `^stats\.`,
+				Aggregation: config.CarbonIngesterAggregationConfiguration{Type: &last},
+				Policies: []config.CarbonIngesterStoragePolicyConfiguration{
+					{Resolution: time.Minute, Retention: 30 * 24 * time.Hour},
+				},
+			},
+			{
+				// The fallback for metrics that none of the rules above match.
+				Pattern:     graphite.MatchAllPattern,
+				Aggregation: config.CarbonIngesterAggregationConfiguration{Type: &mean},
+				Policies: []config.CarbonIngesterStoragePolicyConfiguration{
+					{Resolution: time.Hour, Retention: 365 * 24 * time.Hour},
+				},
+			},
+		},
+	}
+
+	packet := []byte("" +
+		"stats.counters.requests 1 1\n" +
+		"stats.gauges.connections 1 1\n" +
+		"servers.web01.cpu 1 1\n")
+	ingester, err := NewIngester(mockDownsamplerAndWriter, rules, testOptions)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	expectedWriteOpts := func(
+		aggType aggregation.Type,
+		resolution, retention time.Duration,
+	) ingest.WriteOptions {
+		return ingest.WriteOptions{
+			DownsampleOverride: true,
+			DownsampleMappingRules: []downsample.MappingRule{
+				{
+					Aggregations: []aggregation.Type{aggType},
+					Policies: policy.StoragePolicies{
+						policy.NewStoragePolicy(resolution, xtime.Second, retention),
+					},
+				},
+			},
+			WriteOverride: true,
+		}
+	}
+	require.Equal(t, map[string]ingest.WriteOptions{
+		"stats.counters.requests": expectedWriteOpts(
+			aggregation.Sum, 10*time.Second, 7*24*time.Hour),
+		"stats.gauges.connections": expectedWriteOpts(
+			aggregation.Last, time.Minute, 30*24*time.Hour),
+		"servers.web01.cpu": expectedWriteOpts(
+			aggregation.Mean, time.Hour, 365*24*time.Hour),
+	}, found)
+}
+
+func TestNewIngesterInvalidRuleMultiplier(t *testing.T) {
+	zero := 0.0
+	rules := CarbonIngesterRules{
+		Rules: []config.CarbonIngesterRuleConfiguration{
+			{
+				Pattern:    ".*",
+				Multiplier: &zero,
+				Policies:   testRulesMatchAll.Rules[0].Policies,
+			},
+		},
+	}
+
+	_, err := NewIngester(nil, rules, testOptions)
+	require.Error(t, err)
+}
+
+func TestIngesterAppliesTagNameRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  = sync.Mutex{}
+		found = make(map[string]models.Tags)
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		_ ts.Datapoints,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		// Clone tags because they (and their underlying bytes) are pooled.
+		found[string(tags.ID())] = tags.Clone()
+		lock.Unlock()
+		return nil
+	}).AnyTimes()
+
+	opts := testOptions
+	opts.TagNames = []config.CarbonIngesterTagNameRuleConfiguration{
+		{
+			Pattern: `^servers\.`,
+			Names:   []string{"", "server", "resource", "metric"},
+		},
+		{
+			Pattern: `^servers\.`,
+			Names:   []string{"never", "applied"},
+		},
+	}
+
+	packet := []byte("" +
+		"servers.web01.cpu.load 1 1\n" +
+		"servers.web01.cpu.load.extra 1 1\n" +
+		"servers.web01;zone=a 1 1\n" +
+		"hosts.web01.cpu 1 1\n")
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	require.Equal(t, []models.Tag{
+		{Name: graphite.TagName(0), Value: []byte("servers")},
+		{Name: []byte("server"), Value: []byte("web01")},
+		{Name: []byte("resource"), Value: []byte("cpu")},
+		{Name: []byte("metric"), Value: []byte("load")},
+	}, found["servers.web01.cpu.load"].Tags)
+	require.Equal(t, []models.Tag{
+		{Name: graphite.TagName(0), Value: []byte("servers")},
+		{Name: []byte("server"), Value: []byte("web01")},
+		{Name: []byte("resource"), Value: []byte("cpu")},
+		{Name: []byte("metric"), Value: []byte("load")},
+		{Name: graphite.TagName(4), Value: []byte("extra")},
+	}, found["servers.web01.cpu.load.extra"].Tags)
+	require.Equal(t, []models.Tag{
+		{Name: graphite.TagName(0), Value: []byte("servers")},
+		{Name: []byte("server"), Value: []byte("web01")},
+		{Name: []byte("zone"), Value: []byte("a")},
+	}, found[`{__g0__="servers",server="web01",zone="a"}`].Tags)
+	require.Equal(t, mustGenerateTagsFromName(t, []byte("hosts.web01.cpu")).Tags,
+		found["hosts.web01.cpu"].Tags)
+}
+
+func TestNewIngesterInvalidTagNameRules(t *testing.T) {
+	opts := testOptions
+	opts.TagNames = []config.CarbonIngesterTagNameRuleConfiguration{
+		{Pattern: "(", Names: []string{"a"}},
+	}
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Error(t, err)
+
+	opts.TagNames = []config.CarbonIngesterTagNameRuleConfiguration{
+		{Pattern: ".*", Names: []string{"a", "", "a"}},
+	}
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.EqualError(t, err,
+		"duplicate tag name: a for carbon tag name rule pattern: .*")
+}
+
+func TestIngesterNameTag(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock  = sync.Mutex{}
+				found []models.Tags
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				_ context.Context,
+				tags models.Tags,
+				_ ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				lock.Lock()
+				// Clone tags because they (and their underlying bytes) are pooled.
+				found = append(found, tags.Clone())
+				lock.Unlock()
+				return nil
+			}).AnyTimes()
+
+			opts := testOptions
+			opts.NameTag = enabled
+			packet := []byte("" +
+				"foo.bar.baz 1 1\n" +
+				"foo.qux;zone=a 2 2\n")
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+			sort.Slice(found, func(i, j int) bool {
+				return bytes.Compare(found[i].ID(), found[j].ID()) < 0
+			})
+			require.Equal(t, 2, len(found))
+
+			plain := []models.Tag{
+				{Name: graphite.TagName(0), Value: []byte("foo")},
+				{Name: graphite.TagName(1), Value: []byte("bar")},
+				{Name: graphite.TagName(2), Value: []byte("baz")},
+			}
+			tagged := []models.Tag{
+				{Name: graphite.TagName(0), Value: []byte("foo")},
+				{Name: graphite.TagName(1), Value: []byte("qux")},
+				{Name: []byte("zone"), Value: []byte("a")},
+			}
+			if !enabled {
+				require.Equal(t, "foo.bar.baz", string(found[0].ID()))
+				require.Equal(t, plain, found[0].Tags)
+				require.Equal(t, tagged, found[1].Tags)
+				return
+			}
+
+			for _, tags := range found {
+				require.Equal(t, models.TypeQuoted, tags.Opts.IDSchemeType())
+			}
+			require.Equal(t, append(plain, models.Tag{
+				Name: []byte("__name__"), Value: []byte("foo.bar.baz"),
+			}), found[0].Tags)
+			require.Equal(t, append(tagged, models.Tag{
+				Name: []byte("__name__"), Value: []byte("foo.qux"),
+			}), found[1].Tags)
+
+			name, ok := found[0].Name()
+			require.True(t, ok)
+			require.Equal(t, "foo.bar.baz", string(name))
+		})
+	}
+}
+
+func TestIngesterSourceFromRemoteAddr(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock    = sync.Mutex{}
+				sources []string
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				ctx context.Context,
+				_ models.Tags,
+				_ ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				source, _ := ingest.SourceFromContext(ctx)
+				lock.Lock()
+				sources = append(sources, source)
+				lock.Unlock()
+				return nil
+			}).Times(2)
+
+			opts := testOptions
+			opts.SourceFromRemoteAddr = enabled
+			packet := []byte("" +
+				"foo.bar.baz 1 1\n" +
+				"foo.qux 2 2\n")
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&remoteAddrConn{
+				byteConn: &byteConn{b: bytes.NewBuffer(packet)},
+				addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+			})
+
+			expected := ""
+			if enabled {
+				expected = "10.0.0.1"
+			}
+			require.Equal(t, []string{expected, expected}, sources)
+		})
+	}
+}
+
+// idRecordingStorage records the IDs of the series written to it.
+type idRecordingStorage struct {
+	storage.Storage
+
+	sync.Mutex
+	ids []string
+}
+
+func (s *idRecordingStorage) Write(_ context.Context, query *storage.WriteQuery) error {
+	s.Lock()
+	s.ids = append(s.ids, string(query.Tags.ID()))
+	s.Unlock()
+	return nil
+}
+
+func TestIngesterSourceTagID(t *testing.T) {
+	// The source tag must not become part of the graphite ID of the series,
+	// which would rename the series of each client.
+	store := &idRecordingStorage{}
+	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(store, nil,
+		testOptions.WorkerPool, ingest.Options{SourceTagName: "source"})
+
+	rules := CarbonIngesterRules{
+		Rules: []config.CarbonIngesterRuleConfiguration{
+			{
+				Pattern: ".*",
+				Aggregation: config.CarbonIngesterAggregationConfiguration{
+					Enabled: falsePtr,
+				},
+				Policies: []config.CarbonIngesterStoragePolicyConfiguration{
+					{
+						Resolution: 10 * time.Second,
+						Retention:  48 * time.Hour,
+					},
+				},
+			},
+		},
+	}
+	opts := testOptions
+	opts.SourceFromRemoteAddr = true
+	ingester, err := NewIngester(downsamplerAndWriter, rules, opts)
+	require.NoError(t, err)
+	ingester.Handle(&remoteAddrConn{
+		byteConn: &byteConn{b: bytes.NewBuffer([]byte("foo.bar 1 1\n"))},
+		addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+	})
+
+	require.Equal(t, []string{
+		`{__g0__="foo",__g1__="bar",source="10.0.0.1"}`,
+	}, store.ids)
+}
+
+func TestIngesterSeparator(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  = sync.Mutex{}
+		found []models.Tags
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		_ ts.Datapoints,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		// Clone tags because they (and their underlying bytes) are pooled.
+		found = append(found, tags.Clone())
+		lock.Unlock()
+		return nil
+	}).Times(1)
+
+	// The default separator is a literal character of the segments and
+	// names with duplicate configured separators are dropped as malformed.
+	opts := testOptions
+	opts.Separator = '/'
+	packet := []byte("" +
+		"foo/bar.baz 1 1\n" +
+		"foo//qux 2 2\n")
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+	require.Equal(t, 1, len(found))
+	require.Equal(t, []models.Tag{
+		{Name: graphite.TagName(0), Value: []byte("foo")},
+		{Name: graphite.TagName(1), Value: []byte("bar.baz")},
+	}, found[0].Tags)
+}
+
+func TestNewIngesterInvalidSeparator(t *testing.T) {
+	for _, separator := range []byte{';', '=', ' ', '\n'} {
+		opts := testOptions
+		opts.Separator = separator
+		_, err := NewIngester(nil, testRulesMatchAll, opts)
+		require.Equal(t, errInvalidSeparator, err)
+	}
+}
+
+func TestIngesterAllowImplicitTimestamp(t *testing.T) {
+	packet := []byte("" +
+		"foo.bar 1\n" +
+		"foo.baz 2 -1\n" +
+		"foo.qux 3 3\n")
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			mockDownsamplerAndWriter := mock.NewMockDownsamplerAndWriter()
+
+			opts := testOptions
+			opts.AllowImplicitTimestamp = enabled
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+
+			start := time.Now().Truncate(time.Second)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+			end := time.Now()
+
+			timestamps := make(map[string]time.Time)
+			for _, write := range mockDownsamplerAndWriter.Writes() {
+				name := string(write.Tags.Tags[1].Value)
+				timestamps[name] = write.Datapoints[0].Timestamp
+			}
+
+			require.Equal(t, time.Unix(3, 0), timestamps["qux"])
+			if !enabled {
+				// Without a timestamp the line is malformed and -1 is taken
+				// literally.
+				require.Equal(t, 2, len(timestamps))
+				require.Equal(t, time.Unix(-1, 0), timestamps["baz"])
+				return
+			}
+
+			require.Equal(t, 3, len(timestamps))
+			for _, name := range []string{"bar", "baz"} {
+				require.False(t, timestamps[name].Before(start), name)
+				require.False(t, timestamps[name].After(end), name)
+			}
+		})
+	}
+}
+
+func TestIngesterEmptyNames(t *testing.T) {
+	packet := []byte("" +
+		"foo.bar 1 1\n" +
+		" 2 2\n" +
+		"\t 3 3\n" +
+		"foo.baz 4 4\n")
+
+	testCases := []struct {
+		behavior        config.CarbonEmptyNameBehavior
+		expectedWritten []float64
+	}{
+		{behavior: "", expectedWritten: []float64{1, 4}},
+		{behavior: config.CarbonEmptyNameDrop, expectedWritten: []float64{1, 4}},
+		{behavior: config.CarbonEmptyNameRejectConnection, expectedWritten: []float64{1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.behavior), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock    = sync.Mutex{}
+				written []float64
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				_ context.Context,
+				_ models.Tags,
+				dp ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				lock.Lock()
+				written = append(written, dp[0].Value)
+				lock.Unlock()
+				return nil
+			}).AnyTimes()
+
+			scope := tally.NewTestScope("", nil)
+			opts := testOptions
+			opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+			opts.EmptyNames = tc.behavior
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+			sort.Float64s(written)
+			require.Equal(t, tc.expectedWritten, written)
+
+			// The line with no name at all is rejected by the parser, the line
+			// with a whitespace only name is detected by the ingester.
+			counters := scope.Snapshot().Counters()
+			require.Equal(t, int64(1), counters["malformed+"].Value())
+			require.Equal(t, int64(1), counters["empty-name+"].Value())
+		})
+	}
+}
+
+func TestIsEmptyName(t *testing.T) {
+	require.True(t, isEmptyName(nil))
+	require.True(t, isEmptyName([]byte("")))
+	require.True(t, isEmptyName([]byte(" \t\r")))
+	require.False(t, isEmptyName([]byte("foo")))
+	require.False(t, isEmptyName([]byte(" foo ")))
+}
+
+func TestNewIngesterInvalidEmptyNameBehavior(t *testing.T) {
+	opts := testOptions
+	opts.EmptyNames = "bad"
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidEmptyNameBehavior, err)
+}
+
+func TestIngesterNonFiniteValues(t *testing.T) {
+	packet := []byte("" +
+		"foo.a 1 1\n" +
+		"foo.b nan 2\n" +
+		"foo.c +Inf 3\n" +
+		"foo.d -Inf 4\n")
+
+	testCases := []struct {
+		behavior        config.CarbonNonFiniteValueBehavior
+		expectedWritten []string
+		expectedDropped int64
+	}{
+		{behavior: "", expectedWritten: []string{"+Inf", "-Inf", "1", "NaN"}},
+		{behavior: config.CarbonNonFiniteValuePass, expectedWritten: []string{"+Inf", "-Inf", "1", "NaN"}},
+		{behavior: config.CarbonNonFiniteValueDrop, expectedWritten: []string{"1"}, expectedDropped: 3},
+		{behavior: config.CarbonNonFiniteValueZero, expectedWritten: []string{"0", "0", "0", "1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.behavior), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock    = sync.Mutex{}
+				written []string
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				_ context.Context,
+				_ models.Tags,
+				dp ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				lock.Lock()
+				// Compare formatted values since NaN is not equal to itself.
+				written = append(written, strconv.FormatFloat(dp[0].Value, 'g', -1, 64))
+				lock.Unlock()
+				return nil
+			}).AnyTimes()
+
+			scope := tally.NewTestScope("", nil)
+			opts := testOptions
+			opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+			opts.NonFiniteValues = tc.behavior
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+			sort.Strings(written)
+			require.Equal(t, tc.expectedWritten, written)
+
+			counters := scope.Snapshot().Counters()
+			dropped := int64(0)
+			if c, ok := counters["dropped-non-finite+"]; ok {
+				dropped = c.Value()
+			}
+			require.Equal(t, tc.expectedDropped, dropped)
+		})
+	}
+}
+
+func TestNewIngesterInvalidNonFiniteValueBehavior(t *testing.T) {
+	opts := testOptions
+	opts.NonFiniteValues = "bad"
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidNonFiniteValueBehavior, err)
+}
+
+func TestIngesterConfigureTCPConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	noDelay := false
+	opts := testOptions
+	opts.TCPReadBufferSize = 1 << 20
+	opts.TCPWriteBufferSize = 1 << 16
+	opts.TCPNoDelay = &noDelay
+	handler, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	require.NoError(t, handler.(*ingester).configureTCPConn(conn.(*net.TCPConn)))
+}
+
+func TestNewIngesterInvalidTCPBufferSize(t *testing.T) {
+	opts := testOptions
+	opts.TCPReadBufferSize = -1
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidTCPBufferSize, err)
+}
+
+func TestIngesterSplitsAcrossClusters(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		lock     sync.Mutex
+		found    []testMetric
+		clusters []ClusterWriter
+		written  = make(map[string]string)
+	)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+		writer.EXPECT().
+			Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).
+			DoAndReturn(func(
+				_ context.Context,
+				tags models.Tags,
+				dp ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) error {
+				lock.Lock()
+				defer lock.Unlock()
+				id := string(tags.ID())
+				if prev, ok := written[id]; ok && prev != name {
+					return fmt.Errorf("series %s written to clusters %s and %s", id, prev, name)
+				}
+				written[id] = name
+				found = append(found, testMetric{
+					tags: tags.Clone(), timestamp: int(dp[0].Timestamp.Unix()), value: dp[0].Value})
+				if name == "c" {
+					return errors.New("some_error")
+				}
+				return nil
+			}).AnyTimes()
+		clusters = append(clusters, ClusterWriter{Name: name, Writer: writer})
+	}
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.Clusters = clusters
+	handler, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	handler.Handle(&byteConn{b: bytes.NewBuffer(testPacket)})
+	assertTestMetricsAreEqual(t, testMetrics, found)
+
+	counts := make(map[string]int)
+	for _, name := range written {
+		counts[name]++
+	}
+	require.Len(t, counts, 3)
+
+	snapshot := scope.Snapshot().Counters()
+	for _, name := range []string{"a", "b"} {
+		counter, ok := snapshot["cluster.success+cluster="+name]
+		require.True(t, ok)
+		require.Equal(t, int64(counts[name]), counter.Value())
+	}
+	counter, ok := snapshot["cluster.error+cluster=c"]
+	require.True(t, ok)
+	require.Equal(t, int64(counts["c"]), counter.Value())
+	require.Equal(t, int64(counts["c"]), snapshot["error+"].Value())
+}
+
+func TestHashClusterSelectIsConsistent(t *testing.T) {
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		name := []byte(fmt.Sprintf("test.metric.%d", i))
+		idx := HashClusterSelect(name, 4)
+		require.True(t, idx >= 0 && idx < 4)
+		require.Equal(t, idx, HashClusterSelect(name, 4))
+
+		// Appending a cluster should only move series to the new cluster.
+		if grown := HashClusterSelect(name, 5); grown != idx {
+			require.Equal(t, 4, grown)
+			moved++
+		}
+	}
+	require.True(t, moved > 0 && moved < 500)
+}
+
+func TestNewIngesterInvalidClusters(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	writer := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	opts := testOptions
+	opts.Clusters = []ClusterWriter{{Writer: writer}}
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errClusterNameMustBeSet, err)
+
+	opts.Clusters = []ClusterWriter{{Name: "a"}}
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errClusterWriterMustBeSet, err)
+
+	opts.Clusters = []ClusterWriter{{Name: "a", Writer: writer}, {Name: "a", Writer: writer}}
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.Error(t, err)
+}
+
 func TestGenerateTagsFromName(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -334,12 +1241,45 @@ func TestGenerateTagsFromName(t *testing.T) {
 		},
 		{
 			name:         "foo..bar..baz..",
-			expectedErr:  fmt.Errorf("carbon metric: foo..bar..baz.. has duplicate separator"),
+			expectedErr:  fmt.Errorf("carbon metric: foo..bar..baz.. has duplicate separator '.'"),
 			expectedTags: []models.Tag{},
 		},
 		{
 			name:         "foo.bar.baz..",
-			expectedErr:  fmt.Errorf("carbon metric: foo.bar.baz.. has duplicate separator"),
+			expectedErr:  fmt.Errorf("carbon metric: foo.bar.baz.. has duplicate separator '.'"),
+			expectedTags: []models.Tag{},
+		},
+		{
+			name: "foo.bar;env=prod.us;dc=sjc",
+			id:   `{__g0__="foo",__g1__="bar",dc="sjc",env="prod.us"}`,
+			expectedTags: []models.Tag{
+				{Name: graphite.TagName(0), Value: []byte("foo")},
+				{Name: graphite.TagName(1), Value: []byte("bar")},
+				{Name: []byte("dc"), Value: []byte("sjc")},
+				{Name: []byte("env"), Value: []byte("prod.us")},
+			},
+		},
+		{
+			name: "foo;dc=sjc;env=;dc=iad;",
+			id:   `{__g0__="foo",dc="iad"}`,
+			expectedTags: []models.Tag{
+				{Name: graphite.TagName(0), Value: []byte("foo")},
+				{Name: []byte("dc"), Value: []byte("iad")},
+			},
+		},
+		{
+			name:         "foo;dc",
+			expectedErr:  fmt.Errorf("carbon metric: foo;dc has malformed tag: dc"),
+			expectedTags: []models.Tag{},
+		},
+		{
+			name:         "foo;=sjc",
+			expectedErr:  fmt.Errorf("carbon metric: foo;=sjc has malformed tag: =sjc"),
+			expectedTags: []models.Tag{},
+		},
+		{
+			name:         ";dc=sjc",
+			expectedErr:  errCannotGenerateTagsFromEmptyName,
 			expectedTags: []models.Tag{},
 		},
 	}
@@ -357,6 +1297,23 @@ func TestGenerateTagsFromName(t *testing.T) {
 	}
 }
 
+func TestGenerateTagsFromNameSeparator(t *testing.T) {
+	opts := models.NewTagOptions().SetIDSchemeType(models.TypeGraphite)
+	tags, err := generateTagsFromName([]byte("foo/bar.baz/qux;env=prod/us"),
+		'/', opts, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []models.Tag{
+		{Name: graphite.TagName(0), Value: []byte("foo")},
+		{Name: graphite.TagName(1), Value: []byte("bar.baz")},
+		{Name: graphite.TagName(2), Value: []byte("qux")},
+		{Name: []byte("env"), Value: []byte("prod/us")},
+	}, tags.Tags)
+
+	_, err = generateTagsFromName([]byte("foo//bar"), '/', opts, nil, nil)
+	require.Equal(t,
+		fmt.Errorf("carbon metric: foo//bar has duplicate separator '/'"), err)
+}
+
 // byteConn implements the net.Conn interface so that we can test the handler without
 // going over the network.
 type byteConn struct {
@@ -389,6 +1346,15 @@ func (b *byteConn) RemoteAddr() net.Addr {
 	panic("not_implemented")
 }
 
+type remoteAddrConn struct {
+	*byteConn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
 func (b *byteConn) SetDeadline(t time.Time) error {
 	panic("not_implemented")
 }
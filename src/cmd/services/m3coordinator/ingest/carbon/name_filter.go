@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"regexp"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+)
+
+// nameFilter is a compiled carbon name filter, see
+// config.CarbonIngesterNameFilterConfiguration.
+type nameFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func compileNameFilter(
+	cfg config.CarbonIngesterNameFilterConfiguration,
+) (nameFilter, error) {
+	var (
+		f   nameFilter
+		err error
+	)
+	if f.allow, err = compilePatterns(cfg.Allow); err != nil {
+		return nameFilter{}, err
+	}
+	if f.deny, err = compilePatterns(cfg.Deny); err != nil {
+		return nameFilter{}, err
+	}
+	return f, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// allows returns whether a metric with the name should be written.
+func (f nameFilter) allows(name []byte) bool {
+	for _, re := range f.deny {
+		if re.Match(name) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, re := range f.allow {
+		if re.Match(name) {
+			return true
+		}
+	}
+	return false
+}
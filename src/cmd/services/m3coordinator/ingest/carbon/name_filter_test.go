@@ -0,0 +1,124 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestIngesterNameFilter(t *testing.T) {
+	packet := []byte("" +
+		"servers.web01.cpu 1 1\n" +
+		"servers.web02.cpu 2 2\n" +
+		"noisy.host.metric 3 3\n" +
+		"other.metric 4 4\n")
+
+	testCases := []struct {
+		name     string
+		filter   config.CarbonIngesterNameFilterConfiguration
+		expected []string
+	}{
+		{
+			name: "allow only",
+			filter: config.CarbonIngesterNameFilterConfiguration{
+				Allow: []string{`^servers\.`, `^other\.`},
+			},
+			expected: []string{"other.metric", "servers.web01.cpu", "servers.web02.cpu"},
+		},
+		{
+			name: "deny only",
+			filter: config.CarbonIngesterNameFilterConfiguration{
+				Deny: []string{`^noisy\.`},
+			},
+			expected: []string{"other.metric", "servers.web01.cpu", "servers.web02.cpu"},
+		},
+		{
+			name: "deny takes precedence over allow",
+			filter: config.CarbonIngesterNameFilterConfiguration{
+				Allow: []string{`^servers\.`, `^noisy\.`},
+				Deny:  []string{`web02`, `^noisy\.`},
+			},
+			expected: []string{"servers.web01.cpu"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock  = sync.Mutex{}
+				found []string
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				_ context.Context,
+				tags models.Tags,
+				_ ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				lock.Lock()
+				found = append(found, string(tags.ID()))
+				lock.Unlock()
+				return nil
+			}).AnyTimes()
+
+			scope := tally.NewTestScope("", nil)
+			opts := testOptions
+			opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+			opts.NameFilter = tc.filter
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+			sort.Strings(found)
+			require.Equal(t, tc.expected, found)
+
+			filtered := 4 - len(tc.expected)
+			counters := scope.Snapshot().Counters()
+			require.Equal(t, int64(filtered), counters["filtered+"].Value())
+		})
+	}
+}
+
+func TestNewIngesterInvalidNameFilter(t *testing.T) {
+	opts := testOptions
+	opts.NameFilter = config.CarbonIngesterNameFilterConfiguration{Deny: []string{"("}}
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Error(t, err)
+}
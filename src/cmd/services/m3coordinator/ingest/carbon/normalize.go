@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+)
+
+// Normalizer normalizes carbon metric names before they are matched against
+// the rules and tags are generated from them. It must be safe for
+// concurrent use.
+type Normalizer interface {
+	// Normalize appends the normalized name to dst and returns the result,
+	// the name must not be retained.
+	Normalize(dst, name []byte) []byte
+}
+
+type replacement struct {
+	find    []byte
+	replace []byte
+}
+
+// nameNormalizer normalizes the path of carbon metric names as configured
+// by config.CarbonIngesterNormalizationConfiguration.
+type nameNormalizer struct {
+	lowercase     bool
+	stripPrefixes [][]byte
+	replacements  []replacement
+	collapse      bool
+	separator     byte
+}
+
+// NewNormalizer returns a normalizer for the configuration, the zero value
+// configuration returns a normalizer that only collapses duplicate
+// separators. Use config.CarbonDuplicateSeparatorReject to keep dropping
+// names with duplicate separators instead. The separator is that of the
+// ingester, see Options.Separator, and defaults to '.' if zero.
+func NewNormalizer(
+	cfg config.CarbonIngesterNormalizationConfiguration,
+	separator byte,
+) (Normalizer, error) {
+	if separator == 0 {
+		separator = carbonSeparatorByte
+	}
+	n := &nameNormalizer{lowercase: cfg.Lowercase, separator: separator}
+
+	switch cfg.DuplicateSeparators {
+	case "", config.CarbonDuplicateSeparatorCollapse:
+		n.collapse = true
+	case config.CarbonDuplicateSeparatorReject:
+	default:
+		return nil, fmt.Errorf("invalid carbon duplicate separator behavior: %s",
+			cfg.DuplicateSeparators)
+	}
+
+	for _, prefix := range cfg.StripPrefixes {
+		n.stripPrefixes = append(n.stripPrefixes, []byte(prefix))
+	}
+	for _, r := range cfg.Replacements {
+		if r.Find == "" {
+			return nil, fmt.Errorf("carbon name replacement of: %s has nothing to find",
+				r.Replace)
+		}
+		n.replacements = append(n.replacements, replacement{
+			find:    []byte(r.Find),
+			replace: []byte(r.Replace),
+		})
+	}
+
+	return n, nil
+}
+
+func (n *nameNormalizer) Normalize(dst, name []byte) []byte {
+	// Only the path is normalized, the tags of names in the graphite tag
+	// format are kept as is.
+	path, tags := name, []byte(nil)
+	if idx := bytes.IndexByte(name, carbonTagSeparatorByte); idx >= 0 {
+		path, tags = name[:idx], name[idx:]
+	}
+
+	for _, prefix := range n.stripPrefixes {
+		if bytes.HasPrefix(path, prefix) {
+			path = path[len(prefix):]
+			break
+		}
+	}
+	for _, r := range n.replacements {
+		path = bytes.Replace(path, r.find, r.replace, -1)
+	}
+
+	start := len(dst)
+	for _, c := range path {
+		if n.lowercase && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if n.collapse && c == n.separator &&
+			(len(dst) == start || dst[len(dst)-1] == n.separator) {
+			// Skip leading and consecutive separators.
+			continue
+		}
+		dst = append(dst, c)
+	}
+
+	return append(dst, tags...)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizerNormalize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      config.CarbonIngesterNormalizationConfiguration
+		input    string
+		expected string
+	}{
+		{
+			name:     "collapse by default",
+			input:    "..foo..bar...baz.",
+			expected: "foo.bar.baz.",
+		},
+		{
+			name: "reject keeps duplicate separators",
+			cfg: config.CarbonIngesterNormalizationConfiguration{
+				DuplicateSeparators: config.CarbonDuplicateSeparatorReject,
+			},
+			input:    "foo..bar",
+			expected: "foo..bar",
+		},
+		{
+			name:     "lowercase",
+			cfg:      config.CarbonIngesterNormalizationConfiguration{Lowercase: true},
+			input:    "Foo.BAR.baz",
+			expected: "foo.bar.baz",
+		},
+		{
+			name: "strip first matching prefix",
+			cfg: config.CarbonIngesterNormalizationConfiguration{
+				StripPrefixes: []string{"stats.", "stats.gauges."},
+			},
+			input:    "stats.gauges.foo",
+			expected: "gauges.foo",
+		},
+		{
+			name: "replacements are collapsed",
+			cfg: config.CarbonIngesterNormalizationConfiguration{
+				Replacements: []config.CarbonIngesterReplacementConfiguration{
+					{Find: "-", Replace: "_"},
+					{Find: "unwanted", Replace: ""},
+				},
+			},
+			input:    "foo-bar.unwanted.baz",
+			expected: "foo_bar.baz",
+		},
+		{
+			name:     "tags are kept as is",
+			cfg:      config.CarbonIngesterNormalizationConfiguration{Lowercase: true},
+			input:    "Foo..Bar;DC=..sjc",
+			expected: "foo.bar;DC=..sjc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			normalizer, err := NewNormalizer(tc.cfg, 0)
+			require.NoError(t, err)
+
+			prefix := []byte("reused")
+			normalized := normalizer.Normalize(prefix[:0], []byte(tc.input))
+			require.Equal(t, tc.expected, string(normalized))
+		})
+	}
+}
+
+func TestNewNormalizerInvalid(t *testing.T) {
+	_, err := NewNormalizer(config.CarbonIngesterNormalizationConfiguration{
+		DuplicateSeparators: "unknown",
+	}, 0)
+	require.Error(t, err)
+
+	_, err = NewNormalizer(config.CarbonIngesterNormalizationConfiguration{
+		Replacements: []config.CarbonIngesterReplacementConfiguration{{Replace: "a"}},
+	}, 0)
+	require.Error(t, err)
+}
+
+func TestIngesterNormalizesNames(t *testing.T) {
+	packet := []byte("" +
+		"foo..bar 1 1\n" +
+		"foo.baz 2 2\n")
+
+	testCases := []struct {
+		behavior config.CarbonDuplicateSeparatorBehavior
+		expected []string
+	}{
+		{behavior: "", expected: []string{"foo.bar", "foo.baz"}},
+		{behavior: config.CarbonDuplicateSeparatorReject, expected: []string{"foo.baz"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.behavior), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+			var (
+				lock  = sync.Mutex{}
+				found = make(map[string]struct{})
+			)
+			mockDownsamplerAndWriter.EXPECT().
+				Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+				_ context.Context,
+				tags models.Tags,
+				_ ts.Datapoints,
+				_ xtime.Unit,
+				_ ingest.WriteOptions,
+			) interface{} {
+				lock.Lock()
+				found[string(tags.ID())] = struct{}{}
+				lock.Unlock()
+				return nil
+			}).AnyTimes()
+
+			normalizer, err := NewNormalizer(config.CarbonIngesterNormalizationConfiguration{
+				DuplicateSeparators: tc.behavior,
+			}, 0)
+			require.NoError(t, err)
+
+			opts := testOptions
+			opts.Normalizer = normalizer
+			ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+			require.NoError(t, err)
+			ingester.Handle(&byteConn{b: bytes.NewBuffer(packet)})
+
+			require.Equal(t, len(tc.expected), len(found))
+			for _, id := range tc.expected {
+				require.Contains(t, found, id)
+			}
+		})
+	}
+}
+
+func TestNormalizerSeparator(t *testing.T) {
+	normalizer, err := NewNormalizer(config.CarbonIngesterNormalizationConfiguration{}, '/')
+	require.NoError(t, err)
+
+	// Only the configured separator is collapsed.
+	require.Equal(t, "foo/bar..baz",
+		string(normalizer.Normalize(nil, []byte("//foo//bar..baz"))))
+}
@@ -0,0 +1,651 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxPickleFrameSize is the maximum size of a pickle frame, the same
+	// limit the carbon pickle receiver applies.
+	maxPickleFrameSize = 1 << 20
+
+	pickleFrameHeaderSize = 4
+)
+
+var (
+	errPickleFrameTooLarge  = errors.New("pickle frame exceeds max frame size")
+	errPickleStackUnderflow = errors.New("pickle stack underflow")
+	errPickleNoMark         = errors.New("pickle mark not found")
+	errPickleNoStop         = errors.New("pickle ended without stop opcode")
+	errPickleNotList        = errors.New("pickle does not contain a list")
+	errPickleInvalidMetric  = errors.New("pickle metric is not a (path, (timestamp, value)) tuple")
+	errPickleInvalidNumber  = errors.New("pickle metric timestamp or value is not a number")
+)
+
+// Pickle opcodes, see pickletools in the Python standard library. Only
+// the opcodes needed to decode a list of tuples of strings and numbers are
+// supported.
+const (
+	pickleMark            = '('
+	pickleStop            = '.'
+	pickleProto           = 0x80
+	pickleFrame           = 0x95
+	pickleNone            = 'N'
+	pickleNewTrue         = 0x88
+	pickleNewFalse        = 0x89
+	pickleInt             = 'I'
+	pickleBinInt          = 'J'
+	pickleBinInt1         = 'K'
+	pickleBinInt2         = 'M'
+	pickleLong            = 'L'
+	pickleLong1           = 0x8a
+	pickleFloat           = 'F'
+	pickleBinFloat        = 'G'
+	pickleString          = 'S'
+	pickleBinString       = 'T'
+	pickleShortBinString  = 'U'
+	pickleUnicode         = 'V'
+	pickleBinUnicode      = 'X'
+	pickleShortBinUnicode = 0x8c
+	pickleBinBytes        = 'B'
+	pickleShortBinBytes   = 'C'
+	pickleEmptyList       = ']'
+	pickleList            = 'l'
+	pickleAppend          = 'a'
+	pickleAppends         = 'e'
+	pickleEmptyTuple      = ')'
+	pickleTuple           = 't'
+	pickleTuple1          = 0x85
+	pickleTuple2          = 0x86
+	pickleTuple3          = 0x87
+	picklePut             = 'p'
+	pickleBinPut          = 'q'
+	pickleLongBinPut      = 'r'
+	pickleMemoize         = 0x94
+	pickleGet             = 'g'
+	pickleBinGet          = 'h'
+	pickleLongBinGet      = 'j'
+)
+
+// pickleMarkObject is pushed onto the stack by the mark opcode.
+type pickleMarkObject struct{}
+
+// pickleListObject is a list, it is a pointer since lists are mutable and
+// may be referenced from the memo while they are appended to.
+type pickleListObject struct {
+	items []interface{}
+}
+
+// pickleTupleObject is an immutable tuple.
+type pickleTupleObject []interface{}
+
+// pickleMetric is a metric decoded from a pickle frame, its name refers to
+// the frame it was decoded from.
+type pickleMetric struct {
+	name      []byte
+	timestamp time.Time
+	value     float64
+}
+
+// readPickleFrames reads the metrics of a connection in the pickle
+// protocol. Frames that fail to decode are skipped, but the connection is
+// no longer read from once a frame exceeds the max frame size since the
+// frames that follow cannot be trusted.
+func (i *ingester) readPickleFrames(conn net.Conn, w *connWriter) {
+	var (
+		header  [pickleFrameHeaderSize]byte
+		frame   []byte
+		metrics []pickleMetric
+	)
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			if err != io.EOF && !i.isClosing() {
+				i.logger.Errorf("encountered error during carbon pickle ingestion when reading connection: %s", err)
+			}
+			return
+		}
+
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxPickleFrameSize {
+			i.metrics.malformed.Inc(1)
+			i.logger.Errorf("closing carbon pickle ingestion connection: %s: %d bytes",
+				errPickleFrameTooLarge, size)
+			return
+		}
+
+		if cap(frame) < int(size) {
+			frame = make([]byte, size)
+		}
+		frame = frame[:size]
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			if i.isClosing() {
+				return
+			}
+			i.logger.Errorf("encountered error during carbon pickle ingestion when reading connection: %s", err)
+			return
+		}
+
+		var malformed int
+		metrics, malformed = decodePickleMetrics(frame, metrics[:0])
+		i.metrics.malformed.Inc(int64(malformed))
+		for _, metric := range metrics {
+			if !w.write(metric.name, metric.timestamp, metric.value) {
+				return
+			}
+		}
+	}
+}
+
+// decodePickleMetrics decodes the metrics of a pickle frame and appends
+// them to metrics, returning the number of malformed metrics that were
+// skipped. A frame that cannot be decoded counts as a single malformed
+// metric.
+func decodePickleMetrics(frame []byte, metrics []pickleMetric) ([]pickleMetric, int) {
+	obj, err := unpickle(frame)
+	if err != nil {
+		return metrics, 1
+	}
+	list, ok := obj.(*pickleListObject)
+	if !ok {
+		return metrics, 1
+	}
+
+	malformed := 0
+	for _, item := range list.items {
+		metric, err := pickleMetricFromObject(item)
+		if err != nil {
+			malformed++
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, malformed
+}
+
+func pickleMetricFromObject(obj interface{}) (pickleMetric, error) {
+	metric, ok := obj.(pickleTupleObject)
+	if !ok || len(metric) != 2 {
+		return pickleMetric{}, errPickleInvalidMetric
+	}
+	name, ok := metric[0].([]byte)
+	if !ok {
+		return pickleMetric{}, errPickleInvalidMetric
+	}
+	datapoint, ok := metric[1].(pickleTupleObject)
+	if !ok || len(datapoint) != 2 {
+		return pickleMetric{}, errPickleInvalidMetric
+	}
+
+	timestamp, err := pickleNumber(datapoint[0])
+	if err != nil {
+		return pickleMetric{}, err
+	}
+	value, err := pickleNumber(datapoint[1])
+	if err != nil {
+		return pickleMetric{}, err
+	}
+
+	// Timestamps are truncated to seconds as they are by the plaintext
+	// protocol.
+	return pickleMetric{
+		name:      name,
+		timestamp: time.Unix(int64(timestamp), 0),
+		value:     value,
+	}, nil
+}
+
+// pickleNumber returns a number of a metric, which carbon accepts as any
+// of an int, a float or a string.
+func pickleNumber(obj interface{}) (float64, error) {
+	switch v := obj.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return 0, errPickleInvalidNumber
+		}
+		return f, nil
+	default:
+		return 0, errPickleInvalidNumber
+	}
+}
+
+// unpickle decodes a pickle into the object it contains. Strings are
+// returned as byte slices that refer to the pickle where possible.
+func unpickle(data []byte) (interface{}, error) {
+	u := unpickler{data: data, memo: make(map[int]interface{})}
+	return u.run()
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for u.pos < len(u.data) {
+		op := u.data[u.pos]
+		u.pos++
+
+		var err error
+		switch op {
+		case pickleStop:
+			return u.pop()
+		case pickleProto:
+			_, err = u.read(1)
+		case pickleFrame:
+			_, err = u.read(8)
+		case pickleMark:
+			u.push(pickleMarkObject{})
+		case pickleNone:
+			u.push(nil)
+		case pickleNewTrue:
+			u.push(true)
+		case pickleNewFalse:
+			u.push(false)
+		case pickleInt:
+			err = u.loadInt()
+		case pickleBinInt:
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case pickleBinInt1:
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				u.push(int64(b[0]))
+			}
+		case pickleBinInt2:
+			var b []byte
+			if b, err = u.read(2); err == nil {
+				u.push(int64(binary.LittleEndian.Uint16(b)))
+			}
+		case pickleLong:
+			err = u.loadLong()
+		case pickleLong1:
+			err = u.loadLong1()
+		case pickleFloat:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				var f float64
+				if f, err = strconv.ParseFloat(string(line), 64); err == nil {
+					u.push(f)
+				}
+			}
+		case pickleBinFloat:
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case pickleString:
+			err = u.loadString()
+		case pickleUnicode:
+			// Graphite paths are ASCII so raw-unicode-escape sequences
+			// are not expected and are left as is.
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case pickleBinString, pickleBinUnicode, pickleBinBytes:
+			err = u.loadBytes(4)
+		case pickleShortBinString, pickleShortBinUnicode, pickleShortBinBytes:
+			err = u.loadBytes(1)
+		case pickleEmptyList:
+			u.push(&pickleListObject{})
+		case pickleList:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleListObject{items: items})
+			}
+		case pickleAppend:
+			err = u.appendItems(1)
+		case pickleAppends:
+			err = u.appendMark()
+		case pickleEmptyTuple:
+			u.push(pickleTupleObject{})
+		case pickleTuple:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(pickleTupleObject(items))
+			}
+		case pickleTuple1, pickleTuple2, pickleTuple3:
+			err = u.loadTuple(int(op-pickleTuple1) + 1)
+		case picklePut:
+			var idx int
+			if idx, err = u.readLineInt(); err == nil {
+				err = u.put(idx)
+			}
+		case pickleBinPut:
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				err = u.put(int(b[0]))
+			}
+		case pickleLongBinPut:
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				err = u.put(int(binary.LittleEndian.Uint32(b)))
+			}
+		case pickleMemoize:
+			err = u.put(len(u.memo))
+		case pickleGet:
+			var idx int
+			if idx, err = u.readLineInt(); err == nil {
+				err = u.get(idx)
+			}
+		case pickleBinGet:
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				err = u.get(int(b[0]))
+			}
+		case pickleLongBinGet:
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				err = u.get(int(binary.LittleEndian.Uint32(b)))
+			}
+		default:
+			err = fmt.Errorf("unsupported pickle opcode: 0x%x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errPickleNoStop
+}
+
+func (u *unpickler) push(obj interface{}) {
+	u.stack = append(u.stack, obj)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStackUnderflow
+	}
+	obj := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return obj, nil
+}
+
+// popMark pops the objects pushed since the last mark along with the mark.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMarkObject); ok {
+			items := append([]interface{}(nil), u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errPickleNoMark
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || len(u.data)-u.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() ([]byte, error) {
+	idx := bytes.IndexByte(u.data[u.pos:], '\n')
+	if idx < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	line := u.data[u.pos : u.pos+idx]
+	u.pos += idx + 1
+	return line, nil
+}
+
+func (u *unpickler) readLineInt() (int, error) {
+	line, err := u.readLine()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(line))
+}
+
+func (u *unpickler) loadInt() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	// Protocol 0 encodes booleans as ints.
+	switch string(line) {
+	case "00":
+		u.push(false)
+		return nil
+	case "01":
+		u.push(true)
+		return nil
+	}
+	v, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil {
+		return err
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) loadLong() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	line = bytes.TrimSuffix(line, []byte("L"))
+	v, ok := new(big.Int).SetString(string(line), 10)
+	if !ok {
+		return fmt.Errorf("invalid pickle long: %s", line)
+	}
+	u.pushBigInt(v)
+	return nil
+}
+
+func (u *unpickler) loadLong1() error {
+	n, err := u.read(1)
+	if err != nil {
+		return err
+	}
+	b, err := u.read(int(n[0]))
+	if err != nil {
+		return err
+	}
+
+	// Little endian two's complement.
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	u.pushBigInt(v)
+	return nil
+}
+
+func (u *unpickler) pushBigInt(v *big.Int) {
+	if v.IsInt64() {
+		u.push(v.Int64())
+		return
+	}
+	u.push(v)
+}
+
+// loadString loads a protocol 0 string, which is the repr of the string.
+func (u *unpickler) loadString() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	if len(line) < 2 || line[0] != line[len(line)-1] ||
+		(line[0] != '\'' && line[0] != '"') {
+		return fmt.Errorf("invalid pickle string: %s", line)
+	}
+	line = line[1 : len(line)-1]
+	if bytes.IndexByte(line, '\\') < 0 {
+		u.push(line)
+		return nil
+	}
+
+	unescaped, err := unescapePickleString(line)
+	if err != nil {
+		return err
+	}
+	u.push(unescaped)
+	return nil
+}
+
+// unescapePickleString unescapes the escape sequences Python uses in the
+// repr of strings.
+func unescapePickleString(s []byte) ([]byte, error) {
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			result = append(result, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, fmt.Errorf("invalid pickle string escape: %s", s)
+		}
+		switch s[i] {
+		case 'n':
+			result = append(result, '\n')
+		case 'r':
+			result = append(result, '\r')
+		case 't':
+			result = append(result, '\t')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("invalid pickle string escape: %s", s)
+			}
+			v, err := strconv.ParseUint(string(s[i+1:i+3]), 16, 8)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, byte(v))
+			i += 2
+		default:
+			result = append(result, s[i])
+		}
+	}
+	return result, nil
+}
+
+// loadBytes loads a string whose length is encoded little endian in the
+// given number of bytes.
+func (u *unpickler) loadBytes(lenSize int) error {
+	b, err := u.read(lenSize)
+	if err != nil {
+		return err
+	}
+	var n int
+	if lenSize == 1 {
+		n = int(b[0])
+	} else {
+		n = int(binary.LittleEndian.Uint32(b))
+	}
+	str, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	u.push(str)
+	return nil
+}
+
+func (u *unpickler) loadTuple(n int) error {
+	if len(u.stack) < n {
+		return errPickleStackUnderflow
+	}
+	items := append(pickleTupleObject(nil), u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+// appendItems appends the top n objects of the stack to the list below
+// them.
+func (u *unpickler) appendItems(n int) error {
+	if len(u.stack) < n+1 {
+		return errPickleStackUnderflow
+	}
+	list, ok := u.stack[len(u.stack)-n-1].(*pickleListObject)
+	if !ok {
+		return errPickleNotList
+	}
+	list.items = append(list.items, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	return nil
+}
+
+// appendMark appends the objects pushed since the last mark to the list
+// below the mark.
+func (u *unpickler) appendMark() error {
+	items, err := u.popMark()
+	if err != nil {
+		return err
+	}
+	if len(u.stack) == 0 {
+		return errPickleStackUnderflow
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleListObject)
+	if !ok {
+		return errPickleNotList
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) put(idx int) error {
+	if len(u.stack) == 0 {
+		return errPickleStackUnderflow
+	}
+	u.memo[idx] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(idx int) error {
+	obj, ok := u.memo[idx]
+	if !ok {
+		return fmt.Errorf("pickle memo key not found: %d", idx)
+	}
+	u.push(obj)
+	return nil
+}
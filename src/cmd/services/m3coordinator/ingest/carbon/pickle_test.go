@@ -0,0 +1,178 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// Pickles of [("foo.bar.baz", (1552000000, 1.5)), ("foo.qux", (1552000010.0, -2))]
+// as sent by the carbon relays.
+var testPickles = map[string]string{
+	// Python 2 pickle.dumps(metrics), as sent by carbon-c-relay.
+	"python2 protocol 0": "(lp0\n(S'foo.bar.baz'\np1\n(I1552000000\nF1.5\ntp2\ntp3\na(S'foo.qux'\np4\n(F1552000010.0\nI-2\ntp5\ntp6\na.",
+	// Python 2 pickle.dumps(metrics, protocol=2), as sent by carbon-relay.
+	"python2 protocol 2": "\x80\x02]q\x00(U\x0bfoo.bar.bazq\x01J\x00\xa4\x81\\G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03U\x07foo.quxq\x04GA\xd7 i\x02\x80\x00\x00J\xfe\xff\xff\xff\x86q\x05\x86q\x06e.",
+	"python3 protocol 0": "(lp0\n(Vfoo.bar.baz\np1\n(I1552000000\nF1.5\ntp2\ntp3\na(Vfoo.qux\np4\n(F1552000010.0\nI-2\ntp5\ntp6\na.",
+	"python3 protocol 2": "\x80\x02]q\x00(X\x0b\x00\x00\x00foo.bar.bazq\x01J\x00\xa4\x81\\G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x07\x00\x00\x00foo.quxq\x04GA\xd7 i\x02\x80\x00\x00J\xfe\xff\xff\xff\x86q\x05\x86q\x06e.",
+	"python3 protocol 4": "\x80\x04\x95A\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0bfoo.bar.baz\x94J\x00\xa4\x81\\G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x07foo.qux\x94GA\xd7 i\x02\x80\x00\x00J\xfe\xff\xff\xff\x86\x94\x86\x94e.",
+}
+
+var testPickleMetrics = []pickleMetric{
+	{name: []byte("foo.bar.baz"), timestamp: time.Unix(1552000000, 0), value: 1.5},
+	{name: []byte("foo.qux"), timestamp: time.Unix(1552000010, 0), value: -2},
+}
+
+func TestDecodePickleMetrics(t *testing.T) {
+	for name, pickle := range testPickles {
+		t.Run(name, func(t *testing.T) {
+			metrics, malformed := decodePickleMetrics([]byte(pickle), nil)
+			require.Equal(t, 0, malformed)
+			require.Equal(t, testPickleMetrics, metrics)
+		})
+	}
+}
+
+func TestDecodePickleMetricsMalformed(t *testing.T) {
+	// pickle.dumps([("a.b", (1552000000, "x")), "bad", ("c.d", (1552000000, "2.5"))], protocol=2)
+	pickle := "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00\xa4\x81\\X\x01\x00\x00\x00xq\x02\x86q\x03\x86q\x04X\x03\x00\x00\x00badq\x05X\x03\x00\x00\x00c.dq\x06J\x00\xa4\x81\\X\x03\x00\x00\x002.5q\x07\x86q\x08\x86q\x09e."
+	metrics, malformed := decodePickleMetrics([]byte(pickle), nil)
+	require.Equal(t, 2, malformed)
+	require.Equal(t, []pickleMetric{
+		{name: []byte("c.d"), timestamp: time.Unix(1552000000, 0), value: 2.5},
+	}, metrics)
+
+	for _, pickle := range []string{
+		"",
+		"(lp0\n",
+		"\x80\x02K\x01.",
+		"\x80\x02]q\x00(\xffe.",
+	} {
+		metrics, malformed := decodePickleMetrics([]byte(pickle), nil)
+		require.Equal(t, 1, malformed)
+		require.Empty(t, metrics)
+	}
+}
+
+func TestPickleIngesterHandleConn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock  sync.Mutex
+		found []testMetric
+	)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		dp ts.Datapoints,
+		unit xtime.Unit,
+		overrides ingest.WriteOptions,
+	) interface{} {
+		lock.Lock()
+		found = append(found, testMetric{
+			tags: tags.Clone(), timestamp: int(dp[0].Timestamp.Unix()), value: dp[0].Value})
+		lock.Unlock()
+		return nil
+	}).Times(2 * len(testPickleMetrics))
+
+	// Two frames followed by a frame that does not decode, which is skipped.
+	var buf bytes.Buffer
+	for _, pickle := range []string{
+		testPickles["python2 protocol 2"],
+		"(lp0\n",
+		testPickles["python2 protocol 0"],
+	} {
+		var header [pickleFrameHeaderSize]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(pickle)))
+		buf.Write(header[:])
+		buf.WriteString(pickle)
+	}
+
+	ingester, err := NewPickleIngester(mockDownsamplerAndWriter, testRulesMatchAll, testOptions)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: &buf})
+
+	var expected []testMetric
+	for i := 0; i < 2; i++ {
+		for _, metric := range testPickleMetrics {
+			expected = append(expected, testMetric{
+				tags:      mustGenerateTagsFromName(t, metric.name),
+				timestamp: int(metric.timestamp.Unix()),
+				value:     metric.value,
+			})
+		}
+	}
+	sortTestMetrics(expected)
+	sortTestMetrics(found)
+	require.Equal(t, len(expected), len(found))
+	for i := range expected {
+		require.Equal(t, expected[i].tags, found[i].tags)
+		require.Equal(t, expected[i].timestamp, found[i].timestamp)
+		require.Equal(t, expected[i].value, found[i].value)
+	}
+}
+
+func TestPickleIngesterHandleConnFrameTooLarge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	// The connection is not read past the oversized frame header so the
+	// valid frame that follows is not written.
+	var buf bytes.Buffer
+	var header [pickleFrameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], maxPickleFrameSize+1)
+	buf.Write(header[:])
+	pickle := testPickles["python3 protocol 2"]
+	binary.BigEndian.PutUint32(header[:], uint32(len(pickle)))
+	buf.Write(header[:])
+	buf.WriteString(pickle)
+
+	ingester, err := NewPickleIngester(mockDownsamplerAndWriter, testRulesMatchAll, testOptions)
+	require.NoError(t, err)
+	ingester.Handle(&byteConn{b: &buf})
+}
+
+func sortTestMetrics(metrics []testMetric) {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].timestamp == metrics[j].timestamp {
+			return metrics[i].value < metrics[j].value
+		}
+		return metrics[i].timestamp < metrics[j].timestamp
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3x/clock"
+)
+
+// tokenBucket is a token bucket rate limiter, it holds up to burst tokens
+// and is refilled at rate tokens per second. A nil bucket is unlimited.
+type tokenBucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	nowFn  clock.NowFn
+}
+
+// newTokenBucket returns a full token bucket, or nil if the rate is not
+// set. The burst defaults to one second worth of tokens.
+func newTokenBucket(rate float64, burst int, nowFn clock.NowFn) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   nowFn(),
+		nowFn:  nowFn,
+	}
+}
+
+// refill adds the tokens accrued since the last refill, the caller must
+// hold the lock.
+func (b *tokenBucket) refill() {
+	now := b.nowFn()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available and returns whether it did.
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund returns a token taken by allow that was not used, the bucket still
+// never holds more than the burst.
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// reserve takes a token, going into debt if none is available, and returns
+// how long to wait until the token would have been available.
+func (b *tokenBucket) reserve() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// admit returns whether a line of the connection is within the rate limits,
+// if lines are throttled it instead waits for the line to be within them
+// and always returns true.
+func (w *connWriter) admit() bool {
+	i := w.ingester
+	if w.limiter == nil && i.limiter == nil {
+		return true
+	}
+
+	if i.opts.RateLimit.Behavior == config.CarbonRateLimitThrottle {
+		wait := w.limiter.reserve()
+		if globalWait := i.limiter.reserve(); globalWait > wait {
+			wait = globalWait
+		}
+		if wait > 0 {
+			i.metrics.rateLimited.Inc(1)
+			time.Sleep(wait)
+		}
+		return true
+	}
+
+	if !w.limiter.allow() {
+		i.metrics.rateLimited.Inc(1)
+		return false
+	}
+	if !i.limiter.allow() {
+		// The line is dropped, so it must not count against the connection.
+		w.limiter.refund()
+		i.metrics.rateLimited.Inc(1)
+		return false
+	}
+	return true
+}
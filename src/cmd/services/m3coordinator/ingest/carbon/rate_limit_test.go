@@ -0,0 +1,211 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	nowFn := func() time.Time { return now }
+
+	b := newTokenBucket(2, 2, nowFn)
+	require.True(t, b.allow())
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+
+	// The bucket never holds more than the burst.
+	now = now.Add(time.Hour)
+	require.True(t, b.allow())
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	nowFn := func() time.Time { return now }
+
+	b := newTokenBucket(10, 1, nowFn)
+	require.Equal(t, time.Duration(0), b.reserve())
+	require.Equal(t, 100*time.Millisecond, b.reserve())
+	require.Equal(t, 200*time.Millisecond, b.reserve())
+
+	now = now.Add(300 * time.Millisecond)
+	require.Equal(t, time.Duration(0), b.reserve())
+}
+
+func TestTokenBucketDefaults(t *testing.T) {
+	require.Nil(t, newTokenBucket(0, 10, time.Now))
+	require.True(t, (*tokenBucket)(nil).allow())
+	require.Equal(t, time.Duration(0), (*tokenBucket)(nil).reserve())
+
+	require.Equal(t, float64(3), newTokenBucket(2.5, 0, time.Now).burst)
+	require.Equal(t, float64(1), newTokenBucket(0.1, 0, time.Now).burst)
+	(*tokenBucket)(nil).refund()
+}
+
+func newTestRateLimitedIngester(
+	t *testing.T,
+	ctrl *gomock.Controller,
+	rateLimit config.CarbonIngesterRateLimitConfiguration,
+) (Ingester, *int64, tally.TestScope) {
+	var written int64
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(...interface{}) interface{} {
+			atomic.AddInt64(&written, 1)
+			return nil
+		}).AnyTimes()
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.RateLimit = rateLimit
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+	return ingester, &written, scope
+}
+
+func testRateLimitLines(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "foo.bar.%d %d %d\n", i, i, i+1)
+	}
+	return buf.Bytes()
+}
+
+func TestIngesterRateLimitDrop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The rate is low enough that the bucket does not refill during the test.
+	ingester, written, scope := newTestRateLimitedIngester(t, ctrl,
+		config.CarbonIngesterRateLimitConfiguration{
+			PerConnection: 0.001,
+			Burst:         3,
+		})
+
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testRateLimitLines(10))})
+	require.Equal(t, int64(3), atomic.LoadInt64(written))
+
+	// Each connection has its own bucket.
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testRateLimitLines(10))})
+	require.Equal(t, int64(6), atomic.LoadInt64(written))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(14), counters["rate-limited+"].Value())
+}
+
+func TestIngesterRateLimitGlobal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ingester, written, scope := newTestRateLimitedIngester(t, ctrl,
+		config.CarbonIngesterRateLimitConfiguration{
+			Global: 0.001,
+			Burst:  3,
+		})
+
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testRateLimitLines(2))})
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testRateLimitLines(2))})
+	require.Equal(t, int64(3), atomic.LoadInt64(written))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["rate-limited+"].Value())
+}
+
+func TestIngesterRateLimitPerConnectionAndGlobal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	carbonIngester, _, scope := newTestRateLimitedIngester(t, ctrl,
+		config.CarbonIngesterRateLimitConfiguration{
+			PerConnection: 0.001,
+			Global:        0.001,
+			Burst:         3,
+		})
+	i := carbonIngester.(*ingester)
+	w := i.newConnWriter(context.Background())
+
+	// Lines dropped by the global limit do not take the tokens of the
+	// connection.
+	for j := 0; j < 3; j++ {
+		require.True(t, i.limiter.allow())
+	}
+	for j := 0; j < 5; j++ {
+		require.False(t, w.admit())
+	}
+	require.Equal(t, float64(3), w.limiter.tokens)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(5), counters["rate-limited+"].Value())
+}
+
+func TestIngesterRateLimitThrottle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ingester, written, scope := newTestRateLimitedIngester(t, ctrl,
+		config.CarbonIngesterRateLimitConfiguration{
+			PerConnection: 100,
+			Burst:         1,
+			Behavior:      config.CarbonRateLimitThrottle,
+		})
+
+	// Every line after the first waits for a token, 10ms apart.
+	start := time.Now()
+	ingester.Handle(&byteConn{b: bytes.NewBuffer(testRateLimitLines(6))})
+	require.True(t, time.Since(start) >= 40*time.Millisecond)
+	require.Equal(t, int64(6), atomic.LoadInt64(written))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(5), counters["rate-limited+"].Value())
+}
+
+func TestNewIngesterInvalidRateLimit(t *testing.T) {
+	opts := testOptions
+	opts.RateLimit = config.CarbonIngesterRateLimitConfiguration{PerConnection: -1}
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Error(t, err)
+
+	opts.RateLimit = config.CarbonIngesterRateLimitConfiguration{Behavior: "block"}
+	_, err = NewIngester(nil, testRulesMatchAll, opts)
+	require.Error(t, err)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/graphite/graphite"
+	"github.com/m3db/m3/src/query/models"
+)
+
+// tagNameRule is a compiled carbon tag name rule, see
+// config.CarbonIngesterTagNameRuleConfiguration.
+type tagNameRule struct {
+	regexp *regexp.Regexp
+	// names are the tag names by segment index, nil for the segments that
+	// keep their positional tag name.
+	names [][]byte
+}
+
+// compileTagNameRules compiles the tag name rules, keeping their order since
+// the first rule that matches a metric name is the one applied.
+func compileTagNameRules(
+	rules []config.CarbonIngesterTagNameRuleConfiguration,
+) ([]tagNameRule, error) {
+	compiled := make([]tagNameRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			names = make([][]byte, 0, len(rule.Names))
+			seen  = make(map[string]struct{}, len(rule.Names))
+		)
+		for _, name := range rule.Names {
+			if name == "" {
+				names = append(names, nil)
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				return nil, fmt.Errorf(
+					"duplicate tag name: %s for carbon tag name rule pattern: %s",
+					name, rule.Pattern)
+			}
+			seen[name] = struct{}{}
+			names = append(names, []byte(name))
+		}
+
+		compiled = append(compiled, tagNameRule{regexp: re, names: names})
+	}
+
+	return compiled, nil
+}
+
+// applyTagNameRules renames the positional tags generated from a carbon
+// metric name in place using the first tag name rule that matches the name,
+// the tags are left unchanged if no rule matches. Only positional tags are
+// renamed, never the tags of names in the graphite tag format.
+func applyTagNameRules(rules []tagNameRule, name []byte, tags models.Tags) {
+	for _, rule := range rules {
+		if !rule.regexp.Match(name) {
+			continue
+		}
+
+		for i, tagName := range rule.names {
+			if i >= len(tags.Tags) {
+				break
+			}
+			if tagName != nil && bytes.Equal(tags.Tags[i].Name, graphite.TagName(i)) {
+				tags.Tags[i].Name = tagName
+			}
+		}
+		return
+	}
+}
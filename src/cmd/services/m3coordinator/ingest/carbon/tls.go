@@ -0,0 +1,161 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+)
+
+var (
+	errTLSMissingCertificate = errors.New("carbon TLS: certFile and keyFile must be set")
+	errTLSMissingCA          = errors.New("carbon TLS: caFile must be set to verify client certificates")
+)
+
+// TLSListener terminates TLS on the connections accepted by a listener.
+// Connections are read by the ingester exactly as plaintext connections,
+// only the accept path differs.
+type TLSListener struct {
+	net.Listener
+
+	cfg       config.CarbonIngesterTLSConfiguration
+	tlsConfig atomic.Value // *tls.Config
+}
+
+// NewTLSListener returns a listener that terminates TLS on the connections
+// accepted by the listener with the certificates of the configuration.
+func NewTLSListener(
+	l net.Listener,
+	cfg config.CarbonIngesterTLSConfiguration,
+) (*TLSListener, error) {
+	listener := &TLSListener{
+		Listener: l,
+		cfg:      cfg,
+	}
+	if err := listener.Reload(); err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Reload reads the certificates of the listener from their files again,
+// connections accepted afterwards use the new certificates while those
+// already accepted are unaffected. The current certificates are kept if
+// the new ones cannot be loaded.
+func (l *TLSListener) Reload() error {
+	tlsConfig, err := newTLSConfig(l.cfg)
+	if err != nil {
+		return err
+	}
+	l.tlsConfig.Store(tlsConfig)
+	return nil
+}
+
+// Accept accepts the next connection, its TLS handshake is performed on
+// its first read so that a slow client does not hold up the accept loop.
+func (l *TLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := l.tlsConfig.Load().(*tls.Config)
+	return &tlsConn{Conn: tls.Server(conn, tlsConfig), raw: conn}, nil
+}
+
+// tlsConn is a TLS connection that keeps the connection it wraps so that
+// the TCP options of the ingester can still be applied to it.
+type tlsConn struct {
+	*tls.Conn
+
+	raw net.Conn
+}
+
+// tcpConn returns the TCP connection of a connection, if any.
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	if c, ok := conn.(*tlsConn); ok {
+		conn = c.raw
+	}
+	c, ok := conn.(*net.TCPConn)
+	return c, ok
+}
+
+func newTLSConfig(cfg config.CarbonIngesterTLSConfiguration) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errTLSMissingCertificate
+	}
+
+	clientAuth, err := tlsClientAuthType(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("carbon TLS: unable to load certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+	}
+
+	if cfg.CAFile == "" {
+		if clientAuth >= tls.VerifyClientCertIfGiven {
+			return nil, errTLSMissingCA
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("carbon TLS: unable to read CA file: %v", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("carbon TLS: no certificates found in CA file: %s", cfg.CAFile)
+	}
+	return tlsConfig, nil
+}
+
+func tlsClientAuthType(clientAuth config.CarbonTLSClientAuth) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case "", config.CarbonTLSClientAuthNone:
+		return tls.NoClientCert, nil
+	case config.CarbonTLSClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case config.CarbonTLSClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	case config.CarbonTLSClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven, nil
+	case config.CarbonTLSClientAuthRequireAndVerify:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("carbon TLS: unknown client auth: %s", clientAuth)
+	}
+}
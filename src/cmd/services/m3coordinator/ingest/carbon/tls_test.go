@@ -0,0 +1,309 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/cmd/services/m3query/config"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate and its private key, signed by a CA if
+// not self-signed.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(
+	t *testing.T,
+	serial int64,
+	isCA bool,
+	parent *testCertificate,
+) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "carbon"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert,
+		&key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeTestTLSFiles writes the CA and the certificate of the listener to
+// the directory and returns their configuration.
+func writeTestTLSFiles(
+	t *testing.T,
+	dir string,
+	ca, cert testCertificate,
+	clientAuth config.CarbonTLSClientAuth,
+) config.CarbonIngesterTLSConfiguration {
+	cfg := config.CarbonIngesterTLSConfiguration{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ClientAuth: clientAuth,
+	}
+	require.NoError(t, ioutil.WriteFile(cfg.CertFile, cert.certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(cfg.KeyFile, cert.keyPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(cfg.CAFile, ca.certPEM, 0600))
+	return cfg
+}
+
+func newTestTLSListener(
+	t *testing.T,
+	cfg config.CarbonIngesterTLSConfiguration,
+) *TLSListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := NewTLSListener(l, cfg)
+	require.NoError(t, err)
+	return listener
+}
+
+func TestTLSListenerIngestsLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ca     = newTestCertificate(t, 1, true, nil)
+		server = newTestCertificate(t, 2, false, &ca)
+		client = newTestCertificate(t, 3, false, &ca)
+		cfg    = writeTestTLSFiles(t, dir, ca, server,
+			config.CarbonTLSClientAuthRequireAndVerify)
+		listener = newTestTLSListener(t, cfg)
+	)
+	defer listener.Close()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	found := make(chan models.Tags, 1)
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Second, gomock.Any()).DoAndReturn(func(
+		_ context.Context,
+		tags models.Tags,
+		_ ts.Datapoints,
+		_ xtime.Unit,
+		_ ingest.WriteOptions,
+	) interface{} {
+		found <- tags.Clone()
+		return nil
+	})
+
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, testOptions)
+	require.NoError(t, err)
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ingester.Handle(conn)
+		conn.Close()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{client.tlsCertificate(t)},
+	})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("foo.bar.baz 1 1\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	<-handled
+
+	tags := <-found
+	require.Equal(t, "foo.bar.baz", string(tags.ID()))
+}
+
+func TestTLSListenerRejectsClientWithoutCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ca     = newTestCertificate(t, 1, true, nil)
+		server = newTestCertificate(t, 2, false, &ca)
+		cfg    = writeTestTLSFiles(t, dir, ca, server,
+			config.CarbonTLSClientAuthRequireAndVerify)
+		listener = newTestTLSListener(t, cfg)
+	)
+	defer listener.Close()
+
+	handshakeErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			handshakeErr <- err
+			return
+		}
+		defer conn.Close()
+		handshakeErr <- conn.(*tlsConn).Handshake()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		RootCAs: roots,
+	})
+	if err == nil {
+		defer conn.Close()
+	}
+	require.Error(t, <-handshakeErr)
+}
+
+func TestTLSListenerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ca       = newTestCertificate(t, 1, true, nil)
+		cfg      = writeTestTLSFiles(t, dir, ca, newTestCertificate(t, 2, false, &ca), "")
+		listener = newTestTLSListener(t, cfg)
+	)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tlsConn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverSerial := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs: roots,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	require.Equal(t, int64(2), serverSerial())
+
+	writeTestTLSFiles(t, dir, ca, newTestCertificate(t, 3, false, &ca), "")
+	require.NoError(t, listener.Reload())
+	require.Equal(t, int64(3), serverSerial())
+
+	// The current certificate is kept if the new one cannot be loaded.
+	require.NoError(t, ioutil.WriteFile(cfg.KeyFile, []byte("invalid"), 0600))
+	require.Error(t, listener.Reload())
+	require.Equal(t, int64(3), serverSerial())
+}
+
+func TestNewTLSListenerInvalidConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		ca  = newTestCertificate(t, 1, true, nil)
+		cfg = writeTestTLSFiles(t, dir, ca, newTestCertificate(t, 2, false, &ca), "")
+	)
+
+	for _, invalid := range []func(cfg *config.CarbonIngesterTLSConfiguration){
+		func(cfg *config.CarbonIngesterTLSConfiguration) { cfg.CertFile = "" },
+		func(cfg *config.CarbonIngesterTLSConfiguration) { cfg.KeyFile = filepath.Join(dir, "missing.pem") },
+		func(cfg *config.CarbonIngesterTLSConfiguration) { cfg.ClientAuth = "unknown" },
+		func(cfg *config.CarbonIngesterTLSConfiguration) {
+			cfg.ClientAuth = config.CarbonTLSClientAuthRequireAndVerify
+			cfg.CAFile = ""
+		},
+		func(cfg *config.CarbonIngesterTLSConfiguration) { cfg.CAFile = cfg.KeyFile },
+	} {
+		invalidCfg := cfg
+		invalid(&invalidCfg)
+		_, err := NewTLSListener(nil, invalidCfg)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/m3db/m3/src/metrics/carbon"
+)
+
+// defaultMaxDatagramSize is one byte larger than the largest UDP datagram
+// so that only datagrams that do not fit the read buffer are truncated.
+const defaultMaxDatagramSize = 1 << 16
+
+// HandlePacketConn reads the datagrams of a packet connection through a
+// single writer for the lifetime of the connection, so with batching
+// enabled the batches are written when they are full or when the flush
+// interval elapses. Lines with an empty name that would reject a stream
+// connection only skip the rest of their datagram.
+func (i *ingester) HandlePacketConn(conn net.PacketConn) {
+	logger := i.opts.InstrumentOptions.Logger()
+	if !i.addConn(conn) {
+		logger.Debug("carbon ingester is shutting down, not handling packet connection")
+		return
+	}
+	defer i.removeConn(conn)
+
+	size := i.opts.MaxDatagramSize
+	if size <= 0 {
+		size = defaultMaxDatagramSize
+	}
+
+	var (
+		w       = i.newConnWriter(context.Background())
+		buf     = make([]byte, size)
+		metrics []carbon.Metric
+	)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			metrics = i.writeDatagram(w, buf[:n], n == len(buf), metrics[:0])
+		}
+		if err != nil {
+			if !i.isClosing() {
+				logger.Errorf("encountered error during carbon ingestion when reading packet connection: %s", err)
+			}
+			break
+		}
+	}
+
+	logger.Debugf("waiting for outstanding carbon ingestion writes to complete")
+	w.close()
+}
+
+// writeDatagram writes the lines of a datagram, the final line of a
+// datagram that filled the read buffer may have been truncated and is
+// skipped. The metrics slice is reused across datagrams.
+func (i *ingester) writeDatagram(
+	w *connWriter,
+	datagram []byte,
+	truncated bool,
+	metrics []carbon.Metric,
+) []carbon.Metric {
+	if truncated {
+		i.metrics.truncatedDatagram.Inc(1)
+		datagram = datagram[:bytes.LastIndexByte(datagram, '\n')+1]
+	}
+
+	metrics, malformed := carbon.ParseAndAppendPacketWithOptions(metrics,
+		datagram, i.opts.parseOpts())
+	i.metrics.malformed.Inc(int64(malformed))
+	for _, metric := range metrics {
+		if !w.write(metric.Name, metric.Time, metric.Val) {
+			break
+		}
+	}
+	return metrics
+}
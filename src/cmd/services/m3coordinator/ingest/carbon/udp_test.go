@@ -0,0 +1,158 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestcarbon
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// servePacketConn starts handling a UDP socket on loopback with the
+// ingester, returning a client connected to it and a channel that is closed
+// once the ingester stops handling the socket.
+func servePacketConn(t *testing.T, ingester Ingester) (net.Conn, <-chan struct{}) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		ingester.HandlePacketConn(packetConn)
+		packetConn.Close()
+		close(done)
+	}()
+
+	client, err := net.Dial("udp", packetConn.LocalAddr().String())
+	require.NoError(t, err)
+	return client, done
+}
+
+func waitForBatch(t *testing.T, written <-chan struct{}) {
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "batch not written after flush interval")
+	}
+}
+
+func TestIngesterHandlePacketConn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+		written = make(chan struct{}, 2)
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, written)
+
+	opts := testOptions
+	opts.BatchSize = 1000
+	opts.BatchFlushInterval = 10 * time.Millisecond
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	client, done := servePacketConn(t, ingester)
+	defer client.Close()
+
+	// A datagram may contain many lines and its final line does not need
+	// to be terminated, the lines are written once the flush interval
+	// elapses since there is no connection to wait on.
+	_, err = client.Write([]byte("foo.a 1 1\nfoo.b 1 1"))
+	require.NoError(t, err)
+	waitForBatch(t, written)
+
+	_, err = client.Write([]byte("foo.c 1 1\n"))
+	require.NoError(t, err)
+	waitForBatch(t, written)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, ingester.Shutdown(ctx))
+	<-done
+
+	lock.Lock()
+	require.Equal(t, [][]string{
+		{"foo.a", "foo.b"},
+		{"foo.c"},
+	}, batches)
+	lock.Unlock()
+}
+
+func TestIngesterHandlePacketConnTruncatedDatagram(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+
+	var (
+		lock    sync.Mutex
+		batches [][]string
+		written = make(chan struct{}, 1)
+	)
+	expectBatches(mockDownsamplerAndWriter, &lock, &batches, written)
+
+	scope := tally.NewTestScope("", nil)
+	opts := testOptions
+	opts.InstrumentOptions = instrument.NewOptions().SetMetricsScope(scope)
+	opts.BatchSize = 1000
+	opts.BatchFlushInterval = 10 * time.Millisecond
+	opts.MaxDatagramSize = 24
+	ingester, err := NewIngester(mockDownsamplerAndWriter, testRulesMatchAll, opts)
+	require.NoError(t, err)
+
+	client, done := servePacketConn(t, ingester)
+	defer client.Close()
+
+	// Only the first 24 bytes are read, which cut the final line short.
+	_, err = client.Write([]byte("foo.a 1 1\nfoo.b 1 1\nfoo.c 1 1\n"))
+	require.NoError(t, err)
+	waitForBatch(t, written)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, ingester.Shutdown(ctx))
+	<-done
+
+	lock.Lock()
+	require.Equal(t, [][]string{{"foo.a", "foo.b"}}, batches)
+	lock.Unlock()
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["truncated-datagram+"].Value())
+	require.Equal(t, int64(0), counters["malformed+"].Value())
+}
+
+func TestNewIngesterInvalidMaxDatagramSize(t *testing.T) {
+	opts := testOptions
+	opts.MaxDatagramSize = -1
+	_, err := NewIngester(nil, testRulesMatchAll, opts)
+	require.Equal(t, errInvalidMaxDatagramSize, err)
+}
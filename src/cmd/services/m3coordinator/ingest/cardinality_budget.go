@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/clock"
+)
+
+const (
+	defaultCardinalityBudgetDropThreshold = 0.9
+	defaultCardinalityBudgetWindow        = time.Hour
+)
+
+// CardinalityBudgetOptions configures an adaptive budget on the number of
+// distinct series written. Once the number of series seen approaches the
+// ceiling, series that have not been seen before are dropped with a
+// probability that increases linearly from zero at the drop threshold to
+// one at the ceiling, while series that have been seen are always written.
+// A dropped series is dropped consistently for as long as the budget stays
+// under pressure since the decision is derived from the series ID.
+type CardinalityBudgetOptions struct {
+	// MaxSeries is the ceiling on the number of series seen within the
+	// window, the budget is disabled if not set.
+	MaxSeries int
+
+	// DropThreshold is the fraction of MaxSeries above which new series
+	// start being dropped, defaults to 0.9.
+	DropThreshold float64
+
+	// Window is how long a series is considered seen after it was last
+	// written, a series is forgotten between one and two windows after it
+	// was last written. Defaults to an hour.
+	Window time.Duration
+}
+
+// cardinalityBudget tracks the series seen in two generations, the series
+// written in the current window and those written in the previous window
+// that have not yet been written in the current one, bounding the tracked
+// series to MaxSeries.
+type cardinalityBudget struct {
+	sync.Mutex
+
+	maxSeries     int
+	dropThreshold float64
+	window        time.Duration
+	nowFn         clock.NowFn
+
+	windowStart time.Time
+	current     map[uint64]struct{}
+	previous    map[uint64]struct{}
+}
+
+// newCardinalityBudget returns a cardinality budget for the options or nil
+// if the budget is disabled.
+func newCardinalityBudget(
+	opts CardinalityBudgetOptions,
+	nowFn clock.NowFn,
+) *cardinalityBudget {
+	if opts.MaxSeries <= 0 {
+		return nil
+	}
+
+	dropThreshold := opts.DropThreshold
+	if dropThreshold <= 0 || dropThreshold > 1 {
+		dropThreshold = defaultCardinalityBudgetDropThreshold
+	}
+	window := opts.Window
+	if window <= 0 {
+		window = defaultCardinalityBudgetWindow
+	}
+
+	return &cardinalityBudget{
+		maxSeries:     opts.MaxSeries,
+		dropThreshold: dropThreshold,
+		window:        window,
+		nowFn:         nowFn,
+		windowStart:   nowFn(),
+		current:       make(map[uint64]struct{}),
+		previous:      make(map[uint64]struct{}),
+	}
+}
+
+// admit returns whether the series should be written, along with whether
+// the series is new.
+func (b *cardinalityBudget) admit(tags models.Tags) (bool, bool) {
+	if b == nil {
+		return true, false
+	}
+
+	id := tags.HashedID()
+
+	b.Lock()
+	defer b.Unlock()
+
+	if now := b.nowFn(); now.Sub(b.windowStart) >= b.window {
+		b.previous = b.current
+		b.current = make(map[uint64]struct{}, len(b.previous))
+		b.windowStart = now
+	}
+
+	if _, ok := b.current[id]; ok {
+		return true, false
+	}
+	if _, ok := b.previous[id]; ok {
+		delete(b.previous, id)
+		b.current[id] = struct{}{}
+		return true, false
+	}
+
+	if b.shouldDrop(id) {
+		return false, true
+	}
+
+	b.current[id] = struct{}{}
+	return true, true
+}
+
+// dropProbability returns the probability that a new series is dropped
+// given the number of series currently seen.
+func (b *cardinalityBudget) dropProbability() float64 {
+	var (
+		seen      = float64(len(b.current) + len(b.previous))
+		max       = float64(b.maxSeries)
+		threshold = b.dropThreshold * max
+	)
+	if seen < threshold {
+		return 0
+	}
+	if seen >= max || threshold >= max {
+		return 1
+	}
+	return (seen - threshold) / (max - threshold)
+}
+
+func (b *cardinalityBudget) shouldDrop(id uint64) bool {
+	p := b.dropProbability()
+	if p <= 0 {
+		return false
+	}
+	if p >= 1 {
+		return true
+	}
+	return float64(id)/math.MaxUint64 < p
+}
+
+// admitSeries applies the cardinality budget to a series, returning whether
+// it should be written.
+func (d *downsamplerAndWriter) admitSeries(tags models.Tags) bool {
+	admitted, isNew := d.cardinalityBudget.admit(tags)
+	d.recordAdmission(admitted, isNew)
+	return admitted
+}
+
+func (d *downsamplerAndWriter) recordAdmission(admitted, isNew bool) {
+	switch {
+	case !isNew:
+	case admitted:
+		d.metrics.cardinalityAdmitted.Inc(1)
+	default:
+		d.metrics.cardinalityDropped.Inc(1)
+	}
+}
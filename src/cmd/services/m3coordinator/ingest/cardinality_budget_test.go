@@ -0,0 +1,149 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func newTestCardinalityBudgetTags(i int) models.Tags {
+	return models.NewTags(1, nil).AddTag(models.Tag{
+		Name:  []byte("series"),
+		Value: []byte(fmt.Sprintf("%d", i)),
+	})
+}
+
+func TestCardinalityBudgetDisabled(t *testing.T) {
+	budget := newCardinalityBudget(CardinalityBudgetOptions{}, time.Now)
+	require.Nil(t, budget)
+
+	admitted, isNew := budget.admit(newTestCardinalityBudgetTags(0))
+	require.True(t, admitted)
+	require.False(t, isNew)
+}
+
+func TestCardinalityBudgetDropsNewSeries(t *testing.T) {
+	budget := newCardinalityBudget(CardinalityBudgetOptions{
+		MaxSeries:     10,
+		DropThreshold: 0.5,
+	}, time.Now)
+
+	var admittedSeries []int
+	for i := 0; i < 100; i++ {
+		if admitted, _ := budget.admit(newTestCardinalityBudgetTags(i)); admitted {
+			admittedSeries = append(admittedSeries, i)
+		}
+	}
+
+	// Every series is admitted until the drop threshold is reached and no
+	// series beyond the ceiling.
+	require.True(t, len(admittedSeries) >= 5)
+	require.True(t, len(admittedSeries) <= 10)
+	require.Equal(t, []int{0, 1, 2, 3, 4}, admittedSeries[:5])
+
+	// Series that were seen are always admitted.
+	for _, i := range admittedSeries {
+		admitted, isNew := budget.admit(newTestCardinalityBudgetTags(i))
+		require.True(t, admitted)
+		require.False(t, isNew)
+	}
+}
+
+func TestCardinalityBudgetDropProbability(t *testing.T) {
+	budget := newCardinalityBudget(CardinalityBudgetOptions{
+		MaxSeries:     10,
+		DropThreshold: 0.5,
+	}, time.Now)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 0.0, budget.dropProbability())
+		budget.current[uint64(i)] = struct{}{}
+	}
+	require.Equal(t, 0.0, budget.dropProbability())
+
+	budget.previous[100] = struct{}{}
+	budget.previous[101] = struct{}{}
+	require.InDelta(t, 0.4, budget.dropProbability(), 0.0001)
+
+	for i := 5; i < 8; i++ {
+		budget.current[uint64(i)] = struct{}{}
+	}
+	require.Equal(t, 1.0, budget.dropProbability())
+}
+
+func TestCardinalityBudgetForgetsSeries(t *testing.T) {
+	now := time.Now()
+	budget := newCardinalityBudget(CardinalityBudgetOptions{
+		MaxSeries:     1,
+		DropThreshold: 1,
+		Window:        time.Minute,
+	}, func() time.Time { return now })
+
+	admitted, _ := budget.admit(newTestCardinalityBudgetTags(0))
+	require.True(t, admitted)
+	admitted, _ = budget.admit(newTestCardinalityBudgetTags(1))
+	require.False(t, admitted)
+
+	// The series is still seen in the window after it was last written.
+	now = now.Add(time.Minute)
+	admitted, _ = budget.admit(newTestCardinalityBudgetTags(1))
+	require.False(t, admitted)
+
+	now = now.Add(time.Minute)
+	admitted, isNew := budget.admit(newTestCardinalityBudgetTags(1))
+	require.True(t, admitted)
+	require.True(t, isNew)
+}
+
+func TestDownsampleAndWriteCardinalityBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		CardinalityBudget: CardinalityBudgetOptions{MaxSeries: 1},
+	})
+	downAndWrite.downsampler = nil
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	for _, tags := range []models.Tags{testTags1, testTags2, testTags1} {
+		err := downAndWrite.Write(
+			context.Background(), tags, testDatapoints1, xtime.Second, WriteOptions{})
+		require.NoError(t, err)
+	}
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["cardinality-budget.admitted+"].Value())
+	require.Equal(t, int64(1), counters["cardinality-budget.dropped+"].Value())
+}
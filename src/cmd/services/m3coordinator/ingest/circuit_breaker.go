@@ -0,0 +1,239 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3x/clock"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultCircuitBreakerWindow             = 10 * time.Second
+	defaultCircuitBreakerMinWrites          = 100
+	defaultCircuitBreakerErrorRateThreshold = 0.5
+	defaultCircuitBreakerOpenDuration       = 5 * time.Second
+)
+
+// ErrStorageUnavailable is the error of the storage writes that are shed
+// while the storage circuit breaker is open.
+var ErrStorageUnavailable = errors.New("storage unavailable, circuit breaker is open")
+
+// StorageCircuitBreakerOptions configures a circuit breaker around storage
+// writes. Once the rate of failed writes within a window reaches the
+// threshold the breaker opens and storage writes fail fast with
+// ErrStorageUnavailable instead of piling up against unhealthy storage.
+// After the open duration a single probe write is let through, the breaker
+// closes if it succeeds and opens again otherwise.
+type StorageCircuitBreakerOptions struct {
+	// Enabled enables the circuit breaker.
+	Enabled bool
+
+	// Window is the window the error rate is computed over, defaults to
+	// ten seconds.
+	Window time.Duration
+
+	// MinWrites is the minimum number of writes within the window before
+	// the breaker can open, defaults to 100.
+	MinWrites int
+
+	// ErrorRateThreshold is the fraction of failed writes within the window
+	// at which the breaker opens, defaults to 0.5.
+	ErrorRateThreshold float64
+
+	// SlowWriteThreshold, if set, counts writes that take longer than it
+	// as failed even if they succeed.
+	SlowWriteThreshold time.Duration
+
+	// OpenDuration is how long the breaker stays open before probing
+	// storage, defaults to five seconds.
+	OpenDuration time.Duration
+}
+
+type circuitBreakerState int
+
+const (
+	circuitBreakerClosed circuitBreakerState = iota
+	circuitBreakerOpen
+	circuitBreakerHalfOpen
+)
+
+// circuitBreaker tracks the outcome of storage writes within the current
+// window while closed, and whether the probe write is in flight while half
+// open.
+type circuitBreaker struct {
+	sync.Mutex
+
+	window             time.Duration
+	minWrites          int
+	errorRateThreshold float64
+	slowWriteThreshold time.Duration
+	openDuration       time.Duration
+	nowFn              clock.NowFn
+
+	state       circuitBreakerState
+	windowStart time.Time
+	writes      int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+
+	stateGauge tally.Gauge
+	shed       tally.Counter
+}
+
+// newCircuitBreaker returns a circuit breaker for the options or nil if the
+// circuit breaker is disabled.
+func newCircuitBreaker(
+	opts StorageCircuitBreakerOptions,
+	nowFn clock.NowFn,
+	scope tally.Scope,
+) *circuitBreaker {
+	if !opts.Enabled {
+		return nil
+	}
+
+	b := &circuitBreaker{
+		window:             opts.Window,
+		minWrites:          opts.MinWrites,
+		errorRateThreshold: opts.ErrorRateThreshold,
+		slowWriteThreshold: opts.SlowWriteThreshold,
+		openDuration:       opts.OpenDuration,
+		nowFn:              nowFn,
+		stateGauge:         scope.Gauge("storage-circuit-breaker-state"),
+		shed:               scope.Counter("storage-circuit-breaker-shed"),
+	}
+	if b.window <= 0 {
+		b.window = defaultCircuitBreakerWindow
+	}
+	if b.minWrites <= 0 {
+		b.minWrites = defaultCircuitBreakerMinWrites
+	}
+	if b.errorRateThreshold <= 0 {
+		b.errorRateThreshold = defaultCircuitBreakerErrorRateThreshold
+	}
+	if b.openDuration <= 0 {
+		b.openDuration = defaultCircuitBreakerOpenDuration
+	}
+	b.windowStart = nowFn()
+	b.stateGauge.Update(float64(circuitBreakerClosed))
+	return b
+}
+
+// allow returns whether a storage write may proceed, it must be followed
+// by a call to record with the outcome of the write if it does.
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case circuitBreakerOpen:
+		if b.nowFn().Sub(b.openedAt) >= b.openDuration {
+			b.setState(circuitBreakerHalfOpen)
+			b.probing = true
+			return true
+		}
+	case circuitBreakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	default:
+		return true
+	}
+
+	b.shed.Inc(1)
+	return false
+}
+
+// record records the outcome of a storage write that was allowed.
+func (b *circuitBreaker) record(err error, took time.Duration) {
+	failed := isStorageHealthError(err) ||
+		(b.slowWriteThreshold > 0 && took > b.slowWriteThreshold)
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.nowFn()
+	if b.state == circuitBreakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open(now)
+			return
+		}
+		b.setState(circuitBreakerClosed)
+		b.resetWindow(now)
+		return
+	}
+	if b.state == circuitBreakerOpen {
+		// A write allowed before the breaker opened.
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.resetWindow(now)
+	}
+	b.writes++
+	if failed {
+		b.failures++
+	}
+	if b.writes >= b.minWrites &&
+		float64(b.failures) >= b.errorRateThreshold*float64(b.writes) {
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.setState(circuitBreakerOpen)
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.writes = 0
+	b.failures = 0
+}
+
+func (b *circuitBreaker) setState(state circuitBreakerState) {
+	b.state = state
+	b.stateGauge.Update(float64(state))
+}
+
+// isStorageHealthError returns whether a storage write error reflects the
+// health of storage, errors caused by the write itself or by its caller
+// going away do not.
+func isStorageHealthError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case err == context.Canceled:
+		return false
+	case client.IsBadRequestError(err):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/ident"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestDownsampleAndWriteStorageCircuitBreaker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		StorageCircuitBreaker: StorageCircuitBreakerOptions{
+			Enabled:      true,
+			MinWrites:    4,
+			OpenDuration: time.Minute,
+		},
+	})
+	downAndWrite.downsampler = nil
+
+	now := time.Now()
+	downAndWrite.storageBreaker.nowFn = func() time.Time { return now }
+
+	var (
+		attempts int
+		failing  = true
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_, _ ident.ID, _ ident.TagIterator, _ time.Time, _ float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			attempts++
+			if failing {
+				return errors.New("storage error")
+			}
+			return nil
+		}).
+		AnyTimes()
+
+	write := func() error {
+		return downAndWrite.Write(context.Background(), testTags1,
+			testDatapoints1[:1], xtime.Second, WriteOptions{})
+	}
+	state := func() float64 {
+		return scope.Snapshot().Gauges()["storage-circuit-breaker-state+"].Value()
+	}
+
+	// Sustained failures trip the breaker once the minimum number of writes
+	// have been made.
+	for i := 0; i < 4; i++ {
+		err := write()
+		require.Error(t, err)
+		require.NotEqual(t, ErrStorageUnavailable, err)
+	}
+	require.Equal(t, 4, attempts)
+	require.Equal(t, float64(circuitBreakerOpen), state())
+
+	// Writes are shed without reaching storage while the breaker is open.
+	require.Equal(t, ErrStorageUnavailable, write())
+	require.Equal(t, 4, attempts)
+	require.Equal(t, int64(1),
+		scope.Snapshot().Counters()["storage-circuit-breaker-shed+"].Value())
+
+	// Once the open duration elapses a failed probe opens the breaker again.
+	now = now.Add(time.Minute)
+	require.NotEqual(t, ErrStorageUnavailable, write())
+	require.Equal(t, 5, attempts)
+	require.Equal(t, float64(circuitBreakerOpen), state())
+	require.Equal(t, ErrStorageUnavailable, write())
+
+	// A successful probe after storage recovers closes the breaker.
+	failing = false
+	now = now.Add(time.Minute)
+	require.NoError(t, write())
+	require.Equal(t, float64(circuitBreakerClosed), state())
+	require.NoError(t, write())
+	require.Equal(t, 7, attempts)
+}
+
+func TestCircuitBreakerFailures(t *testing.T) {
+	opts := StorageCircuitBreakerOptions{
+		Enabled:   true,
+		MinWrites: 1,
+	}
+
+	// Errors caused by the write itself or its caller going away do not
+	// reflect the health of storage.
+	breaker := newCircuitBreaker(opts, time.Now, tally.NoopScope)
+	require.True(t, breaker.allow())
+	breaker.record(xerrors.NewInvalidParamsError(errors.New("bad request")), time.Millisecond)
+	require.True(t, breaker.allow())
+	breaker.record(context.Canceled, time.Millisecond)
+	require.Equal(t, circuitBreakerClosed, breaker.state)
+
+	// Slow writes count as failed even if they succeed.
+	opts.SlowWriteThreshold = time.Second
+	breaker = newCircuitBreaker(opts, time.Now, tally.NoopScope)
+	require.True(t, breaker.allow())
+	breaker.record(nil, 2*time.Second)
+	require.Equal(t, circuitBreakerOpen, breaker.state)
+	require.False(t, breaker.allow())
+}
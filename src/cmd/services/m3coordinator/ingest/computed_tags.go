@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+
+	"github.com/cespare/xxhash"
+)
+
+const (
+	// maxComputedTagBuckets bounds the number of buckets of a computed tag
+	// so that the number of series a computed tag can create stays bounded.
+	maxComputedTagBuckets = 64
+
+	computedTagInfBucket = "+Inf"
+)
+
+var (
+	errComputedTagNoName        = errors.New("computed tag has no name")
+	errComputedTagNoFunction    = errors.New("computed tag must set exactly one of bucketize or hashMod")
+	errComputedTagTooManyBounds = fmt.Errorf("computed tag has more than %d bucket boundaries",
+		maxComputedTagBuckets)
+)
+
+// ComputedTag is a tag derived at ingest time from another tag of the series
+// or from the value of the written datapoints.
+//
+// A tag derived from the value is computed from the last datapoint of each
+// write so a write carrying several datapoints is tagged as a whole.
+type ComputedTag struct {
+	// Name is the name of the computed tag, it replaces any existing tag with
+	// the same name.
+	Name []byte
+
+	// SourceTag is the name of the tag the computed tag is derived from, if
+	// not set the computed tag is derived from the datapoint value. Series
+	// without the source tag are written without the computed tag.
+	SourceTag []byte
+
+	// Bucketize are the sorted upper bounds of the buckets the source is
+	// placed in, the computed tag is the upper bound of the first bucket that
+	// the source is less than or equal to or +Inf if it is greater than all
+	// the bounds. Sources that are not numbers do not get the computed tag.
+	Bucketize []float64
+
+	// HashMod is the number of values the source is hashed into, the computed
+	// tag is the hash of the source modulo HashMod.
+	HashMod uint64
+}
+
+// Validate validates the computed tag.
+func (t ComputedTag) Validate() error {
+	if len(t.Name) == 0 {
+		return errComputedTagNoName
+	}
+	if (len(t.Bucketize) > 0) == (t.HashMod > 0) {
+		return errComputedTagNoFunction
+	}
+	if len(t.Bucketize) > maxComputedTagBuckets {
+		return errComputedTagTooManyBounds
+	}
+	for i, bound := range t.Bucketize {
+		if math.IsNaN(bound) {
+			return fmt.Errorf("computed tag %s has NaN bucket boundary", t.Name)
+		}
+		if i > 0 && bound <= t.Bucketize[i-1] {
+			return fmt.Errorf("computed tag %s bucket boundaries are not sorted", t.Name)
+		}
+	}
+	return nil
+}
+
+func (t ComputedTag) compute(tags models.Tags, datapoints ts.Datapoints) ([]byte, bool) {
+	var (
+		source      []byte
+		sourceValue float64
+	)
+	if len(t.SourceTag) > 0 {
+		value, ok := tags.Get(t.SourceTag)
+		if !ok {
+			return nil, false
+		}
+		source = value
+	} else {
+		if len(datapoints) == 0 {
+			return nil, false
+		}
+		sourceValue = datapoints[len(datapoints)-1].Value
+		source = strconv.AppendFloat(nil, sourceValue, 'f', -1, 64)
+	}
+
+	if t.HashMod > 0 {
+		bucket := xxhash.Sum64(source) % t.HashMod
+		return strconv.AppendUint(nil, bucket, 10), true
+	}
+
+	if len(t.SourceTag) > 0 {
+		value, err := strconv.ParseFloat(string(source), 64)
+		if err != nil {
+			return nil, false
+		}
+		sourceValue = value
+	}
+	if math.IsNaN(sourceValue) {
+		return nil, false
+	}
+
+	idx := sort.SearchFloat64s(t.Bucketize, sourceValue)
+	if idx == len(t.Bucketize) {
+		return []byte(computedTagInfBucket), true
+	}
+	return strconv.AppendFloat(nil, t.Bucketize[idx], 'f', -1, 64), true
+}
+
+// computeTags returns the tags of the series with the computed tags added,
+// the tags of the caller are never modified.
+func (d *downsamplerAndWriter) computeTags(
+	tags models.Tags,
+	datapoints ts.Datapoints,
+) models.Tags {
+	if len(d.opts.ComputedTags) == 0 {
+		return tags
+	}
+
+	computed := models.Tags{
+		Opts: tags.Opts,
+		Tags: make([]models.Tag, len(tags.Tags), len(tags.Tags)+len(d.opts.ComputedTags)),
+	}
+	copy(computed.Tags, tags.Tags)
+
+	for _, computedTag := range d.opts.ComputedTags {
+		value, ok := computedTag.compute(computed, datapoints)
+		if !ok {
+			continue
+		}
+
+		replaced := false
+		for i, tag := range computed.Tags {
+			if bytes.Equal(tag.Name, computedTag.Name) {
+				computed.Tags[i].Value = value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			computed.Tags = append(computed.Tags,
+				models.Tag{Name: computedTag.Name, Value: value})
+		}
+	}
+
+	if computed.Opts != nil && computed.Opts.IDSchemeType() == models.TypeGraphite {
+		// Graphite IDs are built from the tags in order so keep the
+		// computed tags at the end.
+		return computed
+	}
+	return computed.Normalize()
+}
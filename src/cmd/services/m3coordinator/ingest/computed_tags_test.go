@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputedTagValidate(t *testing.T) {
+	require.NoError(t, ComputedTag{Name: []byte("a"), HashMod: 4}.Validate())
+	require.NoError(t, ComputedTag{Name: []byte("a"), Bucketize: []float64{1, 2}}.Validate())
+	require.Equal(t, errComputedTagNoName, ComputedTag{HashMod: 4}.Validate())
+	require.Equal(t, errComputedTagNoFunction, ComputedTag{Name: []byte("a")}.Validate())
+	require.Equal(t, errComputedTagNoFunction, ComputedTag{
+		Name: []byte("a"), HashMod: 4, Bucketize: []float64{1}}.Validate())
+	require.Error(t, ComputedTag{Name: []byte("a"), Bucketize: []float64{2, 1}}.Validate())
+	require.Equal(t, errComputedTagTooManyBounds, ComputedTag{
+		Name: []byte("a"), Bucketize: make([]float64, maxComputedTagBuckets+1)}.Validate())
+}
+
+func TestComputeTags(t *testing.T) {
+	downAndWrite := &downsamplerAndWriter{opts: Options{
+		ComputedTags: []ComputedTag{
+			{
+				Name:      []byte("latency_bucket"),
+				Bucketize: []float64{0.1, 0.5, 1},
+			},
+			{
+				Name:      []byte("code_bucket"),
+				SourceTag: []byte("code"),
+				Bucketize: []float64{299, 499},
+			},
+			{
+				Name:      []byte("shard"),
+				SourceTag: []byte("host"),
+				HashMod:   1,
+			},
+		},
+	}}
+
+	datapoint := func(v float64) ts.Datapoints {
+		return ts.Datapoints{{Timestamp: time.Unix(0, 1), Value: v}}
+	}
+
+	testCases := []struct {
+		tags       []models.Tag
+		datapoints ts.Datapoints
+		expected   []models.Tag
+	}{
+		{
+			tags: []models.Tag{
+				{Name: []byte("code"), Value: []byte("404")},
+				{Name: []byte("host"), Value: []byte("a")},
+			},
+			datapoints: datapoint(0.2),
+			expected: []models.Tag{
+				{Name: []byte("code"), Value: []byte("404")},
+				{Name: []byte("code_bucket"), Value: []byte("499")},
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("latency_bucket"), Value: []byte("0.5")},
+				{Name: []byte("shard"), Value: []byte("0")},
+			},
+		},
+		{
+			// Sources that are missing or not numbers are not computed and
+			// existing tags with a computed name are replaced.
+			tags: []models.Tag{
+				{Name: []byte("code"), Value: []byte("bad")},
+				{Name: []byte("latency_bucket"), Value: []byte("old")},
+			},
+			datapoints: datapoint(10),
+			expected: []models.Tag{
+				{Name: []byte("code"), Value: []byte("bad")},
+				{Name: []byte("latency_bucket"), Value: []byte("+Inf")},
+			},
+		},
+		{
+			tags: []models.Tag{
+				{Name: []byte("code"), Value: []byte("200")},
+			},
+			expected: []models.Tag{
+				{Name: []byte("code"), Value: []byte("200")},
+				{Name: []byte("code_bucket"), Value: []byte("299")},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tags := models.Tags{Opts: models.NewTagOptions(), Tags: tc.tags}
+		original := tags.Clone()
+
+		computed := downAndWrite.computeTags(tags, tc.datapoints)
+		require.Equal(t, tc.expected, computed.Tags)
+		require.Equal(t, original.Tags, tags.Tags)
+	}
+}
+
+func TestConfigurationNewOptionsInvalidComputedTag(t *testing.T) {
+	cfg := Configuration{
+		ComputedTags: []ComputedTagConfiguration{{Name: "shard"}},
+	}
+	_, err := cfg.NewOptions(instrument.NewOptions())
+	require.Equal(t, errComputedTagNoFunction, err)
+}
@@ -0,0 +1,597 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/retry"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/uber-go/tally"
+)
+
+// Configuration configures the downsampler and writer.
+type Configuration struct {
+	// DuplicateTags determines how series with repeated tag names are handled,
+	// one of: error, keep_first, keep_last or merge. Defaults to error.
+	DuplicateTags DuplicateTagsBehavior `yaml:"duplicateTags"`
+
+	// WorkerPoolSize is the number of workers that write series to storage,
+	// shared by all writes, and so the maximum number of storage writes in
+	// progress at once. Writes block once all the workers are busy. Defaults
+	// to 1024.
+	WorkerPoolSize int `yaml:"workerPoolSize" validate:"min=0"`
+
+	// ImmediateFlushConcurrency bounds the number of concurrent writes that
+	// can request an immediate flush of their aggregated data.
+	ImmediateFlushConcurrency int `yaml:"immediateFlushConcurrency" validate:"min=0"`
+
+	// MaxConcurrentAppenders is the maximum number of downsampler appenders
+	// that can be in use at once across all writes, unbounded if not set.
+	MaxConcurrentAppenders int `yaml:"maxConcurrentAppenders" validate:"min=0"`
+
+	// MaxStoragePolicyFanout is the maximum number of override storage
+	// policies a single write may fan out to, unbounded if not set.
+	MaxStoragePolicyFanout int `yaml:"maxStoragePolicyFanout" validate:"min=0"`
+
+	// TruncateStoragePolicyFanout truncates writes that exceed the storage
+	// policy fanout limit instead of rejecting them.
+	TruncateStoragePolicyFanout bool `yaml:"truncateStoragePolicyFanout"`
+
+	// AnnotationSampling configures sampling of the annotations stored with
+	// written datapoints.
+	AnnotationSampling AnnotationSamplingConfiguration `yaml:"annotationSampling"`
+
+	// PartialFailure determines how writes that fail on only one of the
+	// downsampler and storage paths are handled, one of: fail or report.
+	// Defaults to fail.
+	PartialFailure PartialFailureBehavior `yaml:"partialFailure"`
+
+	// Fallback configures a namespace that receives storage writes which
+	// failed against their intended namespace, disabled if not set.
+	Fallback *FallbackConfiguration `yaml:"fallback"`
+
+	// StorageWriteTimeout bounds each storage write attempt, unbounded if
+	// not set.
+	StorageWriteTimeout time.Duration `yaml:"storageWriteTimeout" validate:"min=0"`
+
+	// StorageRetry retries storage writes that fail with a retryable error,
+	// disabled if not set.
+	StorageRetry *retry.Configuration `yaml:"storageRetry"`
+
+	// StorageCircuitBreaker sheds storage writes while storage is failing,
+	// disabled if not set.
+	StorageCircuitBreaker *StorageCircuitBreakerConfiguration `yaml:"storageCircuitBreaker"`
+
+	// AppenderErrors determines how batch writes handle series that the
+	// downsampler appender fails to accept, one of: abort, skip or restart.
+	// Defaults to abort.
+	AppenderErrors AppenderErrorBehavior `yaml:"appenderErrors"`
+
+	// CardinalityBudget configures an adaptive budget on the number of
+	// distinct series written.
+	CardinalityBudget CardinalityBudgetConfiguration `yaml:"cardinalityBudget"`
+
+	// SubResolution determines how the datapoints of writes that override
+	// their storage policies are combined when more than one falls within
+	// the same resolution window, one of: none, last, sum or mean. Defaults
+	// to none.
+	SubResolution SubResolutionBehavior `yaml:"subResolution"`
+
+	// TagFilter configures the tags stripped from series before they are
+	// written.
+	TagFilter TagFilterConfiguration `yaml:"tagFilter"`
+
+	// TagValidation configures the validation of the tags of series after
+	// all the tag transforms have been applied.
+	TagValidation TagValidationConfiguration `yaml:"tagValidation"`
+
+	// ResourceAttributes configures how the resource attributes of
+	// OpenTelemetry metrics are merged into their tags.
+	ResourceAttributes ResourceAttributesConfiguration `yaml:"resourceAttributes"`
+
+	// SourceTagName is the name of a reserved tag the source of each write,
+	// such as its tenant, is stored in, sources are not stored if not set.
+	SourceTagName string `yaml:"sourceTagName"`
+
+	// ComputedTags are tags derived at ingest time from the tags or values
+	// of written series, applied in order.
+	ComputedTags []ComputedTagConfiguration `yaml:"computedTags"`
+
+	// RelabelConfigs are Prometheus relabel_configs applied in order to
+	// series after the computed tags are added.
+	RelabelConfigs []RelabelConfiguration `yaml:"relabelConfigs"`
+
+	// WriteUnaggregated determines whether the datapoints of writes that do
+	// not override their storage policies are written to the unaggregated
+	// namespace, defaults to true. Disable it for deployments that only
+	// store aggregated data and do not provision an unaggregated namespace.
+	WriteUnaggregated *bool `yaml:"writeUnaggregated"`
+
+	// ValueRoutes route the datapoints of unaggregated writes whose values
+	// exceed a threshold to aggregated namespaces.
+	ValueRoutes []ValueRouteConfiguration `yaml:"valueRoutes"`
+
+	// PoolWriteQueries reuses the queries of storage writes, the storage
+	// must not retain a query once its write returns.
+	PoolWriteQueries bool `yaml:"poolWriteQueries"`
+
+	// DeduplicateBatches collapses exact-duplicate series within a batch
+	// write into a single write of their combined datapoints.
+	DeduplicateBatches bool `yaml:"deduplicateBatches"`
+
+	// BatchTimeout configures a deadline for batch writes that scales with
+	// the number of series in the batch.
+	BatchTimeout BatchTimeoutConfiguration `yaml:"batchTimeout"`
+
+	// WritePriorities configures scheduling storage writes by the priority
+	// of their write.
+	WritePriorities WritePrioritiesConfiguration `yaml:"writePriorities"`
+
+	// TimestampTruncation configures truncating the timestamps of written
+	// datapoints to a coarser resolution.
+	TimestampTruncation TimestampTruncationConfiguration `yaml:"timestampTruncation"`
+
+	// MetricTypes configures how the metric type of the series of batch
+	// writes that do not set one is determined.
+	MetricTypes MetricTypesConfiguration `yaml:"metricTypes"`
+
+	// RejectedWriteLogging configures logging a sample of the series whose
+	// writes fail.
+	RejectedWriteLogging RejectedWriteLoggingConfiguration `yaml:"rejectedWriteLogging"`
+
+	// DefaultUnit is the timestamp precision, e.g. 1s or 1ms, that the
+	// datapoints of writes which do not set a unit are stored with. Defaults
+	// to 1s.
+	DefaultUnit time.Duration `yaml:"defaultUnit" validate:"min=0"`
+}
+
+// RejectedWriteLoggingConfiguration configures logging failed writes.
+type RejectedWriteLoggingConfiguration struct {
+	// SampleRate is the fraction of failed writes that are logged, failed
+	// writes are not logged if not set.
+	SampleRate float64 `yaml:"sampleRate" validate:"min=0,max=1"`
+}
+
+// CardinalityBudgetConfiguration configures the cardinality budget.
+type CardinalityBudgetConfiguration struct {
+	// MaxSeries is the ceiling on the number of series seen within the
+	// window, the budget is disabled if not set.
+	MaxSeries int `yaml:"maxSeries" validate:"min=0"`
+
+	// DropThreshold is the fraction of MaxSeries above which new series
+	// start being dropped, defaults to 0.9.
+	DropThreshold float64 `yaml:"dropThreshold" validate:"min=0,max=1"`
+
+	// Window is how long a series is considered seen after it was last
+	// written, defaults to an hour.
+	Window time.Duration `yaml:"window" validate:"min=0"`
+}
+
+// NewOptions creates cardinality budget options from the configuration.
+func (cfg CardinalityBudgetConfiguration) NewOptions() CardinalityBudgetOptions {
+	return CardinalityBudgetOptions{
+		MaxSeries:     cfg.MaxSeries,
+		DropThreshold: cfg.DropThreshold,
+		Window:        cfg.Window,
+	}
+}
+
+// TimestampTruncationConfiguration configures timestamp truncation.
+type TimestampTruncationConfiguration struct {
+	// Resolution is the resolution timestamps are truncated to, timestamps
+	// are not truncated if not set.
+	Resolution time.Duration `yaml:"resolution" validate:"min=0"`
+
+	// Collisions determines how datapoints whose truncated timestamps
+	// collide are combined, one of: none, last, sum or mean. Defaults to
+	// none which writes them all.
+	Collisions SubResolutionBehavior `yaml:"collisions"`
+}
+
+// NewOptions creates timestamp truncation options from the configuration.
+func (cfg TimestampTruncationConfiguration) NewOptions() TimestampTruncationOptions {
+	return TimestampTruncationOptions{
+		Resolution: cfg.Resolution,
+		Collisions: cfg.Collisions,
+	}
+}
+
+// MetricTypesConfiguration configures the metric type classification.
+type MetricTypesConfiguration struct {
+	// Suffixes classify series by the suffix of their metric name, the
+	// first matching suffix is used.
+	Suffixes []MetricTypeSuffixConfiguration `yaml:"suffixes"`
+
+	// Fallback is the metric type of series that are not classified, one of:
+	// gauge or counter. Defaults to gauge.
+	Fallback MetricType `yaml:"fallback"`
+}
+
+// MetricTypeSuffixConfiguration classifies series by metric name suffix.
+type MetricTypeSuffixConfiguration struct {
+	Suffix string     `yaml:"suffix" validate:"nonzero"`
+	Type   MetricType `yaml:"type"`
+}
+
+// NewOptions creates metric type classification options from the
+// configuration.
+func (cfg MetricTypesConfiguration) NewOptions() MetricTypeClassificationOptions {
+	opts := MetricTypeClassificationOptions{Fallback: cfg.Fallback}
+	for _, suffix := range cfg.Suffixes {
+		opts.Suffixes = append(opts.Suffixes, MetricTypeSuffix{
+			Suffix: []byte(suffix.Suffix),
+			Type:   suffix.Type,
+		})
+	}
+	return opts
+}
+
+// WritePrioritiesConfiguration configures priority scheduling of writes.
+type WritePrioritiesConfiguration struct {
+	// Concurrency is the maximum number of storage writes dispatched to the
+	// write workers at once, priority scheduling is disabled if not set.
+	Concurrency int `yaml:"concurrency" validate:"min=0"`
+
+	// MaxQueued is the maximum number of storage writes queued per priority
+	// before further writes of that priority are shed, unbounded if not set.
+	MaxQueued int `yaml:"maxQueued" validate:"min=0"`
+}
+
+// NewOptions creates write priorities options from the configuration.
+func (cfg WritePrioritiesConfiguration) NewOptions() WritePrioritiesOptions {
+	return WritePrioritiesOptions{
+		Concurrency: cfg.Concurrency,
+		MaxQueued:   cfg.MaxQueued,
+	}
+}
+
+// BatchTimeoutConfiguration configures the deadline of batch writes.
+type BatchTimeoutConfiguration struct {
+	// Base is the timeout of a batch regardless of its size, batch writes
+	// have no deadline if neither base nor perSeries is set.
+	Base time.Duration `yaml:"base" validate:"min=0"`
+
+	// PerSeries is added to the timeout for every series in the batch.
+	PerSeries time.Duration `yaml:"perSeries" validate:"min=0"`
+
+	// Max, if set, is the upper bound on the timeout of a batch.
+	Max time.Duration `yaml:"max" validate:"min=0"`
+}
+
+// NewOptions creates batch timeout options from the configuration.
+func (cfg BatchTimeoutConfiguration) NewOptions() BatchTimeoutOptions {
+	return BatchTimeoutOptions{
+		Base:      cfg.Base,
+		PerSeries: cfg.PerSeries,
+		Max:       cfg.Max,
+	}
+}
+
+// TagValidationConfiguration configures the validation of tags.
+type TagValidationConfiguration struct {
+	// InvalidTags determines how series with invalid tags are handled, one
+	// of: allow, reject or sanitize. Defaults to allow.
+	InvalidTags InvalidTagsBehavior `yaml:"invalidTags"`
+
+	// MaxNameLength is the maximum length in bytes of a tag name, unbounded
+	// if not set.
+	MaxNameLength int `yaml:"maxNameLength" validate:"min=0"`
+
+	// MaxValueLength is the maximum length in bytes of a tag value,
+	// unbounded if not set.
+	MaxValueLength int `yaml:"maxValueLength" validate:"min=0"`
+
+	// Strict additionally treats empty tag values, duplicate tag names and
+	// reserved tag names as invalid.
+	Strict bool `yaml:"strict"`
+}
+
+// NewOptions creates tag validation options from the configuration.
+func (cfg TagValidationConfiguration) NewOptions() TagValidationOptions {
+	return TagValidationOptions{
+		InvalidTags:    cfg.InvalidTags,
+		MaxNameLength:  cfg.MaxNameLength,
+		MaxValueLength: cfg.MaxValueLength,
+		Strict:         cfg.Strict,
+	}
+}
+
+// TagFilterConfiguration configures the tags stripped from series.
+type TagFilterConfiguration struct {
+	// Allow, if set, are the names of the only tags to keep.
+	Allow []string `yaml:"allow"`
+
+	// Deny are the names of tags to strip.
+	Deny []string `yaml:"deny"`
+}
+
+// NewOptions creates tag filter options from the configuration.
+func (cfg TagFilterConfiguration) NewOptions() TagFilterOptions {
+	return TagFilterOptions{
+		Allow: cfg.Allow,
+		Deny:  cfg.Deny,
+	}
+}
+
+// ResourceAttributesConfiguration configures how resource attributes are
+// merged into tags.
+type ResourceAttributesConfiguration struct {
+	// Prefix is prepended to the name of every resource attribute.
+	Prefix string `yaml:"prefix"`
+
+	// Collisions determines how resource attributes that match a tag of the
+	// series are handled, one of: keep_metric, keep_resource or error.
+	// Defaults to keep_metric.
+	Collisions ResourceAttributeCollisionBehavior `yaml:"collisions"`
+}
+
+// NewOptions creates resource attributes options from the configuration.
+func (cfg ResourceAttributesConfiguration) NewOptions() ResourceAttributesOptions {
+	return ResourceAttributesOptions{
+		Prefix:     cfg.Prefix,
+		Collisions: cfg.Collisions,
+	}
+}
+
+// ValueRouteConfiguration configures a value route.
+type ValueRouteConfiguration struct {
+	// Above is the threshold a datapoint value must exceed to be routed.
+	Above float64 `yaml:"above"`
+
+	// Resolution and Retention identify the aggregated namespace to route to.
+	Resolution time.Duration `yaml:"resolution" validate:"nonzero"`
+	Retention  time.Duration `yaml:"retention" validate:"nonzero"`
+}
+
+// NewValueRoute creates a value route from the configuration.
+func (cfg ValueRouteConfiguration) NewValueRoute() ValueRoute {
+	return ValueRoute{
+		Above:         cfg.Above,
+		StoragePolicy: policy.NewStoragePolicy(cfg.Resolution, xtime.Second, cfg.Retention),
+	}
+}
+
+// ComputedTagConfiguration configures a computed tag.
+type ComputedTagConfiguration struct {
+	// Name is the name of the computed tag.
+	Name string `yaml:"name" validate:"nonzero"`
+
+	// SourceTag is the tag the computed tag is derived from, the datapoint
+	// value is used if not set.
+	SourceTag string `yaml:"sourceTag"`
+
+	// Bucketize are the sorted upper bounds of the buckets to place the
+	// source in.
+	Bucketize []float64 `yaml:"bucketize"`
+
+	// HashMod is the number of values to hash the source into.
+	HashMod uint64 `yaml:"hashMod"`
+}
+
+// NewComputedTag creates a computed tag from the configuration.
+func (cfg ComputedTagConfiguration) NewComputedTag() (ComputedTag, error) {
+	computedTag := ComputedTag{
+		Name:      []byte(cfg.Name),
+		Bucketize: cfg.Bucketize,
+		HashMod:   cfg.HashMod,
+	}
+	if cfg.SourceTag != "" {
+		computedTag.SourceTag = []byte(cfg.SourceTag)
+	}
+	if err := computedTag.Validate(); err != nil {
+		return ComputedTag{}, err
+	}
+	return computedTag, nil
+}
+
+// RelabelConfiguration configures a relabel rule, the fields and their
+// defaults are those of Prometheus relabel_configs so that rules can be
+// shared with Prometheus.
+type RelabelConfiguration struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    *string       `yaml:"separator"`
+	Regex        *string       `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  *string       `yaml:"replacement"`
+	Action       RelabelAction `yaml:"action"`
+}
+
+// NewRelabelRule creates a relabel rule from the configuration.
+func (cfg RelabelConfiguration) NewRelabelRule() RelabelRule {
+	rule := RelabelRule{
+		SourceLabels: cfg.SourceLabels,
+		Separator:    ";",
+		Regex:        "(.*)",
+		Modulus:      cfg.Modulus,
+		TargetLabel:  cfg.TargetLabel,
+		Replacement:  "$1",
+		Action:       cfg.Action,
+	}
+	if cfg.Separator != nil {
+		rule.Separator = *cfg.Separator
+	}
+	if cfg.Regex != nil {
+		rule.Regex = *cfg.Regex
+	}
+	if cfg.Replacement != nil {
+		rule.Replacement = *cfg.Replacement
+	}
+	if rule.Action == "" {
+		rule.Action = RelabelReplace
+	}
+	return rule
+}
+
+// StorageCircuitBreakerConfiguration configures the storage circuit
+// breaker, see StorageCircuitBreakerOptions for the defaults.
+type StorageCircuitBreakerConfiguration struct {
+	Window             time.Duration `yaml:"window" validate:"min=0"`
+	MinWrites          int           `yaml:"minWrites" validate:"min=0"`
+	ErrorRateThreshold float64       `yaml:"errorRateThreshold" validate:"min=0,max=1"`
+	SlowWriteThreshold time.Duration `yaml:"slowWriteThreshold" validate:"min=0"`
+	OpenDuration       time.Duration `yaml:"openDuration" validate:"min=0"`
+}
+
+// NewOptions creates storage circuit breaker options from the
+// configuration.
+func (cfg StorageCircuitBreakerConfiguration) NewOptions() StorageCircuitBreakerOptions {
+	return StorageCircuitBreakerOptions{
+		Enabled:            true,
+		Window:             cfg.Window,
+		MinWrites:          cfg.MinWrites,
+		ErrorRateThreshold: cfg.ErrorRateThreshold,
+		SlowWriteThreshold: cfg.SlowWriteThreshold,
+		OpenDuration:       cfg.OpenDuration,
+	}
+}
+
+// FallbackConfiguration configures the fallback namespace.
+type FallbackConfiguration struct {
+	// Resolution and Retention identify the aggregated namespace that
+	// receives fallback writes, the unaggregated namespace is used if they
+	// are not set.
+	Resolution time.Duration `yaml:"resolution" validate:"min=0"`
+	Retention  time.Duration `yaml:"retention" validate:"min=0"`
+
+	// MaxWritesPerSecond bounds the number of fallback writes per second.
+	MaxWritesPerSecond int64 `yaml:"maxWritesPerSecond" validate:"min=0"`
+}
+
+// NewOptions creates fallback options from the configuration.
+func (cfg FallbackConfiguration) NewOptions() FallbackOptions {
+	opts := FallbackOptions{
+		Enabled:            true,
+		MaxWritesPerSecond: cfg.MaxWritesPerSecond,
+	}
+	if cfg.Resolution > 0 || cfg.Retention > 0 {
+		storagePolicy := policy.NewStoragePolicy(cfg.Resolution, xtime.Second, cfg.Retention)
+		opts.StoragePolicy = &storagePolicy
+	}
+	return opts
+}
+
+// AnnotationSamplingConfiguration configures annotation sampling.
+type AnnotationSamplingConfiguration struct {
+	// Mode is the sampling mode, one of: none, every_n or on_change.
+	// Defaults to none which stores every annotation.
+	Mode AnnotationSamplingMode `yaml:"mode"`
+
+	// EveryN is the interval at which annotations are stored when the mode
+	// is every_n.
+	EveryN int `yaml:"everyN" validate:"min=0"`
+
+	// MaxTrackedSeries bounds the number of series whose sampling state is
+	// kept in memory.
+	MaxTrackedSeries int `yaml:"maxTrackedSeries" validate:"min=0"`
+}
+
+// NewOptions creates annotation sampling options from the configuration.
+func (cfg AnnotationSamplingConfiguration) NewOptions() AnnotationSamplingOptions {
+	return AnnotationSamplingOptions{
+		Mode:             cfg.Mode,
+		EveryN:           cfg.EveryN,
+		MaxTrackedSeries: cfg.MaxTrackedSeries,
+	}
+}
+
+// NewOptions creates downsampler and writer options from the configuration.
+func (cfg Configuration) NewOptions(instrumentOpts instrument.Options) (Options, error) {
+	opts := Options{
+		InstrumentOptions:         instrumentOpts,
+		DuplicateTags:             cfg.DuplicateTags,
+		ImmediateFlushConcurrency: cfg.ImmediateFlushConcurrency,
+		MaxConcurrentAppenders:    cfg.MaxConcurrentAppenders,
+		MaxStoragePolicyFanout:    cfg.MaxStoragePolicyFanout,
+
+		TruncateStoragePolicyFanout: cfg.TruncateStoragePolicyFanout,
+		AnnotationSampling:          cfg.AnnotationSampling.NewOptions(),
+		PartialFailure:              cfg.PartialFailure,
+		AppenderErrors:              cfg.AppenderErrors,
+		StorageWriteTimeout:         cfg.StorageWriteTimeout,
+		SubResolution:               cfg.SubResolution,
+		CardinalityBudget:           cfg.CardinalityBudget.NewOptions(),
+		TagFilter:                   cfg.TagFilter.NewOptions(),
+		TagValidation:               cfg.TagValidation.NewOptions(),
+		ResourceAttributes:          cfg.ResourceAttributes.NewOptions(),
+		SourceTagName:               cfg.SourceTagName,
+		PoolWriteQueries:            cfg.PoolWriteQueries,
+		DeduplicateBatches:          cfg.DeduplicateBatches,
+		BatchTimeout:                cfg.BatchTimeout.NewOptions(),
+		WritePriorities:             cfg.WritePriorities.NewOptions(),
+		MetricTypes:                 cfg.MetricTypes.NewOptions(),
+		TimestampTruncation:         cfg.TimestampTruncation.NewOptions(),
+		RejectedWriteLogging: RejectedWriteLoggingOptions{
+			SampleRate: cfg.RejectedWriteLogging.SampleRate,
+		},
+	}
+	if cfg.WriteUnaggregated != nil {
+		opts.SkipUnaggregated = !*cfg.WriteUnaggregated
+	}
+	if cfg.Fallback != nil {
+		opts.Fallback = cfg.Fallback.NewOptions()
+	}
+	if cfg.StorageCircuitBreaker != nil {
+		opts.StorageCircuitBreaker = cfg.StorageCircuitBreaker.NewOptions()
+	}
+	if cfg.StorageRetry != nil {
+		scope := tally.NoopScope
+		if instrumentOpts != nil {
+			scope = instrumentOpts.MetricsScope()
+		}
+		opts.StorageRetry = cfg.StorageRetry.NewOptions(
+			scope.SubScope("storage-retry"))
+	}
+	for _, computedTagCfg := range cfg.ComputedTags {
+		computedTag, err := computedTagCfg.NewComputedTag()
+		if err != nil {
+			return Options{}, err
+		}
+		opts.ComputedTags = append(opts.ComputedTags, computedTag)
+	}
+	if len(cfg.RelabelConfigs) > 0 {
+		rules := make([]RelabelRule, 0, len(cfg.RelabelConfigs))
+		for _, relabelCfg := range cfg.RelabelConfigs {
+			rules = append(rules, relabelCfg.NewRelabelRule())
+		}
+		relabeler, err := NewRelabeler(rules)
+		if err != nil {
+			return Options{}, err
+		}
+		opts.Relabeler = relabeler
+	}
+	for _, valueRouteCfg := range cfg.ValueRoutes {
+		opts.ValueRoutes = append(opts.ValueRoutes, valueRouteCfg.NewValueRoute())
+	}
+	if cfg.DefaultUnit > 0 {
+		unit, err := xtime.UnitFromDuration(cfg.DefaultUnit)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid default unit %v: %v", cfg.DefaultUnit, err)
+		}
+		opts.DefaultUnit = unit
+	}
+	return opts, nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/m3db/m3/src/query/storage"
+)
+
+// DebugState is a point in time snapshot of the work in progress on the
+// writer, meant to be served on demand by an admin endpoint.
+type DebugState struct {
+	// InFlightWrites is the number of single series writes in progress.
+	InFlightWrites int64 `json:"inFlightWrites"`
+	// InFlightBatches is the number of batch writes in progress.
+	InFlightBatches int64 `json:"inFlightBatches"`
+	// AppendersInUse is the number of downsampler appenders in use.
+	AppendersInUse int `json:"appendersInUse"`
+	// AppenderLimit is the maximum number of appenders, zero if unbounded.
+	AppenderLimit int `json:"appenderLimit"`
+	// ImmediateFlushesInFlight is the number of immediate flushes of
+	// aggregated data in progress.
+	ImmediateFlushesInFlight int `json:"immediateFlushesInFlight"`
+	// Namespaces are the outstanding storage writes per namespace, only
+	// namespaces that have been written to are included.
+	Namespaces []NamespaceDebugState `json:"namespaces"`
+}
+
+// NamespaceDebugState is the debug state of writes to a single namespace.
+type NamespaceDebugState struct {
+	MetricsType       string `json:"metricsType"`
+	Resolution        string `json:"resolution,omitempty"`
+	Retention         string `json:"retention,omitempty"`
+	OutstandingWrites int64  `json:"outstandingWrites"`
+}
+
+func (d *downsamplerAndWriter) DebugState() DebugState {
+	appendersInUse, appenderLimit := d.AppenderUsage()
+	state := DebugState{
+		InFlightWrites:           atomic.LoadInt64(&d.inFlightWrites),
+		InFlightBatches:          atomic.LoadInt64(&d.inFlightBatches),
+		AppendersInUse:           appendersInUse,
+		AppenderLimit:            appenderLimit,
+		ImmediateFlushesInFlight: len(d.immediateFlushPermits),
+	}
+
+	d.namespaceOutstanding.Range(func(key, value interface{}) bool {
+		var (
+			attrs     = key.(storage.Attributes)
+			namespace = NamespaceDebugState{
+				MetricsType:       attrs.MetricsType.String(),
+				OutstandingWrites: atomic.LoadInt64(value.(*int64)),
+			}
+		)
+		if attrs.MetricsType == storage.AggregatedMetricsType {
+			namespace.Resolution = attrs.Resolution.String()
+			namespace.Retention = attrs.Retention.String()
+		}
+		state.Namespaces = append(state.Namespaces, namespace)
+		return true
+	})
+
+	sort.Slice(state.Namespaces, func(i, j int) bool {
+		a, b := state.Namespaces[i], state.Namespaces[j]
+		if a.MetricsType != b.MetricsType {
+			return a.MetricsType < b.MetricsType
+		}
+		if a.Resolution != b.Resolution {
+			return a.Resolution < b.Resolution
+		}
+		return a.Retention < b.Retention
+	})
+
+	return state
+}
+
+// storeWrite writes the query to storage while tracking the number of
+// outstanding writes to its namespace.
+func (d *downsamplerAndWriter) storeWrite(
+	ctx context.Context,
+	query *storage.WriteQuery,
+) error {
+	outstanding, ok := d.namespaceOutstanding.Load(query.Attributes)
+	if !ok {
+		outstanding, _ = d.namespaceOutstanding.LoadOrStore(query.Attributes, new(int64))
+	}
+
+	atomic.AddInt64(outstanding.(*int64), 1)
+	err := d.retryStorageWrite(ctx, func() error {
+		if d.storageBreaker != nil && !d.storageBreaker.allow() {
+			return ErrStorageUnavailable
+		}
+
+		start := time.Now()
+		err := d.storeWriteWithTimeout(ctx, query)
+		d.metrics.recordWrite(start, err)
+		if d.storageBreaker != nil {
+			d.storageBreaker.record(err, time.Since(start))
+		}
+		return err
+	})
+	atomic.AddInt64(outstanding.(*int64), -1)
+	return err
+}
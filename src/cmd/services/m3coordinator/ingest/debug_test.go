@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteDebugState(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_ ident.ID,
+			_ ident.ID,
+			_ ident.TagIterator,
+			_ time.Time,
+			_ float64,
+			_ xtime.Unit,
+			_ []byte,
+		) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		})
+
+	datapoints := testDatapoints1[:1]
+	done := make(chan error)
+	go func() {
+		done <- downAndWrite.Write(
+			context.Background(), testTags1, datapoints, xtime.Second, defaultOverride)
+	}()
+
+	<-started
+	state := downAndWrite.DebugState()
+	require.Equal(t, int64(1), state.InFlightWrites)
+	require.Equal(t, []NamespaceDebugState{
+		{
+			MetricsType:       storage.UnaggregatedMetricsType.String(),
+			OutstandingWrites: 1,
+		},
+	}, state.Namespaces)
+
+	close(release)
+	require.NoError(t, <-done)
+
+	state = downAndWrite.DebugState()
+	require.Equal(t, int64(0), state.InFlightWrites)
+	require.Equal(t, int64(0), state.Namespaces[0].OutstandingWrites)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+var errDualTierWithWriteOverride = errors.New(
+	"dual tier writes cannot also override their storage policies")
+
+// DualTierWriteError is returned by Write for writes that set a dual tier
+// storage policy when writing to either tier failed, a nil error for a tier
+// means that the tier was written successfully.
+type DualTierWriteError struct {
+	// UnaggregatedErr is the error writing to the unaggregated namespace.
+	UnaggregatedErr error
+	// AggregatedErr is the error writing to the aggregated namespace.
+	AggregatedErr error
+}
+
+func (e *DualTierWriteError) Error() string {
+	switch {
+	case e.UnaggregatedErr != nil && e.AggregatedErr != nil:
+		return fmt.Sprintf("unaggregated and aggregated writes failed: unaggregated: %v, aggregated: %v",
+			e.UnaggregatedErr, e.AggregatedErr)
+	case e.UnaggregatedErr != nil:
+		return fmt.Sprintf("unaggregated write failed: %v", e.UnaggregatedErr)
+	default:
+		return fmt.Sprintf("aggregated write failed: %v", e.AggregatedErr)
+	}
+}
+
+func dualTierAggregatedAttributes(p policy.StoragePolicy) storage.Attributes {
+	return storage.Attributes{
+		MetricsType: storage.AggregatedMetricsType,
+		Resolution:  p.Resolution().Window,
+		Retention:   p.Retention().Duration(),
+	}
+}
+
+// validateDualTier validates up front that both tiers of a dual tier write
+// can be stored, if the storage supports validating namespaces, so that a
+// misconfigured write fails before anything is written.
+func (d *downsamplerAndWriter) validateDualTier(overrides WriteOptions) error {
+	p := overrides.DualTierStoragePolicy
+	if p == nil {
+		return nil
+	}
+	if overrides.WriteOverride {
+		return errDualTierWithWriteOverride
+	}
+
+	validator, ok := d.store.(storage.AttributesValidator)
+	if !ok {
+		return nil
+	}
+	unaggregated := storage.Attributes{MetricsType: storage.UnaggregatedMetricsType}
+	if err := validator.ValidateAttributes(unaggregated); err != nil {
+		return err
+	}
+	return validator.ValidateAttributes(dualTierAggregatedAttributes(*p))
+}
+
+// writeDualTier writes the datapoints to both the unaggregated namespace
+// and the aggregated namespace of the storage policy. Both tiers are always
+// written, and a *DualTierWriteError describes which of them failed.
+func (d *downsamplerAndWriter) writeDualTier(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	annotation []byte,
+	p policy.StoragePolicy,
+) error {
+	var (
+		wg            sync.WaitGroup
+		aggregatedErr error
+		attrs         = dualTierAggregatedAttributes(p)
+	)
+	wg.Add(1)
+	if err := d.goWrite(ctx, func() {
+		aggregatedErr = d.writeStorage(ctx, &storage.WriteQuery{
+			Tags: tags,
+			Datapoints: combineSubResolutionDatapoints(datapoints,
+				attrs.Resolution, d.opts.SubResolution),
+			Unit:       unit,
+			Annotation: annotation,
+			Attributes: attrs,
+		})
+		wg.Done()
+	}); err != nil {
+		aggregatedErr = err
+		wg.Done()
+	}
+
+	unaggregatedErr := d.writeUnaggregated(ctx, tags, datapoints, unit, annotation)
+	wg.Wait()
+
+	if unaggregatedErr == nil && aggregatedErr == nil {
+		return nil
+	}
+	return &DualTierWriteError{
+		UnaggregatedErr: unaggregatedErr,
+		AggregatedErr:   aggregatedErr,
+	}
+}
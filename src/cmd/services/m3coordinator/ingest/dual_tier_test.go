@@ -0,0 +1,113 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage/m3"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+var testDualTierNamespaces = []m3.AggregatedClusterNamespaceDefinition{
+	{
+		NamespaceID: ident.StringID("1m:48h"),
+		Resolution:  time.Minute,
+		Retention:   48 * time.Hour,
+	},
+}
+
+func TestDownsampleAndWriteDualTier(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, testDualTierNamespaces)
+	downAndWrite.downsampler = nil
+
+	var (
+		lock    sync.Mutex
+		written = make(map[string]int)
+		p       = policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour)
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace, _ ident.ID, _ ident.TagIterator, _ time.Time, _ float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			lock.Lock()
+			written[namespace.String()]++
+			lock.Unlock()
+			if namespace.String() == "1m:48h" {
+				return errors.New("aggregated error")
+			}
+			return nil
+		}).
+		Times(2 * len(testDatapoints1))
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{DualTierStoragePolicy: &p})
+	require.Error(t, err)
+
+	dualTierErr, ok := err.(*DualTierWriteError)
+	require.True(t, ok)
+	require.NoError(t, dualTierErr.UnaggregatedErr)
+	require.Error(t, dualTierErr.AggregatedErr)
+
+	require.Len(t, written, 2)
+	require.Equal(t, len(testDatapoints1), written["1m:48h"])
+}
+
+func TestDownsampleAndWriteDualTierValidatesNamespaces(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, testDualTierNamespaces)
+
+	// Nothing is written, not even to the downsampler, for an unknown
+	// aggregated namespace.
+	downsampler.EXPECT().NewMetricsAppender().Times(0)
+
+	p := policy.NewStoragePolicy(time.Hour, xtime.Second, 48*time.Hour)
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{DualTierStoragePolicy: &p})
+	require.EqualError(t, err,
+		"no configured cluster namespace for: retention=48h0m0s, resolution=1h0m0s")
+
+	err = downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{
+			DualTierStoragePolicy: &p,
+			WriteOverride:         true,
+		})
+	require.Equal(t, errDualTierWithWriteOverride, err)
+}
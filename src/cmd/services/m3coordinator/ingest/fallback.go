@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"github.com/m3db/m3/src/aggregator/rate"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage"
+)
+
+const (
+	defaultFallbackMaxWritesPerSecond = 1000
+)
+
+// FallbackOptions configures a fallback namespace that receives the writes
+// that fail against the namespace they were intended for.
+type FallbackOptions struct {
+	// Enabled enables writing to the fallback namespace.
+	Enabled bool
+
+	// StoragePolicy is the storage policy of the aggregated namespace that
+	// receives fallback writes, if not set the unaggregated namespace is used.
+	StoragePolicy *policy.StoragePolicy
+
+	// MaxWritesPerSecond bounds the number of fallback writes per second so
+	// that a namespace that is persistently failing is surfaced as write
+	// errors rather than being masked by the fallback. Defaults to 1000.
+	MaxWritesPerSecond int64
+}
+
+func newFallbackLimiter(opts FallbackOptions) *rate.Limiter {
+	if !opts.Enabled {
+		return nil
+	}
+
+	limit := opts.MaxWritesPerSecond
+	if limit <= 0 {
+		limit = defaultFallbackMaxWritesPerSecond
+	}
+
+	return rate.NewLimiter(limit, time.Now)
+}
+
+// fallbackAttributes returns the attributes of the fallback namespace.
+func (o FallbackOptions) fallbackAttributes() storage.Attributes {
+	if o.StoragePolicy == nil {
+		return storage.Attributes{
+			MetricsType: storage.UnaggregatedMetricsType,
+		}
+	}
+
+	return storage.Attributes{
+		MetricsType: storage.AggregatedMetricsType,
+		Resolution:  o.StoragePolicy.Resolution().Window,
+		Retention:   o.StoragePolicy.Retention().Duration(),
+	}
+}
+
+// writeStorage writes the query to storage, retrying the write against the
+// fallback namespace if it fails and a fallback is configured. Each storage
+// write targets a single namespace so any failure is attributed to it. The
+// original error is returned if the fallback is not taken or also fails.
+func (d *downsamplerAndWriter) writeStorage(
+	ctx context.Context,
+	query *storage.WriteQuery,
+) error {
+	err := d.storeWrite(ctx, query)
+	if err == nil || d.fallbackLimiter == nil || ctx.Err() != nil ||
+		err == ErrStorageUnavailable {
+		// Shed writes are not retried against the fallback namespace since
+		// it is behind the same open breaker.
+		return err
+	}
+
+	fallbackAttrs := d.opts.Fallback.fallbackAttributes()
+	if query.Attributes == fallbackAttrs {
+		// The fallback namespace itself failed.
+		return err
+	}
+
+	if !d.fallbackLimiter.IsAllowed(1) {
+		d.metrics.fallbackLimited.Inc(1)
+		return err
+	}
+
+	fallbackQuery := *query
+	fallbackQuery.Attributes = fallbackAttrs
+	if fallbackErr := d.storeWrite(ctx, &fallbackQuery); fallbackErr != nil {
+		d.metrics.fallbackErrors.Inc(1)
+		return err
+	}
+
+	d.metrics.fallbackWrites.Inc(1)
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/aggregator/rate"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage/m3"
+	testm3 "github.com/m3db/m3/src/query/test/m3"
+	"github.com/m3db/m3x/ident"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+var (
+	testFallbackNamespaces = []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			NamespaceID: ident.StringID("10s:24h"),
+			Resolution:  10 * time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}
+
+	testFallbackStoragePolicy = policy.NewStoragePolicy(10*time.Second, xtime.Second, 24*time.Hour)
+
+	testFallbackOverrides = WriteOptions{
+		DownsampleOverride: true,
+		WriteOverride:      true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+	}
+)
+
+func newTestFallbackDownsamplerAndWriter(
+	t *testing.T,
+	ctrl *gomock.Controller,
+	namespaceErrs map[string]error,
+) (*downsamplerAndWriter, tally.TestScope, map[string]int) {
+	store, session := testm3.NewStorageAndSessionWithAggregatedNamespaces(
+		t, ctrl, testFallbackNamespaces)
+
+	var (
+		writes     = make(map[string]int)
+		writesLock sync.Mutex
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace ident.ID,
+			_ ident.ID,
+			_ ident.TagIterator,
+			_ time.Time,
+			_ float64,
+			_ xtime.Unit,
+			_ []byte,
+		) error {
+			writesLock.Lock()
+			writes[namespace.String()]++
+			writesLock.Unlock()
+			return namespaceErrs[namespace.String()]
+		}).AnyTimes()
+
+	scope := tally.NewTestScope("", nil)
+	opts := Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		Fallback: FallbackOptions{
+			Enabled:       true,
+			StoragePolicy: &testFallbackStoragePolicy,
+		},
+	}
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, opts)
+	return downAndWrite.(*downsamplerAndWriter), scope, writes
+}
+
+func TestDownsampleAndWriteFallback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, scope, writes := newTestFallbackDownsamplerAndWriter(t, ctrl,
+		map[string]error{"1m:48h": errors.New("namespace unavailable")})
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testFallbackOverrides)
+	require.NoError(t, err)
+	require.Equal(t, len(testDatapoints1), writes["10s:24h"])
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["fallback.success+"].Value())
+}
+
+func TestDownsampleAndWriteFallbackError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	namespaceErr := errors.New("namespace unavailable")
+	downAndWrite, scope, _ := newTestFallbackDownsamplerAndWriter(t, ctrl,
+		map[string]error{
+			"1m:48h":  namespaceErr,
+			"10s:24h": errors.New("fallback unavailable"),
+		})
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testFallbackOverrides)
+	require.EqualError(t, err, namespaceErr.Error())
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["fallback.error+"].Value())
+}
+
+func TestDownsampleAndWriteFallbackLimited(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	namespaceErr := errors.New("namespace unavailable")
+	downAndWrite, scope, writes := newTestFallbackDownsamplerAndWriter(t, ctrl,
+		map[string]error{"1m:48h": namespaceErr})
+
+	now := time.Now()
+	downAndWrite.fallbackLimiter = rate.NewLimiter(1, func() time.Time { return now })
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testFallbackOverrides)
+	require.NoError(t, err)
+
+	err = downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testFallbackOverrides)
+	require.EqualError(t, err, namespaceErr.Error())
+	require.Equal(t, len(testDatapoints1), writes["10s:24h"])
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["fallback.limited+"].Value())
+}
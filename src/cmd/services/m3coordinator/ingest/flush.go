@@ -0,0 +1,45 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+// Flush flushes the downsampler without tearing it down, writing the
+// aggregated datapoints of every aggregation window that has closed to
+// storage instead of waiting for the aggregator to flush them on its own
+// schedule. A window closes once it ends and any buffer it keeps for late
+// samples has passed.
+//
+// Once Flush returns without an error, every sample that was written
+// before it was called has been written to storage, either as is if it was
+// written unaggregated, or as part of the aggregated datapoint of its
+// window if that window had closed. Windows that are still open are not
+// flushed, since their aggregated values are only complete once they close,
+// and are written to storage when they close as usual. Flush does not wait
+// for writes that are still in progress when it is called.
+//
+// It returns an error if any of the flushed datapoints fail to be written
+// or the downsampler is not yet initialized. Writers without a downsampler
+// have nothing to flush.
+func (d *downsamplerAndWriter) Flush() error {
+	if d.downsampler == nil {
+		return nil
+	}
+	return d.downsampler.Flush()
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+	xtime "github.com/m3db/m3x/time"
+)
+
+var errFlushImmediatelyAggregation = errors.New(
+	"immediate flushes require the mapping rules to aggregate with last only, set explicitly")
+
+// validateFlushImmediately rejects writes that request an immediate flush
+// unless every mapping rule of the write aggregates with Last only. The
+// immediate flush writes the last datapoint of each window as is, which is
+// only the aggregated value of the window for the Last aggregation.
+//
+// Last must be set explicitly, rules that leave the aggregations unset are
+// rejected even though the default aggregation of gauges is Last. The
+// default aggregations depend on the metric type the downsampler resolves
+// for each datapoint, which the writer cannot tell in advance.
+func validateFlushImmediately(overrides WriteOptions) error {
+	if !overrides.FlushImmediately || !overrides.DownsampleOverride {
+		return nil
+	}
+	if len(overrides.DownsampleAggregations) > 0 {
+		// The aggregations of the write replace those of the rules.
+		if !isLastAggregation(overrides.DownsampleAggregations) {
+			return xerrors.NewInvalidParamsError(errFlushImmediatelyAggregation)
+		}
+		return nil
+	}
+	for _, rule := range overrides.DownsampleMappingRules {
+		if !isLastAggregation(rule.Aggregations) {
+			return xerrors.NewInvalidParamsError(errFlushImmediatelyAggregation)
+		}
+	}
+	return nil
+}
+
+func isLastAggregation(types []aggregation.Type) bool {
+	return len(types) == 1 && types[0] == aggregation.Last
+}
+
+// maybeFlushImmediately writes the datapoints directly to the aggregated
+// namespaces of the override mapping rules when the write requests an
+// immediate flush, so that an aggregated view of the series is queryable
+// without waiting for the downsampler to flush.
+//
+// Each datapoint is written at the end of the aggregation window it falls
+// into, which is the timestamp the downsampler will use once the window is
+// flushed. Since only writes whose mapping rules aggregate with Last can be
+// flushed immediately, see validateFlushImmediately, the last datapoint
+// written for a window is the value the downsampler later flushes for it.
+// Nothing is flushed from the downsampler itself.
+//
+// Every immediate flush results in a synchronous storage write per storage
+// policy which defeats batching, so the number of immediate flushes in
+// progress at once is bounded and writes that exceed the bound are counted
+// and fall back to being aggregated as usual. Since the writer is not aware of the
+// storage policies of the default mapping rules only writes that override
+// the mapping rules can be flushed immediately.
+func (d *downsamplerAndWriter) maybeFlushImmediately(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) error {
+	if !overrides.FlushImmediately || !overrides.DownsampleOverride ||
+		d.store == nil || d.downsampler == nil {
+		return nil
+	}
+
+	select {
+	case d.immediateFlushPermits <- struct{}{}:
+	default:
+		// Bound reached, the data will be flushed by the downsampler as usual.
+		d.metrics.flushImmediatelySkipped.Inc(1)
+		return nil
+	}
+	defer func() { <-d.immediateFlushPermits }()
+
+	var (
+		wg       sync.WaitGroup
+		multiErr xerrors.MultiError
+		errLock  sync.Mutex
+	)
+	for _, rule := range overrides.DownsampleMappingRules {
+		for _, p := range rule.Policies {
+			var (
+				resolution = p.Resolution().Window
+				aligned    = alignDatapointsToWindowEnd(datapoints, resolution)
+				attrs      = storage.Attributes{
+					MetricsType: storage.AggregatedMetricsType,
+					Resolution:  resolution,
+					Retention:   p.Retention().Duration(),
+				}
+			)
+
+			wg.Add(1)
+			err := d.goWrite(ctx, func() {
+				err := d.writeStorage(ctx, &storage.WriteQuery{
+					Tags:       tags,
+					Datapoints: aligned,
+					Unit:       unit,
+					Attributes: attrs,
+				})
+				if err != nil {
+					errLock.Lock()
+					multiErr = multiErr.Add(err)
+					errLock.Unlock()
+				}
+				wg.Done()
+			})
+			if err != nil {
+				errLock.Lock()
+				multiErr = multiErr.Add(err)
+				errLock.Unlock()
+				wg.Done()
+			}
+		}
+	}
+
+	wg.Wait()
+	return multiErr.FinalError()
+}
+
+func alignDatapointsToWindowEnd(
+	datapoints ts.Datapoints,
+	resolution time.Duration,
+) ts.Datapoints {
+	aligned := make(ts.Datapoints, 0, len(datapoints))
+	for _, dp := range datapoints {
+		aligned = append(aligned, ts.Datapoint{
+			Timestamp:  dp.Timestamp.Truncate(resolution).Add(resolution),
+			Value:      dp.Value,
+			Annotation: dp.Annotation,
+		})
+	}
+	return aligned
+}
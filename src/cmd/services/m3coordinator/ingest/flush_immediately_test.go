@@ -0,0 +1,177 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage/m3"
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+var (
+	testImmediateFlushNamespaces = []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}
+
+	testImmediateFlushMappingRules = []downsample.MappingRule{
+		{
+			Aggregations: []aggregation.Type{aggregation.Last},
+			Policies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			},
+		},
+	}
+
+	testImmediateFlushOverrides = WriteOptions{
+		DownsampleOverride:     true,
+		DownsampleMappingRules: testImmediateFlushMappingRules,
+		FlushImmediately:       true,
+	}
+
+	testImmediateFlushAppenderOpts = downsample.SampleAppenderOptions{
+		Override: true,
+		OverrideRules: downsample.SamplesAppenderOverrideRules{
+			MappingRules: testImmediateFlushMappingRules,
+		},
+	}
+)
+
+func TestDownsampleAndWriteFlushImmediately(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, testImmediateFlushNamespaces)
+
+	expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, testImmediateFlushAppenderOpts)
+	// Once for the immediate flush to the aggregated namespace and once for
+	// the default unaggregated write.
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testImmediateFlushOverrides)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteFlushImmediatelyBoundReached(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, testImmediateFlushNamespaces)
+	scope := tally.NewTestScope("", nil)
+	downAndWrite.metrics = newDownsamplerAndWriterMetrics(scope)
+
+	// Exhaust all the permits so that the write falls back to regular aggregation.
+	for i := 0; i < cap(downAndWrite.immediateFlushPermits); i++ {
+		downAndWrite.immediateFlushPermits <- struct{}{}
+	}
+
+	expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, testImmediateFlushAppenderOpts)
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, testImmediateFlushOverrides)
+	require.NoError(t, err)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["flush-immediately.skipped+"].Value())
+}
+
+func TestDownsampleAndWriteFlushImmediatelyRequiresLastAggregation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No expectations are set on the downsampler or the session, so any
+	// write fails the test.
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, testImmediateFlushNamespaces)
+
+	sumRules := []downsample.MappingRule{
+		{
+			Aggregations: []aggregation.Type{aggregation.Sum},
+			Policies:     testImmediateFlushMappingRules[0].Policies,
+		},
+	}
+	defaultRules := []downsample.MappingRule{
+		{Policies: testImmediateFlushMappingRules[0].Policies},
+	}
+	for _, overrides := range []WriteOptions{
+		{
+			DownsampleOverride:     true,
+			DownsampleMappingRules: sumRules,
+			FlushImmediately:       true,
+		},
+		{
+			// Last must be set explicitly, even if it is the default.
+			DownsampleOverride:     true,
+			DownsampleMappingRules: defaultRules,
+			FlushImmediately:       true,
+		},
+		{
+			// The aggregations of the write replace those of the rules.
+			DownsampleOverride:     true,
+			DownsampleMappingRules: testImmediateFlushMappingRules,
+			DownsampleAggregations: []aggregation.Type{aggregation.Sum},
+			FlushImmediately:       true,
+		},
+	} {
+		err := downAndWrite.Write(
+			context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+		require.Error(t, err)
+		require.True(t, xerrors.IsInvalidParams(err))
+
+		_, err = downAndWrite.ValidateWrite(
+			context.Background(), testTags1, testDatapoints1, overrides)
+		require.True(t, xerrors.IsInvalidParams(err))
+	}
+}
+
+func TestAlignDatapointsToWindowEnd(t *testing.T) {
+	datapoints := ts.Datapoints{
+		{Timestamp: time.Unix(5, 0), Value: 1},
+		{Timestamp: time.Unix(65, 0), Value: 2},
+	}
+
+	aligned := alignDatapointsToWindowEnd(datapoints, time.Minute)
+	require.Equal(t, ts.Datapoints{
+		{Timestamp: time.Unix(60, 0), Value: 1},
+		{Timestamp: time.Unix(120, 0), Value: 2},
+	}, aligned)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+var (
+	errGaugeStatsNotAggregated = errors.New(
+		"gauge stats require the series to be written to aggregated namespaces")
+)
+
+// GaugeStats are the pre-computed statistics of a gauge over an interval,
+// such as those emitted by a statsd flush.
+type GaugeStats struct {
+	Timestamp time.Time
+	Min       float64
+	Max       float64
+	Last      float64
+}
+
+// Validate validates the gauge stats.
+func (s GaugeStats) Validate() error {
+	if math.IsNaN(s.Min) || math.IsNaN(s.Max) || math.IsNaN(s.Last) {
+		return fmt.Errorf("gauge stats at %v contain NaN values", s.Timestamp)
+	}
+	if s.Min > s.Max || s.Last < s.Min || s.Last > s.Max {
+		return fmt.Errorf("gauge stats at %v are not ordered: min=%v, max=%v, last=%v",
+			s.Timestamp, s.Min, s.Max, s.Last)
+	}
+	return nil
+}
+
+// gaugeStatsDatapoints returns the datapoints to write to the downsampler and
+// to storage for the gauge stats.
+//
+// The downsampler receives the min, max and last of each interval as
+// separate gauge samples in that order so that the min, max and last
+// aggregations of the aggregated namespaces are preserved exactly. Other
+// aggregations such as sum, count and mean are computed over the three
+// samples and do not reflect the original gauge. Storage receives only the
+// last value which is what an unaggregated gauge would have recorded.
+func gaugeStatsDatapoints(stats []GaugeStats) (ts.Datapoints, ts.Datapoints, error) {
+	var (
+		downsampleDatapoints = make(ts.Datapoints, 0, 3*len(stats))
+		storageDatapoints    = make(ts.Datapoints, 0, len(stats))
+	)
+	for _, s := range stats {
+		if err := s.Validate(); err != nil {
+			return nil, nil, err
+		}
+
+		downsampleDatapoints = append(downsampleDatapoints,
+			ts.Datapoint{Timestamp: s.Timestamp, Value: s.Min},
+			ts.Datapoint{Timestamp: s.Timestamp, Value: s.Max},
+			ts.Datapoint{Timestamp: s.Timestamp, Value: s.Last})
+		storageDatapoints = append(storageDatapoints,
+			ts.Datapoint{Timestamp: s.Timestamp, Value: s.Last})
+	}
+
+	return downsampleDatapoints, storageDatapoints, nil
+}
+
+// validateGaugeStatsWrite ensures that gauge stats written with the overrides
+// reach the aggregated namespaces, without them only the last value would be
+// stored and the stats would be silently collapsed.
+func (d *downsamplerAndWriter) validateGaugeStatsWrite(overrides WriteOptions) error {
+	if d.downsampler == nil {
+		return errGaugeStatsNotAggregated
+	}
+	if overrides.DownsampleOverride && len(overrides.DownsampleMappingRules) == 0 {
+		return errGaugeStatsNotAggregated
+	}
+	if writeMetricType(overrides) != MetricTypeGauge {
+		return errGaugeStatsMetricType
+	}
+	return nil
+}
+
+func (d *downsamplerAndWriter) WriteGaugeStats(
+	ctx context.Context,
+	tags models.Tags,
+	stats []GaugeStats,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) error {
+	if err := d.validateGaugeStatsWrite(overrides); err != nil {
+		return err
+	}
+
+	downsampleDatapoints, storageDatapoints, err := gaugeStatsDatapoints(stats)
+	if err != nil {
+		return err
+	}
+
+	return d.write(ctx, tags, downsampleDatapoints, storageDatapoints, unit, overrides)
+}
+
+// iterValueDatapoints returns the datapoints to write to the downsampler and
+// to storage for a value of a batch.
+func (d *downsamplerAndWriter) iterValueDatapoints(
+	value IterValue,
+) (ts.Datapoints, ts.Datapoints, error) {
+	if len(value.GaugeStats) == 0 {
+		return value.Datapoints, value.Datapoints, nil
+	}
+
+	if err := d.validateGaugeStatsWrite(WriteOptions{}); err != nil {
+		return nil, nil, err
+	}
+
+	return gaugeStatsDatapoints(value.GaugeStats)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+var testGaugeStats = []GaugeStats{
+	{Timestamp: time.Unix(0, 1), Min: 1, Max: 5, Last: 3},
+	{Timestamp: time.Unix(0, 2), Min: 2, Max: 2, Last: 2},
+}
+
+func TestGaugeStatsValidate(t *testing.T) {
+	require.NoError(t, GaugeStats{Min: 1, Max: 3, Last: 2}.Validate())
+	require.NoError(t, GaugeStats{Min: 1, Max: 1, Last: 1}.Validate())
+	require.Error(t, GaugeStats{Min: 3, Max: 1, Last: 2}.Validate())
+	require.Error(t, GaugeStats{Min: 1, Max: 3, Last: 4}.Validate())
+	require.Error(t, GaugeStats{Min: math.NaN(), Max: 3, Last: 2}.Validate())
+}
+
+func TestDownsampleAndWriteGaugeStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	var downsampleDatapoints, storageDatapoints ts.Datapoints
+	for _, s := range testGaugeStats {
+		for _, v := range []float64{s.Min, s.Max, s.Last} {
+			downsampleDatapoints = append(downsampleDatapoints,
+				ts.Datapoint{Timestamp: s.Timestamp, Value: v})
+		}
+		storageDatapoints = append(storageDatapoints,
+			ts.Datapoint{Timestamp: s.Timestamp, Value: s.Last})
+	}
+
+	expectDefaultDownsampling(ctrl, downsampleDatapoints, downsampler, zeroDownsamplerAppenderOpts)
+	expectDefaultStorageWrites(session, storageDatapoints)
+
+	err := downAndWrite.WriteGaugeStats(
+		context.Background(), testTags1, testGaugeStats, xtime.Second, defaultOverride)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteGaugeStatsInvalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither the downsampler nor the storage should be written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	stats := []GaugeStats{{Timestamp: time.Unix(0, 1), Min: 5, Max: 1, Last: 3}}
+	err := downAndWrite.WriteGaugeStats(
+		context.Background(), testTags1, stats, xtime.Second, defaultOverride)
+	require.Error(t, err)
+}
+
+func TestDownsampleAndWriteGaugeStatsNotAggregated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+
+	err := downAndWrite.WriteGaugeStats(
+		context.Background(), testTags1, testGaugeStats, xtime.Second, defaultOverride)
+	require.Equal(t, errGaugeStatsNotAggregated, err)
+
+	downAndWrite, _, _ = newTestDownsamplerAndWriter(t, ctrl)
+	err = downAndWrite.WriteGaugeStats(
+		context.Background(), testTags1, testGaugeStats, xtime.Second,
+		WriteOptions{DownsampleOverride: true})
+	require.Equal(t, errGaugeStatsNotAggregated, err)
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	errDatapointTypesLengthMismatch = errors.New(
+		"datapoint types must be set for every datapoint of the series")
+	errGaugeStatsMetricType = errors.New(
+		"gauge statistics can only be written as a gauge")
+)
+
+// MetricType is the type of a metric, determining how its samples are
+// aggregated by the downsampler.
+type MetricType uint
+
+const (
+	// MetricTypeUnknown is an unset metric type, the metric type is then
+	// determined by the metric type classification, see
+	// MetricTypeClassificationOptions.
+	MetricTypeUnknown MetricType = iota
+	// MetricTypeGauge aggregates samples as a gauge.
+	MetricTypeGauge
+	// MetricTypeCounter aggregates samples as a counter.
+	MetricTypeCounter
+	// MetricTypeTimer aggregates samples as a timer.
+	MetricTypeTimer
+)
+
+var validMetricTypes = []MetricType{
+	MetricTypeGauge,
+	MetricTypeCounter,
+	MetricTypeTimer,
+}
+
+func (t MetricType) String() string {
+	switch t {
+	case MetricTypeGauge:
+		return "gauge"
+	case MetricTypeCounter:
+		return "counter"
+	case MetricTypeTimer:
+		return "timer"
+	}
+	return "unknown"
+}
+
+// Validate validates the metric type, an unknown metric type is valid.
+func (t MetricType) Validate() error {
+	if t == MetricTypeUnknown {
+		return nil
+	}
+	for _, valid := range validMetricTypes {
+		if t == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid metric type '%d' valid types are: %v",
+		uint(t), validMetricTypes)
+}
+
+// UnmarshalYAML unmarshals a metric type.
+func (t *MetricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*t = MetricTypeUnknown
+		return nil
+	}
+
+	for _, valid := range validMetricTypes {
+		if str == valid.String() {
+			*t = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid MetricType '%s' valid types are: %v",
+		str, validMetricTypes)
+}
+
+// MetricTypeSuffix classifies the series whose metric name ends with the
+// suffix as the metric type.
+type MetricTypeSuffix struct {
+	Suffix []byte
+	Type   MetricType
+}
+
+// MetricTypeClassificationOptions configures how the metric type of each
+// datapoint of a batch is determined when more than one source classifies
+// it. The sources take precedence in the following order:
+//
+//  1. The metric type of the datapoint, see IterValue.DatapointTypes.
+//  2. The metric type of the series, see IterValue.Type.
+//  3. The first of the Suffixes that the metric name of the series ends with.
+//  4. The Fallback metric type.
+//
+// A source that returns an unknown metric type defers to the next one. A
+// series whose metric type and suffix classification disagree is counted
+// as a conflict, and a series that falls through to the fallback as
+// unclassified, since either usually means that a source is misconfigured.
+type MetricTypeClassificationOptions struct {
+	// Suffixes classify series by the suffix of their metric name, the
+	// first matching suffix is used.
+	Suffixes []MetricTypeSuffix
+
+	// Fallback is the metric type of series that no source classifies,
+	// defaults to gauge.
+	Fallback MetricType
+}
+
+// writeMetricType returns the metric type of the datapoints of a Write,
+// which defaults to gauge for backwards compatibility.
+func writeMetricType(overrides WriteOptions) MetricType {
+	if overrides.MetricType == MetricTypeUnknown {
+		return MetricTypeGauge
+	}
+	return overrides.MetricType
+}
+
+// seriesMetricType returns the metric type of a series, which is the
+// metric type of its datapoints that do not set their own.
+func (d *downsamplerAndWriter) seriesMetricType(value IterValue) MetricType {
+	var (
+		explicit   = value.Type
+		classified = d.suffixMetricType(value)
+	)
+	switch {
+	case explicit != MetricTypeUnknown:
+		if classified != MetricTypeUnknown && classified != explicit {
+			d.metrics.metricTypeConflicts.Inc(1)
+		}
+		return explicit
+	case classified != MetricTypeUnknown:
+		return classified
+	}
+
+	d.metrics.metricTypeUnclassified.Inc(1)
+	if fallback := d.opts.MetricTypes.Fallback; fallback != MetricTypeUnknown {
+		return fallback
+	}
+	return MetricTypeGauge
+}
+
+func (d *downsamplerAndWriter) suffixMetricType(value IterValue) MetricType {
+	suffixes := d.opts.MetricTypes.Suffixes
+	if len(suffixes) == 0 {
+		return MetricTypeUnknown
+	}
+
+	name, ok := value.Tags.Name()
+	if !ok {
+		return MetricTypeUnknown
+	}
+	for _, suffix := range suffixes {
+		if bytes.HasSuffix(name, suffix.Suffix) {
+			return suffix.Type
+		}
+	}
+	return MetricTypeUnknown
+}
+
+// datapointMetricTypes validates the metric types of a series of a batch
+// and returns the metric type of the series along with the metric type of
+// each of its datapoints, or nil if all the datapoints share the metric
+// type of the series. Changes of metric type within the series are
+// permitted to support migrating a metric from one type to another, but
+// are counted and logged since they are otherwise likely to be a mistake.
+func (d *downsamplerAndWriter) datapointMetricTypes(
+	value IterValue,
+) (MetricType, []MetricType, error) {
+	if err := value.Type.Validate(); err != nil {
+		return 0, nil, err
+	}
+
+	if len(value.GaugeStats) > 0 {
+		gauge := value.Type == MetricTypeUnknown || value.Type == MetricTypeGauge
+		if !gauge || len(value.DatapointTypes) > 0 {
+			return 0, nil, errGaugeStatsMetricType
+		}
+		return MetricTypeGauge, nil, nil
+	}
+
+	types := value.DatapointTypes
+	if len(types) == 0 {
+		return d.seriesMetricType(value), nil, nil
+	}
+	if len(types) != len(value.Datapoints) {
+		return 0, nil, errDatapointTypesLengthMismatch
+	}
+
+	unknown := 0
+	for _, t := range types {
+		if err := t.Validate(); err != nil {
+			return 0, nil, err
+		}
+		if t == MetricTypeUnknown {
+			unknown++
+		}
+	}
+
+	// The series metric type is only resolved if some datapoint defers to
+	// it so that fully typed series are not counted as unclassified.
+	seriesType := MetricTypeUnknown
+	if unknown > 0 {
+		seriesType = d.seriesMetricType(value)
+		resolved := make([]MetricType, len(types))
+		for i, t := range types {
+			if t == MetricTypeUnknown {
+				t = seriesType
+			}
+			resolved[i] = t
+		}
+		types = resolved
+	}
+
+	changes := 0
+	for i := 1; i < len(types); i++ {
+		if types[i] != types[i-1] {
+			changes++
+		}
+	}
+
+	if changes > 0 {
+		d.metrics.metricTypeChanges.Inc(int64(changes))
+		d.logger.Warnf("metric type changed %d times within series: id=%s",
+			changes, value.Tags.ID())
+	}
+
+	return seriesType, types, nil
+}
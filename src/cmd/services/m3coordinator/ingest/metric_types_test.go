@@ -0,0 +1,251 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestDownsampleAndWriteBatchMetricTypes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+	})
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().Reset().AnyTimes()
+	mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).
+		Times(2)
+	gomock.InOrder(
+		// Series with a per series metric type.
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(0)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(1)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(2)),
+		// Series migrating from a gauge to a counter.
+		mockSamplesAppender.EXPECT().AppendGaugeSample(3.0),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(4)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(5)),
+	)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1, metricType: MetricTypeCounter},
+		{tags: testTags2, datapoints: testDatapoints2, datapointTypes: []MetricType{
+			MetricTypeGauge, MetricTypeCounter, MetricTypeCounter,
+		}},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["metric-type.changes+"].Value())
+}
+
+func TestDownsampleAndWriteMetricType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().AddTag(gomock.Any(), gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).
+		Times(3)
+	gomock.InOrder(
+		// Writes without a metric type are gauges.
+		mockSamplesAppender.EXPECT().AppendGaugeSamples([]float64{0, 1, 2}),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(0)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(1)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(2)),
+		mockSamplesAppender.EXPECT().AppendTimerSample(0.0),
+		mockSamplesAppender.EXPECT().AppendTimerSample(1.0),
+		mockSamplesAppender.EXPECT().AppendTimerSample(2.0),
+	)
+	mockMetricsAppender.EXPECT().Finalize().Times(3)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil).Times(3)
+
+	for _, metricType := range []MetricType{
+		MetricTypeUnknown, MetricTypeCounter, MetricTypeTimer,
+	} {
+		err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+			xtime.Second, WriteOptions{MetricType: metricType})
+		require.NoError(t, err)
+	}
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{MetricType: MetricType(10)})
+	require.Error(t, err)
+}
+
+func TestDownsampleAndWriteBatchInvalidMetricTypes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.store = nil
+
+	mockMetricsAppender := downsample.NewMockMetricsAppender(ctrl)
+	mockMetricsAppender.EXPECT().Finalize().Times(2)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil).Times(2)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1, metricType: MetricType(10)},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.EqualError(t, xerrors.InnerError(err),
+		"invalid metric type '10' valid types are: [gauge counter timer]")
+
+	iter = newTestIter([]testIterEntry{
+		{tags: testTags2, datapoints: testDatapoints2, datapointTypes: []MetricType{
+			MetricTypeCounter,
+		}},
+	})
+	err = downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.Equal(t, errDatapointTypesLengthMismatch, xerrors.InnerError(err))
+}
+
+func TestDatapointMetricTypesGaugeStats(t *testing.T) {
+	downAndWrite := &downsamplerAndWriter{}
+
+	_, _, err := downAndWrite.datapointMetricTypes(IterValue{
+		GaugeStats: []GaugeStats{{Min: 1, Max: 2, Last: 1}},
+		Type:       MetricTypeCounter,
+	})
+	require.Equal(t, errGaugeStatsMetricType, err)
+
+	seriesType, types, err := downAndWrite.datapointMetricTypes(IterValue{
+		GaugeStats: []GaugeStats{{Min: 1, Max: 2, Last: 1}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MetricTypeGauge, seriesType)
+	require.Nil(t, types)
+}
+
+func TestDatapointMetricTypesClassification(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	downAndWrite := &downsamplerAndWriter{
+		opts: Options{
+			MetricTypes: MetricTypeClassificationOptions{
+				Suffixes: []MetricTypeSuffix{
+					{Suffix: []byte("_total"), Type: MetricTypeCounter},
+					{Suffix: []byte("_bytes"), Type: MetricTypeGauge},
+				},
+				Fallback: MetricTypeCounter,
+			},
+		},
+		metrics: newDownsamplerAndWriterMetrics(scope),
+		logger:  instrument.NewOptions().Logger(),
+	}
+
+	newTags := func(name string) models.Tags {
+		return models.NewTags(1, nil).SetName([]byte(name))
+	}
+	dps := ts.Datapoints{{Value: 1}, {Value: 2}}
+
+	tests := []struct {
+		name          string
+		value         IterValue
+		expectedType  MetricType
+		expectedTypes []MetricType
+	}{
+		{
+			name:         "suffix",
+			value:        IterValue{Tags: newTags("requests_total"), Datapoints: dps},
+			expectedType: MetricTypeCounter,
+		},
+		{
+			name: "explicit over suffix",
+			value: IterValue{Tags: newTags("requests_total"), Datapoints: dps,
+				Type: MetricTypeGauge},
+			expectedType: MetricTypeGauge,
+		},
+		{
+			name:         "fallback",
+			value:        IterValue{Tags: newTags("requests"), Datapoints: dps},
+			expectedType: MetricTypeCounter,
+		},
+		{
+			name: "datapoint over suffix",
+			value: IterValue{Tags: newTags("size_bytes"), Datapoints: dps,
+				DatapointTypes: []MetricType{MetricTypeCounter, MetricTypeUnknown}},
+			expectedType:  MetricTypeGauge,
+			expectedTypes: []MetricType{MetricTypeCounter, MetricTypeGauge},
+		},
+		{
+			name: "fully typed datapoints",
+			value: IterValue{Tags: newTags("requests"), Datapoints: dps,
+				DatapointTypes: []MetricType{MetricTypeGauge, MetricTypeGauge}},
+			expectedType:  MetricTypeUnknown,
+			expectedTypes: []MetricType{MetricTypeGauge, MetricTypeGauge},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seriesType, types, err := downAndWrite.datapointMetricTypes(test.value)
+			require.NoError(t, err)
+			require.Equal(t, test.expectedType, seriesType)
+			require.Equal(t, test.expectedTypes, types)
+		})
+	}
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["metric-type.ambiguous+reason=conflict"].Value())
+	require.Equal(t, int64(1), counters["metric-type.ambiguous+reason=unclassified"].Value())
+}
+
+func TestMetricTypeUnmarshalYAML(t *testing.T) {
+	var metricType MetricType
+	require.NoError(t, yaml.Unmarshal([]byte("counter"), &metricType))
+	require.Equal(t, MetricTypeCounter, metricType)
+
+	require.NoError(t, yaml.Unmarshal([]byte(`""`), &metricType))
+	require.Equal(t, MetricTypeUnknown, metricType)
+
+	require.Error(t, yaml.Unmarshal([]byte("histogram"), &metricType))
+}
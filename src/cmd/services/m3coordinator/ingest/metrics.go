@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+var batchSizeBuckets = append(tally.ValueBuckets{0},
+	tally.MustMakeExponentialValueBuckets(1, 2, 16)...)
+
+type downsamplerAndWriterMetrics struct {
+	writeSuccess  tally.Counter
+	writeErrors   tally.Counter
+	writeTimeouts tally.Counter
+	writeLatency  tally.Timer
+
+	downsampleSuccess tally.Counter
+	downsampleErrors  tally.Counter
+	downsampleLatency tally.Timer
+
+	batchSize            tally.Histogram
+	batchDuplicateSeries tally.Counter
+
+	fanoutTruncated tally.Counter
+	fanoutRejected  tally.Counter
+
+	tagsStripped         tally.Counter
+	tagsInvalidRejected  tally.Counter
+	tagsInvalidSanitized tally.Counter
+
+	relabelDropped tally.Counter
+
+	cardinalityAdmitted tally.Counter
+	cardinalityDropped  tally.Counter
+
+	annotationsStored  tally.Counter
+	annotationsDropped tally.Counter
+
+	fallbackWrites  tally.Counter
+	fallbackErrors  tally.Counter
+	fallbackLimited tally.Counter
+
+	appenderSeriesSkipped tally.Counter
+	appenderRestarts      tally.Counter
+
+	valueRouted tally.Counter
+
+	metricTypeChanges      tally.Counter
+	metricTypeConflicts    tally.Counter
+	metricTypeUnclassified tally.Counter
+
+	sequenceSuperseded tally.Counter
+
+	timestampCollisions tally.Counter
+
+	batchTimeout tally.Timer
+
+	flushImmediatelySkipped tally.Counter
+
+	tombstones      tally.Counter
+	tombstoneErrors tally.Counter
+
+	ruleCoverage ruleCoverageMetrics
+}
+
+func newDownsamplerAndWriterMetrics(scope tally.Scope) downsamplerAndWriterMetrics {
+	return downsamplerAndWriterMetrics{
+		writeSuccess:  scope.Counter("write.success"),
+		writeErrors:   scope.Counter("write.error"),
+		writeTimeouts: scope.Counter("write.timeout"),
+		writeLatency:  scope.Timer("write.latency"),
+
+		downsampleSuccess: scope.Counter("downsample.success"),
+		downsampleErrors:  scope.Counter("downsample.error"),
+		downsampleLatency: scope.Timer("downsample.latency"),
+
+		batchSize:            scope.Histogram("batch.size", batchSizeBuckets),
+		batchDuplicateSeries: scope.Counter("batch.duplicate-series"),
+
+		fanoutTruncated: scope.Counter("fanout.truncated"),
+		fanoutRejected:  scope.Counter("fanout.rejected"),
+
+		tagsStripped: scope.Counter("tags.stripped"),
+		tagsInvalidRejected: scope.Tagged(map[string]string{
+			"action": "rejected",
+		}).Counter("tags.invalid"),
+		tagsInvalidSanitized: scope.Tagged(map[string]string{
+			"action": "sanitized",
+		}).Counter("tags.invalid"),
+
+		relabelDropped: scope.Counter("relabel.dropped"),
+
+		cardinalityAdmitted: scope.Counter("cardinality-budget.admitted"),
+		cardinalityDropped:  scope.Counter("cardinality-budget.dropped"),
+
+		annotationsStored:  scope.Counter("annotations.stored"),
+		annotationsDropped: scope.Counter("annotations.dropped"),
+
+		fallbackWrites:  scope.Counter("fallback.success"),
+		fallbackErrors:  scope.Counter("fallback.error"),
+		fallbackLimited: scope.Counter("fallback.limited"),
+
+		appenderSeriesSkipped: scope.Counter("appender.series-skipped"),
+		appenderRestarts:      scope.Counter("appender.restarts"),
+
+		valueRouted: scope.Counter("value-routes.routed"),
+
+		metricTypeChanges: scope.Counter("metric-type.changes"),
+		metricTypeConflicts: scope.Tagged(map[string]string{
+			"reason": "conflict",
+		}).Counter("metric-type.ambiguous"),
+		metricTypeUnclassified: scope.Tagged(map[string]string{
+			"reason": "unclassified",
+		}).Counter("metric-type.ambiguous"),
+
+		sequenceSuperseded: scope.Counter("sequence.superseded"),
+
+		timestampCollisions: scope.Counter("timestamp-truncation.collisions"),
+
+		batchTimeout: scope.Timer("batch.timeout"),
+
+		flushImmediatelySkipped: scope.Counter("flush-immediately.skipped"),
+
+		tombstones:      scope.Counter("tombstones.success"),
+		tombstoneErrors: scope.Counter("tombstones.error"),
+
+		ruleCoverage: newRuleCoverageMetrics(scope),
+	}
+}
+
+// recordWrite records the result and latency of a single storage write
+// attempt.
+func (m downsamplerAndWriterMetrics) recordWrite(start time.Time, err error) {
+	m.writeLatency.Record(time.Since(start))
+	if err != nil {
+		m.writeErrors.Inc(1)
+		return
+	}
+	m.writeSuccess.Inc(1)
+}
+
+// recordDownsample records the result and latency of appending the samples
+// of a series to the downsampler.
+func (m downsamplerAndWriterMetrics) recordDownsample(start time.Time, err error) {
+	m.downsampleLatency.Record(time.Since(start))
+	if err != nil {
+		m.downsampleErrors.Inc(1)
+		return
+	}
+	m.downsampleSuccess.Inc(1)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestDownsampleAndWriteMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+	})
+
+	expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+
+	snapshot := scope.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(t, int64(1), counters["write.success+"].Value())
+	require.Equal(t, int64(1), counters["downsample.success+"].Value())
+	require.Len(t, snapshot.Timers()["write.latency+"].Values(), 1)
+	require.Len(t, snapshot.Timers()["downsample.latency+"].Values(), 1)
+}
+
+func TestDownsampleAndWriteBatchMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+	})
+
+	// The second series fails to be appended.
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().Reset().Times(2)
+	mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).
+		Times(2)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	mockSamplesAppender.EXPECT().AppendGaugeSamples(gomock.Any()).
+		Return(0, errors.New("aggregator out of capacity"))
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints2)
+
+	err := downAndWrite.WriteBatch(context.Background(), newTestIter(testEntries), nil)
+	require.Error(t, err)
+
+	snapshot := scope.Snapshot()
+	counters := snapshot.Counters()
+	require.Equal(t, int64(2), counters["write.success+"].Value())
+	require.Equal(t, int64(1), counters["downsample.success+"].Value())
+	require.Equal(t, int64(1), counters["downsample.error+"].Value())
+
+	histogram := snapshot.Histograms()["batch.size+"]
+	require.NotNil(t, histogram)
+	var batches int64
+	for upper, count := range histogram.Values() {
+		if count > 0 {
+			require.Equal(t, 2.0, upper)
+			batches += count
+		}
+	}
+	require.Equal(t, int64(1), batches)
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package mock provides a DownsamplerAndWriter that records the writes made
+// to it, for the tests of consumers of the ingest package.
+package mock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// DownsamplerAndWriter implements ingest.DownsamplerAndWriter and provides
+// methods to read what was written and set the results of writes. Only
+// Write, WriteWithResourceAttributes and the batch writes are recorded, the
+// other writes return the write result without being recorded.
+type DownsamplerAndWriter interface {
+	ingest.DownsamplerAndWriter
+
+	SetWriteResult(error)
+	SetWriteResultFn(func(Write) error)
+	SetWriteBatchResult(error)
+	Writes() []Write
+	WriteBatches() [][]ingest.IterValue
+}
+
+// Write is a write recorded by DownsamplerAndWriter. The tags and
+// datapoints are copied so that they remain valid if the caller pools them.
+type Write struct {
+	Resource   []models.Tag
+	Tags       models.Tags
+	Datapoints ts.Datapoints
+	Unit       xtime.Unit
+	Overrides  ingest.WriteOptions
+}
+
+type mockDownsamplerAndWriter struct {
+	sync.RWMutex
+	writeResult struct {
+		err error
+		fn  func(Write) error
+	}
+	writeBatchResult struct {
+		err error
+	}
+	sourceDefaults map[string]ingest.WriteOptions
+	writes         []Write
+	writeBatches   [][]ingest.IterValue
+}
+
+// NewMockDownsamplerAndWriter creates a new mock DownsamplerAndWriter
+// instance.
+func NewMockDownsamplerAndWriter() DownsamplerAndWriter {
+	return &mockDownsamplerAndWriter{
+		sourceDefaults: make(map[string]ingest.WriteOptions),
+	}
+}
+
+func (w *mockDownsamplerAndWriter) SetWriteResult(err error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writeResult.err = err
+}
+
+// SetWriteResultFn sets a function that returns the result of each recorded
+// write, it takes precedence over SetWriteResult.
+func (w *mockDownsamplerAndWriter) SetWriteResultFn(fn func(Write) error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writeResult.fn = fn
+}
+
+func (w *mockDownsamplerAndWriter) SetWriteBatchResult(err error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writeBatchResult.err = err
+}
+
+func (w *mockDownsamplerAndWriter) Writes() []Write {
+	w.RLock()
+	defer w.RUnlock()
+	return w.writes
+}
+
+func (w *mockDownsamplerAndWriter) WriteBatches() [][]ingest.IterValue {
+	w.RLock()
+	defer w.RUnlock()
+	return w.writeBatches
+}
+
+func (w *mockDownsamplerAndWriter) Write(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides ingest.WriteOptions,
+) error {
+	return w.WriteWithResourceAttributes(ctx, nil, tags, datapoints, unit, overrides)
+}
+
+func (w *mockDownsamplerAndWriter) WriteWithResourceAttributes(
+	ctx context.Context,
+	resource []models.Tag,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides ingest.WriteOptions,
+) error {
+	write := Write{
+		Tags:       tags.Clone(),
+		Datapoints: append(ts.Datapoints(nil), datapoints...),
+		Unit:       unit,
+		Overrides:  overrides,
+	}
+	for _, tag := range resource {
+		write.Resource = append(write.Resource, tag.Clone())
+	}
+
+	w.Lock()
+	w.writes = append(w.writes, write)
+	err, fn := w.writeResult.err, w.writeResult.fn
+	w.Unlock()
+
+	// The result function is called without holding the lock so that it
+	// can read the recorded writes.
+	if fn != nil {
+		return fn(write)
+	}
+	return err
+}
+
+func (w *mockDownsamplerAndWriter) WriteBatch(
+	ctx context.Context,
+	iter ingest.DownsampleAndWriteIter,
+	commit ingest.BatchCommitFn,
+) error {
+	_, err := w.writeBatch(iter)
+	if commit != nil {
+		commit(err)
+	}
+	return err
+}
+
+func (w *mockDownsamplerAndWriter) WriteSeries(
+	ctx context.Context,
+	series []ingest.WriteSeriesRequest,
+) error {
+	batch := make([]ingest.IterValue, 0, len(series))
+	for _, s := range series {
+		batch = append(batch, ingest.IterValue{
+			Tags:       s.Tags,
+			Datapoints: s.Datapoints,
+			Unit:       s.Unit,
+			Overrides:  s.Overrides,
+		})
+	}
+	return w.WriteBatch(ctx, &sliceIter{idx: -1, values: batch}, nil)
+}
+
+func (w *mockDownsamplerAndWriter) WriteBatchWithResult(
+	ctx context.Context,
+	iter ingest.DownsampleAndWriteIter,
+) (ingest.WriteBatchResult, error) {
+	n, err := w.writeBatch(iter)
+	if err == nil {
+		return ingest.WriteBatchResult{Succeeded: n}, nil
+	}
+
+	result := ingest.WriteBatchResult{
+		Failed: n,
+		Errors: []error{err},
+	}
+	for i := 0; i < n; i++ {
+		result.FailedSeries = append(result.FailedSeries, i)
+	}
+	return result, nil
+}
+
+// writeBatch records the series of the iterator as a batch and returns the
+// number of series and the result of the batch.
+func (w *mockDownsamplerAndWriter) writeBatch(
+	iter ingest.DownsampleAndWriteIter,
+) (int, error) {
+	var batch []ingest.IterValue
+	for iter.Next() {
+		value := iter.Current()
+		value.Tags = value.Tags.Clone()
+		value.Datapoints = append(ts.Datapoints(nil), value.Datapoints...)
+		batch = append(batch, value)
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.writeBatches = append(w.writeBatches, batch)
+	return len(batch), w.writeBatchResult.err
+}
+
+func (w *mockDownsamplerAndWriter) WriteGaugeStats(
+	ctx context.Context,
+	tags models.Tags,
+	stats []ingest.GaugeStats,
+	unit xtime.Unit,
+	overrides ingest.WriteOptions,
+) error {
+	w.RLock()
+	defer w.RUnlock()
+	return w.writeResult.err
+}
+
+func (w *mockDownsamplerAndWriter) WriteSamples(
+	ctx context.Context,
+	tags models.Tags,
+	samples []ingest.MetricSamples,
+	unit xtime.Unit,
+	overrides ingest.WriteOptions,
+) error {
+	w.RLock()
+	defer w.RUnlock()
+	return w.writeResult.err
+}
+
+func (w *mockDownsamplerAndWriter) WriteTombstone(
+	ctx context.Context,
+	tags models.Tags,
+	start time.Time,
+	end time.Time,
+) error {
+	w.RLock()
+	defer w.RUnlock()
+	return w.writeResult.err
+}
+
+func (w *mockDownsamplerAndWriter) RegisterSourceDefaults(
+	source string,
+	defaults ingest.WriteOptions,
+) {
+	w.Lock()
+	defer w.Unlock()
+	w.sourceDefaults[source] = defaults
+}
+
+func (w *mockDownsamplerAndWriter) SetSourceDefaults(
+	defaults map[string]ingest.WriteOptions,
+) {
+	w.Lock()
+	defer w.Unlock()
+	w.sourceDefaults = make(map[string]ingest.WriteOptions, len(defaults))
+	for source, d := range defaults {
+		w.sourceDefaults[source] = d
+	}
+}
+
+func (w *mockDownsamplerAndWriter) SourceDefaults(
+	source string,
+) (ingest.WriteOptions, bool) {
+	w.RLock()
+	defer w.RUnlock()
+	defaults, ok := w.sourceDefaults[source]
+	return defaults, ok
+}
+
+func (w *mockDownsamplerAndWriter) Storage() storage.Storage {
+	return nil
+}
+
+func (w *mockDownsamplerAndWriter) AppenderUsage() (int, int) {
+	return 0, 0
+}
+
+func (w *mockDownsamplerAndWriter) WouldAccept(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+) (bool, string) {
+	return true, ""
+}
+
+func (w *mockDownsamplerAndWriter) ValidateWrite(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	overrides ingest.WriteOptions,
+) (ingest.WriteValidation, error) {
+	return ingest.WriteValidation{Tags: tags}, nil
+}
+
+func (w *mockDownsamplerAndWriter) ResolveDestinations(
+	tags models.Tags,
+	overrides ingest.WriteOptions,
+) ([]storage.Attributes, error) {
+	return nil, nil
+}
+
+func (w *mockDownsamplerAndWriter) DebugState() ingest.DebugState {
+	return ingest.DebugState{}
+}
+
+func (w *mockDownsamplerAndWriter) Flush() error {
+	return nil
+}
+
+// sliceIter iterates over the series of a WriteSeries call.
+type sliceIter struct {
+	idx    int
+	values []ingest.IterValue
+}
+
+func (i *sliceIter) Next() bool {
+	i.idx++
+	return i.idx < len(i.values)
+}
+
+func (i *sliceIter) Current() ingest.IterValue {
+	return i.values[i.idx]
+}
+
+func (i *sliceIter) Reset() error {
+	i.idx = -1
+	return nil
+}
+
+func (i *sliceIter) Error() error {
+	return nil
+}
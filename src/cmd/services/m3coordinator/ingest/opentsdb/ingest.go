@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestopentsdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/log"
+	m3xserver "github.com/m3db/m3x/server"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/uber-go/tally"
+)
+
+var (
+	errIOptsMustBeSet             = errors.New("opentsdb ingester options: instrument options must be set")
+	errTagOptsMustBeSet           = errors.New("opentsdb ingester options: tag options must be set")
+	errInvalidMaxLineLength       = errors.New("opentsdb ingester options: max line length must not be negative")
+	errInvalidTimestampResolution = errors.New("opentsdb ingester options: timestamp resolution must not be negative")
+)
+
+// Options configures the ingester.
+type Options struct {
+	InstrumentOptions instrument.Options
+	TagOptions        models.TagOptions
+
+	// MaxLineLength is the maximum length in bytes of a line, the
+	// connection is closed once it sends a longer line. Defaults to
+	// DefaultMaxLineLength if not set.
+	MaxLineLength int
+
+	// TimestampResolution, if set, is the resolution the timestamps of the
+	// datapoints are truncated to, see ingest.WriteOptions.
+	TimestampResolution time.Duration
+}
+
+// Validate validates the options struct.
+func (o *Options) Validate() error {
+	if o.InstrumentOptions == nil {
+		return errIOptsMustBeSet
+	}
+
+	if o.TagOptions == nil {
+		return errTagOptsMustBeSet
+	}
+
+	if o.MaxLineLength < 0 {
+		return errInvalidMaxLineLength
+	}
+
+	if o.TimestampResolution < 0 {
+		return errInvalidTimestampResolution
+	}
+
+	return nil
+}
+
+// NewIngester returns an ingester for the OpenTSDB telnet protocol.
+func NewIngester(
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	opts Options,
+) (m3xserver.Handler, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ingester{
+		downsamplerAndWriter: downsamplerAndWriter,
+		opts:                 opts,
+		logger:               opts.InstrumentOptions.Logger(),
+		metrics: newOpenTSDBIngesterMetrics(
+			opts.InstrumentOptions.MetricsScope()),
+	}, nil
+}
+
+type ingester struct {
+	downsamplerAndWriter ingest.DownsamplerAndWriter
+	opts                 Options
+	logger               log.Logger
+	metrics              openTSDBIngesterMetrics
+}
+
+// Handle parses and writes the put lines received on the connection, each
+// line is written before the next one is parsed so the writes of a single
+// connection are applied in the order they were received.
+func (i *ingester) Handle(conn net.Conn) {
+	var (
+		// Interfaces require a context be passed, but M3DB client already has timeouts
+		// built in and allocating a new context each time is expensive so we just pass
+		// the same context always and rely on M3DB client timeouts.
+		ctx        = context.Background()
+		scanner    = bufio.NewScanner(conn)
+		datapoints = make(ts.Datapoints, 1)
+		parsedTags []models.Tag
+	)
+
+	maxLineLength := i.opts.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	// The buffer must also fit the newline terminating the longest line.
+	scanner.Buffer(nil, maxLineLength+1)
+
+	i.logger.Debug("handling new opentsdb ingestion connection")
+	for scanner.Scan() {
+		metric, err := Parse(scanner.Bytes(), parsedTags[:0])
+		if err != nil {
+			i.logger.Errorf("error trying to parse opentsdb line: %s, err: %s",
+				scanner.Text(), err)
+			i.metrics.malformed.Inc(1)
+			continue
+		}
+		parsedTags = metric.Tags
+
+		// The metric name takes precedence over a tag with the same name.
+		tags := models.NewTags(len(metric.Tags)+1, i.opts.TagOptions).
+			AddTags(metric.Tags).
+			SetName(metric.Name)
+		datapoints[0] = ts.Datapoint{Timestamp: metric.Timestamp, Value: metric.Value}
+		err = i.downsamplerAndWriter.Write(ctx, tags, datapoints,
+			xtime.Millisecond, ingest.WriteOptions{
+				TimestampResolution: i.opts.TimestampResolution,
+			})
+		if err != nil {
+			i.logger.Errorf("err writing opentsdb metric: %s, err: %s",
+				string(metric.Name), err)
+			i.metrics.err.Inc(1)
+			continue
+		}
+
+		i.metrics.success.Inc(1)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			i.metrics.lineTooLong.Inc(1)
+		}
+		i.logger.Errorf("encountered error during opentsdb ingestion when reading connection: %s", err)
+	}
+
+	// Don't close the connection, that is the server's responsibility.
+}
+
+func (i *ingester) Close() {
+	// We don't maintain any state in-between connections so there is nothing to do here.
+}
+
+func newOpenTSDBIngesterMetrics(m tally.Scope) openTSDBIngesterMetrics {
+	return openTSDBIngesterMetrics{
+		success:     m.Counter("success"),
+		err:         m.Counter("error"),
+		malformed:   m.Counter("malformed"),
+		lineTooLong: m.Counter("line-too-long"),
+	}
+}
+
+type openTSDBIngesterMetrics struct {
+	success     tally.Counter
+	err         tally.Counter
+	malformed   tally.Counter
+	lineTooLong tally.Counter
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestopentsdb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestIngesterHandleConn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var found []string
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Millisecond, gomock.Any()).
+		DoAndReturn(func(
+			_ context.Context,
+			tags models.Tags,
+			dp ts.Datapoints,
+			_ xtime.Unit,
+			opts ingest.WriteOptions,
+		) error {
+			require.True(t, time.Unix(1, 0).Equal(dp[0].Timestamp))
+			require.Equal(t, time.Second, opts.TimestampResolution)
+			found = append(found, string(tags.ID()))
+			return nil
+		}).Times(3)
+
+	scope := tally.NewTestScope("", nil)
+	ingester, err := NewIngester(mockDownsamplerAndWriter, Options{
+		InstrumentOptions:   instrument.NewOptions().SetMetricsScope(scope),
+		TagOptions:          models.NewTagOptions(),
+		TimestampResolution: time.Second,
+	})
+	require.NoError(t, err)
+
+	packet := "" +
+		"put requests 1 1 host=a region=us\n" +
+		"put requests 1 1 host\n" +
+		"version\n" +
+		"put latency 1 1\n" +
+		"put requests 1 2 __name__=overridden host=b\n"
+	ingester.Handle(&byteConn{b: bytes.NewBufferString(packet)})
+
+	require.Equal(t, []string{
+		"__name__=requests,host=a,region=us,",
+		"__name__=latency,",
+		"__name__=requests,host=b,",
+	}, found)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(3), counters["success+"].Value())
+	require.Equal(t, int64(2), counters["malformed+"].Value())
+}
+
+func TestIngesterHandleConnMaxLineLength(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+	mockDownsamplerAndWriter.EXPECT().
+		Write(gomock.Any(), gomock.Any(), gomock.Any(), xtime.Millisecond, gomock.Any()).
+		Return(nil).Times(1)
+
+	scope := tally.NewTestScope("", nil)
+	ingester, err := NewIngester(mockDownsamplerAndWriter, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		TagOptions:        models.NewTagOptions(),
+		MaxLineLength:     64,
+	})
+	require.NoError(t, err)
+
+	// Reading stops at the line that is too long.
+	packet := "" +
+		"put requests 1 1\n" +
+		"put requests 1 1 host=" + strings.Repeat("a", 64) + "\n" +
+		"put requests 1 1\n"
+	ingester.Handle(&byteConn{b: bytes.NewBufferString(packet)})
+
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["line-too-long+"].Value())
+}
+
+func TestNewIngesterValidatesOptions(t *testing.T) {
+	_, err := NewIngester(nil, Options{TagOptions: models.NewTagOptions()})
+	require.Equal(t, errIOptsMustBeSet, err)
+
+	_, err = NewIngester(nil, Options{InstrumentOptions: instrument.NewOptions()})
+	require.Equal(t, errTagOptsMustBeSet, err)
+
+	_, err = NewIngester(nil, Options{
+		InstrumentOptions: instrument.NewOptions(),
+		TagOptions:        models.NewTagOptions(),
+		MaxLineLength:     -1,
+	})
+	require.Equal(t, errInvalidMaxLineLength, err)
+}
+
+// byteConn implements the net.Conn interface so that we can test the handler without
+// going over the network.
+type byteConn struct {
+	b *bytes.Buffer
+}
+
+func (b *byteConn) Read(buf []byte) (n int, err error) {
+	return b.b.Read(buf)
+}
+
+func (b *byteConn) Write(buf []byte) (n int, err error) {
+	panic("not_implemented")
+}
+
+func (b *byteConn) Close() error {
+	return nil
+}
+
+func (b *byteConn) LocalAddr() net.Addr {
+	panic("not_implemented")
+}
+
+func (b *byteConn) RemoteAddr() net.Addr {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetDeadline(t time.Time) error {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetReadDeadline(t time.Time) error {
+	panic("not_implemented")
+}
+
+func (b *byteConn) SetWriteDeadline(t time.Time) error {
+	panic("not_implemented")
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package ingestopentsdb implements ingestion of the OpenTSDB telnet
+// protocol, where each line puts a single datapoint:
+//
+//	put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+//
+// The timestamp is in seconds or, if it has more than ten digits, in
+// milliseconds since the epoch. The metric name is written as the metric
+// name tag and the key=value pairs as the other tags of the series. Lines
+// that are not put commands or that are malformed are skipped.
+package ingestopentsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/unsafe"
+)
+
+const (
+	// DefaultMaxLineLength is the default maximum length of a line.
+	DefaultMaxLineLength = 64 * 1024
+
+	// maxSecondsTimestamp is the largest timestamp interpreted as seconds,
+	// larger timestamps are interpreted as milliseconds.
+	maxSecondsTimestamp = 9999999999
+)
+
+var (
+	putCommand = []byte("put")
+	tagSep     = byte('=')
+
+	// ErrNotPut is returned when a line is not a put command.
+	ErrNotPut = errors.New("not a put command")
+)
+
+// Metric is the datapoint put by a line.
+type Metric struct {
+	Name      []byte
+	Tags      []models.Tag
+	Timestamp time.Time
+	Value     float64
+}
+
+// Parse parses a put line, appending the tags of the line to the tags
+// provided. The name and tags of the returned metric reference the line.
+func Parse(line []byte, tags []models.Tag) (Metric, error) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 || !bytes.Equal(fields[0], putCommand) {
+		return Metric{}, ErrNotPut
+	}
+	if len(fields) < 4 {
+		return Metric{}, fmt.Errorf("put requires a metric, timestamp and value: %s", line)
+	}
+
+	m := Metric{Name: fields[1]}
+
+	timestamp, err := strconv.ParseInt(unsafe.String(fields[2]), 10, 64)
+	if err != nil || timestamp < 0 {
+		return Metric{}, fmt.Errorf("invalid timestamp: %s", fields[2])
+	}
+	if timestamp > maxSecondsTimestamp {
+		m.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+	} else {
+		m.Timestamp = time.Unix(timestamp, 0)
+	}
+
+	m.Value, err = strconv.ParseFloat(unsafe.String(fields[3]), 64)
+	if err != nil {
+		return Metric{}, fmt.Errorf("invalid value: %s", fields[3])
+	}
+
+	for _, field := range fields[4:] {
+		idx := bytes.IndexByte(field, tagSep)
+		if idx <= 0 || idx == len(field)-1 {
+			return Metric{}, fmt.Errorf("invalid tag: %s", field)
+		}
+
+		tag := models.Tag{Name: field[:idx], Value: field[idx+1:]}
+		for _, existing := range tags {
+			if bytes.Equal(existing.Name, tag.Name) {
+				return Metric{}, fmt.Errorf("duplicate tag: %s", tag.Name)
+			}
+		}
+		tags = append(tags, tag)
+	}
+	m.Tags = tags
+
+	return m, nil
+}
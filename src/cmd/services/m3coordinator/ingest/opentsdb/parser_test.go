@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingestopentsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Metric
+	}{
+		{
+			line: "put sys.cpu.user 1356998400 42.5 host=web01 cpu=0",
+			expected: Metric{
+				Name: []byte("sys.cpu.user"),
+				Tags: []models.Tag{
+					{Name: []byte("host"), Value: []byte("web01")},
+					{Name: []byte("cpu"), Value: []byte("0")},
+				},
+				Timestamp: time.Unix(1356998400, 0),
+				Value:     42.5,
+			},
+		},
+		{
+			line: "  put\tsys.cpu.user   1356998400123  -1  host=web01 \r",
+			expected: Metric{
+				Name: []byte("sys.cpu.user"),
+				Tags: []models.Tag{
+					{Name: []byte("host"), Value: []byte("web01")},
+				},
+				Timestamp: time.Unix(1356998400, 123*int64(time.Millisecond)),
+				Value:     -1,
+			},
+		},
+		{
+			line: "put requests 1 1e3",
+			expected: Metric{
+				Name:      []byte("requests"),
+				Timestamp: time.Unix(1, 0),
+				Value:     1000,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			m, err := Parse([]byte(test.line), nil)
+			require.NoError(t, err)
+			require.Equal(t, test.expected.Name, m.Name)
+			require.Equal(t, test.expected.Tags, m.Tags)
+			require.True(t, test.expected.Timestamp.Equal(m.Timestamp))
+			require.Equal(t, test.expected.Value, m.Value)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{line: "", err: ErrNotPut.Error()},
+		{line: "version", err: ErrNotPut.Error()},
+		{line: "PUT requests 1 1", err: ErrNotPut.Error()},
+		{line: "put requests 1", err: "put requires a metric, timestamp and value: put requests 1"},
+		{line: "put requests abc 1", err: "invalid timestamp: abc"},
+		{line: "put requests -1 1", err: "invalid timestamp: -1"},
+		{line: "put requests 1 abc", err: "invalid value: abc"},
+		{line: "put requests 1 1 host", err: "invalid tag: host"},
+		{line: "put requests 1 1 =a", err: "invalid tag: =a"},
+		{line: "put requests 1 1 host=", err: "invalid tag: host="},
+		{line: "put requests 1 1 host=a host=b", err: "duplicate tag: host"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			_, err := Parse([]byte(test.line), nil)
+			require.EqualError(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"time"
+
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/retry"
+	xtime "github.com/m3db/m3x/time"
+)
+
+const (
+	defaultImmediateFlushConcurrency = 16
+)
+
+// Options configures the downsampler and writer. The zero value is valid
+// and results in the default behavior for every option.
+type Options struct {
+	// InstrumentOptions are the instrument options, if not set metrics are
+	// emitted to a no-op scope.
+	InstrumentOptions instrument.Options
+
+	// DuplicateTags determines how series with repeated tag names are handled.
+	DuplicateTags DuplicateTagsBehavior
+
+	// ImmediateFlushConcurrency bounds how many writes requesting an immediate
+	// flush of their aggregated data can be in progress at once, any writes
+	// beyond the bound are aggregated as usual. Defaults to 16 if not set.
+	ImmediateFlushConcurrency int
+
+	// MaxConcurrentAppenders is the maximum number of downsampler appenders
+	// that can be in use at once across all writes, writes block until an
+	// appender is available once the limit is reached. Zero means unbounded.
+	MaxConcurrentAppenders int
+
+	// MaxStoragePolicyFanout is the maximum number of override storage
+	// policies a single write may fan out to. Zero means unbounded.
+	//
+	// Note that this only bounds the storage writes performed directly by the
+	// writer, the rollups produced by mapping rules are written by the
+	// downsampler when it flushes and are not subject to this limit.
+	MaxStoragePolicyFanout int
+
+	// TruncateStoragePolicyFanout determines whether writes that exceed the
+	// storage policy fanout limit are truncated to the first storage
+	// policies within the limit rather than rejected.
+	TruncateStoragePolicyFanout bool
+
+	// AnnotationSampling configures how often the annotations of writes are
+	// stored, by default every annotation is stored.
+	AnnotationSampling AnnotationSamplingOptions
+
+	// PartialFailure determines whether a write stops at the first of the
+	// downsampler and storage paths that fails or writes to both and
+	// reports which of them failed.
+	PartialFailure PartialFailureBehavior
+
+	// Fallback configures a namespace that receives storage writes which
+	// failed against their intended namespace, disabled by default.
+	Fallback FallbackOptions
+
+	// StorageWriteTimeout, if set, bounds each storage write attempt, the
+	// write is made with a context that expires after the timeout and fails
+	// with ErrStorageWriteTimeout if it has not completed by then. Note that
+	// this relies on the storage honoring the context of its writes, the
+	// M3DB session bounds its writes with its own write timeout instead.
+	StorageWriteTimeout time.Duration
+
+	// StorageRetry retries storage writes that fail with a retryable error
+	// with backoff before they are considered failed, disabled if not set.
+	StorageRetry retry.Options
+
+	// StorageRetryable determines whether a storage write error is
+	// retryable, defaults to IsRetryableStorageError.
+	StorageRetryable RetryableErrorFn
+
+	// StorageCircuitBreaker sheds storage writes with ErrStorageUnavailable
+	// while storage is failing, disabled by default.
+	StorageCircuitBreaker StorageCircuitBreakerOptions
+
+	// AppenderErrors determines how batch writes handle series that the
+	// downsampler appender fails to accept, by default the rest of the batch
+	// is not written to the downsampler.
+	AppenderErrors AppenderErrorBehavior
+
+	// CardinalityBudget configures an adaptive budget on the number of
+	// distinct series written, disabled by default.
+	CardinalityBudget CardinalityBudgetOptions
+
+	// SubResolution determines how the datapoints of writes that override
+	// their storage policies are combined when more than one falls within
+	// the same resolution window, by default they are written as is.
+	SubResolution SubResolutionBehavior
+
+	// TagFilter configures the tags stripped from series before any other
+	// tag processing.
+	TagFilter TagFilterOptions
+
+	// TagValidation configures the validation of the tags of series after
+	// all other tag processing, by default tags are not validated.
+	TagValidation TagValidationOptions
+
+	// ResourceAttributes configures how the resource attributes of writes
+	// made with WriteWithResourceAttributes are merged into their tags.
+	ResourceAttributes ResourceAttributesOptions
+
+	// SourceTagName, if set, is the name of a reserved tag that the source
+	// of each write, see NewContextWithSource and IterValue.Source, is
+	// stored in so that the series of each source can be told apart
+	// downstream. The tag is added before the computed tags and tag
+	// validation, any tag of a series with the same name is replaced. Writes
+	// without a source are written as is.
+	SourceTagName string
+
+	// ComputedTags are tags derived at ingest time from the tags or values
+	// of written series, applied in order after all other tag processing.
+	ComputedTags []ComputedTag
+
+	// Relabeler, if set, relabels series after the computed tags are added
+	// and before the tags are validated, series it drops are not written.
+	Relabeler *Relabeler
+
+	// SkipUnaggregated skips writing the datapoints of writes that do not
+	// override their storage policies to the unaggregated namespace, for
+	// deployments that only store the aggregated data produced by the
+	// downsampler. Datapoints routed elsewhere by ValueRoutes and dual tier
+	// writes, which request the unaggregated namespace explicitly, are still
+	// written.
+	SkipUnaggregated bool
+
+	// ValueRoutes route the datapoints of unaggregated writes whose values
+	// exceed a threshold to other namespaces, see ValueRoute for how this
+	// affects queries. Writes that override their storage policies are not
+	// routed.
+	ValueRoutes []ValueRoute
+
+	// TimestampTruncation configures truncating the timestamps of the
+	// datapoints of writes made with Write, disabled by default.
+	TimestampTruncation TimestampTruncationOptions
+
+	// MetricTypes configures how the metric type of the datapoints of batch
+	// writes is determined, by default series that do not set their metric
+	// type are written as gauges.
+	MetricTypes MetricTypeClassificationOptions
+
+	// WritePriorities configures scheduling the storage writes performed by
+	// the write workers by the priority of their write, see
+	// NewContextWithPriority. Disabled by default.
+	WritePriorities WritePrioritiesOptions
+
+	// PoolWriteQueries reuses the queries of storage writes rather than
+	// allocating one for every write to reduce garbage collection under
+	// high write rates. It must only be set if the storage does not retain
+	// a query once its Write returns, which holds for M3DB storage but not
+	// for storages that buffer writes. Disabled by default.
+	PoolWriteQueries bool
+
+	// DeduplicateBatches collapses series of a batch write that are exact
+	// duplicates of an earlier series of the same batch, such as series
+	// resent by retrying clients, into a single write of their combined
+	// datapoints. Deduplicating costs hashing the tags of every series and
+	// holding the whole batch in memory while it is written. Series in the
+	// WriteBatchResult of a deduplicated batch are identified by their index
+	// among the distinct series of the batch. Disabled by default.
+	DeduplicateBatches bool
+
+	// BatchTimeout configures a deadline for batch writes that scales with
+	// the number of series in the batch, batch writes only use the deadline
+	// of their context by default.
+	BatchTimeout BatchTimeoutOptions
+
+	// RejectedWriteLogging configures logging a sample of the series whose
+	// writes fail, disabled by default.
+	RejectedWriteLogging RejectedWriteLoggingOptions
+
+	// LateSampleGracePeriod is how late a sample can arrive and still be
+	// aggregated into the window of its timestamp, it should match the late
+	// sample grace period of the downsampler since the aggregator rejects
+	// samples for windows it no longer holds open. Zero disables it.
+	LateSampleGracePeriod time.Duration
+
+	// DefaultUnit is the unit, i.e. the timestamp precision, that the
+	// datapoints of writes which do not set one are stored with. Defaults to
+	// seconds.
+	DefaultUnit xtime.Unit
+}
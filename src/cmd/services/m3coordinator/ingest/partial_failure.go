@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"fmt"
+)
+
+// PartialFailureBehavior determines how a write is reported when one of the
+// downsampler and storage paths fails.
+type PartialFailureBehavior uint
+
+const (
+	// PartialFailureFail stops a write at the first path that fails and
+	// returns its error, if the downsampler fails the storage is not written.
+	PartialFailureFail PartialFailureBehavior = iota
+	// PartialFailureReport writes to both paths regardless of failures and
+	// returns a *PartialWriteError describing which of the paths failed.
+	PartialFailureReport
+)
+
+var (
+	validPartialFailureBehaviors = []PartialFailureBehavior{
+		PartialFailureFail,
+		PartialFailureReport,
+	}
+)
+
+func (b PartialFailureBehavior) String() string {
+	switch b {
+	case PartialFailureFail:
+		return "fail"
+	case PartialFailureReport:
+		return "report"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals a partial failure behavior.
+func (b *PartialFailureBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = PartialFailureFail
+		return nil
+	}
+
+	for _, valid := range validPartialFailureBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid PartialFailureBehavior '%s' valid types are: %v",
+		str, validPartialFailureBehaviors)
+}
+
+// PartialWriteError is returned by Write when partial failures are reported
+// and at least one of the downsampler and storage paths failed, a nil error
+// for a path means that the path was written successfully.
+type PartialWriteError struct {
+	// DownsamplerErr is the error writing to the downsampler, including any
+	// immediate flush of the aggregated data.
+	DownsamplerErr error
+	// StorageErr is the error writing to storage.
+	StorageErr error
+}
+
+// Partial returns true if only one of the paths failed, in which case the
+// data was written to the other path.
+func (e *PartialWriteError) Partial() bool {
+	return (e.DownsamplerErr == nil) != (e.StorageErr == nil)
+}
+
+func (e *PartialWriteError) Error() string {
+	switch {
+	case e.DownsamplerErr != nil && e.StorageErr != nil:
+		return fmt.Sprintf("downsampler and storage writes failed: downsampler: %v, storage: %v",
+			e.DownsamplerErr, e.StorageErr)
+	case e.DownsamplerErr != nil:
+		return fmt.Sprintf("downsampler write failed: %v", e.DownsamplerErr)
+	default:
+		return fmt.Sprintf("storage write failed: %v", e.StorageErr)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestDownsampleAndWritePartialFailures(t *testing.T) {
+	var (
+		downsamplerErr = errors.New("downsampler error")
+		storageErr     = errors.New("storage error")
+	)
+
+	testCases := []struct {
+		name            string
+		downsamplerFail bool
+		storageFail     bool
+	}{
+		{name: "success"},
+		{name: "downsampler failure", downsamplerFail: true},
+		{name: "storage failure", storageFail: true},
+		{name: "both failures", downsamplerFail: true, storageFail: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+				Options{PartialFailure: PartialFailureReport})
+
+			if tc.downsamplerFail {
+				downsampler.EXPECT().NewMetricsAppender().Return(nil, downsamplerErr)
+			} else {
+				expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+			}
+
+			if tc.storageFail {
+				session.EXPECT().WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(),
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(storageErr).
+					Times(len(testDatapoints1))
+			} else {
+				expectDefaultStorageWrites(session, testDatapoints1)
+			}
+
+			err := downAndWrite.Write(
+				context.Background(), testTags1, testDatapoints1, xtime.Second, defaultOverride)
+			if !tc.downsamplerFail && !tc.storageFail {
+				require.NoError(t, err)
+				return
+			}
+
+			partialErr, ok := err.(*PartialWriteError)
+			require.True(t, ok)
+			require.Equal(t, tc.downsamplerFail, partialErr.DownsamplerErr != nil)
+			require.Equal(t, tc.storageFail, partialErr.StorageErr != nil)
+			require.Equal(t, tc.downsamplerFail != tc.storageFail, partialErr.Partial())
+		})
+	}
+}
+
+func TestDownsampleAndWriteDownsamplerFailureSkipsStorage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No storage writes are expected since the write stops at the
+	// downsampler failure by default.
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl)
+	downsampler.EXPECT().NewMetricsAppender().Return(nil, errors.New("downsampler error"))
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, defaultOverride)
+	require.Error(t, err)
+	_, ok := err.(*PartialWriteError)
+	require.False(t, ok)
+}
+
+func TestPartialFailureBehaviorUnmarshalYAML(t *testing.T) {
+	for _, behavior := range validPartialFailureBehaviors {
+		var cfg Configuration
+		str := "partialFailure: " + behavior.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, behavior, cfg.PartialFailure)
+	}
+
+	var cfg Configuration
+	require.Error(t, yaml.Unmarshal([]byte("partialFailure: bad\n"), &cfg))
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// promTimeSeriesIter is a DownsampleAndWriteIter over Prometheus time series.
+type promTimeSeriesIter struct {
+	idx        int
+	timeseries []*prompb.TimeSeries
+	tagOpts    models.TagOptions
+
+	// values are the converted time series, each time series is converted
+	// the first time it is the current value so that time series are only
+	// converted once even if the iterator is reset.
+	values    []IterValue
+	converted []bool
+}
+
+// NewPromTimeSeriesIter returns an iterator over Prometheus time series that
+// can be written with WriteBatch, the labels and samples of each time series
+// are converted to tags and datapoints with millisecond precision as it is
+// iterated over.
+func NewPromTimeSeriesIter(
+	timeseries []*prompb.TimeSeries,
+	tagOpts models.TagOptions,
+) DownsampleAndWriteIter {
+	return &promTimeSeriesIter{
+		idx:        -1,
+		timeseries: timeseries,
+		tagOpts:    tagOpts,
+		values:     make([]IterValue, len(timeseries)),
+		converted:  make([]bool, len(timeseries)),
+	}
+}
+
+func (i *promTimeSeriesIter) Next() bool {
+	i.idx++
+	return i.idx < len(i.timeseries)
+}
+
+func (i *promTimeSeriesIter) Current() IterValue {
+	if i.idx < 0 || i.idx >= len(i.timeseries) {
+		return IterValue{Tags: models.EmptyTags()}
+	}
+
+	if !i.converted[i.idx] {
+		promTS := i.timeseries[i.idx]
+		i.values[i.idx] = IterValue{
+			Tags:       storage.PromLabelsToM3Tags(promTS.Labels, i.tagOpts),
+			Datapoints: storage.PromSamplesToM3Datapoints(promTS.Samples),
+			Unit:       xtime.Millisecond,
+		}
+		i.converted[i.idx] = true
+	}
+	return i.values[i.idx]
+}
+
+func (i *promTimeSeriesIter) Reset() error {
+	i.idx = -1
+	return nil
+}
+
+func (i *promTimeSeriesIter) Error() error {
+	return nil
+}
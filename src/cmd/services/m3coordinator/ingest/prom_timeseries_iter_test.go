@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/generated/proto/prompb"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPromTimeSeries = []*prompb.TimeSeries{
+	{
+		Labels: []*prompb.Label{
+			{Name: []byte("__name__"), Value: []byte("first")},
+			{Name: []byte("foo"), Value: []byte("bar")},
+		},
+		Samples: []*prompb.Sample{
+			{Timestamp: 1000, Value: 1},
+			{Timestamp: 2000, Value: 2},
+		},
+	},
+	{
+		Labels: []*prompb.Label{
+			{Name: []byte("__name__"), Value: []byte("second")},
+		},
+		Samples: []*prompb.Sample{
+			{Timestamp: 3000, Value: 3},
+		},
+	},
+}
+
+func TestPromTimeSeriesIter(t *testing.T) {
+	iter := NewPromTimeSeriesIter(testPromTimeSeries, models.NewTagOptions())
+
+	require.True(t, iter.Next())
+	value := iter.Current()
+	name, ok := value.Tags.Name()
+	require.True(t, ok)
+	require.Equal(t, "first", string(name))
+	foo, ok := value.Tags.Get([]byte("foo"))
+	require.True(t, ok)
+	require.Equal(t, "bar", string(foo))
+	require.Equal(t, ts.Datapoints{
+		{Timestamp: time.Unix(1, 0), Value: 1},
+		{Timestamp: time.Unix(2, 0), Value: 2},
+	}, value.Datapoints)
+	require.Equal(t, xtime.Millisecond, value.Unit)
+
+	require.True(t, iter.Next())
+	name, ok = iter.Current().Tags.Name()
+	require.True(t, ok)
+	require.Equal(t, "second", string(name))
+
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Error())
+}
+
+func TestPromTimeSeriesIterReset(t *testing.T) {
+	iter := NewPromTimeSeriesIter(testPromTimeSeries, models.NewTagOptions())
+	for iter.Next() {
+	}
+	require.NoError(t, iter.Error())
+
+	require.NoError(t, iter.Reset())
+	require.True(t, iter.Next())
+	name, ok := iter.Current().Tags.Name()
+	require.True(t, ok)
+	require.Equal(t, "first", string(name))
+	require.NoError(t, iter.Error())
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"sync/atomic"
+
+	"github.com/m3db/m3/src/query/models"
+)
+
+// RejectedWriteLoggingOptions configures logging the series whose writes
+// fail, either because they were rejected by the tag processing and
+// validation of the write path or by storage. Series are logged at warn
+// level to the logger of the instrument options.
+type RejectedWriteLoggingOptions struct {
+	// SampleRate is the fraction of failed writes that are logged so that
+	// sustained bad input does not flood the logs, between zero and one.
+	// Failed writes are not logged if not set.
+	SampleRate float64
+}
+
+// rejectedWriteSampler samples the failed writes to log, it is
+// deterministic so that exactly the sample rate of failed writes is logged.
+type rejectedWriteSampler struct {
+	sampleRate float64
+	rejected   uint64
+}
+
+func (s *rejectedWriteSampler) sample() bool {
+	if s.sampleRate <= 0 {
+		return false
+	}
+	if s.sampleRate >= 1 {
+		return true
+	}
+
+	// Log whenever the number of failed writes times the sample rate
+	// crosses an integer, i.e. every 1/rate failed writes.
+	n := atomic.AddUint64(&s.rejected, 1)
+	return uint64(float64(n)*s.sampleRate) > uint64(float64(n-1)*s.sampleRate)
+}
+
+// logRejectedWrite logs a failed write of a series if it is sampled.
+func (d *downsamplerAndWriter) logRejectedWrite(tags models.Tags, err error) {
+	if !d.rejectedWrites.sample() {
+		return
+	}
+	d.logger.Warnf("rejected write: id=%s, err=%v", tags.ID(), err)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/m3db/m3x/instrument"
+	xlog "github.com/m3db/m3x/log"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectedWriteSampler(t *testing.T) {
+	for _, test := range []struct {
+		sampleRate float64
+		sampled    int
+	}{
+		{sampleRate: 0, sampled: 0},
+		{sampleRate: 0.1, sampled: 10},
+		{sampleRate: 0.25, sampled: 25},
+		{sampleRate: 1, sampled: 100},
+	} {
+		s := rejectedWriteSampler{sampleRate: test.sampleRate}
+		sampled := 0
+		for i := 0; i < 100; i++ {
+			if s.sample() {
+				sampled++
+			}
+		}
+		require.Equal(t, test.sampled, sampled, "sample rate %v", test.sampleRate)
+	}
+}
+
+func TestDownsampleAndWriteLogsRejectedWrites(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var buf bytes.Buffer
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetLogger(xlog.NewLogger(&buf)),
+		RejectedWriteLogging: RejectedWriteLoggingOptions{
+			SampleRate: 0.25,
+		},
+	})
+
+	// Series with duplicate tags are rejected by default.
+	for i := 0; i < 20; i++ {
+		err := downAndWrite.Write(context.Background(), testDuplicateTags,
+			testDatapoints1, xtime.Second, WriteOptions{})
+		require.Error(t, err)
+	}
+
+	logged := strings.Count(buf.String(), "rejected write")
+	require.Equal(t, 5, logged)
+	require.Contains(t, buf.String(), string(testDuplicateTags.ID()))
+}
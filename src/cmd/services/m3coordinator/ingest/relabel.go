@@ -0,0 +1,328 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/m3db/m3/src/query/models"
+)
+
+// RelabelAction is the action of a relabel rule, the actions and their
+// semantics are the same as those of Prometheus relabel_configs.
+type RelabelAction string
+
+const (
+	// RelabelReplace sets the target label to the replacement, expanded
+	// with the capture groups of the regex, if the regex matches the
+	// concatenated source label values. The target label is removed if the
+	// expanded replacement is empty.
+	RelabelReplace RelabelAction = "replace"
+	// RelabelKeep drops series whose concatenated source label values do
+	// not match the regex.
+	RelabelKeep RelabelAction = "keep"
+	// RelabelDrop drops series whose concatenated source label values match
+	// the regex.
+	RelabelDrop RelabelAction = "drop"
+	// RelabelHashMod sets the target label to the modulus of a hash of the
+	// concatenated source label values.
+	RelabelHashMod RelabelAction = "hashmod"
+	// RelabelLabelMap copies the values of the labels whose names match the
+	// regex to labels named by the replacement, expanded with the capture
+	// groups of the regex.
+	RelabelLabelMap RelabelAction = "labelmap"
+	// RelabelLabelDrop removes the labels whose names match the regex.
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	// RelabelLabelKeep removes the labels whose names do not match the
+	// regex.
+	RelabelLabelKeep RelabelAction = "labelkeep"
+)
+
+var (
+	validRelabelActions = []RelabelAction{
+		RelabelReplace,
+		RelabelKeep,
+		RelabelDrop,
+		RelabelHashMod,
+		RelabelLabelMap,
+		RelabelLabelDrop,
+		RelabelLabelKeep,
+	}
+
+	relabelLabelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+	errRelabelDropped = errors.New("series dropped by relabeling")
+)
+
+// RelabelRule is a rule of a Relabeler. Unlike Prometheus relabel_configs
+// the fields have no defaults, RelabelConfiguration applies the defaults of
+// Prometheus when read from configuration.
+type RelabelRule struct {
+	// SourceLabels are the labels whose values, joined with Separator, the
+	// regex is matched against.
+	SourceLabels []string
+
+	// Separator joins the values of the source labels.
+	Separator string
+
+	// Regex is the regular expression matched against the joined source
+	// label values, or against label names for the label actions. It is
+	// anchored at both ends.
+	Regex string
+
+	// Modulus is the modulus of the hash of the hashmod action.
+	Modulus uint64
+
+	// TargetLabel is the label set by the replace and hashmod actions.
+	TargetLabel string
+
+	// Replacement is the value of the target label of the replace action
+	// and the label name of the labelmap action, $1 style references are
+	// expanded with the capture groups of the regex.
+	Replacement string
+
+	// Action is the action of the rule.
+	Action RelabelAction
+}
+
+// Validate validates the relabel rule.
+func (r RelabelRule) Validate() error {
+	_, err := newRelabelRule(r)
+	return err
+}
+
+type relabelRule struct {
+	RelabelRule
+	regex *regexp.Regexp
+}
+
+func newRelabelRule(r RelabelRule) (relabelRule, error) {
+	valid := false
+	for _, action := range validRelabelActions {
+		if r.Action == action {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return relabelRule{}, fmt.Errorf("invalid relabel action '%s' valid actions are: %v",
+			r.Action, validRelabelActions)
+	}
+
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return relabelRule{}, fmt.Errorf("invalid relabel regex '%s': %v", r.Regex, err)
+	}
+
+	switch r.Action {
+	case RelabelReplace, RelabelHashMod:
+		if r.TargetLabel == "" {
+			return relabelRule{}, fmt.Errorf("relabel action %s requires a target label",
+				r.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return relabelRule{}, fmt.Errorf("relabel action %s requires source labels",
+				r.Action)
+		}
+	}
+	if r.Action == RelabelHashMod && r.Modulus == 0 {
+		return relabelRule{}, errors.New("relabel action hashmod requires a modulus")
+	}
+
+	return relabelRule{RelabelRule: r, regex: regex}, nil
+}
+
+// Relabeler transforms the tags of series with a list of relabel rules
+// applied in order, as Prometheus relabel_configs do for scraped series.
+// A nil Relabeler leaves series untouched.
+type Relabeler struct {
+	rules []relabelRule
+}
+
+// NewRelabeler creates a relabeler from its rules.
+func NewRelabeler(rules []RelabelRule) (*Relabeler, error) {
+	r := &Relabeler{rules: make([]relabelRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := newRelabelRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %v", i, err)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Relabel returns the tags of the series with the rules applied, or false if
+// the series is dropped by a keep or drop rule or left without tags. The
+// tags of the caller are never modified.
+func (r *Relabeler) Relabel(tags models.Tags) (models.Tags, bool) {
+	if r == nil || len(r.rules) == 0 {
+		return tags, true
+	}
+
+	b := relabelBuilder{tags: tags}
+	for _, rule := range r.rules {
+		if !rule.apply(&b) {
+			return models.Tags{}, false
+		}
+	}
+	if len(b.tags.Tags) == 0 {
+		return models.Tags{}, false
+	}
+	if !b.copied {
+		return tags, true
+	}
+	if b.tags.Opts != nil && b.tags.Opts.IDSchemeType() == models.TypeGraphite {
+		// Graphite IDs are built from the tags in order so keep the
+		// relabeled tags at the end.
+		return b.tags, true
+	}
+	return b.tags.Normalize(), true
+}
+
+func (r relabelRule) apply(b *relabelBuilder) bool {
+	switch r.Action {
+	case RelabelKeep:
+		return r.regex.MatchString(r.sourceValue(b))
+	case RelabelDrop:
+		return !r.regex.MatchString(r.sourceValue(b))
+	case RelabelReplace:
+		value := r.sourceValue(b)
+		indexes := r.regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, value, indexes))
+		if !relabelLabelNameRegexp.MatchString(target) {
+			return true
+		}
+		replacement := r.regex.ExpandString(nil, r.Replacement, value, indexes)
+		if len(replacement) == 0 {
+			b.remove(func(name string) bool { return name == target })
+			return true
+		}
+		b.set(target, replacement)
+	case RelabelHashMod:
+		// Same hash as Prometheus so that series are sharded the same way.
+		sum := md5.Sum([]byte(r.sourceValue(b)))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.Modulus
+		b.set(r.TargetLabel, strconv.AppendUint(nil, mod, 10))
+	case RelabelLabelMap:
+		original := append([]models.Tag(nil), b.tags.Tags...)
+		for _, tag := range original {
+			name := string(tag.Name)
+			if r.regex.MatchString(name) {
+				b.set(r.regex.ReplaceAllString(name, r.Replacement), tag.Value)
+			}
+		}
+	case RelabelLabelDrop:
+		b.remove(r.regex.MatchString)
+	case RelabelLabelKeep:
+		b.remove(func(name string) bool { return !r.regex.MatchString(name) })
+	}
+	return true
+}
+
+// sourceValue returns the values of the source labels joined with the
+// separator, missing labels have an empty value.
+func (r relabelRule) sourceValue(b *relabelBuilder) string {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, name := range r.SourceLabels {
+		values = append(values, string(b.get(name)))
+	}
+	return strings.Join(values, r.Separator)
+}
+
+// relabelBuilder applies changes to tags, copying them on the first change
+// so that the tags of the caller are never modified.
+type relabelBuilder struct {
+	tags   models.Tags
+	copied bool
+}
+
+func (b *relabelBuilder) get(name string) []byte {
+	for _, tag := range b.tags.Tags {
+		if string(tag.Name) == name {
+			return tag.Value
+		}
+	}
+	return nil
+}
+
+func (b *relabelBuilder) copyOnWrite() {
+	if b.copied {
+		return
+	}
+	tags := make([]models.Tag, len(b.tags.Tags), len(b.tags.Tags)+1)
+	copy(tags, b.tags.Tags)
+	b.tags = models.Tags{Opts: b.tags.Opts, Tags: tags}
+	b.copied = true
+}
+
+func (b *relabelBuilder) set(name string, value []byte) {
+	b.copyOnWrite()
+	for i, tag := range b.tags.Tags {
+		if string(tag.Name) == name {
+			b.tags.Tags[i].Value = value
+			return
+		}
+	}
+	b.tags.Tags = append(b.tags.Tags, models.Tag{Name: []byte(name), Value: value})
+}
+
+func (b *relabelBuilder) remove(fn func(name string) bool) {
+	removed := false
+	for _, tag := range b.tags.Tags {
+		if fn(string(tag.Name)) {
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return
+	}
+
+	b.copyOnWrite()
+	kept := b.tags.Tags[:0]
+	for _, tag := range b.tags.Tags {
+		if !fn(string(tag.Name)) {
+			kept = append(kept, tag)
+		}
+	}
+	b.tags.Tags = kept
+}
+
+// relabel applies the relabeler to the tags of a series, recording series
+// that are dropped if record is set.
+func (d *downsamplerAndWriter) relabel(tags models.Tags, record bool) (models.Tags, bool) {
+	tags, ok := d.opts.Relabeler.Relabel(tags)
+	if !ok && record {
+		d.metrics.relabelDropped.Inc(1)
+	}
+	return tags, ok
+}
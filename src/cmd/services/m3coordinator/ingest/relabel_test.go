@@ -0,0 +1,403 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testRelabelTags = models.Tags{
+	Opts: models.NewTagOptions(),
+	Tags: []models.Tag{
+		{Name: []byte("__meta_pod"), Value: []byte("web-1")},
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("env"), Value: []byte("prod")},
+		{Name: []byte("host"), Value: []byte("a")},
+	},
+}
+
+func TestRelabelRuleValidate(t *testing.T) {
+	require.NoError(t, RelabelRule{
+		SourceLabels: []string{"host"},
+		Regex:        "(.*)",
+		TargetLabel:  "instance",
+		Replacement:  "$1",
+		Action:       RelabelReplace,
+	}.Validate())
+	require.NoError(t, RelabelRule{Regex: "tmp_.*", Action: RelabelLabelDrop}.Validate())
+
+	require.Error(t, RelabelRule{Regex: "(.*)"}.Validate())
+	require.Error(t, RelabelRule{Regex: "(", Action: RelabelLabelDrop}.Validate())
+	require.Error(t, RelabelRule{Regex: "(.*)", Action: RelabelReplace}.Validate())
+	require.Error(t, RelabelRule{Regex: "(.*)", Action: RelabelDrop}.Validate())
+	require.Error(t, RelabelRule{
+		SourceLabels: []string{"host"},
+		TargetLabel:  "shard",
+		Action:       RelabelHashMod,
+	}.Validate())
+
+	_, err := NewRelabeler([]RelabelRule{{Action: "rename"}})
+	require.Error(t, err)
+}
+
+func TestRelabeler(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     RelabelRule
+		expected []models.Tag
+		dropped  bool
+	}{
+		{
+			name: "replace",
+			rule: RelabelRule{
+				SourceLabels: []string{"env", "host"},
+				Separator:    ";",
+				Regex:        "(.*);(.*)",
+				TargetLabel:  "instance",
+				Replacement:  "$2.$1",
+				Action:       RelabelReplace,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__meta_pod"), Value: []byte("web-1")},
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("env"), Value: []byte("prod")},
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("instance"), Value: []byte("a.prod")},
+			},
+		},
+		{
+			name: "replace with empty value removes the target",
+			rule: RelabelRule{
+				SourceLabels: []string{"missing"},
+				Regex:        "(.*)",
+				TargetLabel:  "env",
+				Replacement:  "$1",
+				Action:       RelabelReplace,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__meta_pod"), Value: []byte("web-1")},
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("host"), Value: []byte("a")},
+			},
+		},
+		{
+			name: "replace without match",
+			rule: RelabelRule{
+				SourceLabels: []string{"env"},
+				Regex:        "dev",
+				TargetLabel:  "env",
+				Replacement:  "development",
+				Action:       RelabelReplace,
+			},
+			expected: testRelabelTags.Tags,
+		},
+		{
+			name: "keep with match",
+			rule: RelabelRule{
+				SourceLabels: []string{"env"},
+				Regex:        "prod|staging",
+				Action:       RelabelKeep,
+			},
+			expected: testRelabelTags.Tags,
+		},
+		{
+			name: "keep without match",
+			rule: RelabelRule{
+				SourceLabels: []string{"env"},
+				Regex:        "dev",
+				Action:       RelabelKeep,
+			},
+			dropped: true,
+		},
+		{
+			name: "drop with match",
+			rule: RelabelRule{
+				SourceLabels: []string{"__name__"},
+				Regex:        "req.*",
+				Action:       RelabelDrop,
+			},
+			dropped: true,
+		},
+		{
+			// The regex is anchored so a partial match does not drop.
+			name: "drop without match",
+			rule: RelabelRule{
+				SourceLabels: []string{"__name__"},
+				Regex:        "req",
+				Action:       RelabelDrop,
+			},
+			expected: testRelabelTags.Tags,
+		},
+		{
+			name: "hashmod",
+			rule: RelabelRule{
+				SourceLabels: []string{"host"},
+				Modulus:      8,
+				TargetLabel:  "shard",
+				Action:       RelabelHashMod,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__meta_pod"), Value: []byte("web-1")},
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("env"), Value: []byte("prod")},
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("shard"), Value: []byte("1")},
+			},
+		},
+		{
+			name: "labelmap",
+			rule: RelabelRule{
+				Regex:       "__meta_(.+)",
+				Replacement: "$1",
+				Action:      RelabelLabelMap,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__meta_pod"), Value: []byte("web-1")},
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("env"), Value: []byte("prod")},
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("pod"), Value: []byte("web-1")},
+			},
+		},
+		{
+			name: "labeldrop",
+			rule: RelabelRule{
+				Regex:  "__meta_.+|host",
+				Action: RelabelLabelDrop,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("env"), Value: []byte("prod")},
+			},
+		},
+		{
+			name: "labelkeep",
+			rule: RelabelRule{
+				Regex:  "__name__|env",
+				Action: RelabelLabelKeep,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("env"), Value: []byte("prod")},
+			},
+		},
+		{
+			name: "labelkeep of no labels",
+			rule: RelabelRule{
+				Regex:  "other",
+				Action: RelabelLabelKeep,
+			},
+			dropped: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			relabeler, err := NewRelabeler([]RelabelRule{tc.rule})
+			require.NoError(t, err)
+
+			original := testRelabelTags.Clone()
+			relabeled, ok := relabeler.Relabel(testRelabelTags)
+			require.Equal(t, !tc.dropped, ok)
+			if !tc.dropped {
+				require.Equal(t, tc.expected, relabeled.Tags)
+			}
+			require.Equal(t, original.Tags, testRelabelTags.Tags)
+		})
+	}
+}
+
+func TestRelabelerRulesInOrder(t *testing.T) {
+	relabeler, err := NewRelabeler([]RelabelRule{
+		{
+			Regex:       "__meta_(.+)",
+			Replacement: "$1",
+			Action:      RelabelLabelMap,
+		},
+		{
+			Regex:  "__meta_.+",
+			Action: RelabelLabelDrop,
+		},
+		{
+			SourceLabels: []string{"pod"},
+			Regex:        "web-.*",
+			Action:       RelabelKeep,
+		},
+	})
+	require.NoError(t, err)
+
+	relabeled, ok := relabeler.Relabel(testRelabelTags)
+	require.True(t, ok)
+	require.Equal(t, []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("env"), Value: []byte("prod")},
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("pod"), Value: []byte("web-1")},
+	}, relabeled.Tags)
+
+	var nilRelabeler *Relabeler
+	relabeled, ok = nilRelabeler.Relabel(testRelabelTags)
+	require.True(t, ok)
+	require.Equal(t, testRelabelTags, relabeled)
+}
+
+func TestDownsampleAndWriteRelabel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	relabeler, err := NewRelabeler([]RelabelRule{{
+		Regex:  "__meta_.+|host",
+		Action: RelabelLabelDrop,
+	}})
+	require.NoError(t, err)
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		Relabeler: relabeler,
+	})
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().Reset()
+	mockMetricsAppender.EXPECT().AddTags([]models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("env"), Value: []byte("prod")},
+	})
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testRelabelTags, datapoints: testDatapoints1},
+	})
+	err = downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteRelabelDrop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	relabeler, err := NewRelabeler([]RelabelRule{{
+		SourceLabels: []string{"env"},
+		Regex:        "prod",
+		Action:       RelabelDrop,
+	}})
+	require.NoError(t, err)
+
+	// No expectations are set on the session or the appender other than the
+	// batch creating and finalizing it, so any write fails the test.
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		Relabeler:         relabeler,
+	})
+	mockMetricsAppender := downsample.NewMockMetricsAppender(ctrl)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	err = downAndWrite.Write(context.Background(), testRelabelTags, testDatapoints1,
+		0, WriteOptions{})
+	require.NoError(t, err)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testRelabelTags, datapoints: testDatapoints1},
+	})
+	err = downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["relabel.dropped+"].Value())
+
+	result, err := downAndWrite.ValidateWrite(context.Background(), testRelabelTags,
+		testDatapoints1, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, WriteValidation{Dropped: true}, result)
+
+	ok, reason := downAndWrite.WouldAccept(context.Background(), testRelabelTags, testDatapoints1)
+	require.False(t, ok)
+	require.Equal(t, errRelabelDropped.Error(), reason)
+}
+
+func TestRelabelConfiguration(t *testing.T) {
+	var cfg Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(`
+relabelConfigs:
+  - source_labels: [host]
+    target_label: instance
+  - source_labels: [env]
+    regex: dev
+    action: drop
+  - regex: __meta_.+
+    replacement: ""
+    action: labeldrop
+`), &cfg))
+
+	rules := make([]RelabelRule, 0, len(cfg.RelabelConfigs))
+	for _, relabelCfg := range cfg.RelabelConfigs {
+		rules = append(rules, relabelCfg.NewRelabelRule())
+	}
+	require.Equal(t, []RelabelRule{
+		{
+			SourceLabels: []string{"host"},
+			Separator:    ";",
+			Regex:        "(.*)",
+			TargetLabel:  "instance",
+			Replacement:  "$1",
+			Action:       RelabelReplace,
+		},
+		{
+			SourceLabels: []string{"env"},
+			Separator:    ";",
+			Regex:        "dev",
+			Replacement:  "$1",
+			Action:       RelabelDrop,
+		},
+		{
+			Separator:   ";",
+			Regex:       "__meta_.+",
+			Replacement: "",
+			Action:      RelabelLabelDrop,
+		},
+	}, rules)
+
+	opts, err := cfg.NewOptions(instrument.NewOptions())
+	require.NoError(t, err)
+	require.NotNil(t, opts.Relabeler)
+
+	cfg.RelabelConfigs = []RelabelConfiguration{{Action: RelabelHashMod}}
+	_, err = cfg.NewOptions(instrument.NewOptions())
+	require.Error(t, err)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// ResourceAttributeCollisionBehavior determines how a resource attribute is
+// handled when the series already has a tag of the same name.
+type ResourceAttributeCollisionBehavior uint
+
+const (
+	// ResourceAttributeCollisionKeepMetric keeps the tag of the series and
+	// discards the resource attribute.
+	ResourceAttributeCollisionKeepMetric ResourceAttributeCollisionBehavior = iota
+	// ResourceAttributeCollisionKeepResource replaces the tag of the series
+	// with the resource attribute.
+	ResourceAttributeCollisionKeepResource
+	// ResourceAttributeCollisionError rejects the write.
+	ResourceAttributeCollisionError
+)
+
+var validResourceAttributeCollisionBehaviors = []ResourceAttributeCollisionBehavior{
+	ResourceAttributeCollisionKeepMetric,
+	ResourceAttributeCollisionKeepResource,
+	ResourceAttributeCollisionError,
+}
+
+func (b ResourceAttributeCollisionBehavior) String() string {
+	switch b {
+	case ResourceAttributeCollisionKeepMetric:
+		return "keep_metric"
+	case ResourceAttributeCollisionKeepResource:
+		return "keep_resource"
+	case ResourceAttributeCollisionError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals a resource attribute collision behavior.
+func (b *ResourceAttributeCollisionBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = ResourceAttributeCollisionKeepMetric
+		return nil
+	}
+
+	for _, valid := range validResourceAttributeCollisionBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid ResourceAttributeCollisionBehavior '%s' valid types are: %v",
+		str, validResourceAttributeCollisionBehaviors)
+}
+
+// ResourceAttributesOptions configures how the resource attributes of
+// OpenTelemetry metrics are merged into the tags of their series.
+type ResourceAttributesOptions struct {
+	// Prefix is prepended to the name of every resource attribute, for
+	// instance "resource_" to write service.name as resource_service.name.
+	Prefix string
+
+	// Collisions determines how resource attributes whose prefixed name
+	// matches a tag of the series are handled, by default the tag of the
+	// series is kept.
+	Collisions ResourceAttributeCollisionBehavior
+}
+
+func (d *downsamplerAndWriter) WriteWithResourceAttributes(
+	ctx context.Context,
+	resource []models.Tag,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) error {
+	tags, err := mergeResourceAttributes(tags, resource, d.opts.ResourceAttributes)
+	if err != nil {
+		return err
+	}
+
+	return d.Write(ctx, tags, datapoints, unit, overrides)
+}
+
+// mergeResourceAttributes returns the tags with the resource attributes
+// added as prefixed tags. A new tags slice is allocated so that the
+// caller's slice is never mutated.
+func mergeResourceAttributes(
+	tags models.Tags,
+	resource []models.Tag,
+	opts ResourceAttributesOptions,
+) (models.Tags, error) {
+	if len(resource) == 0 {
+		return tags, nil
+	}
+
+	merged := models.Tags{
+		Opts: tags.Opts,
+		Tags: make([]models.Tag, len(tags.Tags), len(tags.Tags)+len(resource)),
+	}
+	copy(merged.Tags, tags.Tags)
+
+	for _, attr := range resource {
+		name := attr.Name
+		if opts.Prefix != "" {
+			name = make([]byte, 0, len(opts.Prefix)+len(attr.Name))
+			name = append(name, opts.Prefix...)
+			name = append(name, attr.Name...)
+		}
+
+		idx := -1
+		for i, tag := range merged.Tags {
+			if bytes.Equal(tag.Name, name) {
+				idx = i
+				break
+			}
+		}
+
+		if idx < 0 {
+			merged.Tags = append(merged.Tags, models.Tag{Name: name, Value: attr.Value})
+			continue
+		}
+
+		switch opts.Collisions {
+		case ResourceAttributeCollisionKeepMetric:
+			// Nothing to do, the tag of the series is already present.
+		case ResourceAttributeCollisionKeepResource:
+			merged.Tags[idx].Value = attr.Value
+		case ResourceAttributeCollisionError:
+			return tags, fmt.Errorf(
+				"resource attribute collides with series tag: %s", string(name))
+		default:
+			return tags, fmt.Errorf(
+				"unknown resource attribute collision behavior: %d", opts.Collisions)
+		}
+	}
+
+	if merged.Opts != nil && merged.Opts.IDSchemeType() == models.TypeGraphite {
+		return merged, nil
+	}
+	return merged.Normalize(), nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/models"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testResourceAttributes = []models.Tag{
+	{Name: []byte("service.name"), Value: []byte("checkout")},
+	{Name: []byte("host"), Value: []byte("resource-host")},
+}
+
+func TestMergeResourceAttributes(t *testing.T) {
+	tags := models.NewTags(2, nil).AddTags([]models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("metric-host")},
+	})
+
+	tests := []struct {
+		name     string
+		opts     ResourceAttributesOptions
+		expected []models.Tag
+	}{
+		{
+			name: "keep metric",
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("host"), Value: []byte("metric-host")},
+				{Name: []byte("service.name"), Value: []byte("checkout")},
+			},
+		},
+		{
+			name: "keep resource",
+			opts: ResourceAttributesOptions{
+				Collisions: ResourceAttributeCollisionKeepResource,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("host"), Value: []byte("resource-host")},
+				{Name: []byte("service.name"), Value: []byte("checkout")},
+			},
+		},
+		{
+			name: "prefix",
+			opts: ResourceAttributesOptions{
+				Prefix:     "resource_",
+				Collisions: ResourceAttributeCollisionError,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("host"), Value: []byte("metric-host")},
+				{Name: []byte("resource_host"), Value: []byte("resource-host")},
+				{Name: []byte("resource_service.name"), Value: []byte("checkout")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, err := mergeResourceAttributes(tags, testResourceAttributes, test.opts)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, merged.Tags)
+		})
+	}
+
+	// The merged tags are never modified.
+	require.Equal(t, []byte("metric-host"), tags.Tags[1].Value)
+
+	_, err := mergeResourceAttributes(tags, testResourceAttributes, ResourceAttributesOptions{
+		Collisions: ResourceAttributeCollisionError,
+	})
+	require.EqualError(t, err, "resource attribute collides with series tag: host")
+}
+
+func TestDownsampleAndWriteWithResourceAttributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		ResourceAttributes: ResourceAttributesOptions{Prefix: "resource_"},
+	})
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	for _, tag := range testTags1.Tags {
+		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
+	}
+	mockMetricsAppender.EXPECT().AddTag([]byte("resource_host"), []byte("resource-host"))
+	mockMetricsAppender.EXPECT().AddTag([]byte("resource_service.name"), []byte("checkout"))
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	err := downAndWrite.WriteWithResourceAttributes(context.Background(),
+		testResourceAttributes, testTags1, testDatapoints1, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+}
+
+func TestResourceAttributeCollisionBehaviorUnmarshalYAML(t *testing.T) {
+	for _, behavior := range validResourceAttributeCollisionBehaviors {
+		var cfg ResourceAttributesConfiguration
+		str := "collisions: " + behavior.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, behavior, cfg.Collisions)
+	}
+
+	var cfg ResourceAttributesConfiguration
+	require.Error(t, yaml.Unmarshal([]byte("collisions: bad\n"), &cfg))
+}
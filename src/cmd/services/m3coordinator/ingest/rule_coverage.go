@@ -0,0 +1,73 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+
+	"github.com/uber-go/tally"
+)
+
+// ruleCoverage accumulates how many of the series of a batch matched the
+// downsampler rules. The matcher does not report which rules matched so
+// series are counted by the kind of rules they matched.
+type ruleCoverage struct {
+	mapping int64
+	rollup  int64
+	none    int64
+}
+
+func (c *ruleCoverage) record(result downsample.SamplesAppenderResult) {
+	if result.MappingRulesMatched {
+		c.mapping++
+	}
+	if result.NumRollups > 0 {
+		c.rollup++
+	}
+	if !result.MappingRulesMatched && result.NumRollups == 0 {
+		c.none++
+	}
+}
+
+type ruleCoverageMetrics struct {
+	mapping tally.Counter
+	rollup  tally.Counter
+	none    tally.Counter
+}
+
+func newRuleCoverageMetrics(scope tally.Scope) ruleCoverageMetrics {
+	counter := func(match string) tally.Counter {
+		return scope.Tagged(map[string]string{"match": match}).Counter("batch.rule-coverage")
+	}
+	return ruleCoverageMetrics{
+		mapping: counter("mapping"),
+		rollup:  counter("rollup"),
+		none:    counter("none"),
+	}
+}
+
+// report emits the coverage of a batch, done once per batch rather than per
+// series to keep accumulation cheap.
+func (m ruleCoverageMetrics) report(c *ruleCoverage) {
+	m.mapping.Inc(c.mapping)
+	m.rollup.Inc(c.rollup)
+	m.none.Inc(c.none)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestDownsampleAndWriteBatchRuleCoverage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+	})
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockSamplesAppender.EXPECT().AppendGaugeSample(gomock.Any()).AnyTimes()
+	mockSamplesAppender.EXPECT().AppendGaugeSamples(gomock.Any()).AnyTimes()
+	mockMetricsAppender.EXPECT().Reset().AnyTimes()
+	mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+	gomock.InOrder(
+		mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+			Return(downsample.SamplesAppenderResult{
+				SamplesAppender:     mockSamplesAppender,
+				MappingRulesMatched: true,
+				NumRollups:          2,
+			}, nil),
+		mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+			Return(downsample.SamplesAppenderResult{
+				SamplesAppender: mockSamplesAppender,
+			}, nil),
+	)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	err := downAndWrite.WriteBatch(context.Background(), newTestIter(testEntries), nil)
+	require.NoError(t, err)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["batch.rule-coverage+match=mapping"].Value())
+	require.Equal(t, int64(1), counters["batch.rule-coverage+match=rollup"].Value())
+	require.Equal(t, int64(1), counters["batch.rule-coverage+match=none"].Value())
+}
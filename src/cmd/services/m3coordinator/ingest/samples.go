@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+var (
+	errSamplesSequences = errors.New(
+		"sequences are not supported when writing samples of several metric types")
+)
+
+// MetricSamples are the datapoints of a series of a single metric type.
+type MetricSamples struct {
+	// Type is the metric type the datapoints are aggregated as by the
+	// downsampler, if unknown the metric type of the overrides of the write
+	// is used.
+	Type       MetricType
+	Datapoints ts.Datapoints
+}
+
+// samplesDatapoints flattens the samples into the datapoints of a write
+// along with the metric type of each datapoint.
+func (d *downsamplerAndWriter) samplesDatapoints(
+	samples []MetricSamples,
+	overrides WriteOptions,
+) (ts.Datapoints, []MetricType, error) {
+	var (
+		defaultType   = writeMetricType(overrides)
+		numDatapoints int
+	)
+	for _, s := range samples {
+		if err := s.Type.Validate(); err != nil {
+			return nil, nil, err
+		}
+		numDatapoints += len(s.Datapoints)
+	}
+
+	var (
+		datapoints = make(ts.Datapoints, 0, numDatapoints)
+		types      = make([]MetricType, 0, numDatapoints)
+	)
+	for _, s := range samples {
+		metricType := s.Type
+		if metricType == MetricTypeUnknown {
+			metricType = defaultType
+		}
+
+		// Truncate each metric type separately so that datapoints of
+		// different types are never combined with one another.
+		for _, dp := range d.truncateTimestamps(s.Datapoints, overrides) {
+			datapoints = append(datapoints, dp)
+			types = append(types, metricType)
+		}
+	}
+
+	return datapoints, types, nil
+}
+
+func (d *downsamplerAndWriter) WriteSamples(
+	ctx context.Context,
+	tags models.Tags,
+	samples []MetricSamples,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) error {
+	if err := overrides.MetricType.Validate(); err != nil {
+		return err
+	}
+	if len(overrides.Sequences) > 0 {
+		return errSamplesSequences
+	}
+
+	datapoints, types, err := d.samplesDatapoints(samples, overrides)
+	if err != nil {
+		return err
+	}
+
+	overrides.datapointTypes = types
+	return d.write(ctx, tags, datapoints, datapoints, unit, overrides)
+}
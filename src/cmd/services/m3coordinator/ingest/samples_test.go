@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteSamples(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	// The tags are added and the appender finalized once for all the metric
+	// types of the write.
+	mockMetricsAppender.EXPECT().AddTag(gomock.Any(), gomock.Any()).
+		Times(len(testTags1.Tags))
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	gomock.InOrder(
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(1)),
+		mockSamplesAppender.EXPECT().AppendCounterSample(int64(2)),
+		mockSamplesAppender.EXPECT().AppendGaugeSample(3.0),
+		mockSamplesAppender.EXPECT().AppendTimerSample(4.0),
+		// Samples without a metric type use the metric type of the write.
+		mockSamplesAppender.EXPECT().AppendGaugeSample(5.0),
+	)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	samples := []MetricSamples{
+		{Type: MetricTypeCounter, Datapoints: ts.Datapoints{
+			{Timestamp: time.Unix(0, 1), Value: 1},
+			{Timestamp: time.Unix(0, 2), Value: 2},
+		}},
+		{Type: MetricTypeGauge, Datapoints: ts.Datapoints{
+			{Timestamp: time.Unix(0, 3), Value: 3},
+		}},
+		{Type: MetricTypeTimer, Datapoints: ts.Datapoints{
+			{Timestamp: time.Unix(0, 4), Value: 4},
+		}},
+		{Datapoints: ts.Datapoints{
+			{Timestamp: time.Unix(0, 5), Value: 5},
+		}},
+	}
+	var storageDatapoints ts.Datapoints
+	for _, s := range samples {
+		storageDatapoints = append(storageDatapoints, s.Datapoints...)
+	}
+	expectDefaultStorageWrites(session, storageDatapoints)
+
+	err := downAndWrite.WriteSamples(context.Background(), testTags1, samples,
+		xtime.Second, defaultOverride)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteSamplesInvalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither the downsampler nor the storage should be written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	err := downAndWrite.WriteSamples(context.Background(), testTags1,
+		[]MetricSamples{{Type: MetricType(10), Datapoints: testDatapoints1}},
+		xtime.Second, defaultOverride)
+	require.Error(t, err)
+
+	err = downAndWrite.WriteSamples(context.Background(), testTags1,
+		[]MetricSamples{{Type: MetricTypeCounter, Datapoints: testDatapoints1}},
+		xtime.Second, WriteOptions{Sequences: []uint64{1, 2, 3}})
+	require.Equal(t, errSamplesSequences, err)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"errors"
+
+	"github.com/m3db/m3/src/query/ts"
+)
+
+var errSequencesLengthMismatch = errors.New(
+	"sequences must be set for every datapoint of the write")
+
+// resolveSequences resolves datapoints that share a timestamp to the single
+// datapoint with the highest sequence, with ties going to the datapoint
+// that appears last. The order of the remaining datapoints is preserved.
+// Resolution happens before the write so that the result does not depend
+// on the order in which the downsampler or storage receive the datapoints,
+// which backends with no notion of a sequence cannot guarantee. Datapoints
+// that share a timestamp across separate writes are not resolved, for
+// those the backend's handling of repeated timestamps applies.
+func (d *downsamplerAndWriter) resolveSequences(
+	datapoints ts.Datapoints,
+	sequences []uint64,
+) (ts.Datapoints, error) {
+	if len(sequences) == 0 {
+		return datapoints, nil
+	}
+	if len(sequences) != len(datapoints) {
+		return nil, errSequencesLengthMismatch
+	}
+
+	// Most writes have no repeated timestamps, avoid allocating for them.
+	seen := make(map[int64]int, len(datapoints))
+	for i, dp := range datapoints {
+		seen[dp.Timestamp.UnixNano()] = i
+	}
+	if len(seen) == len(datapoints) {
+		return datapoints, nil
+	}
+
+	var (
+		resolved          = make(ts.Datapoints, 0, len(seen))
+		resolvedSequences = make([]uint64, 0, len(seen))
+		indexes           = make(map[int64]int, len(seen))
+	)
+	for i, dp := range datapoints {
+		key := dp.Timestamp.UnixNano()
+		idx, ok := indexes[key]
+		if !ok {
+			indexes[key] = len(resolved)
+			resolved = append(resolved, dp)
+			resolvedSequences = append(resolvedSequences, sequences[i])
+			continue
+		}
+		if sequences[i] >= resolvedSequences[idx] {
+			resolved[idx] = dp
+			resolvedSequences[idx] = sequences[i]
+		}
+	}
+
+	d.metrics.sequenceSuperseded.Inc(int64(len(datapoints) - len(resolved)))
+	return resolved, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestResolveSequences(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	downAndWrite := &downsamplerAndWriter{
+		metrics: newDownsamplerAndWriterMetrics(scope),
+	}
+
+	// No sequences or no repeated timestamps leaves the datapoints as is.
+	resolved, err := downAndWrite.resolveSequences(testDatapoints1, nil)
+	require.NoError(t, err)
+	require.Equal(t, ts.Datapoints(testDatapoints1), resolved)
+
+	resolved, err = downAndWrite.resolveSequences(testDatapoints1, []uint64{3, 2, 1})
+	require.NoError(t, err)
+	require.Equal(t, ts.Datapoints(testDatapoints1), resolved)
+
+	var (
+		t0 = time.Unix(10, 0)
+		t1 = time.Unix(20, 0)
+	)
+	datapoints := ts.Datapoints{
+		{Timestamp: t0, Value: 1},
+		{Timestamp: t1, Value: 2},
+		{Timestamp: t0, Value: 3},
+		{Timestamp: t1, Value: 4},
+		{Timestamp: t1, Value: 5},
+	}
+	resolved, err = downAndWrite.resolveSequences(datapoints, []uint64{2, 5, 1, 5, 4})
+	require.NoError(t, err)
+	require.Equal(t, ts.Datapoints{
+		{Timestamp: t0, Value: 1},
+		{Timestamp: t1, Value: 4},
+	}, resolved)
+	require.Equal(t, int64(3),
+		scope.Snapshot().Counters()["sequence.superseded+"].Value())
+
+	_, err = downAndWrite.resolveSequences(datapoints, []uint64{1})
+	require.Equal(t, errSequencesLengthMismatch, err)
+}
+
+func TestDownsampleAndWriteSequences(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions(),
+	})
+	downAndWrite.downsampler = nil
+
+	datapoints := ts.Datapoints{
+		{Timestamp: time.Unix(0, 0), Value: 1},
+		{Timestamp: time.Unix(0, 0), Value: 2},
+	}
+	session.EXPECT().WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any(), 1.0, gomock.Any(), gomock.Any())
+
+	overrides := WriteOptions{Sequences: []uint64{2, 1}}
+	err := downAndWrite.Write(context.Background(), testTags1, datapoints,
+		xtime.Second, overrides)
+	require.NoError(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sync"
+)
+
+type sourceKeyType int
+
+const sourceKey sourceKeyType = iota
+
+// NewContextWithSource returns a context that identifies the source, such
+// as the tenant, of the writes made with it, used to look up the default
+// write options registered for the source.
+func NewContextWithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+// SourceFromContext returns the source identified by the context, if any.
+func SourceFromContext(ctx context.Context) (string, bool) {
+	source, ok := ctx.Value(sourceKey).(string)
+	return source, ok
+}
+
+// sourceDefaults holds the default write options of each source, which
+// can be replaced as a whole to reload them.
+type sourceDefaults struct {
+	sync.RWMutex
+	defaults map[string]WriteOptions
+}
+
+func (s *sourceDefaults) get(source string) (WriteOptions, bool) {
+	s.RLock()
+	defaults, ok := s.defaults[source]
+	s.RUnlock()
+	return defaults, ok
+}
+
+func (s *sourceDefaults) register(source string, defaults WriteOptions) {
+	s.Lock()
+	if s.defaults == nil {
+		s.defaults = make(map[string]WriteOptions)
+	}
+	s.defaults[source] = defaults
+	s.Unlock()
+}
+
+func (s *sourceDefaults) set(defaults map[string]WriteOptions) {
+	replaced := make(map[string]WriteOptions, len(defaults))
+	for source, opts := range defaults {
+		replaced[source] = opts
+	}
+
+	s.Lock()
+	s.defaults = replaced
+	s.Unlock()
+}
+
+func (d *downsamplerAndWriter) RegisterSourceDefaults(
+	source string,
+	defaults WriteOptions,
+) {
+	d.sourceDefaults.register(source, defaults)
+}
+
+func (d *downsamplerAndWriter) SetSourceDefaults(defaults map[string]WriteOptions) {
+	d.sourceDefaults.set(defaults)
+}
+
+func (d *downsamplerAndWriter) SourceDefaults(source string) (WriteOptions, bool) {
+	return d.sourceDefaults.get(source)
+}
+
+// applySourceDefaults returns the overrides of a write with the mapping
+// rules and storage policies that it does not override itself taken from
+// the defaults of its source.
+func (d *downsamplerAndWriter) applySourceDefaults(
+	ctx context.Context,
+	overrides WriteOptions,
+) WriteOptions {
+	if overrides.DownsampleOverride && overrides.WriteOverride {
+		return overrides
+	}
+
+	source, ok := SourceFromContext(ctx)
+	if !ok {
+		return overrides
+	}
+	defaults, ok := d.sourceDefaults.get(source)
+	if !ok {
+		return overrides
+	}
+
+	if !overrides.DownsampleOverride && defaults.DownsampleOverride {
+		overrides.DownsampleOverride = true
+		overrides.DownsampleMappingRules = defaults.DownsampleMappingRules
+	}
+	if !overrides.WriteOverride && defaults.WriteOverride {
+		overrides.WriteOverride = true
+		overrides.WriteStoragePolicies = defaults.WriteStoragePolicies
+		overrides.WriteNamespaceIDs = defaults.WriteNamespaceIDs
+		overrides.WriteMetricsTypes = defaults.WriteMetricsTypes
+	}
+	return overrides
+}
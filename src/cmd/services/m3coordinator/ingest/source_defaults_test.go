@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/metrics/policy"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySourceDefaults(t *testing.T) {
+	var (
+		downAndWrite = &downsamplerAndWriter{}
+		ctx          = NewContextWithSource(context.Background(), "tenant")
+		defaults     = WriteOptions{
+			DownsampleOverride: true,
+			DownsampleMappingRules: []downsample.MappingRule{
+				{Aggregations: []aggregation.Type{aggregation.Last}},
+			},
+			WriteOverride: true,
+			WriteStoragePolicies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			},
+		}
+		writePolicies = []policy.StoragePolicy{
+			policy.NewStoragePolicy(10*time.Second, xtime.Second, 24*time.Hour),
+		}
+	)
+
+	// Nothing is applied before the source registers defaults.
+	require.Equal(t, WriteOptions{}, downAndWrite.applySourceDefaults(ctx, WriteOptions{}))
+
+	downAndWrite.RegisterSourceDefaults("tenant", defaults)
+	registered, ok := downAndWrite.SourceDefaults("tenant")
+	require.True(t, ok)
+	require.Equal(t, defaults, registered)
+
+	require.Equal(t, defaults, downAndWrite.applySourceDefaults(ctx, WriteOptions{}))
+	require.Equal(t, WriteOptions{},
+		downAndWrite.applySourceDefaults(context.Background(), WriteOptions{}))
+
+	// Overrides of the write take precedence over the defaults.
+	applied := downAndWrite.applySourceDefaults(ctx, WriteOptions{
+		WriteOverride:        true,
+		WriteStoragePolicies: writePolicies,
+	})
+	require.Equal(t, WriteOptions{
+		DownsampleOverride:     true,
+		DownsampleMappingRules: defaults.DownsampleMappingRules,
+		WriteOverride:          true,
+		WriteStoragePolicies:   writePolicies,
+	}, applied)
+
+	// Reloading replaces the defaults of every source.
+	downAndWrite.SetSourceDefaults(map[string]WriteOptions{"other": defaults})
+	_, ok = downAndWrite.SourceDefaults("tenant")
+	require.False(t, ok)
+	require.Equal(t, WriteOptions{}, downAndWrite.applySourceDefaults(ctx, WriteOptions{}))
+}
+
+func TestSourceFromContext(t *testing.T) {
+	_, ok := SourceFromContext(context.Background())
+	require.False(t, ok)
+
+	source, ok := SourceFromContext(NewContextWithSource(context.Background(), "tenant"))
+	require.True(t, ok)
+	require.Equal(t, "tenant", source)
+}
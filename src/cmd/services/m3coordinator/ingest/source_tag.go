@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/m3db/m3/src/query/models"
+)
+
+// seriesSource returns the source of a series of a write, the source of the
+// series itself if set, otherwise the source of the context of the write.
+func seriesSource(ctx context.Context, source string) string {
+	if source != "" {
+		return source
+	}
+	source, _ = SourceFromContext(ctx)
+	return source
+}
+
+// tagSource returns the tags of a series with the source tag set to the
+// source of the series, if a source tag is configured and the series has a
+// source. The source tag is reserved, a tag of the series with the same name
+// is replaced so that writers cannot claim to be another source. The tags of
+// the caller are never modified.
+func (d *downsamplerAndWriter) tagSource(
+	tags models.Tags,
+	source string,
+) models.Tags {
+	if d.opts.SourceTagName == "" || source == "" {
+		return tags
+	}
+
+	opts := tags.Opts
+	if opts == nil {
+		opts = models.NewTagOptions()
+	}
+	if opts.IDSchemeType() == models.TypeGraphite {
+		// Graphite IDs are built from the values of the tags in order, which
+		// would make the source part of the metric path, so switch to the
+		// quoted ID scheme as carbon does for names in the graphite tag
+		// format.
+		opts = opts.SetIDSchemeType(models.TypeQuoted)
+	}
+
+	var (
+		name   = []byte(d.opts.SourceTagName)
+		tagged = models.Tags{
+			Opts: opts,
+			Tags: make([]models.Tag, 0, len(tags.Tags)+1),
+		}
+	)
+	for _, tag := range tags.Tags {
+		if !bytes.Equal(tag.Name, name) {
+			tagged.Tags = append(tagged.Tags, tag)
+		}
+	}
+	tagged.Tags = append(tagged.Tags, models.Tag{
+		Name:  name,
+		Value: []byte(source),
+	})
+	return tagged.Normalize()
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage/mock"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSourceTags(tags ...models.Tag) models.Tags {
+	return models.NewTags(len(tags), models.NewTagOptions()).AddTags(tags)
+}
+
+func TestDownsampleAndWriteSourceTag(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		SourceTagName: "tenant",
+	})
+
+	tags := newTestSourceTags(
+		models.Tag{Name: []byte("__name__"), Value: []byte("cpu")},
+		// A series cannot claim to be from another source.
+		models.Tag{Name: []byte("tenant"), Value: []byte("spoofed")},
+	)
+	ctx := NewContextWithSource(context.Background(), "team-a")
+	err := downAndWrite.Write(ctx, tags, testDatapoints1, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+
+	writes := store.Writes()
+	require.Equal(t, 1, len(writes))
+	require.Equal(t, []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("cpu")},
+		{Name: []byte("tenant"), Value: []byte("team-a")},
+	}, writes[0].Tags.Tags)
+
+	// The tags of the caller are not modified.
+	value, ok := tags.Get([]byte("tenant"))
+	require.True(t, ok)
+	require.Equal(t, "spoofed", string(value))
+}
+
+func TestDownsampleAndWriteBatchSourceTag(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		SourceTagName: "tenant",
+	})
+
+	iter := newTestIter([]testIterEntry{
+		{
+			tags:       newTestSourceTags(models.Tag{Name: []byte("a"), Value: []byte("1")}),
+			datapoints: testDatapoints1,
+		},
+		{
+			tags:       newTestSourceTags(models.Tag{Name: []byte("b"), Value: []byte("2")}),
+			datapoints: testDatapoints2,
+			source:     "team-b",
+		},
+	})
+	ctx := NewContextWithSource(context.Background(), "team-a")
+	err := downAndWrite.WriteBatch(ctx, iter, nil)
+	require.NoError(t, err)
+
+	writes := store.Writes()
+	require.Equal(t, 2, len(writes))
+	sources := make(map[string]string, len(writes))
+	for _, write := range writes {
+		source, ok := write.Tags.Get([]byte("tenant"))
+		require.True(t, ok)
+		sources[string(write.Tags.Tags[0].Name)] = string(source)
+	}
+	require.Equal(t, map[string]string{"a": "team-a", "b": "team-b"}, sources)
+}
+
+func TestDownsampleAndWriteSourceTagWithoutSource(t *testing.T) {
+	store := mock.NewMockStorage()
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		SourceTagName: "tenant",
+	})
+
+	tags := newTestSourceTags(models.Tag{Name: []byte("__name__"), Value: []byte("cpu")})
+	err := downAndWrite.Write(context.Background(), tags, testDatapoints1,
+		xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+
+	writes := store.Writes()
+	require.Equal(t, 1, len(writes))
+	require.Equal(t, tags.Tags, writes[0].Tags.Tags)
+}
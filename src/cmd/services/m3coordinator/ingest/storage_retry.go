@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+
+	"github.com/m3db/m3/src/dbnode/client"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/retry"
+)
+
+// RetryableErrorFn determines whether an error is retryable.
+type RetryableErrorFn func(err error) bool
+
+// IsRetryableStorageError returns whether a storage write error is likely
+// to be transient, such as a timeout or a connection reset. Errors caused
+// by the write itself, such as bad requests, and cancellations are not
+// retryable.
+func IsRetryableStorageError(err error) bool {
+	switch {
+	case err == context.Canceled, err == context.DeadlineExceeded:
+		return false
+	case xerrors.IsNonRetryableError(err), client.IsBadRequestError(err):
+		return false
+	}
+	return true
+}
+
+func newStorageRetrier(opts retry.Options) retry.Retrier {
+	if opts == nil {
+		return nil
+	}
+	return retry.NewRetrier(opts)
+}
+
+// retryStorageWrite performs the storage write, retrying it with backoff
+// while it fails with a retryable error and ctx is not done. The error of
+// the last attempt is returned.
+func (d *downsamplerAndWriter) retryStorageWrite(
+	ctx context.Context,
+	write func() error,
+) error {
+	if d.storageRetrier == nil {
+		return write()
+	}
+
+	retryable := d.opts.StorageRetryable
+	if retryable == nil {
+		retryable = IsRetryableStorageError
+	}
+
+	var lastErr error
+	continueFn := func(attempt int) bool {
+		return attempt == 0 || ctx.Err() == nil
+	}
+	err := d.storageRetrier.AttemptWhile(continueFn, func() error {
+		lastErr = write()
+		// Shed writes fail fast rather than waiting out the open breaker.
+		if lastErr == ErrStorageUnavailable ||
+			(lastErr != nil && !retryable(lastErr)) {
+			return xerrors.NewNonRetryableError(lastErr)
+		}
+		return lastErr
+	})
+	if err == nil {
+		return nil
+	}
+	return lastErr
+}
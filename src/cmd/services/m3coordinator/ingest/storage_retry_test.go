@@ -0,0 +1,119 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/ident"
+	"github.com/m3db/m3x/retry"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorageRetryDownsamplerAndWriter(
+	t *testing.T,
+	ctrl *gomock.Controller,
+	errs []error,
+) (*downsamplerAndWriter, *int) {
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		StorageRetry: retry.NewOptions().
+			SetInitialBackoff(time.Millisecond).
+			SetMaxBackoff(time.Millisecond).
+			SetMaxRetries(3),
+	})
+	downAndWrite.downsampler = nil
+
+	attempts := 0
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_, _ ident.ID, _ ident.TagIterator, _ time.Time, _ float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			attempts++
+			if attempts <= len(errs) {
+				return errs[attempts-1]
+			}
+			return nil
+		}).AnyTimes()
+
+	return downAndWrite, &attempts
+}
+
+func TestDownsampleAndWriteStorageRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The write fails twice before it succeeds.
+	transientErr := errors.New("connection reset")
+	downAndWrite, attempts := newTestStorageRetryDownsamplerAndWriter(t, ctrl,
+		[]error{transientErr, transientErr})
+
+	err := downAndWrite.Write(context.Background(), testTags1,
+		ts.Datapoints{testDatapoints1[0]}, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, *attempts)
+}
+
+func TestDownsampleAndWriteStorageRetryExhausted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	transientErr := errors.New("connection reset")
+	downAndWrite, attempts := newTestStorageRetryDownsamplerAndWriter(t, ctrl,
+		[]error{transientErr, transientErr, transientErr, transientErr})
+
+	err := downAndWrite.Write(context.Background(), testTags1,
+		ts.Datapoints{testDatapoints1[0]}, xtime.Second, WriteOptions{})
+	require.EqualError(t, err, transientErr.Error())
+	require.Equal(t, 4, *attempts)
+}
+
+func TestDownsampleAndWriteStorageRetryNonRetryable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	badRequestErr := xerrors.NewInvalidParamsError(errors.New("invalid tags"))
+	downAndWrite, attempts := newTestStorageRetryDownsamplerAndWriter(t, ctrl,
+		[]error{badRequestErr})
+
+	err := downAndWrite.Write(context.Background(), testTags1,
+		ts.Datapoints{testDatapoints1[0]}, xtime.Second, WriteOptions{})
+	require.Error(t, err)
+	require.Equal(t, 1, *attempts)
+}
+
+func TestIsRetryableStorageError(t *testing.T) {
+	require.True(t, IsRetryableStorageError(errors.New("timeout")))
+	require.False(t, IsRetryableStorageError(context.Canceled))
+	require.False(t, IsRetryableStorageError(
+		xerrors.NewNonRetryableError(errors.New("not retryable"))))
+	require.False(t, IsRetryableStorageError(
+		xerrors.NewInvalidParamsError(errors.New("bad request"))))
+}
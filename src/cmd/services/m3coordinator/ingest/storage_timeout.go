@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+
+	"github.com/m3db/m3/src/query/storage"
+)
+
+// ErrStorageWriteTimeout is returned by storage writes that do not complete
+// within the storage write timeout, it is retryable.
+var ErrStorageWriteTimeout = errors.New("storage write timed out")
+
+// storeWriteWithTimeout performs a single storage write attempt with a
+// context that expires after the storage write timeout, if one is set.
+// A write that fails because the timeout expired, rather than the context
+// of the write being done, fails with ErrStorageWriteTimeout.
+func (d *downsamplerAndWriter) storeWriteWithTimeout(
+	ctx context.Context,
+	query *storage.WriteQuery,
+) error {
+	timeout := d.opts.StorageWriteTimeout
+	if timeout <= 0 {
+		return d.store.Write(ctx, query)
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := d.store.Write(writeCtx, query)
+	if err != nil && ctx.Err() == nil &&
+		writeCtx.Err() == context.DeadlineExceeded {
+		d.metrics.writeTimeouts.Inc(1)
+		return ErrStorageWriteTimeout
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/storage"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/retry"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// blockingStorage is a storage whose first blocked writes block until their
+// context is done, the writes after them succeed immediately.
+type blockingStorage struct {
+	storage.Storage
+	blocked  int64
+	attempts int64
+}
+
+func (s *blockingStorage) Write(ctx context.Context, _ *storage.WriteQuery) error {
+	if atomic.AddInt64(&s.attempts, 1) > s.blocked {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDownsampleAndWriteStorageWriteTimeout(t *testing.T) {
+	store := &blockingStorage{blocked: 2}
+	scope := tally.NewTestScope("", nil)
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		InstrumentOptions:   instrument.NewOptions().SetMetricsScope(scope),
+		StorageWriteTimeout: 10 * time.Millisecond,
+	})
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{})
+	require.Equal(t, ErrStorageWriteTimeout, err)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags2, datapoints: testDatapoints2},
+	})
+	err = downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.Equal(t, ErrStorageWriteTimeout, xerrors.InnerError(err))
+
+	require.Equal(t, int64(3), atomic.LoadInt64(&store.attempts))
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["write.timeout+"].Value())
+}
+
+func TestDownsampleAndWriteStorageWriteTimeoutRetried(t *testing.T) {
+	store := &blockingStorage{blocked: 1}
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		StorageWriteTimeout: 10 * time.Millisecond,
+		StorageRetry: retry.NewOptions().
+			SetInitialBackoff(time.Millisecond).
+			SetMaxBackoff(time.Millisecond).
+			SetMaxRetries(3),
+	})
+
+	// The first attempt times out and the retry succeeds.
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), atomic.LoadInt64(&store.attempts))
+}
+
+func TestDownsampleAndWriteStorageWriteTimeoutCancelled(t *testing.T) {
+	store := &blockingStorage{blocked: 1}
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		StorageWriteTimeout: time.Minute,
+	})
+
+	// A write whose own context is done is not reported as timed out.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := downAndWrite.Write(ctx, testTags1, testDatapoints1, xtime.Second,
+		WriteOptions{})
+	require.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+)
+
+// SubResolutionBehavior determines how the datapoints of a write that
+// overrides its storage policies are combined when more than one of them
+// falls within the same resolution window of an aggregated namespace.
+// Writes that do not override their storage policies are aggregated by the
+// downsampler instead.
+type SubResolutionBehavior uint
+
+const (
+	// SubResolutionNone writes the datapoints as is, leaving which of the
+	// datapoints of a window is kept up to the namespace.
+	SubResolutionNone SubResolutionBehavior = iota
+	// SubResolutionLast keeps the datapoint with the latest timestamp.
+	SubResolutionLast
+	// SubResolutionSum writes the sum of the datapoints.
+	SubResolutionSum
+	// SubResolutionMean writes the mean of the datapoints.
+	SubResolutionMean
+)
+
+var validSubResolutionBehaviors = []SubResolutionBehavior{
+	SubResolutionNone,
+	SubResolutionLast,
+	SubResolutionSum,
+	SubResolutionMean,
+}
+
+func (b SubResolutionBehavior) String() string {
+	switch b {
+	case SubResolutionNone:
+		return "none"
+	case SubResolutionLast:
+		return "last"
+	case SubResolutionSum:
+		return "sum"
+	case SubResolutionMean:
+		return "mean"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals a sub resolution behavior.
+func (b *SubResolutionBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = SubResolutionNone
+		return nil
+	}
+
+	for _, valid := range validSubResolutionBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid SubResolutionBehavior '%s' valid types are: %v",
+		str, validSubResolutionBehaviors)
+}
+
+// combineSubResolutionDatapoints combines the datapoints that fall within
+// the same resolution window into a single datapoint per window. Combined
+// datapoints are timestamped at the end of their window to match the
+// datapoints written by the downsampler, see alignDatapointsToWindowEnd.
+// The windows are returned in the order they first appear.
+func combineSubResolutionDatapoints(
+	datapoints ts.Datapoints,
+	resolution time.Duration,
+	behavior SubResolutionBehavior,
+) ts.Datapoints {
+	if behavior == SubResolutionNone || resolution <= 0 {
+		return datapoints
+	}
+
+	return combineDatapointWindows(datapoints, behavior, func(t time.Time) time.Time {
+		return t.Truncate(resolution).Add(resolution)
+	})
+}
+
+// combineDatapointWindows combines the datapoints that window maps to the
+// same timestamp into a single datapoint with that timestamp, returning the
+// windows in the order they first appear. Datapoints are combined as
+// determined by the behavior, which must not be SubResolutionNone.
+func combineDatapointWindows(
+	datapoints ts.Datapoints,
+	behavior SubResolutionBehavior,
+	window func(t time.Time) time.Time,
+) ts.Datapoints {
+	var (
+		combined  = make(ts.Datapoints, 0, len(datapoints))
+		counts    = make([]int, 0, len(datapoints))
+		latest    = make([]time.Time, 0, len(datapoints))
+		windowIdx = make(map[int64]int, len(datapoints))
+	)
+	for _, dp := range datapoints {
+		windowTime := window(dp.Timestamp)
+		idx, ok := windowIdx[windowTime.UnixNano()]
+		if !ok {
+			windowIdx[windowTime.UnixNano()] = len(combined)
+			combined = append(combined, ts.Datapoint{
+				Timestamp:  windowTime,
+				Value:      dp.Value,
+				Annotation: dp.Annotation,
+			})
+			counts = append(counts, 1)
+			latest = append(latest, dp.Timestamp)
+			continue
+		}
+
+		counts[idx]++
+		switch behavior {
+		case SubResolutionLast:
+			if !dp.Timestamp.Before(latest[idx]) {
+				combined[idx].Value = dp.Value
+				combined[idx].Annotation = dp.Annotation
+				latest[idx] = dp.Timestamp
+			}
+		case SubResolutionSum, SubResolutionMean:
+			combined[idx].Value += dp.Value
+		}
+	}
+
+	if behavior == SubResolutionMean {
+		for i := range combined {
+			combined[i].Value /= float64(counts[i])
+		}
+	}
+
+	return combined
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage/m3"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestCombineSubResolutionDatapoints(t *testing.T) {
+	datapoints := ts.Datapoints{
+		{Timestamp: time.Unix(12, 0), Value: 1},
+		{Timestamp: time.Unix(5, 0), Value: 2},
+		{Timestamp: time.Unix(18, 0), Value: 3},
+		{Timestamp: time.Unix(15, 0), Value: 6},
+	}
+
+	tests := []struct {
+		behavior SubResolutionBehavior
+		expected ts.Datapoints
+	}{
+		{
+			behavior: SubResolutionNone,
+			expected: datapoints,
+		},
+		{
+			behavior: SubResolutionLast,
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(20, 0), Value: 3},
+				{Timestamp: time.Unix(10, 0), Value: 2},
+			},
+		},
+		{
+			behavior: SubResolutionSum,
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(20, 0), Value: 10},
+				{Timestamp: time.Unix(10, 0), Value: 2},
+			},
+		},
+		{
+			behavior: SubResolutionMean,
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(20, 0), Value: 10.0 / 3},
+				{Timestamp: time.Unix(10, 0), Value: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.behavior.String(), func(t *testing.T) {
+			combined := combineSubResolutionDatapoints(datapoints, 10*time.Second, test.behavior)
+			require.Equal(t, test.expected, combined)
+		})
+	}
+}
+
+func TestDownsampleAndWriteWithWriteOverridesSubResolution(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+	downAndWrite.downsampler = nil
+	downAndWrite.opts.SubResolution = SubResolutionSum
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+	}
+
+	// All the datapoints fall within the first minute.
+	session.EXPECT().WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(),
+		time.Unix(60, 0), 3.0, gomock.Any(), gomock.Any())
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.NoError(t, err)
+}
+
+func TestSubResolutionBehaviorUnmarshalYAML(t *testing.T) {
+	for _, behavior := range validSubResolutionBehaviors {
+		var cfg Configuration
+		str := "subResolution: " + behavior.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, behavior, cfg.SubResolution)
+	}
+
+	var cfg Configuration
+	require.Error(t, yaml.Unmarshal([]byte("subResolution: bad\n"), &cfg))
+}
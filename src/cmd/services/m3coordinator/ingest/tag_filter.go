@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"bytes"
+
+	"github.com/m3db/m3/src/query/models"
+)
+
+// TagFilterOptions configures the tags stripped from series before they are
+// written, a blunt but effective control of cardinality. The metric name tag
+// is never stripped, nor are the tags of series with graphite IDs since
+// those make up the metric path.
+type TagFilterOptions struct {
+	// Allow, if set, strips every tag whose name is not in it.
+	Allow []string
+	// Deny strips every tag whose name is in it.
+	Deny []string
+}
+
+type tagFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// newTagFilter returns a tag filter for the options or nil if the options
+// do not strip any tags.
+func newTagFilter(opts TagFilterOptions) *tagFilter {
+	if len(opts.Allow) == 0 && len(opts.Deny) == 0 {
+		return nil
+	}
+
+	f := &tagFilter{deny: make(map[string]struct{}, len(opts.Deny))}
+	if len(opts.Allow) > 0 {
+		f.allow = make(map[string]struct{}, len(opts.Allow))
+		for _, name := range opts.Allow {
+			f.allow[name] = struct{}{}
+		}
+	}
+	for _, name := range opts.Deny {
+		f.deny[name] = struct{}{}
+	}
+	return f
+}
+
+func (f *tagFilter) strips(name []byte) bool {
+	if f.allow != nil {
+		if _, ok := f.allow[string(name)]; !ok {
+			return true
+		}
+	}
+	_, ok := f.deny[string(name)]
+	return ok
+}
+
+// filter returns the tags with the filtered tags stripped along with the
+// number of tags stripped. The common case of no tags stripped returns the
+// tags untouched; otherwise a new tags slice is allocated so that the
+// caller's slice is never mutated.
+func (f *tagFilter) filter(tags models.Tags) (models.Tags, int) {
+	if f == nil {
+		return tags, 0
+	}
+
+	if tags.Opts != nil && tags.Opts.IDSchemeType() == models.TypeGraphite {
+		return tags, 0
+	}
+
+	var metricName []byte
+	if tags.Opts != nil {
+		metricName = tags.Opts.MetricName()
+	}
+
+	var filtered []models.Tag
+	for i, tag := range tags.Tags {
+		strip := f.strips(tag.Name) && !bytes.Equal(tag.Name, metricName)
+		if strip && filtered == nil {
+			filtered = make([]models.Tag, i, len(tags.Tags)-1)
+			copy(filtered, tags.Tags[:i])
+			continue
+		}
+		if !strip && filtered != nil {
+			filtered = append(filtered, tag)
+		}
+	}
+
+	if filtered == nil {
+		return tags, 0
+	}
+
+	stripped := len(tags.Tags) - len(filtered)
+	return models.Tags{Opts: tags.Opts, Tags: filtered}, stripped
+}
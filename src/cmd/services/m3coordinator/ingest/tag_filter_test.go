@@ -0,0 +1,171 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/instrument"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testFilterTags = models.Tags{
+	Opts: models.NewTagOptions(),
+	Tags: []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("pod"), Value: []byte("b")},
+		{Name: []byte("region"), Value: []byte("c")},
+	},
+}
+
+func TestTagFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TagFilterOptions
+		expected []string
+	}{
+		{
+			name:     "none",
+			expected: []string{"__name__", "host", "pod", "region"},
+		},
+		{
+			name:     "allow",
+			opts:     TagFilterOptions{Allow: []string{"region"}},
+			expected: []string{"__name__", "region"},
+		},
+		{
+			name:     "deny",
+			opts:     TagFilterOptions{Deny: []string{"host", "pod", "__name__"}},
+			expected: []string{"__name__", "region"},
+		},
+		{
+			name: "allow and deny",
+			opts: TagFilterOptions{
+				Allow: []string{"host", "pod"},
+				Deny:  []string{"pod"},
+			},
+			expected: []string{"__name__", "host"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filtered, stripped := newTagFilter(test.opts).filter(testFilterTags)
+
+			var names []string
+			for _, tag := range filtered.Tags {
+				names = append(names, string(tag.Name))
+			}
+			require.Equal(t, test.expected, names)
+			require.Equal(t, len(testFilterTags.Tags)-len(test.expected), stripped)
+		})
+	}
+
+	// The filtered tags are never modified.
+	require.Equal(t, 4, len(testFilterTags.Tags))
+}
+
+func TestTagFilterGraphite(t *testing.T) {
+	tags := models.NewTags(2, models.NewTagOptions().SetIDSchemeType(models.TypeGraphite)).
+		AddTag(models.Tag{Name: []byte("__g0__"), Value: []byte("foo")}).
+		AddTag(models.Tag{Name: []byte("__g1__"), Value: []byte("bar")})
+
+	filtered, stripped := newTagFilter(TagFilterOptions{
+		Deny: []string{"__g1__"},
+	}).filter(tags)
+	require.Equal(t, tags, filtered)
+	require.Equal(t, 0, stripped)
+}
+
+func TestDownsampleAndWriteTagFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		TagFilter:         TagFilterOptions{Deny: []string{"host", "pod"}},
+	})
+	downAndWrite.store = nil
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().Reset()
+	mockMetricsAppender.EXPECT().AddTags([]models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("region"), Value: []byte("c")},
+	})
+	mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testFilterTags, datapoints: testDatapoints1},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["tags.stripped+"].Value())
+}
+
+func TestDownsampleAndWriteWouldAcceptTagFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		TagFilter: TagFilterOptions{Deny: []string{"foo"}},
+	})
+
+	// The duplicate tag is stripped before duplicates are rejected.
+	ok, reason := downAndWrite.WouldAccept(context.Background(), testDuplicateTags, testDatapoints1)
+	require.True(t, ok)
+	require.Equal(t, "", reason)
+}
+
+func TestTagFilterConfiguration(t *testing.T) {
+	var cfg Configuration
+	require.NoError(t, yaml.Unmarshal([]byte(`
+tagFilter:
+  allow:
+    - region
+  deny:
+    - host
+`), &cfg))
+
+	opts, err := cfg.NewOptions(instrument.NewOptions())
+	require.NoError(t, err)
+	require.Equal(t, TagFilterOptions{
+		Allow: []string{"region"},
+		Deny:  []string{"host"},
+	}, opts.TagFilter)
+}
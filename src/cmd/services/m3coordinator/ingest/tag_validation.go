@@ -0,0 +1,278 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/m3db/m3/src/query/models"
+	xerrors "github.com/m3db/m3x/errors"
+)
+
+// ReservedTagNamePrefix is the prefix of tag names reserved for internal
+// use, see TagValidationOptions.Strict.
+const ReservedTagNamePrefix = "__"
+
+var reservedTagNamePrefix = []byte(ReservedTagNamePrefix)
+
+// InvalidTagsBehavior determines how series whose tags are invalid once all
+// the tag transforms have been applied are handled.
+type InvalidTagsBehavior uint
+
+const (
+	// InvalidTagsAllow writes series without validating their tags.
+	InvalidTagsAllow InvalidTagsBehavior = iota
+	// InvalidTagsReject rejects series with invalid tags.
+	InvalidTagsReject
+	// InvalidTagsSanitize repairs invalid tags, replacing invalid UTF-8 with
+	// the unicode replacement character, truncating names and values that
+	// are too long and dropping tags with an empty name. In strict mode tags
+	// with an empty value or a reserved name and all but the first of the
+	// tags that share a name are dropped too.
+	InvalidTagsSanitize
+)
+
+var validInvalidTagsBehaviors = []InvalidTagsBehavior{
+	InvalidTagsAllow,
+	InvalidTagsReject,
+	InvalidTagsSanitize,
+}
+
+func (b InvalidTagsBehavior) String() string {
+	switch b {
+	case InvalidTagsAllow:
+		return "allow"
+	case InvalidTagsReject:
+		return "reject"
+	case InvalidTagsSanitize:
+		return "sanitize"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals an invalid tags behavior.
+func (b *InvalidTagsBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = InvalidTagsAllow
+		return nil
+	}
+
+	for _, valid := range validInvalidTagsBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid InvalidTagsBehavior '%s' valid types are: %v",
+		str, validInvalidTagsBehaviors)
+}
+
+// TagValidationOptions configures the validation of the tags of series
+// after all the tag transforms, such as the tag filter and computed tags,
+// have been applied so that transforms cannot produce series the index
+// would not accept. Tag names must be non-empty and tag names and values
+// must be valid UTF-8 within the configured lengths.
+//
+// In strict mode tag values must be non-empty, tag names must be unique and
+// must not start with ReservedTagNamePrefix, except for the metric name and
+// the tags of series with graphite IDs which are reserved names themselves.
+type TagValidationOptions struct {
+	// InvalidTags determines how series with invalid tags are handled, by
+	// default tags are not validated.
+	InvalidTags InvalidTagsBehavior
+
+	// MaxNameLength is the maximum length in bytes of a tag name, unbounded
+	// if not set.
+	MaxNameLength int
+
+	// MaxValueLength is the maximum length in bytes of a tag value,
+	// unbounded if not set.
+	MaxValueLength int
+
+	// Strict enables the strict validation of tags.
+	Strict bool
+}
+
+// ValidateTags validates the tags of a series in strict mode, returning an
+// error describing the first invalid tag, see TagValidationOptions.
+func ValidateTags(tags models.Tags) error {
+	opts := TagValidationOptions{Strict: true}
+	if invalid, reason := firstInvalidTag(tags, opts); invalid >= 0 {
+		return fmt.Errorf("series has invalid tag: %s", reason)
+	}
+	return nil
+}
+
+// validateTags applies the tag validation to the tags of a series, the tags
+// are returned untouched if valid and otherwise a new tags slice is
+// allocated so that the caller's slice is never mutated. Invalid series are
+// only counted if record is set so that the series of batches, which are
+// validated for both storage and the downsampler, are counted once.
+func (d *downsamplerAndWriter) validateTags(
+	tags models.Tags,
+	record bool,
+) (models.Tags, error) {
+	opts := d.opts.TagValidation
+	if opts.InvalidTags == InvalidTagsAllow {
+		return tags, nil
+	}
+
+	invalid, reason := firstInvalidTag(tags, opts)
+	if invalid < 0 {
+		return tags, nil
+	}
+
+	if opts.InvalidTags == InvalidTagsReject {
+		if record {
+			d.metrics.tagsInvalidRejected.Inc(1)
+		}
+		return tags, xerrors.NewInvalidParamsError(
+			fmt.Errorf("series has invalid tag: %s", reason))
+	}
+
+	if record {
+		d.metrics.tagsInvalidSanitized.Inc(1)
+	}
+	sanitized := make([]models.Tag, 0, len(tags.Tags))
+	sanitized = append(sanitized, tags.Tags[:invalid]...)
+	for _, tag := range tags.Tags[invalid:] {
+		tag = models.Tag{
+			Name:  sanitizeTagBytes(tag.Name, opts.MaxNameLength),
+			Value: sanitizeTagBytes(tag.Value, opts.MaxValueLength),
+		}
+		if len(tag.Name) == 0 {
+			continue
+		}
+		if opts.Strict {
+			if len(tag.Value) == 0 || hasTagName(sanitized, tag.Name) ||
+				isReservedTagName(tags, tag.Name) {
+				continue
+			}
+		}
+		sanitized = append(sanitized, tag)
+	}
+
+	return models.Tags{Opts: tags.Opts, Tags: sanitized}, nil
+}
+
+// firstInvalidTag returns the index of the first invalid tag and why it is
+// invalid, or -1 if all the tags are valid.
+func firstInvalidTag(tags models.Tags, opts TagValidationOptions) (int, string) {
+	for i, tag := range tags.Tags {
+		if opts.Strict {
+			if reason, ok := strictInvalidTag(tags, i); ok {
+				return i, reason
+			}
+		}
+
+		switch {
+		case len(tag.Name) == 0:
+			return i, "empty name"
+		case !utf8.Valid(tag.Name):
+			return i, fmt.Sprintf("name is not valid UTF-8: %q", tag.Name)
+		case !utf8.Valid(tag.Value):
+			return i, fmt.Sprintf("value of %s is not valid UTF-8: %q", tag.Name, tag.Value)
+		case opts.MaxNameLength > 0 && len(tag.Name) > opts.MaxNameLength:
+			return i, fmt.Sprintf("name exceeds %d bytes: %s", opts.MaxNameLength, tag.Name)
+		case opts.MaxValueLength > 0 && len(tag.Value) > opts.MaxValueLength:
+			return i, fmt.Sprintf("value of %s exceeds %d bytes", tag.Name, opts.MaxValueLength)
+		}
+	}
+	return -1, ""
+}
+
+// strictInvalidTag returns why the tag at index i is invalid in strict mode,
+// if it is.
+func strictInvalidTag(tags models.Tags, i int) (string, bool) {
+	tag := tags.Tags[i]
+	switch {
+	case len(tag.Value) == 0:
+		return fmt.Sprintf("value of %s is empty", tag.Name), true
+	case isReservedTagName(tags, tag.Name):
+		return fmt.Sprintf("name %s has the reserved prefix %s",
+			tag.Name, ReservedTagNamePrefix), true
+	}
+	if hasTagName(tags.Tags[:i], tag.Name) {
+		return fmt.Sprintf("duplicate name: %s", tag.Name), true
+	}
+	return "", false
+}
+
+// hasTagName returns whether any of the tags has the name, series generally
+// have a small number of tags so a linear scan is cheaper than allocating a
+// set.
+func hasTagName(tags []models.Tag, name []byte) bool {
+	for _, tag := range tags {
+		if bytes.Equal(tag.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedTagName returns whether the name is reserved for internal use,
+// the metric name and the tags of graphite IDs use reserved names
+// themselves so are permitted.
+func isReservedTagName(tags models.Tags, name []byte) bool {
+	if !bytes.HasPrefix(name, reservedTagNamePrefix) {
+		return false
+	}
+	opts := tags.Opts
+	if opts == nil {
+		opts = models.NewTagOptions()
+	}
+	if opts.IDSchemeType() == models.TypeGraphite {
+		return false
+	}
+	return !bytes.Equal(name, opts.MetricName())
+}
+
+// sanitizeTagBytes replaces invalid UTF-8 with the replacement character
+// and truncates the result to at most maxLen bytes on a rune boundary.
+func sanitizeTagBytes(b []byte, maxLen int) []byte {
+	if utf8.Valid(b) && (maxLen <= 0 || len(b) <= maxLen) {
+		return b
+	}
+
+	var (
+		sanitized = make([]byte, 0, len(b))
+		encoded   [utf8.UTFMax]byte
+	)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		n := utf8.EncodeRune(encoded[:], r)
+		if maxLen > 0 && len(sanitized)+n > maxLen {
+			break
+		}
+		sanitized = append(sanitized, encoded[:n]...)
+	}
+	return sanitized
+}
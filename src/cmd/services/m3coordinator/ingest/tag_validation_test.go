@@ -0,0 +1,261 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testInvalidTags = models.Tags{
+	Opts: models.NewTagOptions(),
+	Tags: []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("a\xffb")},
+		{Name: []byte(""), Value: []byte("empty")},
+		{Name: []byte("region"), Value: []byte("région")},
+	},
+}
+
+func TestValidateTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TagValidationOptions
+		expected []models.Tag
+		err      bool
+	}{
+		{
+			name:     "allow",
+			expected: testInvalidTags.Tags,
+		},
+		{
+			name: "reject",
+			opts: TagValidationOptions{InvalidTags: InvalidTagsReject},
+			err:  true,
+		},
+		{
+			name: "sanitize",
+			opts: TagValidationOptions{InvalidTags: InvalidTagsSanitize},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("requests")},
+				{Name: []byte("host"), Value: []byte("a�b")},
+				{Name: []byte("region"), Value: []byte("région")},
+			},
+		},
+		{
+			name: "sanitize truncates on rune boundary",
+			opts: TagValidationOptions{
+				InvalidTags:    InvalidTagsSanitize,
+				MaxValueLength: 2,
+			},
+			expected: []models.Tag{
+				{Name: []byte("__name__"), Value: []byte("re")},
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("region"), Value: []byte("r")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			downAndWrite := &downsamplerAndWriter{
+				opts:    Options{TagValidation: test.opts},
+				metrics: newDownsamplerAndWriterMetrics(tally.NoopScope),
+			}
+
+			validated, err := downAndWrite.validateTags(testInvalidTags, true)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, validated.Tags)
+		})
+	}
+
+	// The tags of the caller are never mutated.
+	require.Equal(t, []byte("a\xffb"), testInvalidTags.Tags[1].Value)
+}
+
+func TestDownsampleAndWriteRejectsInvalidTagsAfterComputedTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		TagValidation: TagValidationOptions{
+			InvalidTags:    InvalidTagsReject,
+			MaxValueLength: 3,
+		},
+		ComputedTags: []ComputedTag{
+			{Name: []byte("computed"), Bucketize: []float64{1}},
+		},
+	})
+	downAndWrite.downsampler = nil
+
+	// The tags of the write are valid but the computed "+Inf" value is not.
+	tags := models.NewTags(1, nil).AddTag(models.Tag{
+		Name:  []byte("host"),
+		Value: []byte("a"),
+	})
+	err := downAndWrite.Write(
+		context.Background(), tags, testDatapoints1, xtime.Second, WriteOptions{})
+	require.EqualError(t, err, "series has invalid tag: value of computed exceeds 3 bytes")
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["tags.invalid+action=rejected"].Value())
+}
+
+func TestDownsampleAndWriteWouldAcceptTagValidation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		TagValidation: TagValidationOptions{InvalidTags: InvalidTagsReject},
+	})
+
+	ok, reason := downAndWrite.WouldAccept(context.Background(), testInvalidTags, testDatapoints1)
+	require.False(t, ok)
+	require.Contains(t, reason, "not valid UTF-8")
+
+	ok, _ = downAndWrite.WouldAccept(context.Background(), testTags1, testDatapoints1)
+	require.True(t, ok)
+}
+
+func TestInvalidTagsBehaviorUnmarshalYAML(t *testing.T) {
+	var behavior InvalidTagsBehavior
+	require.NoError(t, yaml.Unmarshal([]byte("sanitize"), &behavior))
+	require.Equal(t, InvalidTagsSanitize, behavior)
+
+	require.NoError(t, yaml.Unmarshal([]byte(`""`), &behavior))
+	require.Equal(t, InvalidTagsAllow, behavior)
+
+	require.Error(t, yaml.Unmarshal([]byte("drop"), &behavior))
+}
+
+func TestValidateTagsStrict(t *testing.T) {
+	graphiteOpts := models.NewTagOptions().SetIDSchemeType(models.TypeGraphite)
+	tests := []struct {
+		name string
+		tags models.Tags
+		err  string
+	}{
+		{
+			name: "valid",
+			tags: testTags1,
+		},
+		{
+			name: "metric name",
+			tags: models.NewTags(0, nil).
+				AddTag(models.Tag{Name: []byte("__name__"), Value: []byte("a")}),
+		},
+		{
+			name: "graphite tags",
+			tags: models.NewTags(0, graphiteOpts).
+				AddTag(models.Tag{Name: []byte("__g0__"), Value: []byte("a")}),
+		},
+		{
+			name: "empty name",
+			tags: models.NewTags(0, nil).
+				AddTag(models.Tag{Name: []byte(""), Value: []byte("a")}),
+			err: "series has invalid tag: empty name",
+		},
+		{
+			name: "empty value",
+			tags: models.NewTags(0, nil).
+				AddTag(models.Tag{Name: []byte("host"), Value: []byte("")}),
+			err: "series has invalid tag: value of host is empty",
+		},
+		{
+			name: "reserved name",
+			tags: models.NewTags(0, nil).
+				AddTag(models.Tag{Name: []byte("__host"), Value: []byte("a")}),
+			err: "series has invalid tag: name __host has the reserved prefix __",
+		},
+		{
+			name: "duplicate name",
+			tags: models.Tags{Opts: models.NewTagOptions(), Tags: []models.Tag{
+				{Name: []byte("host"), Value: []byte("a")},
+				{Name: []byte("host"), Value: []byte("b")},
+			}},
+			err: "series has invalid tag: duplicate name: host",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateTags(test.tags)
+			if test.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestDownsampleAndWriteStrictTagValidation(t *testing.T) {
+	tags := models.Tags{Opts: models.NewTagOptions(), Tags: []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("a")},
+		{Name: []byte("host"), Value: []byte("b")},
+		{Name: []byte("__internal"), Value: []byte("c")},
+		{Name: []byte("region"), Value: []byte("")},
+	}}
+
+	lenient := &downsamplerAndWriter{
+		opts: Options{TagValidation: TagValidationOptions{
+			InvalidTags: InvalidTagsReject,
+		}},
+		metrics: newDownsamplerAndWriterMetrics(tally.NoopScope),
+	}
+	validated, err := lenient.validateTags(tags, true)
+	require.NoError(t, err)
+	require.Equal(t, tags.Tags, validated.Tags)
+
+	strict := &downsamplerAndWriter{
+		opts: Options{TagValidation: TagValidationOptions{
+			InvalidTags: InvalidTagsReject,
+			Strict:      true,
+		}},
+		metrics: newDownsamplerAndWriterMetrics(tally.NoopScope),
+	}
+	_, err = strict.validateTags(tags, true)
+	require.EqualError(t, err, "series has invalid tag: duplicate name: host")
+
+	strict.opts.TagValidation.InvalidTags = InvalidTagsSanitize
+	validated, err = strict.validateTags(tags, true)
+	require.NoError(t, err)
+	require.Equal(t, []models.Tag{
+		{Name: []byte("__name__"), Value: []byte("requests")},
+		{Name: []byte("host"), Value: []byte("a")},
+	}, validated.Tags)
+}
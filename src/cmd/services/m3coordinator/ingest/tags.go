@@ -0,0 +1,225 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+)
+
+// DuplicateTagsBehavior determines how a series that contains more than one
+// tag with the same name is handled by the write path.
+type DuplicateTagsBehavior uint
+
+const (
+	// DuplicateTagsError rejects any series that has repeated tag names.
+	DuplicateTagsError DuplicateTagsBehavior = iota
+	// DuplicateTagsKeepFirst keeps the first occurrence of a repeated tag name
+	// and discards the rest.
+	DuplicateTagsKeepFirst
+	// DuplicateTagsKeepLast keeps the last occurrence of a repeated tag name
+	// and discards the rest.
+	DuplicateTagsKeepLast
+	// DuplicateTagsMerge combines the values of a repeated tag name into a
+	// single tag, joining the values in order of appearance with a comma.
+	DuplicateTagsMerge
+)
+
+var (
+	validDuplicateTagsBehaviors = []DuplicateTagsBehavior{
+		DuplicateTagsError,
+		DuplicateTagsKeepFirst,
+		DuplicateTagsKeepLast,
+		DuplicateTagsMerge,
+	}
+
+	duplicateTagsMergeSeparator = []byte(",")
+)
+
+func (b DuplicateTagsBehavior) String() string {
+	switch b {
+	case DuplicateTagsError:
+		return "error"
+	case DuplicateTagsKeepFirst:
+		return "keep_first"
+	case DuplicateTagsKeepLast:
+		return "keep_last"
+	case DuplicateTagsMerge:
+		return "merge"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmarshalYAML unmarshals a duplicate tags behavior.
+func (b *DuplicateTagsBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		*b = DuplicateTagsError
+		return nil
+	}
+
+	for _, valid := range validDuplicateTagsBehaviors {
+		if str == valid.String() {
+			*b = valid
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid DuplicateTagsBehavior '%s' valid types are: %v",
+		str, validDuplicateTagsBehaviors)
+}
+
+// prepareTags applies all the filters and validation that the write path
+// performs on the tags of a series before writing them, returning the tags
+// that should be written or an error if the series must be rejected.
+func (d *downsamplerAndWriter) prepareTags(tags models.Tags) (models.Tags, error) {
+	tags, stripped := d.tagFilter.filter(tags)
+	if stripped > 0 {
+		d.metrics.tagsStripped.Inc(int64(stripped))
+	}
+
+	return resolveDuplicateTags(tags, d.opts.DuplicateTags)
+}
+
+// pipelineTags runs the tags of a series through the tag pipeline of the
+// write path: filtering, duplicate tags, the source tag, computed tags,
+// relabeling and validation. It returns false if relabeling drops the
+// series. Stripped tags and dropped and invalid series are only counted if
+// record is set, so that validating a series does not count it and the
+// series of batches are counted once.
+func (d *downsamplerAndWriter) pipelineTags(
+	ctx context.Context,
+	tags models.Tags,
+	source string,
+	datapoints ts.Datapoints,
+	record bool,
+) (models.Tags, bool, error) {
+	tags, stripped := d.tagFilter.filter(tags)
+	if record && stripped > 0 {
+		d.metrics.tagsStripped.Inc(int64(stripped))
+	}
+	tags, err := resolveDuplicateTags(tags, d.opts.DuplicateTags)
+	if err != nil {
+		return tags, false, err
+	}
+	tags = d.tagSource(tags, seriesSource(ctx, source))
+	tags = d.computeTags(tags, datapoints)
+	tags, ok := d.relabel(tags, record)
+	if !ok {
+		return tags, false, nil
+	}
+	tags, err = d.validateTags(tags, record)
+	if err != nil {
+		return tags, false, err
+	}
+	return tags, true, nil
+}
+
+func (d *downsamplerAndWriter) WouldAccept(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+) (bool, string) {
+	_, ok, err := d.pipelineTags(ctx, tags, "", datapoints, false)
+	if err != nil {
+		return false, err.Error()
+	}
+	if !ok {
+		return false, errRelabelDropped.Error()
+	}
+	return true, ""
+}
+
+// resolveDuplicateTags applies the duplicate tags behavior to the tags. The
+// common case of no duplicates returns the tags untouched; otherwise a new
+// tags slice is allocated so that the caller's slice is never mutated.
+func resolveDuplicateTags(
+	tags models.Tags,
+	behavior DuplicateTagsBehavior,
+) (models.Tags, error) {
+	name, ok := firstDuplicateTagName(tags.Tags)
+	if !ok {
+		return tags, nil
+	}
+
+	if behavior == DuplicateTagsError {
+		return tags, xerrors.NewInvalidParamsError(
+			fmt.Errorf("series has duplicate tag name: %s", string(name)))
+	}
+
+	resolved := make([]models.Tag, 0, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		idx := -1
+		for i, existing := range resolved {
+			if bytes.Equal(existing.Name, tag.Name) {
+				idx = i
+				break
+			}
+		}
+
+		if idx < 0 {
+			resolved = append(resolved, tag)
+			continue
+		}
+
+		switch behavior {
+		case DuplicateTagsKeepFirst:
+			// Nothing to do, the first occurrence is already present.
+		case DuplicateTagsKeepLast:
+			resolved[idx].Value = tag.Value
+		case DuplicateTagsMerge:
+			value := make([]byte, 0,
+				len(resolved[idx].Value)+len(duplicateTagsMergeSeparator)+len(tag.Value))
+			value = append(value, resolved[idx].Value...)
+			value = append(value, duplicateTagsMergeSeparator...)
+			value = append(value, tag.Value...)
+			resolved[idx].Value = value
+		default:
+			return tags, fmt.Errorf("unknown duplicate tags behavior: %d", behavior)
+		}
+	}
+
+	return models.Tags{Opts: tags.Opts, Tags: resolved}, nil
+}
+
+func firstDuplicateTagName(tags []models.Tag) ([]byte, bool) {
+	// Series generally have a small number of tags so a quadratic scan is
+	// cheaper than allocating a set.
+	for i := 1; i < len(tags); i++ {
+		for j := 0; j < i; j++ {
+			if bytes.Equal(tags[i].Name, tags[j].Name) {
+				return tags[i].Name, true
+			}
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m3db/m3/src/query/models"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Constructed directly rather than with AddTags to preserve the order.
+var testDuplicateTags = models.Tags{
+	Opts: models.NewTagOptions(),
+	Tags: []models.Tag{
+		{Name: []byte("foo"), Value: []byte("a")},
+		{Name: []byte("bar"), Value: []byte("b")},
+		{Name: []byte("foo"), Value: []byte("c")},
+	},
+}
+
+func TestResolveDuplicateTags(t *testing.T) {
+	testCases := []struct {
+		behavior DuplicateTagsBehavior
+		expected []models.Tag
+		hasError bool
+	}{
+		{
+			behavior: DuplicateTagsError,
+			hasError: true,
+		},
+		{
+			behavior: DuplicateTagsKeepFirst,
+			expected: []models.Tag{
+				{Name: []byte("foo"), Value: []byte("a")},
+				{Name: []byte("bar"), Value: []byte("b")},
+			},
+		},
+		{
+			behavior: DuplicateTagsKeepLast,
+			expected: []models.Tag{
+				{Name: []byte("foo"), Value: []byte("c")},
+				{Name: []byte("bar"), Value: []byte("b")},
+			},
+		},
+		{
+			behavior: DuplicateTagsMerge,
+			expected: []models.Tag{
+				{Name: []byte("foo"), Value: []byte("a,c")},
+				{Name: []byte("bar"), Value: []byte("b")},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.behavior.String(), func(t *testing.T) {
+			tags, err := resolveDuplicateTags(testDuplicateTags, tc.behavior)
+			if tc.hasError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, tags.Tags)
+			// Make sure the input was not mutated.
+			require.Equal(t, 3, len(testDuplicateTags.Tags))
+			require.Equal(t, []byte("a"), testDuplicateTags.Tags[0].Value)
+		})
+	}
+}
+
+func TestResolveDuplicateTagsNoDuplicates(t *testing.T) {
+	for _, behavior := range validDuplicateTagsBehaviors {
+		tags, err := resolveDuplicateTags(testTags1, behavior)
+		require.NoError(t, err)
+		require.Equal(t, testTags1, tags)
+	}
+}
+
+func TestDuplicateTagsBehaviorUnmarshalYAML(t *testing.T) {
+	for _, behavior := range validDuplicateTagsBehaviors {
+		var cfg Configuration
+		str := "duplicateTags: " + behavior.String() + "\n"
+		require.NoError(t, yaml.Unmarshal([]byte(str), &cfg))
+		require.Equal(t, behavior, cfg.DuplicateTags)
+	}
+
+	var cfg Configuration
+	require.Error(t, yaml.Unmarshal([]byte("duplicateTags: bad\n"), &cfg))
+}
+
+func TestDownsampleAndWriteDuplicateTagsError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither the downsampler nor the storage should be written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	err := downAndWrite.Write(
+		context.Background(), testDuplicateTags, testDatapoints1, xtime.Second, defaultOverride)
+	require.Error(t, err)
+}
+
+func TestDownsampleAndWriteBatchDuplicateTagsKeepLast(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+	downAndWrite.opts.DuplicateTags = DuplicateTagsKeepLast
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testDuplicateTags, datapoints: testDatapoints1},
+	})
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteWouldAccept(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Nothing should be written to the downsampler or storage.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	ok, reason := downAndWrite.WouldAccept(context.Background(), testTags1, testDatapoints1)
+	require.True(t, ok)
+	require.Equal(t, "", reason)
+
+	ok, reason = downAndWrite.WouldAccept(context.Background(), testDuplicateTags, testDatapoints1)
+	require.False(t, ok)
+	require.Equal(t, "series has duplicate tag name: foo", reason)
+
+	downAndWrite.opts.DuplicateTags = DuplicateTagsKeepFirst
+	ok, _ = downAndWrite.WouldAccept(context.Background(), testDuplicateTags, testDatapoints1)
+	require.True(t, ok)
+}
+
+func TestDownsampleAndWriteWouldAcceptSourceTag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	relabeler, err := NewRelabeler([]RelabelRule{{
+		SourceLabels: []string{"tenant"},
+		Regex:        "team-a",
+		Action:       RelabelDrop,
+	}})
+	require.NoError(t, err)
+
+	// Nothing should be written to the downsampler or storage.
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		SourceTagName: "tenant",
+		Relabeler:     relabeler,
+	})
+
+	ctx := NewContextWithSource(context.Background(), "team-a")
+	ok, reason := downAndWrite.WouldAccept(ctx, testTags1, testDatapoints1)
+	require.False(t, ok)
+	require.Equal(t, errRelabelDropped.Error(), reason)
+
+	ctx = NewContextWithSource(context.Background(), "team-b")
+	ok, _ = downAndWrite.WouldAccept(ctx, testTags1, testDatapoints1)
+	require.True(t, ok)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+)
+
+// TimestampTruncationOptions configures truncating the timestamps of the
+// datapoints of writes made with Write to a coarser resolution, keeping
+// series aligned which improves their compression.
+type TimestampTruncationOptions struct {
+	// Resolution is the resolution timestamps are truncated to, timestamps
+	// are not truncated if not set. Sources can set their own resolution
+	// with WriteOptions.TimestampResolution.
+	Resolution time.Duration
+
+	// Collisions determines how the datapoints of a write whose truncated
+	// timestamps collide are combined, by default they are all written and
+	// the last one written wins.
+	Collisions SubResolutionBehavior
+}
+
+// truncateTimestamps returns the datapoints with their timestamps
+// truncated to the resolution of the write, combining those that collide
+// as configured. The datapoints of the caller are never mutated.
+func (d *downsamplerAndWriter) truncateTimestamps(
+	datapoints ts.Datapoints,
+	overrides WriteOptions,
+) ts.Datapoints {
+	resolution := d.opts.TimestampTruncation.Resolution
+	if overrides.TimestampResolution > 0 {
+		resolution = overrides.TimestampResolution
+	}
+	if resolution <= 0 || len(datapoints) == 0 {
+		return datapoints
+	}
+
+	collisions := d.opts.TimestampTruncation.Collisions
+	if collisions != SubResolutionNone {
+		truncated := combineDatapointWindows(datapoints, collisions, func(t time.Time) time.Time {
+			return t.Truncate(resolution)
+		})
+		if combined := len(datapoints) - len(truncated); combined > 0 {
+			d.metrics.timestampCollisions.Inc(int64(combined))
+		}
+		return truncated
+	}
+
+	truncated := make(ts.Datapoints, 0, len(datapoints))
+	for _, dp := range datapoints {
+		truncated = append(truncated, ts.Datapoint{
+			Timestamp:  dp.Timestamp.Truncate(resolution),
+			Value:      dp.Value,
+			Annotation: dp.Annotation,
+		})
+	}
+	return truncated
+}
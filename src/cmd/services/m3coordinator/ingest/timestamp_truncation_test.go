@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestTruncateTimestamps(t *testing.T) {
+	datapoints := ts.Datapoints{
+		{Timestamp: time.Unix(12, 400), Value: 1},
+		{Timestamp: time.Unix(12, 900), Value: 2},
+		{Timestamp: time.Unix(13, 100), Value: 3},
+	}
+
+	tests := []struct {
+		name       string
+		opts       TimestampTruncationOptions
+		overrides  WriteOptions
+		expected   ts.Datapoints
+		collisions int64
+	}{
+		{
+			name:     "disabled",
+			expected: datapoints,
+		},
+		{
+			name: "keep collisions",
+			opts: TimestampTruncationOptions{Resolution: time.Second},
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(12, 0), Value: 1},
+				{Timestamp: time.Unix(12, 0), Value: 2},
+				{Timestamp: time.Unix(13, 0), Value: 3},
+			},
+		},
+		{
+			name: "sum collisions",
+			opts: TimestampTruncationOptions{
+				Resolution: time.Second,
+				Collisions: SubResolutionSum,
+			},
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(12, 0), Value: 3},
+				{Timestamp: time.Unix(13, 0), Value: 3},
+			},
+			collisions: 1,
+		},
+		{
+			name: "write resolution",
+			opts: TimestampTruncationOptions{
+				Resolution: time.Second,
+				Collisions: SubResolutionLast,
+			},
+			overrides: WriteOptions{TimestampResolution: 10 * time.Second},
+			expected: ts.Datapoints{
+				{Timestamp: time.Unix(10, 0), Value: 3},
+			},
+			collisions: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scope := tally.NewTestScope("", nil)
+			downAndWrite := &downsamplerAndWriter{
+				opts:    Options{TimestampTruncation: test.opts},
+				metrics: newDownsamplerAndWriterMetrics(scope),
+			}
+
+			truncated := downAndWrite.truncateTimestamps(datapoints, test.overrides)
+			require.Equal(t, test.expected, truncated)
+
+			counters := scope.Snapshot().Counters()
+			require.Equal(t, test.collisions,
+				counters["timestamp-truncation.collisions+"].Value())
+		})
+	}
+
+	// The datapoints of the caller are never mutated.
+	require.Equal(t, time.Unix(12, 400), datapoints[0].Timestamp)
+}
+
+func TestDownsampleAndWriteTruncatesTimestamps(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		InstrumentOptions: instrument.NewOptions(),
+		TimestampTruncation: TimestampTruncationOptions{
+			Resolution: time.Second,
+			Collisions: SubResolutionLast,
+		},
+	})
+	downAndWrite.downsampler = nil
+
+	session.EXPECT().WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(),
+		time.Unix(5, 0), 2.0, gomock.Any(), gomock.Any())
+
+	datapoints := ts.Datapoints{
+		{Timestamp: time.Unix(5, 100), Value: 1},
+		{Timestamp: time.Unix(5, 200), Value: 2},
+	}
+	err := downAndWrite.Write(
+		context.Background(), testTags1, datapoints, xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+)
+
+var (
+	errTombstonesNotSupported   = errors.New("storage does not support deleting series")
+	errTombstoneRangeIncomplete = errors.New("tombstone range must set both start and end or neither")
+	errTombstoneRangeInvalid    = errors.New("tombstone range start must be before end")
+)
+
+// WriteTombstone deletes a series from storage, either entirely if neither
+// start nor end is set or only the datapoints within [start, end). The tags
+// go through the same filtering and validation as writes so that they
+// identify the stored series, computed tags are not derived since they can
+// depend on the written values and so must be passed explicitly.
+//
+// Only storage is affected, datapoints that were already aggregated by the
+// downsampler are flushed to the aggregated namespaces as usual.
+func (d *downsamplerAndWriter) WriteTombstone(
+	ctx context.Context,
+	tags models.Tags,
+	start time.Time,
+	end time.Time,
+) error {
+	if err := validateTombstoneRange(start, end); err != nil {
+		return err
+	}
+
+	deleter, ok := d.store.(storage.Deleter)
+	if !ok {
+		return errTombstonesNotSupported
+	}
+
+	tags, err := d.prepareTags(tags)
+	if err != nil {
+		return err
+	}
+
+	err = deleter.Delete(ctx, &storage.DeleteQuery{
+		Tags:  tags,
+		Start: start,
+		End:   end,
+	})
+	if err != nil {
+		d.metrics.tombstoneErrors.Inc(1)
+		return err
+	}
+	d.metrics.tombstones.Inc(1)
+	return nil
+}
+
+func validateTombstoneRange(start, end time.Time) error {
+	if start.IsZero() != end.IsZero() {
+		return errTombstoneRangeIncomplete
+	}
+	if !start.IsZero() && !start.Before(end) {
+		return errTombstoneRangeInvalid
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/storage"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+type testDeletingStorage struct {
+	storage.Storage
+
+	deleted []*storage.DeleteQuery
+}
+
+func (s *testDeletingStorage) Delete(_ context.Context, query *storage.DeleteQuery) error {
+	s.deleted = append(s.deleted, query)
+	return nil
+}
+
+func TestValidateTombstoneRange(t *testing.T) {
+	now := time.Now()
+	require.NoError(t, validateTombstoneRange(time.Time{}, time.Time{}))
+	require.NoError(t, validateTombstoneRange(now.Add(-time.Hour), now))
+	require.Equal(t, errTombstoneRangeIncomplete, validateTombstoneRange(now, time.Time{}))
+	require.Equal(t, errTombstoneRangeIncomplete, validateTombstoneRange(time.Time{}, now))
+	require.Equal(t, errTombstoneRangeInvalid, validateTombstoneRange(now, now))
+	require.Equal(t, errTombstoneRangeInvalid, validateTombstoneRange(now, now.Add(-time.Hour)))
+}
+
+func TestWriteTombstoneNotSupported(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+	err := downAndWrite.WriteTombstone(context.Background(), testTags1, time.Time{}, time.Time{})
+	require.Equal(t, errTombstonesNotSupported, err)
+}
+
+func TestWriteTombstone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+	store := &testDeletingStorage{Storage: downAndWrite.store}
+	downAndWrite.store = store
+
+	var (
+		end   = time.Now()
+		start = end.Add(-time.Hour)
+	)
+	err := downAndWrite.WriteTombstone(context.Background(), testTags1, start, end)
+	require.NoError(t, err)
+
+	err = downAndWrite.WriteTombstone(context.Background(), testTags1, end, start)
+	require.Equal(t, errTombstoneRangeInvalid, err)
+
+	require.Len(t, store.deleted, 1)
+	require.Equal(t, testTags1, store.deleted[0].Tags)
+	require.Equal(t, start, store.deleted[0].Start)
+	require.Equal(t, end, store.deleted[0].End)
+}
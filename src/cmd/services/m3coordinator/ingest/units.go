@@ -0,0 +1,59 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"fmt"
+
+	xerrors "github.com/m3db/m3x/errors"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// defaultUnit is the unit of writes that do not set one if the writer does
+// not configure a default unit.
+const defaultUnit = xtime.Second
+
+// writeUnit returns the unit a write is stored with, substituting the
+// default unit of the writer if the write does not set one.
+func (d *downsamplerAndWriter) writeUnit(unit xtime.Unit) (xtime.Unit, error) {
+	if unit == xtime.None {
+		unit = d.opts.DefaultUnit
+	}
+	if unit == xtime.None {
+		unit = defaultUnit
+	}
+	if !unit.IsValid() {
+		return xtime.None, xerrors.NewInvalidParamsError(fmt.Errorf(
+			"invalid unit '%d' valid units are: %v", uint(unit), validUnits))
+	}
+	return unit, nil
+}
+
+var validUnits = []xtime.Unit{
+	xtime.Second,
+	xtime.Millisecond,
+	xtime.Microsecond,
+	xtime.Nanosecond,
+	xtime.Minute,
+	xtime.Hour,
+	xtime.Day,
+	xtime.Year,
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteDefaultUnit(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultUnit xtime.Unit
+		unit        xtime.Unit
+		expected    xtime.Unit
+	}{
+		{name: "unset", unit: xtime.None, expected: xtime.Second},
+		{name: "configured", defaultUnit: xtime.Millisecond, unit: xtime.None, expected: xtime.Millisecond},
+		{name: "set by write", defaultUnit: xtime.Millisecond, unit: xtime.Nanosecond, expected: xtime.Nanosecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+				Options{DefaultUnit: test.defaultUnit})
+
+			expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+			for _, dp := range testDatapoints1 {
+				session.EXPECT().WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(),
+					gomock.Any(), dp.Value, test.expected, gomock.Any())
+			}
+
+			err := downAndWrite.Write(
+				context.Background(), testTags1, testDatapoints1, test.unit, WriteOptions{})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDownsampleAndWriteInvalidUnit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No expectations are set on the downsampler or the session, so any
+	// write fails the test.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Unit(100), WriteOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid unit '100'")
+
+	// A default unit that is not valid is rejected in the same way.
+	downAndWrite, _, _ = newTestDownsamplerAndWriterWithOptions(t, ctrl,
+		Options{DefaultUnit: xtime.Unit(100)})
+	err = downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.None, WriteOptions{})
+	require.Error(t, err)
+}
+
+func TestConfigurationNewOptionsDefaultUnit(t *testing.T) {
+	opts, err := Configuration{DefaultUnit: time.Millisecond}.NewOptions(instrument.NewOptions())
+	require.NoError(t, err)
+	require.Equal(t, xtime.Millisecond, opts.DefaultUnit)
+
+	_, err = Configuration{DefaultUnit: 3 * time.Second}.NewOptions(instrument.NewOptions())
+	require.Error(t, err)
+}
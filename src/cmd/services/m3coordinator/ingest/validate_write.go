@@ -0,0 +1,222 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+)
+
+// WriteValidation describes where a write would be written to, as returned
+// by ValidateWrite.
+type WriteValidation struct {
+	// Tags are the tags of the series after filtering, computed tags,
+	// relabeling and tag validation are applied.
+	Tags models.Tags
+	// Dropped is whether the series would be dropped by relabeling, if so
+	// none of the other fields are set.
+	Dropped bool
+	// Downsample is whether the datapoints would be written to the
+	// downsampler.
+	Downsample bool
+	// DownsampleOptions are the samples appender options the downsampler
+	// would be written to with.
+	DownsampleOptions downsample.SampleAppenderOptions
+	// Destinations are the storage namespaces the datapoints would be
+	// written to directly.
+	Destinations []storage.Attributes
+}
+
+// ValidateWrite applies the same transforms and validation as Write to a
+// series without writing it to either the downsampler or storage. Since
+// nothing is written the cardinality budget is not consulted, and immediate
+// flushes, which are best effort, are not included in the destinations.
+func (d *downsamplerAndWriter) ValidateWrite(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	overrides WriteOptions,
+) (WriteValidation, error) {
+	return d.validateWrite(ctx, tags, datapoints, overrides, false)
+}
+
+// ResolveDestinations returns the namespaces a write of the series with the
+// overrides would target, without writing it. Since no datapoints are given
+// every namespace a value route could send a datapoint to is included. The
+// aggregated namespaces of override mapping rules are included while those
+// of the default mapping rules of the downsampler are not, as they are only
+// known to the downsampler.
+func (d *downsamplerAndWriter) ResolveDestinations(
+	tags models.Tags,
+	overrides WriteOptions,
+) ([]storage.Attributes, error) {
+	result, err := d.validateWrite(context.Background(), tags, nil, overrides, true)
+	if err != nil {
+		return nil, err
+	}
+
+	destinations := result.Destinations
+	if !result.Downsample || !result.DownsampleOptions.Override {
+		return destinations, nil
+	}
+	for _, rule := range result.DownsampleOptions.OverrideRules.MappingRules {
+		for _, p := range rule.Policies {
+			destinations = appendDestination(destinations, storage.Attributes{
+				MetricsType: storage.AggregatedMetricsType,
+				Resolution:  p.Resolution().Window,
+				Retention:   p.Retention().Duration(),
+			})
+		}
+	}
+	return destinations, nil
+}
+
+// appendDestination appends a namespace to the destinations unless it is
+// already one of them.
+func appendDestination(
+	destinations []storage.Attributes,
+	attrs storage.Attributes,
+) []storage.Attributes {
+	for _, existing := range destinations {
+		if existing == attrs {
+			return destinations
+		}
+	}
+	return append(destinations, attrs)
+}
+
+// validateWrite implements ValidateWrite, if allRoutes is set the
+// destinations include every value route regardless of the datapoints.
+func (d *downsamplerAndWriter) validateWrite(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	overrides WriteOptions,
+	allRoutes bool,
+) (WriteValidation, error) {
+	if err := overrides.MetricType.Validate(); err != nil {
+		return WriteValidation{}, err
+	}
+
+	datapoints, err := d.resolveSequences(datapoints, overrides.Sequences)
+	if err != nil {
+		return WriteValidation{}, err
+	}
+	datapoints = d.truncateTimestamps(datapoints, overrides)
+
+	// Nothing is written so nothing is counted.
+	tags, ok, err := d.pipelineTags(ctx, tags, "", datapoints, false)
+	if err != nil {
+		return WriteValidation{}, err
+	}
+	if !ok {
+		return WriteValidation{Dropped: true}, nil
+	}
+
+	overrides = d.applySourceDefaults(ctx, overrides)
+	overrides, err = d.limitStoragePolicyFanout(overrides, false)
+	if err != nil {
+		return WriteValidation{}, err
+	}
+	if err := d.validateDualTier(overrides); err != nil {
+		return WriteValidation{}, err
+	}
+	if err := validateFlushImmediately(overrides); err != nil {
+		return WriteValidation{}, err
+	}
+
+	result := WriteValidation{Tags: tags}
+	appenderOpts, shouldDownsample := downsampleAppenderOptions(overrides)
+	if d.downsampler != nil && shouldDownsample {
+		result.Downsample = true
+		result.DownsampleOptions = appenderOpts
+	}
+	result.Destinations = d.writeDestinations(datapoints, overrides, allRoutes)
+	return result, nil
+}
+
+// writeDestinations returns the storage namespaces that maybeWriteStorage
+// would write the datapoints to, or could write any datapoint to if
+// allRoutes is set.
+func (d *downsamplerAndWriter) writeDestinations(
+	datapoints ts.Datapoints,
+	overrides WriteOptions,
+	allRoutes bool,
+) []storage.Attributes {
+	if d.store == nil {
+		return nil
+	}
+
+	unaggregated := storage.Attributes{
+		MetricsType: storage.UnaggregatedMetricsType,
+	}
+	if p := overrides.DualTierStoragePolicy; p != nil {
+		return []storage.Attributes{unaggregated, dualTierAggregatedAttributes(*p)}
+	}
+
+	if overrides.WriteOverride {
+		destinations := make([]storage.Attributes, 0, len(overrides.WriteStoragePolicies))
+		for i := range overrides.WriteStoragePolicies {
+			destinations = append(destinations, storagePolicyAttributes(overrides, i))
+		}
+		return destinations
+	}
+
+	routes := d.opts.ValueRoutes
+	if len(routes) == 0 {
+		if d.opts.SkipUnaggregated {
+			return nil
+		}
+		return []storage.Attributes{unaggregated}
+	}
+
+	// Only namespaces that at least one datapoint is routed to are written.
+	routed := make([]bool, len(routes)+1)
+	for _, dp := range datapoints {
+		routed[valueRouteIndex(routes, dp.Value)+1] = true
+	}
+	if allRoutes {
+		for i := range routed {
+			routed[i] = true
+		}
+	}
+	var destinations []storage.Attributes
+	for i, ok := range routed {
+		if !ok || (i == 0 && d.opts.SkipUnaggregated) {
+			continue
+		}
+		if i == 0 {
+			destinations = append(destinations, unaggregated)
+			continue
+		}
+		p := routes[i-1].StoragePolicy
+		destinations = append(destinations, storage.Attributes{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  p.Resolution().Window,
+			Retention:   p.Retention().Duration(),
+		})
+	}
+	return destinations
+}
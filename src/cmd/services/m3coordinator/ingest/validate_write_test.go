@@ -0,0 +1,190 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/metrics/aggregation"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteValidateWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No expectations are set on the downsampler or the session, so any
+	// write fails the test.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	result, err := downAndWrite.ValidateWrite(context.Background(), testTags1,
+		testDatapoints1, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, testTags1, result.Tags)
+	require.True(t, result.Downsample)
+	require.Equal(t, zeroDownsamplerAppenderOpts, result.DownsampleOptions)
+	require.Equal(t, []storage.Attributes{
+		{MetricsType: storage.UnaggregatedMetricsType},
+	}, result.Destinations)
+
+	result, err = downAndWrite.ValidateWrite(context.Background(), testTags1,
+		testDatapoints1, WriteOptions{
+			DownsampleOverride: true,
+			WriteOverride:      true,
+			WriteStoragePolicies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			},
+		})
+	require.NoError(t, err)
+	require.False(t, result.Downsample)
+	require.Equal(t, []storage.Attributes{
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}, result.Destinations)
+}
+
+func TestDownsampleAndWriteValidateWriteFanoutExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+		Options{MaxStoragePolicyFanout: 1})
+
+	_, err := downAndWrite.ValidateWrite(context.Background(), testTags1,
+		testDatapoints1, WriteOptions{
+			WriteOverride: true,
+			WriteStoragePolicies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+				policy.NewStoragePolicy(10*time.Second, xtime.Second, 24*time.Hour),
+			},
+		})
+	require.Error(t, err)
+}
+
+func TestDownsampleAndWriteResolveDestinations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	// The default mapping rules are only known to the downsampler, so only
+	// the unaggregated namespace is resolved.
+	destinations, err := downAndWrite.ResolveDestinations(testTags1, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []storage.Attributes{
+		{MetricsType: storage.UnaggregatedMetricsType},
+	}, destinations)
+
+	// Override mapping rules and storage policies both resolve to their
+	// aggregated namespaces, each namespace is only included once.
+	destinations, err = downAndWrite.ResolveDestinations(testTags1, WriteOptions{
+		DownsampleOverride: true,
+		DownsampleMappingRules: []downsample.MappingRule{
+			{
+				Aggregations: []aggregation.Type{aggregation.Max},
+				Policies: policy.StoragePolicies{
+					policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+					policy.NewStoragePolicy(time.Hour, xtime.Second, 720*time.Hour),
+				},
+			},
+		},
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []storage.Attributes{
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Hour,
+			Retention:   720 * time.Hour,
+		},
+	}, destinations)
+
+	// Overriding the mapping rules without any rule skips downsampling.
+	destinations, err = downAndWrite.ResolveDestinations(testTags1, WriteOptions{
+		DownsampleOverride: true,
+		WriteOverride:      true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, destinations)
+}
+
+func TestDownsampleAndWriteResolveDestinationsValueRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		ValueRoutes: []ValueRoute{
+			{
+				Above:         1,
+				StoragePolicy: policy.NewStoragePolicy(time.Second, xtime.Second, 24*time.Hour),
+			},
+		},
+	})
+
+	// Without datapoints every namespace a value could be routed to is
+	// resolved.
+	destinations, err := downAndWrite.ResolveDestinations(testTags1, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []storage.Attributes{
+		{MetricsType: storage.UnaggregatedMetricsType},
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}, destinations)
+}
+
+func TestDownsampleAndWriteResolveDestinationsFanoutExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+		Options{MaxStoragePolicyFanout: 1})
+
+	_, err := downAndWrite.ResolveDestinations(testTags1, WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(10*time.Second, xtime.Second, 24*time.Hour),
+		},
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+	xerrors "github.com/m3db/m3x/errors"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// ValueRoute routes the datapoints of unaggregated writes whose value
+// exceeds a threshold to an aggregated namespace, typically one with a
+// higher resolution or a longer retention to capture outliers.
+//
+// Routing splits a series across namespaces: the datapoints that exceed the
+// threshold are only stored in the routed namespace and the rest only in
+// the unaggregated namespace. Queries are served from a single namespace
+// chosen by the query range, so a query served by the unaggregated
+// namespace does not see the routed datapoints and a query served by the
+// routed namespace sees only them.
+type ValueRoute struct {
+	// Above is the threshold a datapoint value must exceed to be routed.
+	Above float64
+	// StoragePolicy is the storage policy of the namespace to route to.
+	StoragePolicy policy.StoragePolicy
+}
+
+// valueRouteIndex returns the index of the route with the highest threshold
+// that the value exceeds, or -1 if the value does not exceed any.
+func valueRouteIndex(routes []ValueRoute, value float64) int {
+	idx := -1
+	for i, route := range routes {
+		if value > route.Above && (idx < 0 || route.Above > routes[idx].Above) {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// writeUnaggregated writes the datapoints to the unaggregated namespace,
+// except for those routed elsewhere by value.
+func (d *downsamplerAndWriter) writeUnaggregated(
+	ctx context.Context,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	annotation []byte,
+) error {
+	unaggregated := storage.Attributes{
+		MetricsType: storage.UnaggregatedMetricsType,
+	}
+
+	routes := d.opts.ValueRoutes
+	if len(routes) == 0 {
+		if d.opts.SkipUnaggregated {
+			return nil
+		}
+		query := d.writeQueries.get()
+		query.Tags = tags
+		query.Datapoints = datapoints
+		query.Unit = unit
+		query.Annotation = annotation
+		query.Attributes = unaggregated
+		err := d.writeStorage(ctx, query)
+		d.writeQueries.put(query)
+		return err
+	}
+
+	// Datapoints that aren't routed are at index zero.
+	routed := make([]ts.Datapoints, len(routes)+1)
+	for _, dp := range datapoints {
+		idx := valueRouteIndex(routes, dp.Value) + 1
+		routed[idx] = append(routed[idx], dp)
+	}
+
+	var multiErr xerrors.MultiError
+	for i, routeDatapoints := range routed {
+		if len(routeDatapoints) == 0 || (i == 0 && d.opts.SkipUnaggregated) {
+			continue
+		}
+
+		attributes := unaggregated
+		if i > 0 {
+			p := routes[i-1].StoragePolicy
+			attributes = storage.Attributes{
+				MetricsType: storage.AggregatedMetricsType,
+				Resolution:  p.Resolution().Window,
+				Retention:   p.Retention().Duration(),
+			}
+			d.metrics.valueRouted.Inc(int64(len(routeDatapoints)))
+		}
+
+		err := d.writeStorage(ctx, &storage.WriteQuery{
+			Tags:       tags,
+			Datapoints: routeDatapoints,
+			Unit:       unit,
+			Annotation: annotation,
+			Attributes: attributes,
+		})
+		if err != nil {
+			multiErr = multiErr.Add(err)
+		}
+	}
+
+	return multiErr.FinalError()
+}
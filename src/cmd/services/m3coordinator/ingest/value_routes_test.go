@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage/m3"
+	testm3 "github.com/m3db/m3/src/query/test/m3"
+	"github.com/m3db/m3x/ident"
+	"github.com/m3db/m3x/instrument"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestValueRouteIndex(t *testing.T) {
+	routes := []ValueRoute{{Above: 10}, {Above: 100}, {Above: 50}}
+	require.Equal(t, -1, valueRouteIndex(routes, 10))
+	require.Equal(t, 0, valueRouteIndex(routes, 11))
+	require.Equal(t, 2, valueRouteIndex(routes, 100))
+	require.Equal(t, 1, valueRouteIndex(routes, 101))
+}
+
+func TestDownsampleAndWriteValueRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	store, session := testm3.NewStorageAndSessionWithAggregatedNamespaces(t, ctrl,
+		[]m3.AggregatedClusterNamespaceDefinition{
+			{
+				NamespaceID: ident.StringID("1s:24h"),
+				Resolution:  time.Second,
+				Retention:   24 * time.Hour,
+			},
+		})
+
+	var (
+		values     = make(map[string][]float64)
+		valuesLock sync.Mutex
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace ident.ID,
+			_ ident.ID,
+			_ ident.TagIterator,
+			_ time.Time,
+			value float64,
+			_ xtime.Unit,
+			_ []byte,
+		) error {
+			valuesLock.Lock()
+			values[namespace.String()] = append(values[namespace.String()], value)
+			valuesLock.Unlock()
+			return nil
+		}).Times(len(testDatapoints1))
+
+	scope := tally.NewTestScope("", nil)
+	downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+		InstrumentOptions: instrument.NewOptions().SetMetricsScope(scope),
+		ValueRoutes: []ValueRoute{
+			{
+				Above:         1,
+				StoragePolicy: policy.NewStoragePolicy(time.Second, xtime.Second, 24*time.Hour),
+			},
+		},
+	})
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, defaultOverride)
+	require.NoError(t, err)
+
+	for _, v := range values {
+		sort.Float64s(v)
+	}
+	require.Equal(t, map[string][]float64{
+		"metrics": {0, 1},
+		"1s:24h":  {2},
+	}, values)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["value-routes.routed+"].Value())
+}
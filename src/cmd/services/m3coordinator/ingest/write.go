@@ -22,27 +22,81 @@ package ingest
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/m3db/m3/src/aggregator/rate"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/metrics/aggregation"
 	"github.com/m3db/m3/src/metrics/policy"
 	"github.com/m3db/m3/src/query/models"
 	"github.com/m3db/m3/src/query/storage"
 	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3x/clock"
 	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/instrument"
+	"github.com/m3db/m3x/log"
+	"github.com/m3db/m3x/retry"
 	xsync "github.com/m3db/m3x/sync"
 	xtime "github.com/m3db/m3x/time"
 )
 
+// ErrNoWriteDestination is returned by writes of a DownsamplerAndWriter that
+// has neither a downsampler nor storage to write to, which would otherwise
+// silently discard every write.
+var ErrNoWriteDestination = errors.New(
+	"downsampler and writer has neither a downsampler nor storage to write to")
+
 // DownsampleAndWriteIter is an interface that can be implemented to use
 // the WriteBatch method.
 type DownsampleAndWriteIter interface {
 	Next() bool
-	Current() (models.Tags, ts.Datapoints, xtime.Unit)
+	Current() IterValue
 	Reset() error
 	Error() error
 }
 
+// IterValue is the value returned by a DownsampleAndWriteIter.
+type IterValue struct {
+	Tags       models.Tags
+	Datapoints ts.Datapoints
+	Unit       xtime.Unit
+
+	// GaugeStats are pre-computed gauge statistics to write for the series,
+	// if set they are written in place of the datapoints.
+	GaugeStats []GaugeStats
+
+	// Type is the metric type of the datapoints of the series, if unknown
+	// the series is classified as described by
+	// MetricTypeClassificationOptions.
+	Type MetricType
+	// DatapointTypes optionally sets the metric type of each datapoint,
+	// for metrics migrating from one type to another. If set it must be
+	// the same length as the datapoints and takes precedence over Type for
+	// every datapoint with a known metric type.
+	DatapointTypes []MetricType
+
+	// Source optionally identifies the source of the series, such as the
+	// tenant that sent it, in place of the source of the context of the
+	// batch, see Options.SourceTagName.
+	Source string
+
+	// Overrides optionally overrides the mapping rules and storage policies
+	// of the series the same way the overrides of a Write do, only the
+	// DownsampleOverride, DownsampleMappingRules, DownsampleAggregations,
+	// WriteOverride, WriteStoragePolicies, WriteNamespaceIDs and
+	// WriteMetricsTypes fields are used.
+	Overrides WriteOptions
+}
+
+// BatchCommitFn is called with the result of a batch once it has been
+// written, allowing consumers of at-least-once sources to acknowledge the
+// batch only after it is durably written.
+type BatchCommitFn func(err error)
+
 // DownsamplerAndWriter is the interface for the downsamplerAndWriter which
 // writes metrics to the downsampler as well as to storage in unaggregated form.
 type DownsamplerAndWriter interface {
@@ -54,13 +108,133 @@ type DownsamplerAndWriter interface {
 		overrides WriteOptions,
 	) error
 
-	// TODO(rartoul): Batch interface should also support downsampling rules.
+	// WriteBatch writes all the series of the iterator, if commit is not nil
+	// it is called exactly once after all the writes of the batch have
+	// completed with the error of the batch, which is nil only if every write
+	// succeeded. Once ctx is cancelled no further series are written and
+	// the error of the batch includes the error of ctx. A batch that fails
+	// once its series started being written fails with a *BatchWriteError.
 	WriteBatch(
 		ctx context.Context,
 		iter DownsampleAndWriteIter,
+		commit BatchCommitFn,
+	) error
+
+	// WriteSeries writes the series the same way as WriteBatch, it is a
+	// convenience for callers with a handful of series already in memory.
+	// Producers that stream large numbers of series should implement
+	// DownsampleAndWriteIter and use WriteBatch instead.
+	WriteSeries(ctx context.Context, series []WriteSeriesRequest) error
+
+	// WriteBatchWithResult writes all the series of the iterator the same
+	// way as WriteBatch and additionally returns which of the series failed
+	// to be written, for callers that respond to partial failures.
+	WriteBatchWithResult(
+		ctx context.Context,
+		iter DownsampleAndWriteIter,
+	) (WriteBatchResult, error)
+
+	// WriteGaugeStats writes pre-computed gauge statistics for a series, the
+	// min, max and last values are preserved by the aggregated namespaces and
+	// the last value is written to the unaggregated namespace.
+	WriteGaugeStats(
+		ctx context.Context,
+		tags models.Tags,
+		stats []GaugeStats,
+		unit xtime.Unit,
+		overrides WriteOptions,
 	) error
 
+	// WriteWithResourceAttributes writes a series of an OpenTelemetry
+	// metric, merging the attributes of the resource that produced it into
+	// its tags as configured by the resource attributes options.
+	WriteWithResourceAttributes(
+		ctx context.Context,
+		resource []models.Tag,
+		tags models.Tags,
+		datapoints ts.Datapoints,
+		unit xtime.Unit,
+		overrides WriteOptions,
+	) error
+
+	// WriteSamples writes the datapoints of several metric types of a
+	// series, such as the counters, gauges and timers of a single flush, to
+	// the downsampler with a single appender so the tags of the series are
+	// only added once. Storage receives the datapoints of all the metric
+	// types, datapoints of different types that share a timestamp collide in
+	// the unaggregated namespace. Sequences are not supported.
+	WriteSamples(
+		ctx context.Context,
+		tags models.Tags,
+		samples []MetricSamples,
+		unit xtime.Unit,
+		overrides WriteOptions,
+	) error
+
+	// WriteTombstone deletes a series, or only its datapoints within the
+	// given time range if set, from storage. The storage must support
+	// deletes, see storage.Deleter.
+	WriteTombstone(
+		ctx context.Context,
+		tags models.Tags,
+		start time.Time,
+		end time.Time,
+	) error
+
+	// RegisterSourceDefaults registers the mapping rules and storage
+	// policies used by the writes of a source, see NewContextWithSource,
+	// that do not override them. Only the overrides that are set in the
+	// defaults are applied.
+	RegisterSourceDefaults(source string, defaults WriteOptions)
+
+	// SetSourceDefaults replaces the defaults of all sources, allowing them
+	// to be reloaded.
+	SetSourceDefaults(defaults map[string]WriteOptions)
+
+	// SourceDefaults returns the defaults registered for a source.
+	SourceDefaults(source string) (WriteOptions, bool)
+
 	Storage() storage.Storage
+
+	// AppenderUsage returns the number of downsampler appenders currently in
+	// use across all calls and the maximum allowed, a limit of zero means
+	// the number of concurrent appenders is unbounded.
+	AppenderUsage() (inUse int, limit int)
+
+	// WouldAccept runs the same tag pipeline the write path applies to a
+	// series written with the context and datapoints, including the source
+	// and computed tags, without writing anything, returning whether a write
+	// of the series would be accepted and if not the reason why.
+	WouldAccept(
+		ctx context.Context,
+		tags models.Tags,
+		datapoints ts.Datapoints,
+	) (bool, string)
+
+	// ValidateWrite runs the same transforms and validation as Write without
+	// writing anything, returning where the series would be written.
+	ValidateWrite(
+		ctx context.Context,
+		tags models.Tags,
+		datapoints ts.Datapoints,
+		overrides WriteOptions,
+	) (WriteValidation, error)
+
+	// ResolveDestinations returns the storage namespaces a write of the
+	// series with the overrides would target, without writing anything.
+	ResolveDestinations(
+		tags models.Tags,
+		overrides WriteOptions,
+	) ([]storage.Attributes, error)
+
+	// DebugState returns a point in time snapshot of the writes in progress.
+	DebugState() DebugState
+
+	// Flush writes the aggregated datapoints of the aggregation windows the
+	// downsampler has closed to storage, for callers that buffer writes and
+	// acknowledge them upstream at flush boundaries. See flush.go for what
+	// it guarantees.
+	Flush() error
 }
 
 // WriteOptions contains overrides for the downsampling mapping
@@ -71,6 +245,71 @@ type WriteOptions struct {
 
 	DownsampleOverride bool
 	WriteOverride      bool
+
+	// DownsampleAggregations optionally overrides the aggregation types the
+	// datapoints are downsampled with, for example to aggregate pre-summed
+	// counters as a sum. With DownsampleOverride set it replaces the
+	// aggregations of each of the DownsampleMappingRules, so that the rules
+	// only need to set the storage policies, otherwise it replaces those of
+	// the default and matched mapping rules of the series. The aggregations
+	// of rollup rules are kept.
+	DownsampleAggregations []aggregation.Type
+
+	// WriteNamespaceIDs optionally sets the ID of the namespace each of the
+	// WriteStoragePolicies is written to, in which case the namespace is
+	// selected by its ID rather than by the resolution and retention of the
+	// storage policy. If set it must be the same length as the storage
+	// policies, an empty ID keeps selecting the namespace of its storage
+	// policy by resolution and retention.
+	WriteNamespaceIDs []string
+
+	// WriteMetricsTypes optionally sets the metrics type of the namespace
+	// each of the WriteStoragePolicies is written to, by default overridden
+	// storage policies are written to aggregated namespaces. If set it must
+	// be the same length as the storage policies. Storage policies written
+	// to the unaggregated namespace are written their raw datapoints
+	// regardless of the sub-resolution behavior, and unless the namespace is
+	// selected by its ID the resolution and retention of the storage policy
+	// are not used to select it.
+	WriteMetricsTypes []storage.MetricsType
+
+	// FlushImmediately requests that the aggregated form of the write is made
+	// available in storage right away instead of at the next downsampler flush,
+	// see maybeFlushImmediately for details and the tradeoffs involved. It is
+	// meant to be used sparingly for low volume but critical series. Writes
+	// that request it are rejected unless their mapping rules aggregate with
+	// Last only.
+	FlushImmediately bool
+
+	// Annotation is an opaque annotation stored with the datapoints of the
+	// write, subject to the configured annotation sampling.
+	Annotation []byte
+
+	// Sequences optionally sets a monotonic source sequence for each of the
+	// datapoints of a Write, used to deterministically keep only the latest
+	// of the datapoints that share a timestamp, see resolveSequences.
+	Sequences []uint64
+
+	// TimestampResolution, if set, overrides the resolution the timestamps
+	// of the datapoints of a Write are truncated to, allowing each source to
+	// set its own, see TimestampTruncationOptions.
+	TimestampResolution time.Duration
+
+	// DualTierStoragePolicy, if set, writes the datapoints to both the
+	// unaggregated namespace and the aggregated namespace of the storage
+	// policy, for example to keep raw data for a short retention alongside
+	// a long retention rollup. It cannot be combined with WriteOverride and
+	// both namespaces are validated before anything is written, if either
+	// tier fails to be written Write returns a *DualTierWriteError.
+	DualTierStoragePolicy *policy.StoragePolicy
+
+	// MetricType is the metric type the datapoints of a Write are aggregated
+	// as by the downsampler, defaults to gauge.
+	MetricType MetricType
+
+	// datapointTypes is the metric type of each of the datapoints of a
+	// write of samples of several metric types, see WriteSamples.
+	datapointTypes []MetricType
 }
 
 // downsamplerAndWriter encapsulates the logic for writing data to the downsampler,
@@ -79,18 +318,78 @@ type downsamplerAndWriter struct {
 	store       storage.Storage
 	downsampler downsample.Downsampler
 	workerPool  xsync.PooledWorkerPool
+	opts        Options
+	metrics     downsamplerAndWriterMetrics
+	logger      log.Logger
+
+	immediateFlushPermits chan struct{}
+	appenderPermits       chan struct{}
+	appendersInUse        int64
+	annotationSampler     *annotationSampler
+	tagFilter             *tagFilter
+	cardinalityBudget     *cardinalityBudget
+	fallbackLimiter       *rate.Limiter
+	storageRetrier        retry.Retrier
+	storageBreaker        *circuitBreaker
+	priorityScheduler     *priorityScheduler
+	sourceDefaults        sourceDefaults
+	rejectedWrites        rejectedWriteSampler
+	writeQueries          *writeQueryPool
+
+	inFlightWrites       int64
+	inFlightBatches      int64
+	namespaceOutstanding sync.Map
+
+	nowFn clock.NowFn
 }
 
-// NewDownsamplerAndWriter creates a new downsampler and writer.
+// NewDownsamplerAndWriter creates a new downsampler and writer. The worker
+// pool bounds the number of concurrent storage writes across all writes to
+// its size as long as it does not grow on demand. If it is nil every storage
+// write runs on its own goroutine unless bounded by the write priorities
+// options.
 func NewDownsamplerAndWriter(
 	store storage.Storage,
 	downsampler downsample.Downsampler,
 	workerPool xsync.PooledWorkerPool,
+	opts Options,
 ) DownsamplerAndWriter {
+	immediateFlushConcurrency := opts.ImmediateFlushConcurrency
+	if immediateFlushConcurrency <= 0 {
+		immediateFlushConcurrency = defaultImmediateFlushConcurrency
+	}
+
+	instrumentOpts := opts.InstrumentOptions
+	if instrumentOpts == nil {
+		instrumentOpts = instrument.NewOptions()
+	}
+
+	var appenderPermits chan struct{}
+	if opts.MaxConcurrentAppenders > 0 {
+		appenderPermits = make(chan struct{}, opts.MaxConcurrentAppenders)
+	}
+
+	scope := instrumentOpts.MetricsScope()
 	return &downsamplerAndWriter{
 		store:       store,
 		downsampler: downsampler,
 		workerPool:  workerPool,
+		opts:        opts,
+		metrics:     newDownsamplerAndWriterMetrics(scope),
+		logger:      instrumentOpts.Logger(),
+
+		immediateFlushPermits: make(chan struct{}, immediateFlushConcurrency),
+		appenderPermits:       appenderPermits,
+		annotationSampler:     newAnnotationSampler(opts.AnnotationSampling),
+		tagFilter:             newTagFilter(opts.TagFilter),
+		cardinalityBudget:     newCardinalityBudget(opts.CardinalityBudget, time.Now),
+		fallbackLimiter:       newFallbackLimiter(opts.Fallback),
+		storageRetrier:        newStorageRetrier(opts.StorageRetry),
+		storageBreaker:        newCircuitBreaker(opts.StorageCircuitBreaker, time.Now, scope),
+		priorityScheduler:     newPriorityScheduler(workerPool, opts.WritePriorities, scope),
+		rejectedWrites:        rejectedWriteSampler{sampleRate: opts.RejectedWriteLogging.SampleRate},
+		writeQueries:          newWriteQueryPool(opts.PoolWriteQueries),
+		nowFn:                 time.Now,
 	}
 }
 
@@ -101,81 +400,240 @@ func (d *downsamplerAndWriter) Write(
 	unit xtime.Unit,
 	overrides WriteOptions,
 ) error {
-	err := d.maybeWriteDownsampler(tags, datapoints, unit, overrides)
+	if err := overrides.MetricType.Validate(); err != nil {
+		return err
+	}
+
+	datapoints, err := d.resolveSequences(datapoints, overrides.Sequences)
+	if err != nil {
+		return err
+	}
+	datapoints = d.truncateTimestamps(datapoints, overrides)
+
+	return d.write(ctx, tags, datapoints, datapoints, unit, overrides)
+}
+
+// write writes a series to the downsampler and storage, the datapoints
+// written to each may differ when the series carries statistics that only
+// the downsampler can represent, see WriteGaugeStats.
+func (d *downsamplerAndWriter) write(
+	ctx context.Context,
+	tags models.Tags,
+	downsampleDatapoints ts.Datapoints,
+	storageDatapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) (err error) {
+	if d.store == nil && d.downsampler == nil {
+		return ErrNoWriteDestination
+	}
+
+	atomic.AddInt64(&d.inFlightWrites, 1)
+	defer atomic.AddInt64(&d.inFlightWrites, -1)
+	defer func() {
+		if err != nil {
+			d.logRejectedWrite(tags, err)
+		}
+	}()
+
+	unit, err = d.writeUnit(unit)
+	if err != nil {
+		return err
+	}
+
+	tags, ok, err := d.pipelineTags(ctx, tags, "", storageDatapoints, true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if !d.admitSeries(tags) {
+		return nil
+	}
+
+	overrides = d.applySourceDefaults(ctx, overrides)
+	overrides, err = d.limitStoragePolicyFanout(overrides, true)
+	if err != nil {
+		return err
+	}
+	err = d.validateDualTier(overrides)
+	if err != nil {
+		return err
+	}
+	err = validateFlushImmediately(overrides)
+	if err != nil {
+		return err
+	}
+
+	if d.opts.PartialFailure == PartialFailureReport {
+		return d.writeReportingPartialFailures(ctx, tags, downsampleDatapoints,
+			storageDatapoints, unit, overrides)
+	}
+
+	err = d.maybeWriteDownsampler(ctx, tags, downsampleDatapoints, unit, overrides)
+	if err != nil {
+		return err
+	}
+
+	err = d.maybeFlushImmediately(ctx, tags, storageDatapoints, unit, overrides)
 	if err != nil {
 		return err
 	}
 
-	return d.maybeWriteStorage(ctx, tags, datapoints, unit, overrides)
+	return d.maybeWriteStorage(ctx, tags, storageDatapoints, unit, overrides)
+}
+
+// writeReportingPartialFailures writes to both the downsampler and storage
+// even if one of them fails so that callers can tell from the returned
+// *PartialWriteError which of the paths needs to be retried.
+func (d *downsamplerAndWriter) writeReportingPartialFailures(
+	ctx context.Context,
+	tags models.Tags,
+	downsampleDatapoints ts.Datapoints,
+	storageDatapoints ts.Datapoints,
+	unit xtime.Unit,
+	overrides WriteOptions,
+) error {
+	downsamplerErr := d.maybeWriteDownsampler(ctx, tags, downsampleDatapoints, unit, overrides)
+	if downsamplerErr == nil {
+		downsamplerErr = d.maybeFlushImmediately(ctx, tags, storageDatapoints, unit, overrides)
+	}
+
+	storageErr := d.maybeWriteStorage(ctx, tags, storageDatapoints, unit, overrides)
+	if downsamplerErr == nil && storageErr == nil {
+		return nil
+	}
+
+	return &PartialWriteError{
+		DownsamplerErr: downsamplerErr,
+		StorageErr:     storageErr,
+	}
 }
 
 func (d *downsamplerAndWriter) maybeWriteDownsampler(
+	ctx context.Context,
 	tags models.Tags,
 	datapoints ts.Datapoints,
 	unit xtime.Unit,
 	overrides WriteOptions,
-) error {
+) (err error) {
+	appenderOpts, shouldDownsample := downsampleAppenderOptions(overrides)
+	if d.downsampler == nil || !shouldDownsample {
+		return nil
+	}
+
+	// TODO(rartoul): MetricsAppender has a Finalize() method, but it does not actually reuse many
+	// resources. If we can pool this properly we can get a nice speedup.
+	appender, err := d.newMetricsAppender(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Finalize the appender even if appending fails part way so that
+		// its resources are always released, an error appending takes
+		// precedence over an error finalizing.
+		if finalizeErr := d.finalizeMetricsAppender(appender); err == nil {
+			err = finalizeErr
+		}
+	}()
+
+	for _, tag := range tags.Tags {
+		appender.AddTag(tag.Name, tag.Value)
+	}
+
+	if tags.Opts.IDSchemeType() == models.TypeGraphite {
+		// NB(r): This is gross, but if this is a graphite metric then
+		// we are going to set a special tag that means the downsampler
+		// will write a graphite ID. This should really be plumbed
+		// through the downsampler in general, but right now the aggregator
+		// does not allow context to be attached to a metric so when it calls
+		// back the context is lost currently.
+		appender.AddTag(downsample.MetricsOptionIDSchemeTagName,
+			downsample.GraphiteIDSchemeTagValue)
+	}
+
+	start := time.Now()
+	result, err := appender.SamplesAppender(appenderOpts)
+	if err != nil {
+		d.metrics.recordDownsample(start, err)
+		return err
+	}
+
+	_, err = d.appendSamples(result.SamplesAppender, datapoints,
+		writeMetricType(overrides), overrides.datapointTypes, d.nowFn())
+	d.metrics.recordDownsample(start, err)
+	return err
+}
+
+// downsampleAppenderOptions returns the samples appender options for the
+// mapping rule overrides and whether the datapoints should be downsampled.
+func downsampleAppenderOptions(
+	overrides WriteOptions,
+) (downsample.SampleAppenderOptions, bool) {
 	var (
-		downsamplerExists = d.downsampler != nil
 		// If they didn't request the mapping rules to be overridden, then assume they want the default
 		// ones.
 		useDefaultMappingRules = !overrides.DownsampleOverride
 		// If they did try and override the mapping rules, make sure they've provided at least one.
 		downsampleOverride = overrides.DownsampleOverride && len(overrides.DownsampleMappingRules) > 0
-		// Only downsample if the downsampler exists, and they either want to use the default mapping
-		// rules, or they're trying to override the mapping rules and they've provided at least one
-		// override to do so.
-		shouldDownsample = downsamplerExists && (useDefaultMappingRules || downsampleOverride)
 	)
-	if shouldDownsample {
-		// TODO(rartoul): MetricsAppender has a Finalize() method, but it does not actually reuse many
-		// resources. If we can pool this properly we can get a nice speedup.
-		appender, err := d.downsampler.NewMetricsAppender()
-		if err != nil {
-			return err
-		}
-
-		for _, tag := range tags.Tags {
-			appender.AddTag(tag.Name, tag.Value)
-		}
+	if !downsampleOverride {
+		// Only downsample if they either want to use the default mapping rules,
+		// or they're trying to override the mapping rules and they've provided
+		// at least one override to do so.
+		return downsample.SampleAppenderOptions{
+			OverrideRules: downsample.SamplesAppenderOverrideRules{
+				Aggregations: overrides.DownsampleAggregations,
+			},
+		}, useDefaultMappingRules
+	}
 
-		if tags.Opts.IDSchemeType() == models.TypeGraphite {
-			// NB(r): This is gross, but if this is a graphite metric then
-			// we are going to set a special tag that means the downsampler
-			// will write a graphite ID. This should really be plumbed
-			// through the downsampler in general, but right now the aggregator
-			// does not allow context to be attached to a metric so when it calls
-			// back the context is lost currently.
-			appender.AddTag(downsample.MetricsOptionIDSchemeTagName,
-				downsample.GraphiteIDSchemeTagValue)
-		}
+	return downsample.SampleAppenderOptions{
+		Override: true,
+		OverrideRules: downsample.SamplesAppenderOverrideRules{
+			MappingRules: overrides.DownsampleMappingRules,
+			Aggregations: overrides.DownsampleAggregations,
+		},
+	}, true
+}
 
-		var appenderOpts downsample.SampleAppenderOptions
-		if downsampleOverride {
-			appenderOpts = downsample.SampleAppenderOptions{
-				Override: true,
-				OverrideRules: downsample.SamplesAppenderOverrideRules{
-					MappingRules: overrides.DownsampleMappingRules,
-				},
-			}
-		}
+// limitStoragePolicyFanout applies the storage policy fanout limit to the
+// overrides of a write, exceeding the limit is only counted if record is set.
+func (d *downsamplerAndWriter) limitStoragePolicyFanout(
+	overrides WriteOptions,
+	record bool,
+) (WriteOptions, error) {
+	if err := validateWriteNamespaceIDs(overrides); err != nil {
+		return overrides, err
+	}
 
-		samplesAppender, err := appender.SamplesAppender(appenderOpts)
-		if err != nil {
-			return err
-		}
+	limit := d.opts.MaxStoragePolicyFanout
+	if limit <= 0 || !overrides.WriteOverride ||
+		len(overrides.WriteStoragePolicies) <= limit {
+		return overrides, nil
+	}
 
-		for _, dp := range datapoints {
-			err := samplesAppender.AppendGaugeSample(dp.Value)
-			if err != nil {
-				return err
-			}
+	if !d.opts.TruncateStoragePolicyFanout {
+		if record {
+			d.metrics.fanoutRejected.Inc(1)
 		}
-
-		appender.Finalize()
+		return overrides, fmt.Errorf(
+			"write fans out to %d storage policies which exceeds the limit of %d",
+			len(overrides.WriteStoragePolicies), limit)
 	}
 
-	return nil
+	if record {
+		d.metrics.fanoutTruncated.Inc(1)
+	}
+	overrides.WriteStoragePolicies = overrides.WriteStoragePolicies[:limit]
+	if len(overrides.WriteNamespaceIDs) > 0 {
+		overrides.WriteNamespaceIDs = overrides.WriteNamespaceIDs[:limit]
+	}
+	if len(overrides.WriteMetricsTypes) > 0 {
+		overrides.WriteMetricsTypes = overrides.WriteMetricsTypes[:limit]
+	}
+	return overrides, nil
 }
 
 func (d *downsamplerAndWriter) maybeWriteStorage(
@@ -194,15 +652,14 @@ func (d *downsamplerAndWriter) maybeWriteStorage(
 		return nil
 	}
 
+	annotation := d.sampleAnnotation(tags, overrides.Annotation)
+
+	if p := overrides.DualTierStoragePolicy; p != nil {
+		return d.writeDualTier(ctx, tags, datapoints, unit, annotation, *p)
+	}
+
 	if storageExists && useDefaultStoragePolicies {
-		return d.store.Write(ctx, &storage.WriteQuery{
-			Tags:       tags,
-			Datapoints: datapoints,
-			Unit:       unit,
-			Attributes: storage.Attributes{
-				MetricsType: storage.UnaggregatedMetricsType,
-			},
-		})
+		return d.writeUnaggregated(ctx, tags, datapoints, unit, annotation)
 	}
 
 	var (
@@ -211,22 +668,14 @@ func (d *downsamplerAndWriter) maybeWriteStorage(
 		errLock  sync.Mutex
 	)
 
-	for _, p := range overrides.WriteStoragePolicies {
-		p := p // Capture for goroutine.
+	for i := range overrides.WriteStoragePolicies {
+		query := d.storagePolicyWriteQuery(tags, datapoints, unit,
+			annotation, overrides, i)
 
 		wg.Add(1)
-		d.workerPool.Go(func() {
-			err := d.store.Write(ctx, &storage.WriteQuery{
-				Tags:       tags,
-				Datapoints: datapoints,
-				Unit:       unit,
-				Attributes: storage.Attributes{
-					// Assume all overridden storage policies are for aggregated namespaces.
-					MetricsType: storage.AggregatedMetricsType,
-					Resolution:  p.Resolution().Window,
-					Retention:   p.Retention().Duration(),
-				},
-			})
+		err := d.goWrite(ctx, func() {
+			err := d.writeStorage(ctx, query)
+			d.writeQueries.put(query)
 			if err != nil {
 				errLock.Lock()
 				multiErr = multiErr.Add(err)
@@ -234,100 +683,376 @@ func (d *downsamplerAndWriter) maybeWriteStorage(
 			}
 			wg.Done()
 		})
+		if err != nil {
+			d.writeQueries.put(query)
+			errLock.Lock()
+			multiErr = multiErr.Add(err)
+			errLock.Unlock()
+			wg.Done()
+		}
 	}
 
 	wg.Wait()
 	return multiErr.FinalError()
 }
 
+// storagePolicyWriteQuery returns the query to write the datapoints to the
+// namespace of the overridden storage policy at index i of the overrides,
+// the query is returned to the write query pool once written.
+func (d *downsamplerAndWriter) storagePolicyWriteQuery(
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	unit xtime.Unit,
+	annotation []byte,
+	overrides WriteOptions,
+	i int,
+) *storage.WriteQuery {
+	attrs := storagePolicyAttributes(overrides, i)
+	if attrs.MetricsType == storage.AggregatedMetricsType {
+		datapoints = combineSubResolutionDatapoints(datapoints,
+			attrs.Resolution, d.opts.SubResolution)
+	}
+	query := d.writeQueries.get()
+	query.Tags = tags
+	query.Datapoints = datapoints
+	query.Unit = unit
+	query.Annotation = annotation
+	query.Attributes = attrs
+	return query
+}
+
 func (d *downsamplerAndWriter) WriteBatch(
 	ctx context.Context,
 	iter DownsampleAndWriteIter,
+	commit BatchCommitFn,
 ) error {
-	var (
-		wg       = sync.WaitGroup{}
-		multiErr xerrors.MultiError
-		errLock  sync.Mutex
-		addError = func(err error) {
-			errLock.Lock()
-			multiErr = multiErr.Add(err)
-			errLock.Unlock()
-		}
-	)
+	err := d.writeBatch(ctx, iter, newBatchErrors())
+	if commit != nil {
+		commit(err)
+	}
+	return err
+}
+
+func (d *downsamplerAndWriter) writeBatch(
+	ctx context.Context,
+	iter DownsampleAndWriteIter,
+	errs *batchErrors,
+) error {
+	if d.store == nil && d.downsampler == nil {
+		errs.add(ErrNoWriteDestination)
+		return ErrNoWriteDestination
+	}
+
+	atomic.AddInt64(&d.inFlightBatches, 1)
+	defer atomic.AddInt64(&d.inFlightBatches, -1)
 
+	iter, err := d.deduplicateBatch(iter)
+	if err != nil {
+		errs.add(err)
+		return err
+	}
+
+	ctx, cancel, err := d.withBatchTimeout(ctx, iter)
+	if err != nil {
+		errs.add(err)
+		return err
+	}
+	defer cancel()
+
+	var wg sync.WaitGroup
 	if d.store != nil {
 		// Write unaggregated. Spin up all the background goroutines that make
 		// network requests before we do the synchronous work of writing to the
 		// downsampler.
-		for iter.Next() {
-			wg.Add(1)
-			tags, datapoints, unit := iter.Current()
-			d.workerPool.Go(func() {
-				err := d.store.Write(ctx, &storage.WriteQuery{
-					Tags:       tags,
-					Datapoints: datapoints,
-					Unit:       unit,
-					Attributes: storage.Attributes{
-						MetricsType: storage.UnaggregatedMetricsType,
-					},
+		series := 0
+		for ; iter.Next(); series++ {
+			// Stop enqueuing writes once the caller has gone away or the
+			// deadline of the batch has passed.
+			if ctx.Err() != nil {
+				break
+			}
+
+			var (
+				idx      = series // Capture for goroutine.
+				value    = iter.Current()
+				addError = func(err error) {
+					errs.addSeries(idx, err)
+					d.logRejectedWrite(value.Tags, err)
+				}
+			)
+			_, datapoints, err := d.iterValueDatapoints(value)
+			if err != nil {
+				addError(err)
+				continue
+			}
+			tags, ok, err := d.pipelineTags(ctx, value.Tags, value.Source,
+				datapoints, true)
+			if err != nil {
+				addError(err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if !d.admitSeries(tags) {
+				continue
+			}
+
+			overrides, err := d.limitStoragePolicyFanout(value.Overrides, true)
+			if err != nil {
+				addError(err)
+				continue
+			}
+			unit, err := d.writeUnit(value.Unit)
+			if err != nil {
+				addError(err)
+				continue
+			}
+
+			var queries []*storage.WriteQuery
+			switch {
+			case overrides.WriteOverride:
+				for i := range overrides.WriteStoragePolicies {
+					queries = append(queries, d.storagePolicyWriteQuery(tags,
+						datapoints, unit, nil, overrides, i))
+				}
+			case !d.opts.SkipUnaggregated:
+				query := d.writeQueries.get()
+				query.Tags = tags
+				query.Datapoints = datapoints
+				query.Unit = unit
+				query.Attributes = storage.Attributes{
+					MetricsType: storage.UnaggregatedMetricsType,
+				}
+				queries = append(queries, query)
+			}
+
+			for _, query := range queries {
+				query := query // Capture for goroutine.
+
+				wg.Add(1)
+				err = d.goWrite(ctx, func() {
+					// The query is only returned to the pool once its
+					// write has completed since writes are asynchronous.
+					err := d.writeStorage(ctx, query)
+					d.writeQueries.put(query)
+					if err != nil {
+						addError(err)
+					}
+					wg.Done()
 				})
 				if err != nil {
+					d.writeQueries.put(query)
 					addError(err)
+					wg.Done()
 				}
-				wg.Done()
-			})
+			}
 		}
+		errs.seen(series)
 	}
 
 	// Iter does not need to be synchronized because even though we use it to spawn
 	// many goroutines above, the iteration is always synchronous.
 	resetErr := iter.Reset()
 	if resetErr != nil {
-		addError(resetErr)
+		errs.add(resetErr)
 	}
 
-	if d.downsampler != nil && resetErr == nil {
-		err := d.writeAggregatedBatch(iter)
+	if d.downsampler != nil && resetErr == nil && ctx.Err() == nil {
+		err := d.writeAggregatedBatch(ctx, iter, errs)
 		if err != nil {
-			addError(err)
+			errs.add(err)
 		}
 	}
 
 	wg.Wait()
-	return multiErr.LastError()
+	d.metrics.batchSize.RecordValue(float64(errs.numSeries()))
+	multiErr := errs.multiError()
+	if err := ctx.Err(); err != nil {
+		// Report the cancellation in the result of the batch too.
+		errs.add(err)
+		if !multiErr.Empty() {
+			// Return the cancellation along with the errors of the writes
+			// that were attempted before it.
+			err = multiErr.Add(err).FinalError()
+		}
+		return errs.batchWriteError(iter, err, true)
+	}
+	if err := multiErr.LastError(); err != nil {
+		return errs.batchWriteError(iter, err, false)
+	}
+	return nil
 }
 
 func (d *downsamplerAndWriter) writeAggregatedBatch(
+	ctx context.Context,
 	iter DownsampleAndWriteIter,
+	errs *batchErrors,
 ) error {
-	appender, err := d.downsampler.NewMetricsAppender()
+	appender, err := d.newMetricsAppender(ctx)
 	if err != nil {
 		return err
 	}
 
-	var opts downsample.SampleAppenderOptions
-	for iter.Next() {
-		appender.Reset()
-		tags, datapoints, _ := iter.Current()
-		for _, tag := range tags.Tags {
-			appender.AddTag(tag.Name, tag.Value)
+	var (
+		coverage ruleCoverage
+		multiErr xerrors.MultiError
+	)
+	defer d.metrics.ruleCoverage.report(&coverage)
+
+	series := 0
+	for ; iter.Next(); series++ {
+		// The series appended so far are still finalized below, the
+		// cancellation itself is returned by writeBatch.
+		if ctx.Err() != nil {
+			break
 		}
 
-		samplesAppender, err := appender.SamplesAppender(opts)
+		var (
+			idx      = series
+			value    = iter.Current()
+			addError = func(err error) {
+				errs.addSeries(idx, err)
+				d.logRejectedWrite(value.Tags, err)
+			}
+			// Errors preparing the series were already logged when writing
+			// to storage, if there is storage.
+			addPrepareError = func(err error) {
+				if d.store != nil {
+					errs.addSeries(idx, err)
+					return
+				}
+				addError(err)
+			}
+		)
+		// Series that are not downsampled, such as pre-aggregated series
+		// written straight to aggregated namespaces, were written to
+		// storage already so skip preparing their tags again.
+		appenderOpts, shouldDownsample := downsampleAppenderOptions(value.Overrides)
+		if !shouldDownsample {
+			continue
+		}
+
+		datapoints, storageDatapoints, err := d.iterValueDatapoints(value)
+		if err != nil {
+			// Skip just this series rather than aborting the rest of the batch.
+			addPrepareError(err)
+			continue
+		}
+		// Stripped tags and dropped and invalid series were already counted
+		// when writing to storage, if there is storage.
+		tags, ok, err := d.pipelineTags(ctx, value.Tags, value.Source,
+			storageDatapoints, d.store == nil)
+		if err != nil {
+			addPrepareError(err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// Admission of the series was already recorded when writing to
+		// storage, if there is storage.
+		admitted, isNew := d.cardinalityBudget.admit(tags)
+		if d.store == nil {
+			d.recordAdmission(admitted, isNew)
+		}
+		if !admitted {
+			continue
+		}
+
+		seriesType, types, err := d.datapointMetricTypes(value)
 		if err != nil {
-			return err
+			addError(err)
+			continue
 		}
 
-		for _, dp := range datapoints {
-			err := samplesAppender.AppendGaugeSample(dp.Value)
+		appended, err := d.appendBatchSeries(appender, tags, datapoints,
+			appenderOpts, seriesType, types, &coverage)
+		if err == nil {
+			continue
+		}
+
+		switch d.opts.AppenderErrors {
+		case AppenderErrorSkip:
+			d.metrics.appenderSeriesSkipped.Inc(1)
+			addError(err)
+		case AppenderErrorRestart:
+			// Finalize the appender to flush what has been appended so far and
+			// retry the rest of the series once with a fresh appender. An
+			// error finalizing is not specific to this series so it is
+			// returned for the batch.
+			if err := d.finalizeMetricsAppender(appender); err != nil {
+				multiErr = multiErr.Add(err)
+			}
+			appender, err = d.newMetricsAppender(ctx)
 			if err != nil {
-				return err
+				addError(err)
+				return multiErr.FinalError()
+			}
+			d.metrics.appenderRestarts.Inc(1)
+
+			if types != nil {
+				types = types[appended:]
 			}
+			_, err = d.appendBatchSeries(appender, tags, datapoints[appended:],
+				appenderOpts, seriesType, types, &coverage)
+			if err != nil {
+				d.metrics.appenderSeriesSkipped.Inc(1)
+				addError(err)
+			}
+		default:
+			// Finalize the appender to flush the series appended before the
+			// failing one, an error finalizing is returned for the batch.
+			addError(err)
+			return d.finalizeMetricsAppender(appender)
 		}
 	}
-	appender.Finalize()
+	errs.seen(series)
+	if err := d.finalizeMetricsAppender(appender); err != nil {
+		multiErr = multiErr.Add(err)
+	}
+
+	if err := iter.Error(); err != nil {
+		multiErr = multiErr.Add(err)
+	}
+	return multiErr.FinalError()
+}
+
+// appendBatchSeries appends the datapoints of a series of a batch to the
+// appender with the samples appender options of the series, returning the
+// number of datapoints appended before any error, see appendSamples.
+// Datapoints are appended as the series metric type unless types sets the
+// metric type of each datapoint. The rules matched by the series are
+// recorded once all its datapoints have been appended.
+func (d *downsamplerAndWriter) appendBatchSeries(
+	appender downsample.MetricsAppender,
+	tags models.Tags,
+	datapoints ts.Datapoints,
+	opts downsample.SampleAppenderOptions,
+	seriesType MetricType,
+	types []MetricType,
+	coverage *ruleCoverage,
+) (int, error) {
+	appender.Reset()
+	appender.AddTags(tags.Tags)
+
+	start := time.Now()
+	result, err := appender.SamplesAppender(opts)
+	if err != nil {
+		d.metrics.recordDownsample(start, err)
+		return 0, err
+	}
+
+	appended, err := d.appendSamples(result.SamplesAppender, datapoints,
+		seriesType, types, d.nowFn())
+	d.metrics.recordDownsample(start, err)
+	if err != nil {
+		return appended, err
+	}
 
-	return iter.Error()
+	coverage.record(result)
+	return len(datapoints), nil
 }
 
 func (d *downsamplerAndWriter) Storage() storage.Storage {
@@ -0,0 +1,285 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	xerrors "github.com/m3db/m3x/errors"
+)
+
+// WriteBatchResult is the result of writing each of the series of a batch.
+// Series are identified by their index in the iteration order of the batch
+// and a series fails if any of its writes to the downsampler or to storage
+// fails. Series that are dropped on purpose, such as series rejected by the
+// cardinality budget, count as succeeded. Series that were not written
+// because the batch was cancelled are not counted.
+type WriteBatchResult struct {
+	Succeeded int
+	Failed    int
+
+	// FailedSeries are the indices of the series that failed in ascending
+	// order.
+	FailedSeries []int
+
+	// Errors are all the errors of the batch, including those that do not
+	// belong to any one series such as the cancellation of the batch, so
+	// that callers can tell whether the batch is worth retrying.
+	Errors []error
+}
+
+// BatchWriteError is the error of a batch write that failed once its series
+// started being written, it reports how many of the series of the batch
+// were written. The error of the batch is available through InnerError so
+// that helpers such as xerrors.IsInvalidParams see through it.
+type BatchWriteError struct {
+	// Total is the number of series in the batch.
+	Total int
+	// Succeeded and Failed count the series of the batch as reported by
+	// WriteBatchResult, the remaining series of the total were not written
+	// because the batch was cancelled.
+	Succeeded int
+	Failed    int
+
+	// Cancelled is true if the batch was cancelled, or its deadline passed,
+	// before all of its series were written. Otherwise the batch failed
+	// because of the errors of its writes.
+	Cancelled bool
+
+	// Err is the error of the batch, the last error of its writes or, if
+	// the batch was cancelled, the error of the context along with the
+	// errors of the writes attempted before it.
+	Err error
+}
+
+// Partial returns true if some but not all of the series of the batch
+// were written.
+func (e *BatchWriteError) Partial() bool {
+	return e.Succeeded > 0 && e.Succeeded < e.Total
+}
+
+// InnerError returns the error of the batch.
+func (e *BatchWriteError) InnerError() error {
+	return e.Err
+}
+
+func (e *BatchWriteError) Error() string {
+	if e.Cancelled {
+		return fmt.Sprintf("batch write cancelled with %d of %d series written: %v",
+			e.Succeeded, e.Total, e.Err)
+	}
+	return fmt.Sprintf("batch write failed for %d of %d series: %v",
+		e.Failed, e.Total, e.Err)
+}
+
+func (d *downsamplerAndWriter) WriteBatchWithResult(
+	ctx context.Context,
+	iter DownsampleAndWriteIter,
+) (WriteBatchResult, error) {
+	errs := newBatchErrors()
+	err := d.writeBatch(ctx, iter, errs)
+	return errs.result(), err
+}
+
+// numBatchErrorShards is the number of shards the errors of a batch are
+// accumulated in, so that the many concurrent writes of a batch that fail at
+// once rarely contend on the same lock.
+const numBatchErrorShards = 16
+
+// batchError is an error of a batch, seq orders the errors of the batch and
+// idx is the index of the series it belongs to or -1 if it belongs to none.
+type batchError struct {
+	seq uint64
+	idx int
+	err error
+}
+
+type batchErrorShard struct {
+	sync.Mutex
+	errors []batchError
+
+	// Pad the shard to a cache line so that adding to one shard does not
+	// invalidate its neighbors.
+	_ [32]byte
+}
+
+// batchErrors collects the errors of a batch and the series they belong to.
+// Errors are appended to shards and only merged, in the order they were
+// added, once the writes of the batch have completed.
+type batchErrors struct {
+	seq    uint64
+	shards [numBatchErrorShards]batchErrorShard
+
+	// series is only accessed by the goroutine writing the batch.
+	series int
+}
+
+func newBatchErrors() *batchErrors {
+	return &batchErrors{}
+}
+
+// add adds an error that does not belong to any one series.
+func (e *batchErrors) add(err error) {
+	e.addSeries(-1, err)
+}
+
+// addSeries adds an error of the series at index idx.
+func (e *batchErrors) addSeries(idx int, err error) {
+	seq := atomic.AddUint64(&e.seq, 1)
+	shard := &e.shards[seq%numBatchErrorShards]
+	shard.Lock()
+	shard.errors = append(shard.errors, batchError{seq: seq, idx: idx, err: err})
+	shard.Unlock()
+}
+
+// seen records that the first n series of the batch have been written.
+func (e *batchErrors) seen(n int) {
+	if n > e.series {
+		e.series = n
+	}
+}
+
+// merged returns the errors of all the shards in the order they were added.
+func (e *batchErrors) merged() []batchError {
+	var maxSeq uint64
+	for i := range e.shards {
+		e.shards[i].Lock()
+		defer e.shards[i].Unlock()
+		for _, batchErr := range e.shards[i].errors {
+			if batchErr.seq > maxSeq {
+				maxSeq = batchErr.seq
+			}
+		}
+	}
+
+	// Errors are numbered in the order they are added so each is placed at
+	// its number rather than sorting them.
+	merged := make([]batchError, maxSeq)
+	for i := range e.shards {
+		for _, batchErr := range e.shards[i].errors {
+			merged[batchErr.seq-1] = batchErr
+		}
+	}
+
+	// Errors that were still being added leave gaps.
+	n := 0
+	for _, batchErr := range merged {
+		if batchErr.seq != 0 {
+			merged[n] = batchErr
+			n++
+		}
+	}
+	return merged[:n]
+}
+
+// multiError returns the errors of the batch in the order they were added.
+func (e *batchErrors) multiError() xerrors.MultiError {
+	multiErr := xerrors.NewMultiError()
+	for _, batchErr := range e.merged() {
+		multiErr = multiErr.Add(batchErr.err)
+	}
+	return multiErr
+}
+
+// numSeries returns the number of series of the batch that have been
+// written or have failed.
+func (e *batchErrors) numSeries() int {
+	series := e.series
+	for i := range e.shards {
+		shard := &e.shards[i]
+		shard.Lock()
+		for _, batchErr := range shard.errors {
+			if batchErr.idx >= series {
+				series = batchErr.idx + 1
+			}
+		}
+		shard.Unlock()
+	}
+	return series
+}
+
+// batchWriteError returns the error of the batch, err, along with the
+// result of its series. Unless the batch was cancelled every series of the
+// batch has been seen by the time it completes so the series of the batch
+// are only counted from the iterator if it was.
+func (e *batchErrors) batchWriteError(
+	iter DownsampleAndWriteIter,
+	err error,
+	cancelled bool,
+) error {
+	result := e.result()
+	total := result.Succeeded + result.Failed
+	if cancelled && iter.Reset() == nil {
+		total = 0
+		for iter.Next() {
+			total++
+		}
+	}
+
+	return &BatchWriteError{
+		Total:     total,
+		Succeeded: result.Succeeded,
+		Failed:    result.Failed,
+		Cancelled: cancelled,
+		Err:       err,
+	}
+}
+
+func (e *batchErrors) result() WriteBatchResult {
+	var (
+		merged = e.merged()
+		series = e.series
+		failed []int
+		errs   []error
+	)
+	for _, batchErr := range merged {
+		errs = append(errs, batchErr.err)
+		if batchErr.idx < 0 {
+			continue
+		}
+		failed = append(failed, batchErr.idx)
+		if batchErr.idx >= series {
+			series = batchErr.idx + 1
+		}
+	}
+
+	// Series with more than one error are only counted once.
+	sort.Ints(failed)
+	unique := failed[:0]
+	for i, idx := range failed {
+		if i == 0 || idx != failed[i-1] {
+			unique = append(unique, idx)
+		}
+	}
+	if len(unique) == 0 {
+		unique = nil
+	}
+
+	return WriteBatchResult{
+		Succeeded:    series - len(unique),
+		Failed:       len(unique),
+		FailedSeries: unique,
+		Errors:       errs,
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteBatchWithResult(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+
+	// Only the writes of the second series fail.
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			_, _ ident.ID, _ ident.TagIterator, _ time.Time, value float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			if value == testDatapoints2[0].Value {
+				return errors.New("storage error")
+			}
+			return nil
+		}).
+		Times(2*len(testDatapoints1) + len(testDatapoints2))
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags2, datapoints: testDatapoints2},
+		{tags: testTags1, datapoints: testDatapoints1},
+	})
+	result, err := downAndWrite.WriteBatchWithResult(context.Background(), iter)
+	require.Error(t, err)
+	require.Equal(t, WriteBatchResult{
+		Succeeded:    2,
+		Failed:       1,
+		FailedSeries: []int{1},
+		Errors:       []error{errors.New("storage error")},
+	}, result)
+}
+
+func TestDownsampleAndWriteBatchWithResultInvalidSeries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		TagValidation: TagValidationOptions{InvalidTags: InvalidTagsReject},
+	})
+	downAndWrite.downsampler = nil
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+
+	invalidTags := models.NewTags(1, nil).AddTag(models.Tag{
+		Name:  []byte("invalid"),
+		Value: []byte{0xff},
+	})
+	iter := newTestIter([]testIterEntry{
+		{tags: invalidTags, datapoints: testDatapoints2},
+		{tags: testTags1, datapoints: testDatapoints1},
+	})
+	result, err := downAndWrite.WriteBatchWithResult(context.Background(), iter)
+	require.Error(t, err)
+	require.True(t, xerrors.IsInvalidParams(err))
+
+	// Invalid series are client errors that retrying cannot fix.
+	require.Len(t, result.Errors, 1)
+	require.True(t, xerrors.IsInvalidParams(result.Errors[0]))
+	result.Errors = nil
+	require.Equal(t, WriteBatchResult{
+		Succeeded:    1,
+		Failed:       1,
+		FailedSeries: []int{0},
+	}, result)
+}
+
+// resetErrorIter fails to reset, so the batch cannot be iterated twice.
+type resetErrorIter struct {
+	*testIter
+}
+
+func (i resetErrorIter) Reset() error {
+	return errors.New("reset error")
+}
+
+func TestDownsampleAndWriteBatchWithResultBatchTimeoutError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Counting the series to size the timeout of the batch resets the
+	// iterator, nothing should be written if that fails.
+	downAndWrite, _, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{
+		BatchTimeout: BatchTimeoutOptions{Base: time.Second},
+	})
+
+	iter := resetErrorIter{newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+	})}
+	result, err := downAndWrite.WriteBatchWithResult(context.Background(), iter)
+	require.EqualError(t, err, "reset error")
+	require.Equal(t, []error{errors.New("reset error")}, result.Errors)
+}
+
+// failingSeriesStorage fails the writes of the series with the given IDs.
+type failingSeriesStorage struct {
+	storage.Storage
+
+	failing map[string]struct{}
+}
+
+func (s failingSeriesStorage) Write(_ context.Context, query *storage.WriteQuery) error {
+	if _, ok := s.failing[string(query.Tags.ID())]; ok {
+		return errors.New("storage error")
+	}
+	return nil
+}
+
+func TestDownsampleAndWriteBatchWriteError(t *testing.T) {
+	tests := []struct {
+		name     string
+		failing  []models.Tags
+		expected *BatchWriteError
+		partial  bool
+	}{
+		{
+			name: "all succeed",
+		},
+		{
+			name:    "all fail",
+			failing: []models.Tags{testTags1, testTags2},
+			expected: &BatchWriteError{
+				Total:  2,
+				Failed: 2,
+				Err:    errors.New("storage error"),
+			},
+		},
+		{
+			name:    "partial failure",
+			failing: []models.Tags{testTags2},
+			expected: &BatchWriteError{
+				Total:     2,
+				Succeeded: 1,
+				Failed:    1,
+				Err:       errors.New("storage error"),
+			},
+			partial: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := failingSeriesStorage{failing: make(map[string]struct{})}
+			for _, tags := range test.failing {
+				store.failing[string(tags.ID())] = struct{}{}
+			}
+			downAndWrite := NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{})
+
+			iter := newTestIter([]testIterEntry{
+				{tags: testTags1, datapoints: testDatapoints1},
+				{tags: testTags2, datapoints: testDatapoints2},
+			})
+			err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+			if test.expected == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Equal(t, test.expected, err)
+			require.Equal(t, test.partial, err.(*BatchWriteError).Partial())
+		})
+	}
+}
+
+func TestDownsampleAndWriteBatchWriteErrorCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags2, datapoints: testDatapoints2},
+	})
+	err := downAndWrite.WriteBatch(ctx, iter, nil)
+	require.Error(t, err)
+
+	batchErr, ok := err.(*BatchWriteError)
+	require.True(t, ok)
+	require.True(t, batchErr.Cancelled)
+	require.False(t, batchErr.Partial())
+	require.Equal(t, 2, batchErr.Total)
+	require.Equal(t, context.Canceled, xerrors.InnerError(err))
+	require.EqualError(t, err,
+		"batch write cancelled with 0 of 2 series written: context canceled")
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/ts"
+	xsync "github.com/m3db/m3x/sync"
+	xtime "github.com/m3db/m3x/time"
+)
+
+var (
+	benchmarkWorkerPoolSizes = []int{16, 256, 1024}
+	benchmarkParallelism     = []int{1, 8}
+)
+
+func BenchmarkDownsampleAndWrite(b *testing.B) {
+	entries := newBenchmarkEntries(1, 1)
+	benchmarkDownsampleAndWrite(b, func(w DownsamplerAndWriter) error {
+		entry := entries[0]
+		return w.Write(context.Background(), entry.tags, entry.datapoints,
+			xtime.Second, WriteOptions{})
+	})
+}
+
+func BenchmarkDownsampleAndWriteBatchSmall(b *testing.B) {
+	entries := newBenchmarkEntries(10, 1)
+	benchmarkDownsampleAndWrite(b, func(w DownsamplerAndWriter) error {
+		return w.WriteBatch(context.Background(), newTestIter(entries), nil)
+	})
+}
+
+func BenchmarkDownsampleAndWriteBatchLarge(b *testing.B) {
+	entries := newBenchmarkEntries(1000, 1)
+	benchmarkDownsampleAndWrite(b, func(w DownsamplerAndWriter) error {
+		return w.WriteBatch(context.Background(), newTestIter(entries), nil)
+	})
+}
+
+// BenchmarkDownsampleAndWriteBatchCardinality writes batches of an
+// increasing number of distinct series to measure how the batch write path
+// scales with cardinality. Allocations are reported per batch, divide them
+// by the number of series for the allocations of each series written.
+func BenchmarkDownsampleAndWriteBatchCardinality(b *testing.B) {
+	for _, numSeries := range []int{100, 1000, 10000} {
+		for _, numDatapoints := range []int{1, 10} {
+			entries := newBenchmarkEntries(numSeries, numDatapoints)
+			name := fmt.Sprintf("series=%d,datapoints=%d", numSeries, numDatapoints)
+			b.Run(name, func(b *testing.B) {
+				w := newBenchmarkDownsamplerAndWriter(b, 256)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := w.WriteBatch(context.Background(), newTestIter(entries), nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDownsampleAndWriteOverrides measures a single write with each of
+// the overrides that change the path it takes through the writer.
+func BenchmarkDownsampleAndWriteOverrides(b *testing.B) {
+	var (
+		entry         = newBenchmarkEntries(1, 1)[0]
+		storagePolicy = policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour)
+	)
+	testCases := []struct {
+		name      string
+		overrides WriteOptions
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "storage-policy-override",
+			overrides: WriteOptions{
+				WriteOverride:        true,
+				WriteStoragePolicies: []policy.StoragePolicy{storagePolicy},
+			},
+		},
+		{
+			name: "mapping-rule-override",
+			overrides: WriteOptions{
+				DownsampleOverride: true,
+				DownsampleMappingRules: []downsample.MappingRule{
+					{Policies: policy.StoragePolicies{storagePolicy}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			w := newBenchmarkDownsamplerAndWriter(b, 16)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := w.Write(context.Background(), entry.tags, entry.datapoints,
+					xtime.Second, tc.overrides)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDownsampleAndWriteStoragePolicies compares running the storage
+// writes of a write that overrides many storage policies on a goroutine
+// per storage policy, which is what happens without a worker pool, with
+// running them on a bounded worker pool.
+func BenchmarkDownsampleAndWriteStoragePolicies(b *testing.B) {
+	var (
+		entry     = newBenchmarkEntries(1, 1)[0]
+		overrides = WriteOptions{WriteOverride: true}
+	)
+	for i := 1; i <= 12; i++ {
+		overrides.WriteStoragePolicies = append(overrides.WriteStoragePolicies,
+			policy.NewStoragePolicy(time.Duration(i)*time.Minute, xtime.Second, 48*time.Hour))
+	}
+
+	for _, pooled := range []bool{false, true} {
+		name := "goroutine-per-policy"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			var workerPool xsync.PooledWorkerPool
+			if pooled {
+				var err error
+				workerPool, err = xsync.NewPooledWorkerPool(16,
+					xsync.NewPooledWorkerPoolOptions().SetGrowOnDemand(true))
+				if err != nil {
+					b.Fatal(err)
+				}
+				workerPool.Init()
+			}
+
+			w := NewDownsamplerAndWriter(benchmarkStorage{},
+				benchmarkDownsampler{}, workerPool, Options{})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := w.Write(context.Background(), entry.tags, entry.datapoints,
+						xtime.Second, overrides)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkDownsampleAndWritePoolWriteQueries compares the allocations of
+// writes with and without pooling the queries of their storage writes.
+func BenchmarkDownsampleAndWritePoolWriteQueries(b *testing.B) {
+	var (
+		entries   = newBenchmarkEntries(100, 1)
+		overrides = WriteOptions{WriteOverride: true}
+	)
+	for i := 1; i <= 4; i++ {
+		overrides.WriteStoragePolicies = append(overrides.WriteStoragePolicies,
+			policy.NewStoragePolicy(time.Duration(i)*time.Minute, xtime.Second, 48*time.Hour))
+	}
+
+	writeFns := []struct {
+		name    string
+		writeFn func(w DownsamplerAndWriter) error
+	}{
+		{
+			name: "write",
+			writeFn: func(w DownsamplerAndWriter) error {
+				entry := entries[0]
+				return w.Write(context.Background(), entry.tags, entry.datapoints,
+					xtime.Second, WriteOptions{})
+			},
+		},
+		{
+			name: "write-storage-policies",
+			writeFn: func(w DownsamplerAndWriter) error {
+				entry := entries[0]
+				return w.Write(context.Background(), entry.tags, entry.datapoints,
+					xtime.Second, overrides)
+			},
+		},
+		{
+			name: "batch",
+			writeFn: func(w DownsamplerAndWriter) error {
+				return w.WriteBatch(context.Background(), newTestIter(entries), nil)
+			},
+		},
+	}
+
+	for _, writeFn := range writeFns {
+		for _, pooled := range []bool{false, true} {
+			name := fmt.Sprintf("%s,pooled=%v", writeFn.name, pooled)
+			b.Run(name, func(b *testing.B) {
+				workerPool, err := xsync.NewPooledWorkerPool(16,
+					xsync.NewPooledWorkerPoolOptions().SetGrowOnDemand(true))
+				if err != nil {
+					b.Fatal(err)
+				}
+				workerPool.Init()
+
+				w := NewDownsamplerAndWriter(benchmarkStorage{},
+					benchmarkDownsampler{}, workerPool, Options{
+						PoolWriteQueries: pooled,
+					})
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := writeFn.writeFn(w); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkAppendSamples compares appending the datapoints of a series one
+// sample at a time with appending them in bulk.
+func BenchmarkAppendSamples(b *testing.B) {
+	var (
+		now                                        = time.Now()
+		samplesAppender downsample.SamplesAppender = benchmarkSamplesAppender{}
+		d                                          = &downsamplerAndWriter{}
+	)
+	for _, numDatapoints := range []int{10, 1000} {
+		datapoints := newBenchmarkEntries(1, numDatapoints)[0].datapoints
+
+		b.Run(fmt.Sprintf("datapoints=%d,bulk=false", numDatapoints), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, dp := range datapoints {
+					err := d.appendSample(samplesAppender, dp, MetricTypeGauge, now)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("datapoints=%d,bulk=true", numDatapoints), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := d.appendSamples(samplesAppender, datapoints,
+					MetricTypeGauge, nil, now)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDownsampleAndWriteBatchErrors writes batches whose storage
+// writes all fail, measuring the cost of accumulating the errors of a batch
+// from many concurrent writes.
+func BenchmarkDownsampleAndWriteBatchErrors(b *testing.B) {
+	entries := newBenchmarkEntries(1000, 1)
+	for _, parallelism := range benchmarkParallelism {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			workerPool, err := xsync.NewPooledWorkerPool(1024,
+				xsync.NewPooledWorkerPoolOptions().SetGrowOnDemand(true))
+			if err != nil {
+				b.Fatal(err)
+			}
+			workerPool.Init()
+			w := NewDownsamplerAndWriter(benchmarkStorage{err: errBenchmarkStorage},
+				nil, workerPool, Options{})
+
+			b.ReportAllocs()
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := w.WriteBatch(context.Background(), newTestIter(entries), nil)
+					if err == nil {
+						b.Fatal("expected batch to fail")
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkBatchErrors adds errors to the errors of a single batch from
+// many goroutines at once, as the writes of a large failing batch do.
+func BenchmarkBatchErrors(b *testing.B) {
+	for _, parallelism := range benchmarkParallelism {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			var (
+				errs = newBatchErrors()
+				next int64
+			)
+			b.ReportAllocs()
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					errs.addSeries(int(atomic.AddInt64(&next, 1)), errBenchmarkStorage)
+				}
+			})
+		})
+	}
+}
+
+// benchmarkDownsampleAndWrite runs the write function against a writer
+// for each combination of worker pool size and number of concurrent
+// writers per CPU.
+func benchmarkDownsampleAndWrite(
+	b *testing.B,
+	writeFn func(w DownsamplerAndWriter) error,
+) {
+	for _, workerPoolSize := range benchmarkWorkerPoolSizes {
+		for _, parallelism := range benchmarkParallelism {
+			name := fmt.Sprintf("workers=%d,parallelism=%d", workerPoolSize, parallelism)
+			b.Run(name, func(b *testing.B) {
+				w := newBenchmarkDownsamplerAndWriter(b, workerPoolSize)
+
+				b.ReportAllocs()
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if err := writeFn(w); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// newBenchmarkDownsamplerAndWriter returns a writer with a worker pool of
+// the given size that discards everything written to it. As in production
+// the pool does not grow on demand so its size bounds the concurrent writes.
+func newBenchmarkDownsamplerAndWriter(
+	b *testing.B,
+	workerPoolSize int,
+) DownsamplerAndWriter {
+	workerPool, err := xsync.NewPooledWorkerPool(workerPoolSize,
+		xsync.NewPooledWorkerPoolOptions().SetGrowOnDemand(false))
+	if err != nil {
+		b.Fatal(err)
+	}
+	workerPool.Init()
+
+	return NewDownsamplerAndWriter(benchmarkStorage{},
+		benchmarkDownsampler{}, workerPool, Options{})
+}
+
+func newBenchmarkEntries(numSeries, numDatapoints int) []testIterEntry {
+	var (
+		now     = time.Now()
+		entries = make([]testIterEntry, 0, numSeries)
+	)
+	for i := 0; i < numSeries; i++ {
+		tags := models.NewTags(2, models.NewTagOptions()).AddTags([]models.Tag{
+			{Name: []byte("__name__"), Value: []byte("benchmark_metric")},
+			{Name: []byte("series"), Value: []byte(fmt.Sprintf("%d", i))},
+		})
+		datapoints := make(ts.Datapoints, 0, numDatapoints)
+		for j := 0; j < numDatapoints; j++ {
+			datapoints = append(datapoints, ts.Datapoint{
+				Timestamp: now.Add(time.Duration(j) * time.Second),
+				Value:     float64(j),
+			})
+		}
+		entries = append(entries, testIterEntry{tags: tags, datapoints: datapoints})
+	}
+	return entries
+}
+
+var errBenchmarkStorage = errors.New("benchmark storage error")
+
+// benchmarkStorage is a storage that discards writes, isolating the cost
+// of the write path from the cost of the storage it writes to. Writes fail
+// with err if set.
+type benchmarkStorage struct {
+	storage.Storage
+
+	err error
+}
+
+func (s benchmarkStorage) Write(context.Context, *storage.WriteQuery) error {
+	return s.err
+}
+
+// benchmarkDownsampler is a downsampler that discards samples.
+type benchmarkDownsampler struct{}
+
+func (d benchmarkDownsampler) NewMetricsAppender() (downsample.MetricsAppender, error) {
+	return benchmarkMetricsAppender{}, nil
+}
+
+func (d benchmarkDownsampler) Flush() error {
+	return nil
+}
+
+type benchmarkMetricsAppender struct{}
+
+func (a benchmarkMetricsAppender) AddTag(name, value []byte) {}
+
+func (a benchmarkMetricsAppender) AddTags(tags []models.Tag) {}
+func (a benchmarkMetricsAppender) Reset()                    {}
+func (a benchmarkMetricsAppender) Finalize() error           { return nil }
+
+func (a benchmarkMetricsAppender) SamplesAppender(
+	opts downsample.SampleAppenderOptions,
+) (downsample.SamplesAppenderResult, error) {
+	return downsample.SamplesAppenderResult{
+		SamplesAppender:     benchmarkSamplesAppender{},
+		MappingRulesMatched: true,
+	}, nil
+}
+
+type benchmarkSamplesAppender struct{}
+
+func (a benchmarkSamplesAppender) AppendCounterSample(value int64) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendGaugeSample(value float64) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendGaugeSampleWithAnnotation(value float64, annotation []byte) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendTimerSample(value float64) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendCounterTimedSample(t time.Time, value int64) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendGaugeTimedSample(t time.Time, value float64) error {
+	return nil
+}
+
+func (a benchmarkSamplesAppender) AppendGaugeSamples(values []float64) (int, error) {
+	return len(values), nil
+}
+
+func (a benchmarkSamplesAppender) AppendGaugeTimedSamples(samples []downsample.TimedSample) (int, error) {
+	return len(samples), nil
+}
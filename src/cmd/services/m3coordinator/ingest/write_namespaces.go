@@ -0,0 +1,83 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"errors"
+
+	"github.com/m3db/m3/src/query/storage"
+	xerrors "github.com/m3db/m3x/errors"
+)
+
+var (
+	errWriteNamespaceIDsLengthMismatch = errors.New(
+		"write namespace IDs must be set for every write storage policy")
+	errWriteMetricsTypesLengthMismatch = errors.New(
+		"write metrics types must be set for every write storage policy")
+)
+
+// validateWriteNamespaceIDs ensures that the namespace IDs and metrics types
+// of the overrides, if any, line up with the storage policies.
+func validateWriteNamespaceIDs(overrides WriteOptions) error {
+	numPolicies := len(overrides.WriteStoragePolicies)
+	if n := len(overrides.WriteNamespaceIDs); n > 0 && n != numPolicies {
+		return xerrors.NewInvalidParamsError(errWriteNamespaceIDsLengthMismatch)
+	}
+	if n := len(overrides.WriteMetricsTypes); n > 0 && n != numPolicies {
+		return xerrors.NewInvalidParamsError(errWriteMetricsTypesLengthMismatch)
+	}
+	return nil
+}
+
+// writeNamespaceID returns the ID of the namespace the storage policy at
+// index i of the overrides is written to, or an empty ID if the namespace
+// is selected by the resolution and retention of the storage policy.
+func writeNamespaceID(overrides WriteOptions, i int) string {
+	if i >= len(overrides.WriteNamespaceIDs) {
+		return ""
+	}
+	return overrides.WriteNamespaceIDs[i]
+}
+
+// writeMetricsType returns the metrics type of the namespace the storage
+// policy at index i of the overrides is written to, overridden storage
+// policies are for aggregated namespaces unless the overrides say otherwise.
+func writeMetricsType(overrides WriteOptions, i int) storage.MetricsType {
+	if i >= len(overrides.WriteMetricsTypes) {
+		return storage.AggregatedMetricsType
+	}
+	return overrides.WriteMetricsTypes[i]
+}
+
+// storagePolicyAttributes returns the attributes of the namespace of the
+// overridden storage policy at index i of the overrides.
+func storagePolicyAttributes(
+	overrides WriteOptions,
+	i int,
+) storage.Attributes {
+	p := overrides.WriteStoragePolicies[i]
+	return storage.Attributes{
+		MetricsType: writeMetricsType(overrides, i),
+		Resolution:  p.Resolution().Window,
+		Retention:   p.Retention().Duration(),
+		NamespaceID: writeNamespaceID(overrides, i),
+	}
+}
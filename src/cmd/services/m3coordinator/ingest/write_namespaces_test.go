@@ -0,0 +1,190 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/storage/m3"
+	testm3 "github.com/m3db/m3/src/query/test/m3"
+	xerrors "github.com/m3db/m3x/errors"
+	"github.com/m3db/m3x/ident"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampleAndWriteWithWriteNamespaceIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			NamespaceID: ident.StringID("10s:24h"),
+			Resolution:  10 * time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+	downAndWrite.downsampler = nil
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(10*time.Second, xtime.Second, 24*time.Hour),
+		},
+		// The first storage policy is written to the namespace selected by
+		// its ID, the second to the namespace of its resolution and retention.
+		WriteNamespaceIDs: []string{"10s:24h", ""},
+	}
+	session.EXPECT().WriteTagged(ident.NewIDMatcher("10s:24h"), gomock.Any(),
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Times(2 * len(testDatapoints1))
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.NoError(t, err)
+
+	destinations, err := downAndWrite.ResolveDestinations(testTags1, overrides)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Attributes{
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+			NamespaceID: "10s:24h",
+		},
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  10 * time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}, destinations)
+}
+
+func TestDownsampleAndWriteWriteNamespaceIDsLengthMismatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither the downsampler nor the storage should be written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+		WriteNamespaceIDs: []string{"a", "b"},
+	}
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.Error(t, err)
+	require.True(t, xerrors.IsInvalidParams(err))
+}
+
+func TestDownsampleAndWriteWithWriteMetricsTypes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+	downAndWrite.downsampler = nil
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(time.Second, xtime.Second, 24*time.Hour),
+		},
+		WriteMetricsTypes: []storage.MetricsType{
+			storage.AggregatedMetricsType,
+			storage.UnaggregatedMetricsType,
+		},
+	}
+	session.EXPECT().WriteTagged(ident.NewIDMatcher("1m:48h"), gomock.Any(),
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Times(len(testDatapoints1))
+	session.EXPECT().WriteTagged(ident.NewIDMatcher(testm3.TestNamespaceID),
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).
+		Times(len(testDatapoints1))
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.NoError(t, err)
+
+	destinations, err := downAndWrite.ResolveDestinations(testTags1, overrides)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Attributes{
+		{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			MetricsType: storage.UnaggregatedMetricsType,
+			Resolution:  time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}, destinations)
+}
+
+func TestDownsampleAndWriteWriteMetricsTypesLengthMismatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither the downsampler nor the storage should be written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+		},
+		WriteMetricsTypes: []storage.MetricsType{
+			storage.AggregatedMetricsType,
+			storage.UnaggregatedMetricsType,
+		},
+	}
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.Error(t, err)
+	require.True(t, xerrors.IsInvalidParams(err))
+}
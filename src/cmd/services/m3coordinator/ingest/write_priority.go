@@ -0,0 +1,230 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	xsync "github.com/m3db/m3x/sync"
+
+	"github.com/uber-go/tally"
+)
+
+var errWriteShed = errors.New("write shed, priority queue is full")
+
+// WritePriority is the priority of a write, under overload the storage
+// writes of higher priority writes are dispatched to the write workers
+// before those of lower priority writes.
+type WritePriority uint
+
+const (
+	// WritePriorityBestEffort is the priority of writes that do not set one.
+	WritePriorityBestEffort WritePriority = iota
+	// WritePriorityCritical is the priority of writes that must survive
+	// overload, such as those of metrics backing SLOs.
+	WritePriorityCritical
+
+	numWritePriorities = int(WritePriorityCritical) + 1
+)
+
+func (p WritePriority) String() string {
+	switch p {
+	case WritePriorityBestEffort:
+		return "best_effort"
+	case WritePriorityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+type priorityKeyType int
+
+const priorityKey priorityKeyType = iota
+
+// NewContextWithPriority returns a context that sets the priority of the
+// writes made with it.
+func NewContextWithPriority(ctx context.Context, priority WritePriority) context.Context {
+	return context.WithValue(ctx, priorityKey, priority)
+}
+
+// PriorityFromContext returns the priority of the writes made with the
+// context, writes are best effort unless the context sets a priority.
+func PriorityFromContext(ctx context.Context) WritePriority {
+	priority, ok := ctx.Value(priorityKey).(WritePriority)
+	if !ok || int(priority) >= numWritePriorities {
+		return WritePriorityBestEffort
+	}
+	return priority
+}
+
+// WritePrioritiesOptions configures scheduling the storage writes that are
+// performed by the write workers, the storage writes of batches and of
+// writes that override their storage policies, by the priority of their
+// write. Storage writes are queued per priority and dispatched highest
+// priority first whenever fewer than Concurrency are in progress.
+type WritePrioritiesOptions struct {
+	// Concurrency is the maximum number of storage writes dispatched to the
+	// write workers at once, storage writes are dispatched in the order they
+	// are made if not set.
+	Concurrency int
+
+	// MaxQueued is the maximum number of storage writes queued per
+	// priority, once reached further storage writes of that priority are
+	// shed. Unbounded if not set.
+	MaxQueued int
+}
+
+// priorityScheduler dispatches tasks to a worker pool highest priority
+// first. A worker that completes a task runs the next queued task itself
+// rather than dispatching it so that workers never block on the pool.
+type priorityScheduler struct {
+	sync.Mutex
+
+	workerPool  xsync.PooledWorkerPool
+	concurrency int
+	maxQueued   int
+	running     int
+	queues      [numWritePriorities][]func()
+	metrics     [numWritePriorities]writePriorityMetrics
+}
+
+type writePriorityMetrics struct {
+	queued tally.Gauge
+	shed   tally.Counter
+}
+
+// newPriorityScheduler returns a priority scheduler for the options or nil
+// if priority scheduling is disabled.
+func newPriorityScheduler(
+	workerPool xsync.PooledWorkerPool,
+	opts WritePrioritiesOptions,
+	scope tally.Scope,
+) *priorityScheduler {
+	if opts.Concurrency <= 0 {
+		return nil
+	}
+
+	s := &priorityScheduler{
+		workerPool:  workerPool,
+		concurrency: opts.Concurrency,
+		maxQueued:   opts.MaxQueued,
+	}
+	for i := range s.metrics {
+		priorityScope := scope.Tagged(map[string]string{
+			"priority": WritePriority(i).String(),
+		})
+		s.metrics[i] = writePriorityMetrics{
+			queued: priorityScope.Gauge("write-priority.queued"),
+			shed:   priorityScope.Counter("write-priority.shed"),
+		}
+	}
+	return s
+}
+
+// schedule queues the task to run at the priority, returning an error if
+// the queue of the priority is full in which case the task never runs.
+func (s *priorityScheduler) schedule(priority WritePriority, task func()) error {
+	s.Lock()
+	queue := s.queues[priority]
+	if s.maxQueued > 0 && len(queue) >= s.maxQueued {
+		s.Unlock()
+		s.metrics[priority].shed.Inc(1)
+		return errWriteShed
+	}
+	s.queues[priority] = append(queue, task)
+	s.metrics[priority].queued.Update(float64(len(queue) + 1))
+
+	if s.running >= s.concurrency {
+		s.Unlock()
+		return nil
+	}
+	next, _ := s.nextWithLock()
+	s.running++
+	s.Unlock()
+
+	goWithPool(s.workerPool, func() {
+		s.run(next)
+	})
+	return nil
+}
+
+func (s *priorityScheduler) run(task func()) {
+	for {
+		task()
+
+		s.Lock()
+		next, ok := s.nextWithLock()
+		if !ok {
+			s.running--
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+		task = next
+	}
+}
+
+// nextWithLock dequeues the oldest task of the highest priority with
+// queued tasks.
+func (s *priorityScheduler) nextWithLock() (func(), bool) {
+	for priority := numWritePriorities - 1; priority >= 0; priority-- {
+		queue := s.queues[priority]
+		if len(queue) == 0 {
+			continue
+		}
+
+		task := queue[0]
+		queue[0] = nil
+		s.queues[priority] = queue[1:]
+		s.metrics[priority].queued.Update(float64(len(queue) - 1))
+		return task, true
+	}
+	return nil, false
+}
+
+// goWithPool runs the work on the worker pool or, if there is no worker
+// pool, on its own goroutine.
+func goWithPool(workerPool xsync.PooledWorkerPool, work func()) {
+	if workerPool == nil {
+		go work()
+		return
+	}
+	workerPool.Go(work)
+}
+
+// goWrite runs a storage write on the write workers, scheduled by the
+// priority of the context if priority scheduling is enabled. If an error is
+// returned the write is shed and never runs.
+func (d *downsamplerAndWriter) goWrite(ctx context.Context, write func()) error {
+	if d.priorityScheduler == nil {
+		goWithPool(d.workerPool, write)
+		return nil
+	}
+
+	priority := PriorityFromContext(ctx)
+	if err := d.priorityScheduler.schedule(priority, write); err != nil {
+		return fmt.Errorf("%s write: %v", priority, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	xsync "github.com/m3db/m3x/sync"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func newTestPriorityScheduler(
+	t *testing.T,
+	opts WritePrioritiesOptions,
+	scope tally.Scope,
+) *priorityScheduler {
+	workerPool, err := xsync.NewPooledWorkerPool(4, xsync.NewPooledWorkerPoolOptions())
+	require.NoError(t, err)
+	workerPool.Init()
+
+	return newPriorityScheduler(workerPool, opts, scope)
+}
+
+func TestPriorityFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, WritePriorityBestEffort, PriorityFromContext(ctx))
+
+	ctx = NewContextWithPriority(ctx, WritePriorityCritical)
+	require.Equal(t, WritePriorityCritical, PriorityFromContext(ctx))
+}
+
+func TestPrioritySchedulerDisabled(t *testing.T) {
+	require.Nil(t, newPriorityScheduler(nil, WritePrioritiesOptions{}, tally.NoopScope))
+}
+
+func TestPrioritySchedulerDispatchesHighestPriorityFirst(t *testing.T) {
+	scheduler := newTestPriorityScheduler(t,
+		WritePrioritiesOptions{Concurrency: 1}, tally.NoopScope)
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		order   []string
+		blocked = make(chan struct{})
+		record  = func(name string) func() {
+			wg.Add(1)
+			return func() {
+				lock.Lock()
+				order = append(order, name)
+				lock.Unlock()
+				wg.Done()
+			}
+		}
+	)
+
+	// Occupy the only dispatch slot until all the other tasks are queued.
+	wg.Add(1)
+	require.NoError(t, scheduler.schedule(WritePriorityBestEffort, func() {
+		<-blocked
+		wg.Done()
+	}))
+	require.NoError(t, scheduler.schedule(WritePriorityBestEffort, record("best-effort-1")))
+	require.NoError(t, scheduler.schedule(WritePriorityCritical, record("critical-1")))
+	require.NoError(t, scheduler.schedule(WritePriorityBestEffort, record("best-effort-2")))
+	require.NoError(t, scheduler.schedule(WritePriorityCritical, record("critical-2")))
+	close(blocked)
+	wg.Wait()
+
+	require.Equal(t, []string{
+		"critical-1", "critical-2", "best-effort-1", "best-effort-2",
+	}, order)
+}
+
+func TestPrioritySchedulerShedsWhenQueueFull(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	scheduler := newTestPriorityScheduler(t,
+		WritePrioritiesOptions{Concurrency: 1, MaxQueued: 1}, scope)
+
+	var (
+		wg      sync.WaitGroup
+		blocked = make(chan struct{})
+		done    = func() { wg.Done() }
+	)
+	wg.Add(3)
+	require.NoError(t, scheduler.schedule(WritePriorityBestEffort, func() {
+		<-blocked
+		wg.Done()
+	}))
+	require.NoError(t, scheduler.schedule(WritePriorityBestEffort, done))
+	require.Equal(t, errWriteShed, scheduler.schedule(WritePriorityBestEffort, done))
+	// Each priority has its own queue.
+	require.NoError(t, scheduler.schedule(WritePriorityCritical, done))
+	close(blocked)
+	wg.Wait()
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["write-priority.shed+priority=best_effort"].Value())
+	require.Equal(t, int64(0), counters["write-priority.shed+priority=critical"].Value())
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"sync"
+
+	"github.com/m3db/m3/src/query/storage"
+)
+
+// writeQueryPool reuses the queries of storage writes, a nil pool
+// allocates a new query for every write.
+type writeQueryPool struct {
+	pool sync.Pool
+}
+
+func newWriteQueryPool(enabled bool) *writeQueryPool {
+	if !enabled {
+		return nil
+	}
+
+	return &writeQueryPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return &storage.WriteQuery{}
+			},
+		},
+	}
+}
+
+// get returns an empty query.
+func (p *writeQueryPool) get() *storage.WriteQuery {
+	if p == nil {
+		return &storage.WriteQuery{}
+	}
+	return p.pool.Get().(*storage.WriteQuery)
+}
+
+// put returns the query to the pool, it must only be called once the
+// storage write of the query has returned. The query is reset so that the
+// pool does not keep the tags and datapoints of the write alive.
+func (p *writeQueryPool) put(query *storage.WriteQuery) {
+	if p == nil {
+		return
+	}
+	*query = storage.WriteQuery{}
+	p.pool.Put(query)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/metrics/policy"
+	"github.com/m3db/m3/src/query/storage"
+	xtime "github.com/m3db/m3x/time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteQueryPool(t *testing.T) {
+	var disabled *writeQueryPool
+	require.Nil(t, newWriteQueryPool(false))
+	require.Equal(t, &storage.WriteQuery{}, disabled.get())
+	disabled.put(&storage.WriteQuery{Tags: testTags1})
+
+	pool := newWriteQueryPool(true)
+	query := pool.get()
+	query.Tags = testTags1
+	query.Datapoints = testDatapoints1
+	pool.put(query)
+	require.Equal(t, storage.WriteQuery{}, *query)
+	require.Equal(t, &storage.WriteQuery{}, pool.get())
+}
+
+// copyingStorage records a copy of each query written since the queries of
+// pooled writes are reused once their write returns.
+type copyingStorage struct {
+	storage.Storage
+
+	sync.Mutex
+	writes []storage.WriteQuery
+}
+
+func (s *copyingStorage) Write(_ context.Context, query *storage.WriteQuery) error {
+	s.Lock()
+	s.writes = append(s.writes, *query)
+	s.Unlock()
+	return nil
+}
+
+func TestDownsampleAndWritePoolWriteQueries(t *testing.T) {
+	var (
+		store         = &copyingStorage{}
+		storagePolicy = policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour)
+		downAndWrite  = NewDownsamplerAndWriter(store, nil, testWorkerPool, Options{
+			PoolWriteQueries: true,
+		})
+	)
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, WriteOptions{})
+	require.NoError(t, err)
+	err = downAndWrite.Write(context.Background(), testTags2, testDatapoints2,
+		xtime.Second, WriteOptions{
+			WriteOverride:        true,
+			WriteStoragePolicies: []policy.StoragePolicy{storagePolicy},
+		})
+	require.NoError(t, err)
+	err = downAndWrite.WriteBatch(context.Background(), newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1},
+		{tags: testTags2, datapoints: testDatapoints2},
+	}), nil)
+	require.NoError(t, err)
+
+	require.Equal(t, 4, len(store.writes))
+	require.Equal(t, storage.WriteQuery{
+		Tags:       testTags1,
+		Datapoints: testDatapoints1,
+		Unit:       xtime.Second,
+		Attributes: storage.Attributes{MetricsType: storage.UnaggregatedMetricsType},
+	}, store.writes[0])
+	require.Equal(t, storage.WriteQuery{
+		Tags:       testTags2,
+		Datapoints: testDatapoints2,
+		Unit:       xtime.Second,
+		Attributes: storage.Attributes{
+			MetricsType: storage.AggregatedMetricsType,
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}, store.writes[1])
+
+	// The series of the batch are written concurrently.
+	batchWrites := map[string]storage.WriteQuery{}
+	for _, write := range store.writes[2:] {
+		batchWrites[string(write.Tags.ID())] = write
+	}
+	for _, tags := range []string{string(testTags1.ID()), string(testTags2.ID())} {
+		write, ok := batchWrites[tags]
+		require.True(t, ok)
+		require.Equal(t, storage.UnaggregatedMetricsType, write.Attributes.MetricsType)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3x/time"
+)
+
+// WriteSeriesRequest is a series to write with WriteSeries.
+type WriteSeriesRequest struct {
+	Tags       models.Tags
+	Datapoints ts.Datapoints
+	Unit       xtime.Unit
+
+	// Overrides optionally overrides the mapping rules and storage policies
+	// of the series, see IterValue.
+	Overrides WriteOptions
+}
+
+func (d *downsamplerAndWriter) WriteSeries(
+	ctx context.Context,
+	series []WriteSeriesRequest,
+) error {
+	return d.WriteBatch(ctx, newWriteSeriesIter(series), nil)
+}
+
+// writeSeriesIter iterates over the series of a WriteSeries call.
+type writeSeriesIter struct {
+	idx    int
+	series []WriteSeriesRequest
+}
+
+func newWriteSeriesIter(series []WriteSeriesRequest) *writeSeriesIter {
+	return &writeSeriesIter{idx: -1, series: series}
+}
+
+func (i *writeSeriesIter) Next() bool {
+	i.idx++
+	return i.idx < len(i.series)
+}
+
+func (i *writeSeriesIter) Current() IterValue {
+	if i.idx < 0 || i.idx >= len(i.series) {
+		return IterValue{Tags: models.EmptyTags()}
+	}
+
+	curr := i.series[i.idx]
+	return IterValue{
+		Tags:       curr.Tags,
+		Datapoints: curr.Datapoints,
+		Unit:       curr.Unit,
+		Overrides:  curr.Overrides,
+	}
+}
+
+func (i *writeSeriesIter) Reset() error {
+	i.idx = -1
+	return nil
+}
+
+func (i *writeSeriesIter) Error() error {
+	return nil
+}
@@ -22,7 +22,9 @@ package ingest
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -40,6 +42,7 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 var (
@@ -124,8 +127,13 @@ type testIter struct {
 }
 
 type testIterEntry struct {
-	tags       models.Tags
-	datapoints []ts.Datapoint
+	tags           models.Tags
+	datapoints     []ts.Datapoint
+	gaugeStats     []GaugeStats
+	metricType     MetricType
+	datapointTypes []MetricType
+	source         string
+	overrides      WriteOptions
 }
 
 func newTestIter(entries []testIterEntry) *testIter {
@@ -135,18 +143,42 @@ func newTestIter(entries []testIterEntry) *testIter {
 	}
 }
 
+// cancellingTestIter cancels a context once cancelAfter values have been
+// iterated.
+type cancellingTestIter struct {
+	*testIter
+	cancel      context.CancelFunc
+	cancelAfter int
+}
+
+func (i *cancellingTestIter) Next() bool {
+	if i.idx+1 == i.cancelAfter {
+		i.cancel()
+	}
+	return i.testIter.Next()
+}
+
 func (i *testIter) Next() bool {
 	i.idx++
 	return i.idx < len(i.entries)
 }
 
-func (i *testIter) Current() (models.Tags, ts.Datapoints, xtime.Unit) {
+func (i *testIter) Current() IterValue {
 	if len(i.entries) == 0 || i.idx < 0 || i.idx >= len(i.entries) {
-		return models.EmptyTags(), nil, 0
+		return IterValue{Tags: models.EmptyTags()}
 	}
 
 	curr := i.entries[i.idx]
-	return curr.tags, curr.datapoints, xtime.Second
+	return IterValue{
+		Tags:           curr.tags,
+		Datapoints:     curr.datapoints,
+		Unit:           xtime.Second,
+		GaugeStats:     curr.gaugeStats,
+		Type:           curr.metricType,
+		DatapointTypes: curr.datapointTypes,
+		Source:         curr.source,
+		Overrides:      curr.overrides,
+	}
 }
 
 func (i *testIter) Reset() error {
@@ -229,6 +261,71 @@ func TestDownsampleAndWriteWithDownsampleOverridesAndMappingRules(t *testing.T)
 	require.NoError(t, err)
 }
 
+func TestDownsampleAndWriteWithDownsampleAggregations(t *testing.T) {
+	mappingRules := []downsample.MappingRule{
+		{
+			Aggregations: []aggregation.Type{aggregation.Mean},
+			Policies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(
+					time.Minute, xtime.Second, 48*time.Hour),
+			},
+		},
+	}
+	aggregations := []aggregation.Type{aggregation.Sum, aggregation.Max}
+
+	testCases := []struct {
+		name                           string
+		overrides                      WriteOptions
+		expectedSamplesAppenderOptions downsample.SampleAppenderOptions
+	}{
+		{
+			// The aggregations of the default and matched mapping rules are
+			// overridden by the downsampler.
+			name: "default-mapping-rules",
+			overrides: WriteOptions{
+				DownsampleAggregations: aggregations,
+			},
+			expectedSamplesAppenderOptions: downsample.SampleAppenderOptions{
+				OverrideRules: downsample.SamplesAppenderOverrideRules{
+					Aggregations: aggregations,
+				},
+			},
+		},
+		{
+			name: "mapping-rule-overrides",
+			overrides: WriteOptions{
+				DownsampleOverride:     true,
+				DownsampleMappingRules: mappingRules,
+				DownsampleAggregations: aggregations,
+			},
+			expectedSamplesAppenderOptions: downsample.SampleAppenderOptions{
+				Override: true,
+				OverrideRules: downsample.SamplesAppenderOverrideRules{
+					MappingRules: mappingRules,
+					Aggregations: aggregations,
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+			expectDefaultDownsampling(ctrl, testDatapoints1, downsampler,
+				tc.expectedSamplesAppenderOptions)
+			expectDefaultStorageWrites(session, testDatapoints1)
+
+			err := downAndWrite.Write(
+				context.Background(), testTags1, testDatapoints1, xtime.Second, tc.overrides)
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestDownsampleAndWriteWithWriteOverridesAndNoStoragePolicies(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -296,6 +393,119 @@ func TestDownsampleAndWriteWithWriteOverridesAndStoragePolicies(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestDownsampleAndWriteWithWriteOverridesStoragePolicyError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			NamespaceID: ident.StringID("10:24h"),
+			Resolution:  10 * time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}
+	downAndWrite, _, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+	downAndWrite.downsampler = nil
+
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(
+				time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(
+				10*time.Second, xtime.Second, 24*time.Hour),
+		},
+	}
+
+	// Only the writes to one of the two namespaces fail.
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace, _ ident.ID, _ ident.TagIterator, _ time.Time, _ float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			if namespace.String() == "10:24h" {
+				return errors.New("storage error")
+			}
+			return nil
+		}).
+		Times(len(aggregatedNamespaces) * len(testDatapoints1))
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "storage error")
+}
+
+func TestDownsampleAndWriteStoragePolicyFanoutLimit(t *testing.T) {
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			NamespaceID: ident.StringID("10:24h"),
+			Resolution:  10 * time.Second,
+			Retention:   24 * time.Hour,
+		},
+	}
+	overrides := WriteOptions{
+		WriteOverride: true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(
+				time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(
+				10*time.Second, xtime.Second, 24*time.Hour),
+		},
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		downAndWrite, _, _ := newTestDownsamplerAndWriterWithAggregatedNamespace(
+			t, ctrl, aggregatedNamespaces)
+		scope := tally.NewTestScope("", nil)
+		downAndWrite.metrics = newDownsamplerAndWriterMetrics(scope)
+		downAndWrite.opts.MaxStoragePolicyFanout = 1
+
+		// Nothing should be written since the write is rejected upfront.
+		err := downAndWrite.Write(
+			context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+		require.Error(t, err)
+		require.Equal(t, int64(1), scope.Snapshot().Counters()["fanout.rejected+"].Value())
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+			t, ctrl, aggregatedNamespaces)
+		scope := tally.NewTestScope("", nil)
+		downAndWrite.metrics = newDownsamplerAndWriterMetrics(scope)
+		downAndWrite.opts.MaxStoragePolicyFanout = 1
+		downAndWrite.opts.TruncateStoragePolicyFanout = true
+
+		// Only the first storage policy should be written to.
+		expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+		expectDefaultStorageWrites(session, testDatapoints1)
+
+		err := downAndWrite.Write(
+			context.Background(), testTags1, testDatapoints1, xtime.Second, overrides)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), scope.Snapshot().Counters()["fanout.truncated+"].Value())
+	})
+}
+
 func TestDownsampleAndWriteNoDownsampler(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -310,6 +520,21 @@ func TestDownsampleAndWriteNoDownsampler(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestDownsampleAndWriteSkipUnaggregated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+		Options{SkipUnaggregated: true})
+
+	// No storage writes are expected.
+	expectDefaultDownsampling(ctrl, testDatapoints1, downsampler, zeroDownsamplerAppenderOpts)
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, defaultOverride)
+	require.NoError(t, err)
+}
+
 func TestDownsampleAndWriteBatch(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -324,19 +549,11 @@ func TestDownsampleAndWriteBatch(t *testing.T) {
 	mockMetricsAppender.
 		EXPECT().
 		SamplesAppender(zeroDownsamplerAppenderOpts).
-		Return(mockSamplesAppender, nil).Times(2)
-	for _, tag := range testTags1.Tags {
-		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
-	}
-	for _, dp := range testDatapoints1 {
-		mockSamplesAppender.EXPECT().AppendGaugeSample(dp.Value)
-	}
-	for _, tag := range testTags2.Tags {
-		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
-	}
-	for _, dp := range testDatapoints2 {
-		mockSamplesAppender.EXPECT().AppendGaugeSample(dp.Value)
-	}
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).Times(2)
+	mockMetricsAppender.EXPECT().AddTags(testTags1.Tags)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	mockMetricsAppender.EXPECT().AddTags(testTags2.Tags)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints2)
 	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
 
 	mockMetricsAppender.EXPECT().Reset().Times(2)
@@ -352,7 +569,92 @@ func TestDownsampleAndWriteBatch(t *testing.T) {
 	}
 
 	iter := newTestIter(testEntries)
-	err := downAndWrite.WriteBatch(context.Background(), iter)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteFinalizeError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.
+		EXPECT().
+		SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
+	for _, tag := range testTags1.Tags {
+		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
+	}
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+	mockMetricsAppender.EXPECT().Finalize().Return(errors.New("finalize failed"))
+
+	err := downAndWrite.Write(
+		context.Background(), testTags1, testDatapoints1, xtime.Second, WriteOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "finalize failed")
+}
+
+func TestDownsampleAndWriteBatchFinalizeError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.
+		EXPECT().
+		SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).Times(2)
+	mockMetricsAppender.EXPECT().AddTags(testTags1.Tags)
+	mockMetricsAppender.EXPECT().AddTags(testTags2.Tags)
+	mockSamplesAppender.EXPECT().AppendGaugeSamples(gomock.Any()).Times(2)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+	mockMetricsAppender.EXPECT().Reset().Times(2)
+	mockMetricsAppender.EXPECT().Finalize().Return(errors.New("finalize failed"))
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints2)
+
+	iter := newTestIter(testEntries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "finalize failed")
+}
+
+func TestDownsampleAndWriteBatchSkipUnaggregated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, downsampler, _ := newTestDownsamplerAndWriterWithOptions(t, ctrl,
+		Options{SkipUnaggregated: true})
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.
+		EXPECT().
+		SamplesAppender(zeroDownsamplerAppenderOpts).
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil).Times(2)
+	mockMetricsAppender.EXPECT().AddTags(testTags1.Tags)
+	mockMetricsAppender.EXPECT().AddTags(testTags2.Tags)
+	mockSamplesAppender.EXPECT().AppendGaugeSamples(gomock.Any()).Times(2)
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+	mockMetricsAppender.EXPECT().Reset().Times(2)
+	mockMetricsAppender.EXPECT().Finalize()
+
+	// No storage writes are expected.
+	iter := newTestIter(testEntries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
 	require.NoError(t, err)
 }
 
@@ -373,8 +675,267 @@ func TestDownsampleAndWriteBatchNoDownsampler(t *testing.T) {
 	}
 
 	iter := newTestIter(testEntries)
-	err := downAndWrite.WriteBatch(context.Background(), iter)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteNoWriteDestination(t *testing.T) {
+	downAndWrite := NewDownsamplerAndWriter(nil, nil, testWorkerPool, Options{})
+
+	err := downAndWrite.Write(context.Background(), testTags1, testDatapoints1,
+		xtime.Second, defaultOverride)
+	require.Equal(t, ErrNoWriteDestination, err)
+
+	var committed error
+	err = downAndWrite.WriteBatch(context.Background(), newTestIter(testEntries),
+		func(err error) { committed = err })
+	require.Equal(t, ErrNoWriteDestination, err)
+	require.Equal(t, ErrNoWriteDestination, committed)
+
+	result, err := downAndWrite.WriteBatchWithResult(context.Background(),
+		newTestIter(testEntries))
+	require.Equal(t, ErrNoWriteDestination, err)
+	require.Equal(t, []error{ErrNoWriteDestination}, result.Errors)
+}
+
+func TestDownsampleAndWriteBatchNoWorkerPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+	downAndWrite.workerPool = nil
+
+	expectDefaultStorageWrites(session, testDatapoints1)
+	expectDefaultStorageWrites(session, testDatapoints2)
+
+	iter := newTestIter(testEntries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+}
+
+func TestDownsampleAndWriteBatchWithOverrides(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+	}
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+
+	mappingRules := []downsample.MappingRule{
+		{
+			Aggregations: []aggregation.Type{aggregation.Mean},
+			Policies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(
+					time.Minute, xtime.Second, 48*time.Hour),
+			},
+		},
+	}
+	overrideAppenderOpts := downsample.SampleAppenderOptions{
+		Override: true,
+		OverrideRules: downsample.SamplesAppenderOverrideRules{
+			MappingRules: mappingRules,
+		},
+	}
+
+	// The first series overrides both its mapping rules and storage policies,
+	// the second uses the defaults.
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1, overrides: WriteOptions{
+			DownsampleOverride:     true,
+			DownsampleMappingRules: mappingRules,
+			WriteOverride:          true,
+			WriteStoragePolicies: []policy.StoragePolicy{
+				policy.NewStoragePolicy(
+					time.Minute, xtime.Second, 48*time.Hour),
+			},
+		}},
+		{tags: testTags2, datapoints: testDatapoints2},
+	})
+
+	var (
+		mockSamplesAppender = downsample.NewMockSamplesAppender(ctrl)
+		mockMetricsAppender = downsample.NewMockMetricsAppender(ctrl)
+	)
+	mockMetricsAppender.EXPECT().Reset().Times(2)
+	mockMetricsAppender.EXPECT().AddTags(gomock.Any()).AnyTimes()
+	gomock.InOrder(
+		mockMetricsAppender.EXPECT().SamplesAppender(overrideAppenderOpts).
+			Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil),
+		mockMetricsAppender.EXPECT().SamplesAppender(zeroDownsamplerAppenderOpts).
+			Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil),
+	)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints1)
+	expectGaugeSamples(mockSamplesAppender, testDatapoints2)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	var (
+		lock       sync.Mutex
+		namespaces = make(map[float64]string)
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace, _ ident.ID, _ ident.TagIterator, _ time.Time, value float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			lock.Lock()
+			namespaces[value] = namespace.String()
+			lock.Unlock()
+			return nil
+		}).
+		Times(len(testDatapoints1) + len(testDatapoints2))
+
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
 	require.NoError(t, err)
+
+	for _, dp := range testDatapoints1 {
+		require.Equal(t, "1m:48h", namespaces[dp.Value])
+	}
+	for _, dp := range testDatapoints2 {
+		require.NotEqual(t, "1m:48h", namespaces[dp.Value])
+	}
+}
+
+func TestDownsampleAndWriteBatchPreAggregated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	aggregatedNamespaces := []m3.AggregatedClusterNamespaceDefinition{
+		{
+			NamespaceID: ident.StringID("1m:48h"),
+			Resolution:  time.Minute,
+			Retention:   48 * time.Hour,
+		},
+		{
+			NamespaceID: ident.StringID("10m:720h"),
+			Resolution:  10 * time.Minute,
+			Retention:   720 * time.Hour,
+		},
+	}
+	downAndWrite, downsampler, session := newTestDownsamplerAndWriterWithAggregatedNamespace(
+		t, ctrl, aggregatedNamespaces)
+
+	// Pre-aggregated series are written straight to the aggregated
+	// namespaces and are not downsampled.
+	overrides := WriteOptions{
+		DownsampleOverride: true,
+		WriteOverride:      true,
+		WriteStoragePolicies: []policy.StoragePolicy{
+			policy.NewStoragePolicy(time.Minute, xtime.Second, 48*time.Hour),
+			policy.NewStoragePolicy(10*time.Minute, xtime.Second, 720*time.Hour),
+		},
+	}
+	iter := newTestIter([]testIterEntry{
+		{tags: testTags1, datapoints: testDatapoints1, overrides: overrides},
+		{tags: testTags2, datapoints: testDatapoints2, overrides: overrides},
+	})
+
+	mockMetricsAppender := downsample.NewMockMetricsAppender(ctrl)
+	mockMetricsAppender.EXPECT().Finalize()
+	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
+
+	var (
+		lock       sync.Mutex
+		namespaces = make(map[string]int)
+	)
+	session.EXPECT().
+		WriteTagged(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(
+			namespace, _ ident.ID, _ ident.TagIterator, _ time.Time, _ float64,
+			_ xtime.Unit, _ []byte,
+		) error {
+			lock.Lock()
+			namespaces[namespace.String()]++
+			lock.Unlock()
+			return nil
+		}).
+		Times(2 * (len(testDatapoints1) + len(testDatapoints2)))
+
+	err := downAndWrite.WriteBatch(context.Background(), iter, nil)
+	require.NoError(t, err)
+
+	numDatapoints := len(testDatapoints1) + len(testDatapoints2)
+	require.Equal(t, map[string]int{
+		"1m:48h":   numDatapoints,
+		"10m:720h": numDatapoints,
+	}, namespaces)
+}
+
+func TestDownsampleAndWriteBatchCancelledContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Neither storage nor the downsampler are written to.
+	downAndWrite, _, _ := newTestDownsamplerAndWriter(t, ctrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := downAndWrite.WriteBatch(ctx, newTestIter(testEntries), nil)
+	require.Equal(t, &BatchWriteError{
+		Total:     len(testEntries),
+		Cancelled: true,
+		Err:       context.Canceled,
+	}, err)
+}
+
+func TestDownsampleAndWriteBatchCancelledMidBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+
+	// Only the series dispatched before the cancellation may be written,
+	// whether they are depends on whether their write observes the
+	// cancellation.
+	for _, dp := range testDatapoints1 {
+		session.EXPECT().WriteTagged(
+			gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), dp.Value, gomock.Any(), gomock.Any()).
+			MaxTimes(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iter := &cancellingTestIter{
+		testIter:    newTestIter(testEntries),
+		cancel:      cancel,
+		cancelAfter: 1,
+	}
+	err := downAndWrite.WriteBatch(ctx, iter, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), context.Canceled.Error())
+}
+
+func TestDownsampleAndWriteBatchCommit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	downAndWrite, _, session := newTestDownsamplerAndWriter(t, ctrl)
+	downAndWrite.downsampler = nil
+
+	writeErr := errors.New("write error")
+	session.EXPECT().WriteTagged(
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(writeErr).AnyTimes()
+
+	var commits []error
+	iter := newTestIter(testEntries)
+	err := downAndWrite.WriteBatch(context.Background(), iter, func(err error) {
+		commits = append(commits, err)
+	})
+	require.Error(t, err)
+	require.Equal(t, []error{err}, commits)
 }
 
 func expectDefaultDownsampling(
@@ -388,19 +949,34 @@ func expectDefaultDownsampling(
 	mockMetricsAppender.
 		EXPECT().
 		SamplesAppender(downsampleOpts).
-		Return(mockSamplesAppender, nil)
+		Return(downsample.SamplesAppenderResult{SamplesAppender: mockSamplesAppender}, nil)
 	for _, tag := range testTags1.Tags {
 		mockMetricsAppender.EXPECT().AddTag(tag.Name, tag.Value)
 	}
 
-	for _, dp := range datapoints {
-		mockSamplesAppender.EXPECT().AppendGaugeSample(dp.Value)
-	}
+	expectGaugeSamples(mockSamplesAppender, datapoints)
 	downsampler.EXPECT().NewMetricsAppender().Return(mockMetricsAppender, nil)
 
 	mockMetricsAppender.EXPECT().Finalize()
 }
 
+// expectGaugeSamples expects the values of the datapoints of a series to be
+// appended as gauge samples, in a single call if there is more than one.
+func expectGaugeSamples(
+	samplesAppender *downsample.MockSamplesAppender,
+	datapoints []ts.Datapoint,
+) *gomock.Call {
+	if len(datapoints) == 1 {
+		return samplesAppender.EXPECT().AppendGaugeSample(datapoints[0].Value)
+	}
+
+	values := make([]float64, 0, len(datapoints))
+	for _, dp := range datapoints {
+		values = append(values, dp.Value)
+	}
+	return samplesAppender.EXPECT().AppendGaugeSamples(values)
+}
+
 func expectDefaultStorageWrites(session *client.MockSession, datapoints []ts.Datapoint) {
 	for _, dp := range datapoints {
 		session.EXPECT().WriteTagged(
@@ -411,10 +987,18 @@ func expectDefaultStorageWrites(session *client.MockSession, datapoints []ts.Dat
 func newTestDownsamplerAndWriter(
 	t *testing.T,
 	ctrl *gomock.Controller,
+) (*downsamplerAndWriter, *downsample.MockDownsampler, *client.MockSession) {
+	return newTestDownsamplerAndWriterWithOptions(t, ctrl, Options{})
+}
+
+func newTestDownsamplerAndWriterWithOptions(
+	t *testing.T,
+	ctrl *gomock.Controller,
+	opts Options,
 ) (*downsamplerAndWriter, *downsample.MockDownsampler, *client.MockSession) {
 	storage, session := testm3.NewStorageAndSession(t, ctrl)
 	downsampler := downsample.NewMockDownsampler(ctrl)
-	return NewDownsamplerAndWriter(storage, downsampler, testWorkerPool).(*downsamplerAndWriter), downsampler, session
+	return NewDownsamplerAndWriter(storage, downsampler, testWorkerPool, opts).(*downsamplerAndWriter), downsampler, session
 }
 
 func newTestDownsamplerAndWriterWithAggregatedNamespace(
@@ -425,7 +1009,7 @@ func newTestDownsamplerAndWriterWithAggregatedNamespace(
 	storage, session := testm3.NewStorageAndSessionWithAggregatedNamespaces(
 		t, ctrl, aggregatedNamespaces)
 	downsampler := downsample.NewMockDownsampler(ctrl)
-	return NewDownsamplerAndWriter(storage, downsampler, testWorkerPool).(*downsamplerAndWriter), downsampler, session
+	return NewDownsamplerAndWriter(storage, downsampler, testWorkerPool, Options{}).(*downsamplerAndWriter), downsampler, session
 }
 
 func init() {
@@ -27,6 +27,7 @@ import (
 
 	etcdclient "github.com/m3db/m3/src/cluster/client/etcd"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
 	ingestm3msg "github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/m3msg"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/server/m3msg"
 	"github.com/m3db/m3/src/metrics/aggregation"
@@ -50,6 +51,7 @@ const (
 	M3DBStorageType BackendStorageType = "m3db"
 
 	defaultCarbonIngesterListenAddress = "0.0.0.0:7204"
+	defaultCarbonIngesterSeparator     = byte('.')
 	errNoIDGenerationScheme            = "error: a recent breaking change means that an ID " +
 		"generation scheme is required in coordinator configuration settings. " +
 		"More information is available here: %s"
@@ -114,12 +116,22 @@ type Configuration struct {
 	// Downsample configurates how the metrics should be downsampled.
 	Downsample downsample.Configuration `yaml:"downsample"`
 
+	// Writer configures the downsampler and writer used by all write paths.
+	Writer ingest.Configuration `yaml:"writer"`
+
 	// Ingest is the ingest server.
 	Ingest *IngestConfiguration `yaml:"ingest"`
 
 	// Carbon is the carbon configuration.
 	Carbon *CarbonConfiguration `yaml:"carbon"`
 
+	// BinaryIngest is the configuration for the binary protocol ingester.
+	BinaryIngest *BinaryIngestConfiguration `yaml:"binaryIngest"`
+
+	// OpenTSDBIngest is the configuration for the OpenTSDB telnet protocol
+	// ingester.
+	OpenTSDBIngest *OpenTSDBIngestConfiguration `yaml:"openTSDBIngest"`
+
 	// Limits specifies limits on per-query resource usage.
 	Limits *LimitsConfiguration `yaml:"limits"`
 
@@ -210,14 +222,369 @@ type CarbonConfiguration struct {
 	Ingester *CarbonIngesterConfiguration `yaml:"ingester"`
 }
 
+// BinaryIngestConfiguration is the configuration for the binary protocol
+// ingester.
+type BinaryIngestConfiguration struct {
+	ListenAddress string `yaml:"listenAddress" validate:"nonzero"`
+	MaxFrameSize  int    `yaml:"maxFrameSize" validate:"min=0"`
+}
+
+// OpenTSDBIngestConfiguration is the configuration for the OpenTSDB telnet
+// protocol ingester.
+type OpenTSDBIngestConfiguration struct {
+	ListenAddress string `yaml:"listenAddress" validate:"nonzero"`
+	MaxLineLength int    `yaml:"maxLineLength" validate:"min=0"`
+
+	// TimestampResolution, if set, is the resolution the timestamps of
+	// OpenTSDB datapoints are truncated to, overriding the timestamp
+	// truncation resolution of the coordinator's ingest configuration.
+	TimestampResolution time.Duration `yaml:"timestampResolution" validate:"min=0"`
+}
+
 // CarbonIngesterConfiguration is the configuration struct for carbon ingestion.
 type CarbonIngesterConfiguration struct {
 	Debug          bool                              `yaml:"debug"`
 	ListenAddress  string                            `yaml:"listenAddress"`
 	MaxConcurrency int                               `yaml:"maxConcurrency"`
 	Rules          []CarbonIngesterRuleConfiguration `yaml:"rules"`
+
+	// PickleListenAddress, if set, is the listen address of a second
+	// listener that accepts metrics in the pickle protocol used by
+	// carbon-relay and carbon-c-relay.
+	PickleListenAddress string `yaml:"pickleListenAddress"`
+
+	// UDPListenAddress, if set, is the listen address of a UDP socket that
+	// accepts datagrams of one or more newline delimited lines in the
+	// plaintext protocol.
+	UDPListenAddress string `yaml:"udpListenAddress"`
+
+	// DefaultRulesFallback, if set, applies the default rules, which are
+	// otherwise only used when no rules are configured, to the metrics that
+	// none of the configured rules match instead of dropping them.
+	DefaultRulesFallback bool `yaml:"defaultRulesFallback"`
+
+	// MaxConcurrencyPerConnection bounds the number of concurrent writes
+	// from a single connection, unbounded if not set.
+	MaxConcurrencyPerConnection int `yaml:"maxConcurrencyPerConnection" validate:"min=0"`
+
+	// EmptyNames determines how lines with an empty or whitespace only
+	// metric name are handled, one of: drop or reject_connection. Defaults
+	// to drop.
+	EmptyNames CarbonEmptyNameBehavior `yaml:"emptyNames"`
+
+	// NonFiniteValues determines how lines with a NaN or infinite value are
+	// handled, one of: pass, drop or zero. Defaults to pass.
+	NonFiniteValues CarbonNonFiniteValueBehavior `yaml:"nonFiniteValues"`
+
+	// TCP tunes the TCP connections accepted by the carbon listener.
+	TCP CarbonIngesterTCPConfiguration `yaml:"tcp"`
+
+	// TimestampResolution, if set, is the resolution the timestamps of
+	// carbon datapoints are truncated to, overriding the timestamp
+	// truncation resolution of the coordinator's ingest configuration.
+	TimestampResolution time.Duration `yaml:"timestampResolution" validate:"min=0"`
+
+	// Batch batches the writes of the lines of each connection, lines are
+	// written one at a time if not set.
+	Batch CarbonIngesterBatchConfiguration `yaml:"batch"`
+
+	// MaxLineLength is the maximum length in bytes of a carbon line, longer
+	// lines are skipped. Defaults to ~0.25MiB.
+	MaxLineLength int `yaml:"maxLineLength" validate:"min=0"`
+
+	// MaxDatagramSize is the maximum size in bytes of the datagrams read
+	// from the UDP socket, the final line of longer datagrams is skipped.
+	// Defaults to 64KiB.
+	MaxDatagramSize int `yaml:"maxDatagramSize" validate:"min=0"`
+
+	// TagNames names the tags generated from the segments of matching
+	// metric names, by default the tag of each segment is named after its
+	// position, i.e. __g0__, __g1__, etc.
+	TagNames []CarbonIngesterTagNameRuleConfiguration `yaml:"tagNames"`
+
+	// Normalization normalizes metric names before they are matched against
+	// the rules and tags are generated from them.
+	Normalization CarbonIngesterNormalizationConfiguration `yaml:"normalization"`
+
+	// NameFilter drops metrics by their normalized name before tags are
+	// generated from them.
+	NameFilter CarbonIngesterNameFilterConfiguration `yaml:"nameFilter"`
+
+	// RateLimit limits the rate at which the lines of carbon connections are
+	// written, lines are not rate limited if not set.
+	RateLimit CarbonIngesterRateLimitConfiguration `yaml:"rateLimit"`
+
+	// NameTag adds a __name__ tag with the full path of the metric name to
+	// the tags generated from its segments. Note that it changes the IDs of
+	// the series written.
+	NameTag bool `yaml:"nameTag"`
+
+	// SourceFromRemoteAddr identifies the remote host of each carbon TCP
+	// connection as the source of its writes, which is stored in the source
+	// tag of the coordinator's ingest configuration if one is set.
+	SourceFromRemoteAddr bool `yaml:"sourceFromRemoteAddr"`
+
+	// TLS, if set, terminates TLS on the plaintext and pickle listeners.
+	TLS *CarbonIngesterTLSConfiguration `yaml:"tls"`
+
+	// Separator is the single character that separates the segments of
+	// metric names, defaults to ".". Duplicate separator handling applies to
+	// this character and "." is treated as a literal character of segments
+	// if another separator is set.
+	Separator string `yaml:"separator"`
+
+	// AllowImplicitTimestamp accepts plaintext lines without a timestamp or
+	// with a timestamp of -1, timestamping them with the time they are
+	// received at instead of dropping them as malformed.
+	AllowImplicitTimestamp bool `yaml:"allowImplicitTimestamp"`
+
+	// Clusters, if set, splits the carbon series across the clusters by a
+	// consistent hash of their names so that each series is always written
+	// to the same cluster. The coordinator's own clusters are only written
+	// to by a cluster that does not configure any M3DB clusters of its own.
+	Clusters []CarbonIngesterClusterConfiguration `yaml:"clusters"`
+}
+
+// CarbonIngesterClusterConfiguration configures a cluster that a share of
+// the carbon series are written to.
+type CarbonIngesterClusterConfiguration struct {
+	// Name identifies the cluster in metrics, it must be unique.
+	Name string `yaml:"name" validate:"nonzero"`
+
+	// Clusters are the M3DB clusters and namespaces the series of the
+	// cluster are stored in, the coordinator's own clusters are used if
+	// not set. Every storage policy of the carbon rules needs a matching
+	// aggregated namespace.
+	Clusters m3.ClustersStaticConfiguration `yaml:"clusters"`
+}
+
+// CarbonIngesterTLSConfiguration configures terminating TLS on the carbon
+// listeners. The certificates are read from their files when the listeners
+// start and again whenever the coordinator receives SIGHUP, connections
+// accepted after a reload use the new certificates.
+type CarbonIngesterTLSConfiguration struct {
+	// CertFile is the path of the PEM encoded certificate chain presented
+	// by the listeners.
+	CertFile string `yaml:"certFile" validate:"nonzero"`
+
+	// KeyFile is the path of the PEM encoded private key of the certificate.
+	KeyFile string `yaml:"keyFile" validate:"nonzero"`
+
+	// CAFile is the path of the PEM encoded CA certificates that client
+	// certificates are verified against, required to verify clients.
+	CAFile string `yaml:"caFile"`
+
+	// ClientAuth is the policy for client certificates, one of: none,
+	// request, require, verify_if_given or require_and_verify. Defaults to
+	// none.
+	ClientAuth CarbonTLSClientAuth `yaml:"clientAuth"`
+}
+
+// CarbonIngesterRateLimitConfiguration limits the rate at which carbon lines
+// are written with token buckets that hold up to a burst of lines and are
+// refilled at a rate in lines per second. Each connection has its own bucket
+// and all connections optionally share a global bucket, a line is only
+// written once it has a token from both.
+type CarbonIngesterRateLimitConfiguration struct {
+	// PerConnection is the rate in lines per second at which the lines of
+	// each connection are written, unlimited if not set.
+	PerConnection float64 `yaml:"perConnection" validate:"min=0"`
+
+	// Global is the rate in lines per second at which the lines of all
+	// connections combined are written, unlimited if not set.
+	Global float64 `yaml:"global" validate:"min=0"`
+
+	// Burst is the number of lines that can be written at once ahead of the
+	// rate, defaults to one second worth of lines of each rate.
+	Burst int `yaml:"burst" validate:"min=0"`
+
+	// Behavior determines how lines in excess of the rate are handled, one
+	// of: drop or throttle. Defaults to drop.
+	Behavior CarbonRateLimitBehavior `yaml:"behavior"`
 }
 
+// CarbonIngesterNameFilterConfiguration drops carbon metrics whose name
+// matches any of the deny patterns or, if there are allow patterns, none of
+// the allow patterns. The patterns are regular expressions matched against
+// the full metric name, including its tags if in the graphite tag format.
+type CarbonIngesterNameFilterConfiguration struct {
+	// Allow, if set, drops every metric whose name matches none of its
+	// patterns.
+	Allow []string `yaml:"allow"`
+
+	// Deny drops every metric whose name matches any of its patterns, even
+	// if it also matches an allow pattern.
+	Deny []string `yaml:"deny"`
+}
+
+// CarbonIngesterNormalizationConfiguration configures the normalization of
+// carbon metric names, only the path of names in the graphite tag format is
+// normalized. The prefixes are stripped first, then the replacements are
+// applied in order, then the name is lowercased and finally duplicate
+// separators are handled.
+type CarbonIngesterNormalizationConfiguration struct {
+	// Lowercase lowercases metric names.
+	Lowercase bool `yaml:"lowercase"`
+
+	// StripPrefixes are prefixes removed from the start of metric names,
+	// only the first matching prefix is removed.
+	StripPrefixes []string `yaml:"stripPrefixes"`
+
+	// Replacements replace every occurrence of a string in metric names.
+	Replacements []CarbonIngesterReplacementConfiguration `yaml:"replacements"`
+
+	// DuplicateSeparators determines how metric names with empty segments,
+	// such as foo..bar, are handled, one of: collapse or reject. Defaults to
+	// collapse.
+	DuplicateSeparators CarbonDuplicateSeparatorBehavior `yaml:"duplicateSeparators"`
+}
+
+// CarbonIngesterReplacementConfiguration replaces every occurrence of a
+// string in carbon metric names.
+type CarbonIngesterReplacementConfiguration struct {
+	Find    string `yaml:"find" validate:"nonzero"`
+	Replace string `yaml:"replace"`
+}
+
+// CarbonIngesterBatchConfiguration configures the batching of the writes of
+// carbon lines.
+type CarbonIngesterBatchConfiguration struct {
+	// Size is the maximum number of metrics in a batch, batching is
+	// disabled if not set.
+	Size int `yaml:"size" validate:"min=0"`
+
+	// FlushInterval is the interval at which batches are written even if
+	// they are not full, defaults to one second.
+	FlushInterval time.Duration `yaml:"flushInterval" validate:"min=0"`
+
+	// FlushDownsampler flushes the downsampler once the batches are written
+	// at each flush interval and when a connection is done, so that the
+	// aggregations of the windows that have closed are in storage by then.
+	// It flushes the aggregations of every series so it is costly with
+	// many connections.
+	FlushDownsampler bool `yaml:"flushDownsampler"`
+}
+
+// CarbonIngesterTagNameRuleConfiguration names the tags generated from the
+// segments of the carbon metric names that match its pattern, for example
+// the names ["", "server", "resource", "metric"] turn servers.web01.cpu.load
+// into {__g0__="servers", server="web01", resource="cpu", metric="load"}.
+// Only the first matching rule is applied.
+type CarbonIngesterTagNameRuleConfiguration struct {
+	// Pattern is the regular expression matched against metric names.
+	Pattern string `yaml:"pattern" validate:"nonzero"`
+
+	// Names are the tag names of the segments in order, segments without a
+	// name, either empty or past the end of the names, keep their
+	// positional tag name.
+	Names []string `yaml:"names"`
+}
+
+// CarbonIngesterTCPConfiguration tunes the TCP connections accepted by the
+// carbon listener, the defaults are kept for any values not set.
+type CarbonIngesterTCPConfiguration struct {
+	// KeepAlive enables TCP keep-alive probes, defaults to true so that
+	// connections of clients that went away without closing are reclaimed.
+	KeepAlive *bool `yaml:"keepAlive"`
+
+	// KeepAlivePeriod is the period between keep-alive probes, defaults to
+	// the OS default which is commonly two hours.
+	KeepAlivePeriod time.Duration `yaml:"keepAlivePeriod" validate:"min=0"`
+
+	// ReadBufferSize is the size in bytes of the OS receive buffer of each
+	// connection, defaults to the OS default. Larger buffers, around 1MiB,
+	// help absorb bursts from high throughput clients.
+	ReadBufferSize int `yaml:"readBufferSize" validate:"min=0"`
+
+	// WriteBufferSize is the size in bytes of the OS send buffer of each
+	// connection, defaults to the OS default. The ingester never writes to
+	// carbon connections so this rarely needs to be set.
+	WriteBufferSize int `yaml:"writeBufferSize" validate:"min=0"`
+
+	// NoDelay disables Nagle's algorithm, defaults to true.
+	NoDelay *bool `yaml:"noDelay"`
+}
+
+// KeepAliveOrDefault returns whether TCP keep-alive is enabled.
+func (c CarbonIngesterTCPConfiguration) KeepAliveOrDefault() bool {
+	if c.KeepAlive != nil {
+		return *c.KeepAlive
+	}
+
+	return true
+}
+
+// CarbonEmptyNameBehavior determines how carbon lines with an empty or
+// whitespace only metric name are handled.
+type CarbonEmptyNameBehavior string
+
+const (
+	// CarbonEmptyNameDrop drops lines with an empty name.
+	CarbonEmptyNameDrop CarbonEmptyNameBehavior = "drop"
+	// CarbonEmptyNameRejectConnection stops reading from and closes the
+	// connection a line with an empty name was received on.
+	CarbonEmptyNameRejectConnection CarbonEmptyNameBehavior = "reject_connection"
+)
+
+// CarbonNonFiniteValueBehavior determines how carbon lines with a NaN or
+// infinite value are handled.
+type CarbonNonFiniteValueBehavior string
+
+const (
+	// CarbonNonFiniteValuePass writes non-finite values as is.
+	CarbonNonFiniteValuePass CarbonNonFiniteValueBehavior = "pass"
+	// CarbonNonFiniteValueDrop drops lines with a non-finite value.
+	CarbonNonFiniteValueDrop CarbonNonFiniteValueBehavior = "drop"
+	// CarbonNonFiniteValueZero writes non-finite values as zero.
+	CarbonNonFiniteValueZero CarbonNonFiniteValueBehavior = "zero"
+)
+
+// CarbonDuplicateSeparatorBehavior determines how carbon metric names with
+// empty segments are handled.
+type CarbonDuplicateSeparatorBehavior string
+
+const (
+	// CarbonDuplicateSeparatorCollapse collapses consecutive separators and
+	// removes leading separators, i.e. foo..bar becomes foo.bar.
+	CarbonDuplicateSeparatorCollapse CarbonDuplicateSeparatorBehavior = "collapse"
+	// CarbonDuplicateSeparatorReject keeps names as is, lines whose name has
+	// consecutive separators are dropped as malformed.
+	CarbonDuplicateSeparatorReject CarbonDuplicateSeparatorBehavior = "reject"
+)
+
+// CarbonRateLimitBehavior determines how carbon lines in excess of the rate
+// limit are handled.
+type CarbonRateLimitBehavior string
+
+const (
+	// CarbonRateLimitDrop drops lines in excess of the rate limit.
+	CarbonRateLimitDrop CarbonRateLimitBehavior = "drop"
+	// CarbonRateLimitThrottle pauses reading from the connection until the
+	// line can be written within the rate limit, pushing back on the client.
+	CarbonRateLimitThrottle CarbonRateLimitBehavior = "throttle"
+)
+
+// CarbonTLSClientAuth is the policy of the carbon listeners for the
+// certificates of their clients.
+type CarbonTLSClientAuth string
+
+const (
+	// CarbonTLSClientAuthNone does not request client certificates.
+	CarbonTLSClientAuthNone CarbonTLSClientAuth = "none"
+	// CarbonTLSClientAuthRequest requests a client certificate but does not
+	// require or verify one.
+	CarbonTLSClientAuthRequest CarbonTLSClientAuth = "request"
+	// CarbonTLSClientAuthRequire requires a client certificate but does not
+	// verify it.
+	CarbonTLSClientAuthRequire CarbonTLSClientAuth = "require"
+	// CarbonTLSClientAuthVerifyIfGiven verifies the client certificate if
+	// the client presents one.
+	CarbonTLSClientAuthVerifyIfGiven CarbonTLSClientAuth = "verify_if_given"
+	// CarbonTLSClientAuthRequireAndVerify requires and verifies a client
+	// certificate.
+	CarbonTLSClientAuthRequireAndVerify CarbonTLSClientAuth = "require_and_verify"
+)
+
 // LookbackDurationOrDefault validates the LookbackDuration
 func (c Configuration) LookbackDurationOrDefault() (time.Duration, error) {
 	if c.LookbackDuration == nil {
@@ -252,13 +619,40 @@ func (c *CarbonIngesterConfiguration) ListenAddressOrDefault() string {
 	return defaultCarbonIngesterListenAddress
 }
 
+// SeparatorOrDefault returns the specified carbon ingester separator if
+// provided, or the default separator if not.
+func (c *CarbonIngesterConfiguration) SeparatorOrDefault() (byte, error) {
+	switch len(c.Separator) {
+	case 0:
+		return defaultCarbonIngesterSeparator, nil
+	case 1:
+		return c.Separator[0], nil
+	default:
+		return 0, fmt.Errorf("carbon separator must be a single character: %s",
+			c.Separator)
+	}
+}
+
 // RulesOrDefault returns the specified carbon ingester rules if provided, or generates reasonable
-// defaults using the provided aggregated namespaces if not.
+// defaults using the provided aggregated namespaces if not. The defaults are appended to the
+// specified rules if DefaultRulesFallback is set.
 func (c *CarbonIngesterConfiguration) RulesOrDefault(namespaces m3.ClusterNamespaces) []CarbonIngesterRuleConfiguration {
-	if len(c.Rules) > 0 {
+	if len(c.Rules) == 0 {
+		return defaultCarbonIngesterRules(namespaces)
+	}
+	if !c.DefaultRulesFallback {
 		return c.Rules
 	}
 
+	// Rules are applied in order so the defaults only apply to the metrics
+	// that none of the specified rules match.
+	defaults := defaultCarbonIngesterRules(namespaces)
+	rules := make([]CarbonIngesterRuleConfiguration, 0, len(c.Rules)+len(defaults))
+	rules = append(rules, c.Rules...)
+	return append(rules, defaults...)
+}
+
+func defaultCarbonIngesterRules(namespaces m3.ClusterNamespaces) []CarbonIngesterRuleConfiguration {
 	if namespaces.NumAggregatedClusterNamespaces() == 0 {
 		return nil
 	}
@@ -299,6 +693,20 @@ type CarbonIngesterRuleConfiguration struct {
 	Pattern     string                                     `yaml:"pattern"`
 	Aggregation CarbonIngesterAggregationConfiguration     `yaml:"aggregation"`
 	Policies    []CarbonIngesterStoragePolicyConfiguration `yaml:"policies"`
+
+	// Multiplier scales the values of matching metrics before they are
+	// written, for example 0.125 to convert bits to bytes.
+	Multiplier *float64 `yaml:"multiplier"`
+}
+
+// MultiplierOrDefault returns the value multiplier of the rule if provided,
+// or one otherwise.
+func (c CarbonIngesterRuleConfiguration) MultiplierOrDefault() float64 {
+	if c.Multiplier != nil {
+		return *c.Multiplier
+	}
+
+	return 1
 }
 
 // CarbonIngesterAggregationConfiguration is the configuration struct
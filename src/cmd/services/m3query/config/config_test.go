@@ -23,11 +23,18 @@ package config
 import (
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/m3db/m3/src/dbnode/client"
+	"github.com/m3db/m3/src/query/graphite/graphite"
 	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
+	"github.com/m3db/m3/src/query/storage/m3"
 	xdocs "github.com/m3db/m3/src/x/docs"
 	xconfig "github.com/m3db/m3x/config"
+	"github.com/m3db/m3x/ident"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/validator.v2"
@@ -179,3 +186,111 @@ func TestNilQueryConversionSize(t *testing.T) {
 	err := q.Validate()
 	require.NoError(t, err)
 }
+
+func TestCarbonIngesterTCPConfiguration(t *testing.T) {
+	var cfg CarbonIngesterConfiguration
+	require.NoError(t, yaml.Unmarshal([]byte(`
+tcp:
+  keepAlivePeriod: 1m
+  readBufferSize: 1048576
+  noDelay: false
+`), &cfg))
+	require.NoError(t, validator.Validate(cfg))
+
+	assert.True(t, cfg.TCP.KeepAliveOrDefault())
+	assert.Equal(t, time.Minute, cfg.TCP.KeepAlivePeriod)
+	assert.Equal(t, 1048576, cfg.TCP.ReadBufferSize)
+	assert.Equal(t, 0, cfg.TCP.WriteBufferSize)
+	require.NotNil(t, cfg.TCP.NoDelay)
+	assert.False(t, *cfg.TCP.NoDelay)
+
+	cfg.TCP.ReadBufferSize = -1
+	require.Error(t, validator.Validate(cfg))
+}
+
+func TestCarbonIngesterClustersConfiguration(t *testing.T) {
+	var cfg CarbonIngesterConfiguration
+	require.NoError(t, yaml.Unmarshal([]byte(`
+clusters:
+  - name: local
+  - name: remote
+    clusters:
+      - namespaces:
+          - namespace: unaggregated
+            type: unaggregated
+            retention: 48h
+          - namespace: aggregated
+            type: aggregated
+            retention: 720h
+            resolution: 1m
+`), &cfg))
+	require.NoError(t, validator.Validate(cfg))
+
+	require.Len(t, cfg.Clusters, 2)
+	assert.Equal(t, "local", cfg.Clusters[0].Name)
+	assert.Len(t, cfg.Clusters[0].Clusters, 0)
+
+	assert.Equal(t, "remote", cfg.Clusters[1].Name)
+	require.Len(t, cfg.Clusters[1].Clusters, 1)
+	namespaces := cfg.Clusters[1].Clusters[0].Namespaces
+	require.Len(t, namespaces, 2)
+	assert.Equal(t, "unaggregated", namespaces[0].Namespace)
+	assert.Equal(t, storage.UnaggregatedMetricsType, namespaces[0].Type)
+	assert.Equal(t, 48*time.Hour, namespaces[0].Retention)
+	assert.Equal(t, "aggregated", namespaces[1].Namespace)
+	assert.Equal(t, storage.AggregatedMetricsType, namespaces[1].Type)
+	assert.Equal(t, 720*time.Hour, namespaces[1].Retention)
+	assert.Equal(t, time.Minute, namespaces[1].Resolution)
+
+	cfg.Clusters[1].Name = ""
+	require.Error(t, validator.Validate(cfg.Clusters[1]))
+}
+
+func TestCarbonIngesterSeparatorOrDefault(t *testing.T) {
+	var cfg CarbonIngesterConfiguration
+	separator, err := cfg.SeparatorOrDefault()
+	require.NoError(t, err)
+	assert.Equal(t, byte('.'), separator)
+
+	require.NoError(t, yaml.Unmarshal([]byte(`separator: /`), &cfg))
+	separator, err = cfg.SeparatorOrDefault()
+	require.NoError(t, err)
+	assert.Equal(t, byte('/'), separator)
+
+	cfg.Separator = "::"
+	_, err = cfg.SeparatorOrDefault()
+	require.Error(t, err)
+}
+
+func TestCarbonIngesterRulesOrDefault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	session := client.NewMockSession(ctrl)
+	clusters, err := m3.NewClusters(m3.UnaggregatedClusterNamespaceDefinition{
+		NamespaceID: ident.StringID("unaggregated"),
+		Session:     session,
+		Retention:   48 * time.Hour,
+	}, m3.AggregatedClusterNamespaceDefinition{
+		NamespaceID: ident.StringID("aggregated"),
+		Session:     session,
+		Retention:   30 * 24 * time.Hour,
+		Resolution:  time.Minute,
+	})
+	require.NoError(t, err)
+	namespaces := clusters.ClusterNamespaces()
+
+	var cfg CarbonIngesterConfiguration
+	defaults := cfg.RulesOrDefault(namespaces)
+	require.Len(t, defaults, 1)
+	assert.Equal(t, graphite.MatchAllPattern, defaults[0].Pattern)
+	assert.Equal(t, []CarbonIngesterStoragePolicyConfiguration{
+		{Resolution: time.Minute, Retention: 30 * 24 * time.Hour},
+	}, defaults[0].Policies)
+
+	cfg.Rules = []CarbonIngesterRuleConfiguration{{Pattern: `^stats\.counters\.`}}
+	assert.Equal(t, cfg.Rules, cfg.RulesOrDefault(namespaces))
+
+	cfg.DefaultRulesFallback = true
+	assert.Equal(t, append(cfg.Rules, defaults...), cfg.RulesOrDefault(namespaces))
+}
@@ -22,6 +22,7 @@ package carbon
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -31,6 +32,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/m3db/m3x/clock"
 	"github.com/m3db/m3x/instrument"
 	"github.com/m3db/m3x/unsafe"
 )
@@ -47,6 +49,10 @@ const (
 
 	initScannerBufferSize = 2 << 15 // ~ 65KiB
 	maxScannerBufferSize  = 2 << 17 // ~ 0.25iB
+
+	// implicitTimestampStr is the timestamp of lines that are timestamped
+	// with the time they are parsed at.
+	implicitTimestampStr = "-1"
 )
 
 var (
@@ -62,6 +68,25 @@ type Metric struct {
 	Val  float64
 }
 
+// ParseOptions configures the parsing of carbon lines.
+type ParseOptions struct {
+	// AllowImplicitTimestamp, if set, accepts lines that omit the timestamp,
+	// i.e. "name value", or whose timestamp is -1. Such lines are given the
+	// time they are parsed at as their timestamp instead of being malformed.
+	AllowImplicitTimestamp bool
+
+	// NowFn returns the time lines with an implicit timestamp are parsed at,
+	// defaults to time.Now.
+	NowFn clock.NowFn
+}
+
+func (o ParseOptions) now() time.Time {
+	if o.NowFn == nil {
+		return time.Now()
+	}
+	return o.NowFn()
+}
+
 // ToLine converts the carbon Metric struct to a line.
 func (m *Metric) ToLine() string {
 	return string(m.Name) + " " + strconv.FormatFloat(m.Val, floatFormatByte, floatPrecision, floatBitSize) +
@@ -70,21 +95,31 @@ func (m *Metric) ToLine() string {
 
 // ParsePacket parses a carbon packet and returns the metrics and number of malformed lines.
 func ParsePacket(packet []byte) ([]Metric, int) {
-	return parsePacket([]Metric{}, packet)
+	return parsePacket([]Metric{}, packet, ParseOptions{})
 }
 
 // ParseAndAppendPacket does the same thing as parse packet, but it allows the caller to pass
 // in the []Metric to facilitate pooling.
 func ParseAndAppendPacket(mets []Metric, packet []byte) ([]Metric, int) {
-	return parsePacket(mets, packet)
+	return parsePacket(mets, packet, ParseOptions{})
+}
+
+// ParseAndAppendPacketWithOptions does the same thing as ParseAndAppendPacket
+// except that lines are parsed with the options.
+func ParseAndAppendPacketWithOptions(
+	mets []Metric,
+	packet []byte,
+	opts ParseOptions,
+) ([]Metric, int) {
+	return parsePacket(mets, packet, opts)
 }
 
-func parsePacket(mets []Metric, packet []byte) ([]Metric, int) {
+func parsePacket(mets []Metric, packet []byte, opts ParseOptions) ([]Metric, int) {
 	var malformed, prevIdx, i int
 	for i = 0; i < len(packet); i++ {
 		if packet[i] == '\n' {
 			if (i - prevIdx) > 1 {
-				name, timestamp, value, err := Parse(packet[prevIdx:i])
+				name, timestamp, value, err := ParseWithOptions(packet[prevIdx:i], opts)
 				if err == nil {
 					mets = append(mets, Metric{
 						Name: name,
@@ -100,7 +135,7 @@ func parsePacket(mets []Metric, packet []byte) ([]Metric, int) {
 	}
 
 	if (i - prevIdx) > 1 {
-		name, timestamp, value, err := Parse(packet[prevIdx:i])
+		name, timestamp, value, err := ParseWithOptions(packet[prevIdx:i], opts)
 		if err == nil {
 			mets = append(mets, Metric{
 				Name: name,
@@ -154,6 +189,15 @@ func ParseName(line []byte) (name []byte, rest []byte, err error) {
 // all but the name and returns the timestamp of the metric, its value, the
 // time it was received and any error encountered.
 func ParseRemainder(rest []byte) (timestamp time.Time, value float64, err error) {
+	return ParseRemainderWithOptions(rest, ParseOptions{})
+}
+
+// ParseRemainderWithOptions does the same thing as ParseRemainder except that
+// the remainder is parsed with the options.
+func ParseRemainderWithOptions(
+	rest []byte,
+	opts ParseOptions,
+) (timestamp time.Time, value float64, err error) {
 	if !utf8.Valid(rest) {
 		err = errNotUTF8
 		return
@@ -161,7 +205,8 @@ func ParseRemainder(rest []byte) (timestamp time.Time, value float64, err error)
 
 	// Determine the start and end offsets for the value.
 	valStart, valEnd := parseWordOffsets(rest)
-	if valStart == -1 || valEnd == -1 || valEnd >= len(rest) {
+	if valStart == -1 || valEnd == -1 ||
+		(valEnd >= len(rest) && !opts.AllowImplicitTimestamp) {
 		// If we couldn't determine the offsets, or the end of the value is also
 		// the end of the line, then this is an invalid line.
 		err = errInvalidLine
@@ -186,6 +231,18 @@ func ParseRemainder(rest []byte) (timestamp time.Time, value float64, err error)
 	rest = rest[valEnd:]
 	secStart, secEnd := parseWordOffsets(rest)
 
+	if opts.AllowImplicitTimestamp {
+		// The timestamp is omitted if there is nothing but spaces after the
+		// value.
+		omitted := secStart == -1
+		implicit := !omitted && secEnd == len(rest) &&
+			string(rest[secStart:secEnd]) == implicitTimestampStr
+		if omitted || implicit {
+			timestamp = opts.now()
+			return
+		}
+	}
+
 	if secStart == -1 || secEnd == -1 || secEnd != len(rest) {
 		// If we couldn't determine the offsets, or the end of the the timestamp
 		// is not the end of the line (I.E there are still characters after the end
@@ -214,13 +271,22 @@ func ParseRemainder(rest []byte) (timestamp time.Time, value float64, err error)
 
 // Parse parses a carbon line into the corresponding parts.
 func Parse(line []byte) (name []byte, timestamp time.Time, value float64, err error) {
+	return ParseWithOptions(line, ParseOptions{})
+}
+
+// ParseWithOptions does the same thing as Parse except that the line is
+// parsed with the options.
+func ParseWithOptions(
+	line []byte,
+	opts ParseOptions,
+) (name []byte, timestamp time.Time, value float64, err error) {
 	var rest []byte
 	name, rest, err = ParseName(line)
 	if err != nil {
 		return
 	}
 
-	timestamp, value, err = ParseRemainder(rest)
+	timestamp, value, err = ParseRemainderWithOptions(rest, opts)
 	return
 }
 
@@ -234,21 +300,92 @@ type Scanner struct {
 	// The number of malformed metrics encountered.
 	MalformedCount int
 
-	iOpts instrument.Options
+	// The number of lines skipped for being longer than the max line length.
+	TooLongCount int
+
+	// ParseOptions are the options lines are parsed with, they can be set
+	// before scanning.
+	ParseOptions ParseOptions
+
+	iOpts         instrument.Options
+	maxLineLength int
+	// discarding is whether the rest of a line that is too long is being
+	// skipped.
+	discarding bool
 }
 
 // NewScanner creates a new carbon scanner.
 func NewScanner(r io.Reader, iOpts instrument.Options) *Scanner {
+	return NewScannerWithMaxLineLength(r, 0, iOpts)
+}
+
+// NewScannerWithMaxLineLength creates a new carbon scanner that skips, and
+// counts, lines longer than maxLineLength bytes, excluding the newline,
+// without buffering more than the max line length. Lines may be split across
+// any number of reads of the underlying io.Reader. The default max line
+// length of ~0.25MiB is used if maxLineLength is not positive.
+func NewScannerWithMaxLineLength(
+	r io.Reader,
+	maxLineLength int,
+	iOpts instrument.Options,
+) *Scanner {
+	if maxLineLength <= 0 {
+		maxLineLength = maxScannerBufferSize
+	}
+	// The buffer must also fit the newline terminating the longest line.
+	maxBufferSize := maxLineLength + 1
+	initBufferSize := initScannerBufferSize
+	if initBufferSize > maxBufferSize {
+		initBufferSize = maxBufferSize
+	}
+
 	s := bufio.NewScanner(r)
 
 	// Force the scanner to use a large buffer upfront to reduce the number of
 	// syscalls that occur if the io.Reader is backed by something that requires
 	// I/O (like a TCP connection).
-	// TODO(rartoul): Make this configurable.
-	s.Buffer(make([]byte, 0, initScannerBufferSize), maxScannerBufferSize)
+	s.Buffer(make([]byte, 0, initBufferSize), maxBufferSize)
 
-	s.Split(bufio.ScanLines)
-	return &Scanner{scanner: s, iOpts: iOpts}
+	scanner := &Scanner{scanner: s, iOpts: iOpts, maxLineLength: maxLineLength}
+	s.Split(scanner.scanLines)
+	return scanner
+}
+
+// scanLines splits lines like bufio.ScanLines except that lines longer than
+// the max line length are skipped, their bytes are consumed as they are read
+// rather than buffered until the newline.
+func (s *Scanner) scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if s.discarding {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 && !atEOF {
+			return len(data), nil, nil
+		}
+		s.discarding = false
+		s.skipTooLong()
+		if idx < 0 {
+			return len(data), nil, nil
+		}
+		return idx + 1, nil, nil
+	}
+
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if token == nil && err == nil && len(data) > s.maxLineLength {
+		// No newline within the max line length, skip the rest of the line.
+		s.discarding = true
+		return len(data), nil, nil
+	}
+	if len(token) > s.maxLineLength {
+		s.skipTooLong()
+		return advance, nil, err
+	}
+	return advance, token, err
+}
+
+func (s *Scanner) skipTooLong() {
+	s.iOpts.Logger().Errorf(
+		"skipping carbon line longer than the max line length of %d bytes",
+		s.maxLineLength)
+	s.TooLongCount++
 }
 
 // Scan scans for the next carbon metric. Malformed metrics are skipped but counted.
@@ -259,7 +396,8 @@ func (s *Scanner) Scan() bool {
 		}
 
 		var err error
-		if s.path, s.timestamp, s.value, err = Parse(s.scanner.Bytes()); err != nil {
+		s.path, s.timestamp, s.value, err = ParseWithOptions(s.scanner.Bytes(), s.ParseOptions)
+		if err != nil {
 			s.iOpts.Logger().Errorf(
 				"error trying to scan malformed carbon line: %s, err: %s",
 				string(s.path), err.Error())
@@ -26,6 +26,7 @@ import (
 	"math"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/m3db/m3x/instrument"
@@ -88,6 +89,37 @@ func TestScannerMetric(t *testing.T) {
 	assert.Equal(t, 0, s.MalformedCount)
 }
 
+func TestScannerMaxLineLength(t *testing.T) {
+	line := "foo.bar 1 1"
+	for _, tooLong := range []string{
+		line + ".0",
+		strings.Repeat("x", 10*len(line)),
+	} {
+		var (
+			buf = bytes.NewBufferString(
+				line + "\n" + tooLong + "\n" + line + "\n" + tooLong)
+			s = NewScannerWithMaxLineLength(iotest.OneByteReader(buf), len(line), testIOpts)
+		)
+		for i := 0; i < 2; i++ {
+			require.True(t, s.Scan(), "could not parse line split across reads, err: %v", s.Err())
+			name, _, _ := s.Metric()
+			assert.Equal(t, "foo.bar", string(name))
+		}
+
+		assert.False(t, s.Scan(), "parsed line longer than max line length")
+		assert.NoError(t, s.Err())
+		assert.Equal(t, 2, s.TooLongCount)
+	}
+
+	// Lines just over the max line length are skipped too, including at the
+	// end of the input.
+	s := NewScannerWithMaxLineLength(
+		bytes.NewBufferString(line+".\n"+line+"."), len(line), testIOpts)
+	assert.False(t, s.Scan(), "parsed line longer than max line length")
+	assert.NoError(t, s.Err())
+	assert.Equal(t, 2, s.TooLongCount)
+}
+
 func TestParse(t *testing.T) {
 	for i := range testLines {
 		name, ts, value, err := Parse([]byte(testLines[i].line))
@@ -140,6 +172,68 @@ func TestParseErrors(t *testing.T) {
 	assertParseError(t, "foo 4384 1428951394 1428951394 bar")
 }
 
+func TestParseImplicitTimestamp(t *testing.T) {
+	var (
+		now  = time.Unix(1428951394, 0)
+		opts = ParseOptions{
+			AllowImplicitTimestamp: true,
+			NowFn:                  func() time.Time { return now },
+		}
+	)
+	for _, line := range []string{
+		"foo.bar 4394",
+		"foo.bar 4394 ",
+		"foo.bar  4394  ",
+		"foo.bar 4394 -1",
+		"foo.bar 4394  -1",
+	} {
+		name, ts, value, err := ParseWithOptions([]byte(line), opts)
+		require.NoError(t, err, "could not parse %s", line)
+		assert.Equal(t, "foo.bar", string(name))
+		assert.Equal(t, now, ts)
+		assert.Equal(t, 4394.0, value)
+	}
+
+	// Explicit timestamps are kept.
+	_, ts, _, err := ParseWithOptions([]byte("foo.bar 4394 1"), opts)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1, 0), ts)
+
+	for _, line := range []string{
+		"foo.bar",
+		"foo.bar ",
+		"foo.bar 4394 -1 bar",
+		"foo.bar 4394 -2x",
+		"foo.bar zed",
+	} {
+		_, _, _, err := ParseWithOptions([]byte(line), opts)
+		assert.Error(t, err, "parsed invalid line %s", line)
+	}
+
+	// Implicit timestamps are malformed unless allowed.
+	assertParseError(t, "foo.bar 4394")
+	_, ts, _, err = Parse([]byte("foo.bar 4394 -1"))
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(-1, 0), ts)
+}
+
+func TestScannerImplicitTimestamp(t *testing.T) {
+	now := time.Unix(1428951394, 0)
+	s := NewScanner(bytes.NewBufferString("foo.bar 1\nfoo.baz 2 -1\n"), testIOpts)
+	s.ParseOptions = ParseOptions{
+		AllowImplicitTimestamp: true,
+		NowFn:                  func() time.Time { return now },
+	}
+	for _, expected := range []string{"foo.bar", "foo.baz"} {
+		require.True(t, s.Scan(), "could not parse line, err: %v", s.Err())
+		name, ts, _ := s.Metric()
+		assert.Equal(t, expected, string(name))
+		assert.Equal(t, now, ts)
+	}
+	assert.False(t, s.Scan())
+	assert.Equal(t, 0, s.MalformedCount)
+}
+
 func TestParsePacket(t *testing.T) {
 	mets, malformed := ParsePacket([]byte(`
 foo.bar.zed 45565.02 1428951394
@@ -162,6 +256,16 @@ foo.bar.invalid 1428951394`))
 	require.Equal(t, 2, malformed)
 }
 
+func TestParseAndAppendPacketWithOptions(t *testing.T) {
+	mets, malformed := ParseAndAppendPacketWithOptions([]Metric{}, []byte(`
+foo.bar.zed 45565.02 1428951394
+foo.bar.zed 45565.02
+foo.bar.zed 45565.02 -1
+foo.bar.invalid`), ParseOptions{AllowImplicitTimestamp: true})
+	require.Equal(t, 3, len(mets))
+	require.Equal(t, 1, malformed)
+}
+
 func TestCarbonToLine(t *testing.T) {
 	validateLine(t, "foo.bar.zed 45565.02 1428951394")
 	validateLine(t, "foo.bar.nan NaN 1428951395")
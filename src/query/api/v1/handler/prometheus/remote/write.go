@@ -26,15 +26,13 @@ import (
 	"net/http"
 
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	"github.com/m3db/m3/src/dbnode/client"
 	"github.com/m3db/m3/src/query/api/v1/handler"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus"
 	"github.com/m3db/m3/src/query/generated/proto/prompb"
 	"github.com/m3db/m3/src/query/models"
-	"github.com/m3db/m3/src/query/storage"
-	"github.com/m3db/m3/src/query/ts"
 	"github.com/m3db/m3/src/query/util/logging"
 	"github.com/m3db/m3/src/x/net/http"
-	xtime "github.com/m3db/m3x/time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/uber-go/tally"
@@ -99,11 +97,21 @@ func (h *PromWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.write(r.Context(), req)
+	result, err := h.write(r.Context(), req)
 	if err != nil {
-		h.promWriteMetrics.writeErrorsServer.Inc(1)
-		logging.WithContext(r.Context()).Error("Write error", zap.Any("err", err))
-		xhttp.Error(w, err, http.StatusInternalServerError)
+		// Prometheus retries batches that fail with a server error and drops
+		// those that fail with a client error, so only respond with a client
+		// error if every failure is one that a retry cannot fix.
+		status := http.StatusInternalServerError
+		if isBadRequestBatch(result) {
+			status = http.StatusBadRequest
+			h.promWriteMetrics.writeErrorsClient.Inc(1)
+		} else {
+			h.promWriteMetrics.writeErrorsServer.Inc(1)
+		}
+		logging.WithContext(r.Context()).Error("Write error",
+			zap.Int("status", status), zap.Int("failed", result.Failed), zap.Any("err", err))
+		xhttp.Error(w, err, status)
 		return
 	}
 
@@ -124,54 +132,24 @@ func (h *PromWriteHandler) parseRequest(r *http.Request) (*prompb.WriteRequest,
 	return &req, nil
 }
 
-func (h *PromWriteHandler) write(ctx context.Context, r *prompb.WriteRequest) error {
-	iter := newPromTSIter(r.Timeseries, h.tagOptions)
-	return h.downsamplerAndWriter.WriteBatch(ctx, iter)
+func (h *PromWriteHandler) write(
+	ctx context.Context,
+	r *prompb.WriteRequest,
+) (ingest.WriteBatchResult, error) {
+	iter := ingest.NewPromTimeSeriesIter(r.Timeseries, h.tagOptions)
+	return h.downsamplerAndWriter.WriteBatchWithResult(ctx, iter)
 }
 
-func newPromTSIter(timeseries []*prompb.TimeSeries, tagOpts models.TagOptions) *promTSIter {
-	// Construct the tags and datapoints upfront so that if the iterator
-	// is reset, we don't have to generate them twice.
-	var (
-		tags       = make([]models.Tags, 0, len(timeseries))
-		datapoints = make([]ts.Datapoints, 0, len(timeseries))
-	)
-	for _, promTS := range timeseries {
-		tags = append(tags, storage.PromLabelsToM3Tags(promTS.Labels, tagOpts))
-		datapoints = append(datapoints, storage.PromSamplesToM3Datapoints(promTS.Samples))
+// isBadRequestBatch returns whether all the errors of a batch are client
+// errors, such as series with invalid tags.
+func isBadRequestBatch(result ingest.WriteBatchResult) bool {
+	if len(result.Errors) == 0 {
+		return false
 	}
-
-	return &promTSIter{
-		idx:        -1,
-		tags:       tags,
-		datapoints: datapoints,
+	for _, err := range result.Errors {
+		if !client.IsBadRequestError(err) {
+			return false
+		}
 	}
-}
-
-type promTSIter struct {
-	idx        int
-	tags       []models.Tags
-	datapoints []ts.Datapoints
-}
-
-func (i *promTSIter) Next() bool {
-	i.idx++
-	return i.idx < len(i.tags)
-}
-
-func (i *promTSIter) Current() (models.Tags, ts.Datapoints, xtime.Unit) {
-	if len(i.tags) == 0 || i.idx < 0 || i.idx >= len(i.tags) {
-		return models.EmptyTags(), nil, 0
-	}
-
-	return i.tags[i.idx], i.datapoints[i.idx], xtime.Millisecond
-}
-
-func (i *promTSIter) Reset() error {
-	i.idx = -1
-	return nil
-}
-
-func (i *promTSIter) Error() error {
-	return nil
+	return true
 }
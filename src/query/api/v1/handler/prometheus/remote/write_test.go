@@ -22,6 +22,7 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -32,6 +33,7 @@ import (
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
 	"github.com/m3db/m3/src/query/util/logging"
 	xclock "github.com/m3db/m3x/clock"
+	xerrors "github.com/m3db/m3x/errors"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -57,7 +59,7 @@ func TestPromWrite(t *testing.T) {
 
 	ctrl := gomock.NewController(t)
 	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
-	mockDownsamplerAndWriter.EXPECT().WriteBatch(gomock.Any(), gomock.Any())
+	mockDownsamplerAndWriter.EXPECT().WriteBatchWithResult(gomock.Any(), gomock.Any())
 
 	promWrite := &PromWriteHandler{downsamplerAndWriter: mockDownsamplerAndWriter}
 
@@ -68,7 +70,7 @@ func TestPromWrite(t *testing.T) {
 	r, err := promWrite.parseRequest(req)
 	require.Nil(t, err, "unable to parse request")
 
-	writeErr := promWrite.write(context.TODO(), r)
+	_, writeErr := promWrite.write(context.TODO(), r)
 	require.NoError(t, writeErr)
 }
 
@@ -77,7 +79,7 @@ func TestWriteErrorMetricCount(t *testing.T) {
 
 	ctrl := gomock.NewController(t)
 	mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
-	mockDownsamplerAndWriter.EXPECT().WriteBatch(gomock.Any(), gomock.Any())
+	mockDownsamplerAndWriter.EXPECT().WriteBatchWithResult(gomock.Any(), gomock.Any())
 
 	reporter := xmetrics.NewTestStatsReporter(xmetrics.NewTestStatsReporterOptions())
 	scope, closer := tally.NewRootScope(tally.ScopeOptions{Reporter: reporter}, time.Millisecond)
@@ -97,3 +99,63 @@ func TestWriteErrorMetricCount(t *testing.T) {
 	}, 5*time.Second)
 	require.True(t, foundMetric)
 }
+
+func TestPromWriteErrorStatus(t *testing.T) {
+	logging.InitWithCores(nil)
+
+	tests := []struct {
+		name   string
+		errs   []error
+		status int
+	}{
+		{
+			name:   "bad request",
+			errs:   []error{xerrors.NewInvalidParamsError(errors.New("invalid tags"))},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "partial bad request",
+			errs: []error{
+				xerrors.NewInvalidParamsError(errors.New("invalid tags")),
+				errors.New("storage error"),
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "server error",
+			errs:   []error{errors.New("storage error")},
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDownsamplerAndWriter := ingest.NewMockDownsamplerAndWriter(ctrl)
+			mockDownsamplerAndWriter.EXPECT().
+				WriteBatchWithResult(gomock.Any(), gomock.Any()).
+				Return(ingest.WriteBatchResult{
+					Succeeded:    1,
+					Failed:       1,
+					FailedSeries: []int{1},
+					Errors:       tc.errs,
+				}, tc.errs[len(tc.errs)-1])
+
+			scope := tally.NewTestScope("", nil)
+			promWrite := &PromWriteHandler{
+				downsamplerAndWriter: mockDownsamplerAndWriter,
+				promWriteMetrics:     newPromWriteMetrics(scope),
+			}
+
+			promReq := test.GeneratePromWriteRequest()
+			promReqBody := test.GeneratePromWriteRequestBody(t, promReq)
+			req, err := http.NewRequest("POST", PromWriteURL, promReqBody)
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			promWrite.ServeHTTP(recorder, req)
+			require.Equal(t, tc.status, recorder.Code)
+		})
+	}
+}
@@ -61,7 +61,7 @@ func makeTagOptions() models.TagOptions {
 }
 
 func setupHandler(store storage.Storage) (*Handler, error) {
-	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(store, nil, testWorkerPool)
+	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(store, nil, testWorkerPool, ingest.Options{})
 	return NewHandler(
 		downsamplerAndWriter,
 		makeTagOptions(),
@@ -78,7 +78,7 @@ func TestHandlerFetchTimeoutError(t *testing.T) {
 
 	ctrl := gomock.NewController(t)
 	storage, _ := m3.NewStorageAndSession(t, ctrl)
-	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(storage, nil, testWorkerPool)
+	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(storage, nil, testWorkerPool, ingest.Options{})
 
 	negValue := -1 * time.Second
 	dbconfig := &dbconfig.DBConfiguration{Client: client.Configuration{FetchTimeout: &negValue}}
@@ -92,7 +92,7 @@ func TestHandlerFetchTimeout(t *testing.T) {
 
 	ctrl := gomock.NewController(t)
 	storage, _ := m3.NewStorageAndSession(t, ctrl)
-	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(storage, nil, testWorkerPool)
+	downsamplerAndWriter := ingest.NewDownsamplerAndWriter(storage, nil, testWorkerPool, ingest.Options{})
 
 	fourMin := 4 * time.Minute
 	dbconfig := &dbconfig.DBConfiguration{Client: client.Configuration{FetchTimeout: &fourMin}}
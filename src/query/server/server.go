@@ -24,6 +24,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -36,7 +37,9 @@ import (
 	etcdclient "github.com/m3db/m3/src/cluster/client/etcd"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/downsample"
 	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
+	ingestbinary "github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/binary"
 	ingestcarbon "github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/carbon"
+	ingestopentsdb "github.com/m3db/m3/src/cmd/services/m3coordinator/ingest/opentsdb"
 	dbconfig "github.com/m3db/m3/src/cmd/services/m3dbnode/config"
 	"github.com/m3db/m3/src/cmd/services/m3query/config"
 	"github.com/m3db/m3/src/dbnode/client"
@@ -58,6 +61,7 @@ import (
 	"github.com/m3db/m3/src/x/serialize"
 	"github.com/m3db/m3x/clock"
 	xconfig "github.com/m3db/m3x/config"
+	xerrors "github.com/m3db/m3x/errors"
 	"github.com/m3db/m3x/instrument"
 	"github.com/m3db/m3x/pool"
 	xserver "github.com/m3db/m3x/server"
@@ -88,6 +92,7 @@ var (
 
 	defaultDownsamplerAndWriterWorkerPoolSize = 1024
 	defaultCarbonIngesterWorkerPoolSize       = 1024
+	carbonIngesterShutdownTimeout             = 10 * time.Second
 )
 
 type cleanupFn func() error
@@ -250,7 +255,15 @@ func Run(runOpts RunOptions) {
 
 	engine := executor.NewEngine(backendStorage, scope.SubScope("engine"), *cfg.LookbackDuration)
 
-	downsamplerAndWriter, err := newDownsamplerAndWriter(backendStorage, downsampler)
+	writerOpts, err := cfg.Writer.NewOptions(instrumentOptions.SetMetricsScope(
+		scope.SubScope("downsampler-and-writer")))
+	if err != nil {
+		logger.Fatal("unable to create downsampler and writer options", zap.Error(err))
+	}
+	writerOpts.LateSampleGracePeriod = cfg.Downsample.LateSampleGracePeriod
+
+	downsamplerAndWriter, err := newDownsamplerAndWriter(backendStorage, downsampler,
+		writerOpts, cfg.Writer.WorkerPoolSize)
 	if err != nil {
 		logger.Fatal("unable to create new downsampler and writer", zap.Error(err))
 	}
@@ -313,8 +326,31 @@ func Run(runOpts RunOptions) {
 	}
 
 	if cfg.Carbon != nil && cfg.Carbon.Ingester != nil {
-		startCarbonIngestion(
-			cfg.Carbon, instrumentOptions, logger, m3dbClusters, downsamplerAndWriter)
+		carbonClusters, cleanupCarbonClusters, err := newCarbonClusters(runOpts, cfg,
+			tagOptions, logger, m3dbClusters, downsamplerAndWriter, writerOpts,
+			instrumentOptions, readWorkerPool, writeWorkerPool)
+		if err != nil {
+			logger.Fatal("unable to set up carbon clusters", zap.Error(err))
+		}
+		defer cleanupCarbonClusters()
+
+		shutdownCarbon := startCarbonIngestion(cfg.Carbon, instrumentOptions,
+			logger, m3dbClusters, downsamplerAndWriter, carbonClusters)
+		defer func() {
+			if err := shutdownCarbon(); err != nil {
+				logger.Error("unable to drain carbon ingestion connections", zap.Error(err))
+			}
+		}()
+	}
+
+	if cfg.BinaryIngest != nil {
+		startBinaryIngestion(
+			cfg.BinaryIngest, instrumentOptions, tagOptions, logger, downsamplerAndWriter)
+	}
+
+	if cfg.OpenTSDBIngest != nil {
+		startOpenTSDBIngestion(
+			cfg.OpenTSDBIngest, instrumentOptions, tagOptions, logger, downsamplerAndWriter)
 	}
 
 	var interruptCh <-chan error = make(chan error)
@@ -760,13 +796,110 @@ func startGrpcServer(
 	return server, startErr
 }
 
+// carbonCluster is a cluster that a share of the carbon series are written to.
+type carbonCluster struct {
+	name     string
+	clusters m3.Clusters
+	writer   ingest.DownsamplerAndWriter
+}
+
+// newCarbonClusters sets up the clusters the carbon series are split across,
+// a cluster without any M3DB clusters of its own writes to the coordinator's.
+func newCarbonClusters(
+	runOpts RunOptions,
+	cfg config.Configuration,
+	tagOptions models.TagOptions,
+	logger *zap.Logger,
+	m3dbClusters m3.Clusters,
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+	writerOpts ingest.Options,
+	instrumentOptions instrument.Options,
+	readWorkerPool xsync.PooledWorkerPool,
+	writeWorkerPool xsync.PooledWorkerPool,
+) ([]carbonCluster, cleanupFn, error) {
+	var (
+		carbonClusters []carbonCluster
+		cleanups       []cleanupFn
+	)
+	cleanup := func() error {
+		var lastErr error
+		for _, cleanup := range cleanups {
+			if err := cleanup(); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	for _, clusterCfg := range cfg.Carbon.Ingester.Clusters {
+		if len(clusterCfg.Clusters) == 0 {
+			carbonClusters = append(carbonClusters, carbonCluster{
+				name:     clusterCfg.Name,
+				clusters: m3dbClusters,
+				writer:   downsamplerAndWriter,
+			})
+			continue
+		}
+
+		// The series of the cluster are only written to its own M3DB
+		// clusters and never fanned out to any remote coordinators.
+		storageCfg := cfg
+		storageCfg.Clusters = clusterCfg.Clusters
+		storageCfg.RPC = nil
+
+		clusters, poolWrapper, err := initClusters(storageCfg, nil, logger)
+		if err != nil {
+			cleanup()
+			return nil, nil, errors.Wrapf(err,
+				"unable to init carbon cluster %s", clusterCfg.Name)
+		}
+
+		clusterIOpts := instrumentOptions.SetMetricsScope(instrumentOptions.MetricsScope().
+			Tagged(map[string]string{"carbon-cluster": clusterCfg.Name}))
+		clusterStorage, _, downsampler, storageCleanup, err := newM3DBStorage(
+			RunOptions{},
+			storageCfg,
+			tagOptions,
+			logger,
+			clusters,
+			poolWrapper,
+			clusterIOpts,
+			readWorkerPool,
+			writeWorkerPool,
+		)
+		if err != nil {
+			cleanup()
+			return nil, nil, errors.Wrapf(err,
+				"unable to set up carbon cluster %s", clusterCfg.Name)
+		}
+		cleanups = append(cleanups, storageCleanup)
+
+		writer, err := newDownsamplerAndWriter(clusterStorage, downsampler,
+			writerOpts, cfg.Writer.WorkerPoolSize)
+		if err != nil {
+			cleanup()
+			return nil, nil, errors.Wrapf(err,
+				"unable to create downsampler and writer for carbon cluster %s", clusterCfg.Name)
+		}
+
+		carbonClusters = append(carbonClusters, carbonCluster{
+			name:     clusterCfg.Name,
+			clusters: clusters,
+			writer:   writer,
+		})
+	}
+
+	return carbonClusters, cleanup, nil
+}
+
 func startCarbonIngestion(
 	cfg *config.CarbonConfiguration,
 	iOpts instrument.Options,
 	logger *zap.Logger,
 	m3dbClusters m3.Clusters,
 	downsamplerAndWriter ingest.DownsamplerAndWriter,
-) {
+	carbonClusters []carbonCluster,
+) cleanupFn {
 	ingesterCfg := cfg.Ingester
 	logger.Info("carbon ingestion enabled, configuring ingester")
 
@@ -799,13 +932,25 @@ func startCarbonIngestion(
 		logger.Fatal("carbon ingestion is only supported when connecting to M3DB clusters directly")
 	}
 
-	// Validate provided rules.
+	// Validate provided rules against every cluster that series are written to.
 	var (
 		clusterNamespaces = m3dbClusters.ClusterNamespaces()
 		rules             = ingestcarbon.CarbonIngesterRules{
 			Rules: ingesterCfg.RulesOrDefault(clusterNamespaces),
 		}
+		targetClusters = []m3.Clusters{m3dbClusters}
+		clusterWriters []ingestcarbon.ClusterWriter
 	)
+	if len(carbonClusters) > 0 {
+		targetClusters = targetClusters[:0]
+		for _, cluster := range carbonClusters {
+			targetClusters = append(targetClusters, cluster.clusters)
+			clusterWriters = append(clusterWriters, ingestcarbon.ClusterWriter{
+				Name:   cluster.name,
+				Writer: cluster.writer,
+			})
+		}
+	}
 	for _, rule := range rules.Rules {
 		// Sort so we can detect duplicates.
 		sort.Slice(rule.Policies, func(i, j int) bool {
@@ -830,43 +975,80 @@ func startCarbonIngestion(
 					zap.String("pattern", rule.Pattern), zap.Duration("resolution", policy.Resolution), zap.Duration("retention", policy.Retention))
 			}
 
-			_, ok := m3dbClusters.AggregatedClusterNamespace(m3.RetentionResolution{
-				Resolution: policy.Resolution,
-				Retention:  policy.Retention,
-			})
+			for _, clusters := range targetClusters {
+				_, ok := clusters.AggregatedClusterNamespace(m3.RetentionResolution{
+					Resolution: policy.Resolution,
+					Retention:  policy.Retention,
+				})
 
-			// Disallow storage policies that don't match any known M3DB clusters.
-			if !ok {
-				logger.Fatal(
-					"cannot enable carbon ingestion without a corresponding aggregated M3DB namespace",
-					zap.String("resolution", policy.Resolution.String()), zap.String("retention", policy.Retention.String()))
+				// Disallow storage policies that don't match any known M3DB clusters.
+				if !ok {
+					logger.Fatal(
+						"cannot enable carbon ingestion without a corresponding aggregated M3DB namespace",
+						zap.String("resolution", policy.Resolution.String()), zap.String("retention", policy.Retention.String()))
+				}
 			}
 		}
 	}
 
 	if len(rules.Rules) == 0 {
 		logger.Warn("no carbon ingestion rules were provided and no aggregated M3DB namespaces exist, carbon metrics will not be ingested")
-		return
+		return func() error { return nil }
 	}
 
 	if len(ingesterCfg.Rules) == 0 {
 		logger.Info("no carbon ingestion rules were provided, all carbon metrics will be written to all aggregated M3DB namespaces")
 	}
 
+	separator, err := ingesterCfg.SeparatorOrDefault()
+	if err != nil {
+		logger.Fatal("invalid carbon separator", zap.Error(err))
+	}
+
+	normalizer, err := ingestcarbon.NewNormalizer(ingesterCfg.Normalization, separator)
+	if err != nil {
+		logger.Fatal("unable to create carbon name normalizer", zap.Error(err))
+	}
+
 	// Create ingester.
-	ingester, err := ingestcarbon.NewIngester(
-		downsamplerAndWriter, rules, ingestcarbon.Options{
-			Debug:             ingesterCfg.Debug,
-			InstrumentOptions: carbonIOpts,
-			WorkerPool:        workerPool,
-		})
+	ingesterOpts := ingestcarbon.Options{
+		Debug:             ingesterCfg.Debug,
+		InstrumentOptions: carbonIOpts,
+		WorkerPool:        workerPool,
+
+		MaxConcurrencyPerConnection: ingesterCfg.MaxConcurrencyPerConnection,
+		EmptyNames:                  ingesterCfg.EmptyNames,
+		NonFiniteValues:             ingesterCfg.NonFiniteValues,
+		TCPReadBufferSize:           ingesterCfg.TCP.ReadBufferSize,
+		TCPWriteBufferSize:          ingesterCfg.TCP.WriteBufferSize,
+		TCPNoDelay:                  ingesterCfg.TCP.NoDelay,
+		TimestampResolution:         ingesterCfg.TimestampResolution,
+		MaxLineLength:               ingesterCfg.MaxLineLength,
+		MaxDatagramSize:             ingesterCfg.MaxDatagramSize,
+		BatchSize:                   ingesterCfg.Batch.Size,
+		BatchFlushInterval:          ingesterCfg.Batch.FlushInterval,
+		BatchFlushDownsampler:       ingesterCfg.Batch.FlushDownsampler,
+		TagNames:                    ingesterCfg.TagNames,
+		Normalizer:                  normalizer,
+		NameFilter:                  ingesterCfg.NameFilter,
+		RateLimit:                   ingesterCfg.RateLimit,
+		NameTag:                     ingesterCfg.NameTag,
+		SourceFromRemoteAddr:        ingesterCfg.SourceFromRemoteAddr,
+		Separator:                   separator,
+		AllowImplicitTimestamp:      ingesterCfg.AllowImplicitTimestamp,
+		Clusters:                    clusterWriters,
+	}
+	ingester, err := ingestcarbon.NewIngester(downsamplerAndWriter, rules, ingesterOpts)
 	if err != nil {
 		logger.Fatal("unable to create carbon ingester", zap.Error(err))
 	}
 
 	// Start server.
 	var (
-		serverOpts          = xserver.NewOptions().SetInstrumentOptions(carbonIOpts)
+		serverOpts = xserver.NewOptions().
+				SetInstrumentOptions(carbonIOpts).
+				SetTCPConnectionKeepAlive(ingesterCfg.TCP.KeepAliveOrDefault()).
+				SetTCPConnectionKeepAlivePeriod(ingesterCfg.TCP.KeepAlivePeriod)
 		carbonListenAddress = ingesterCfg.ListenAddressOrDefault()
 		carbonServer        = xserver.NewServer(carbonListenAddress, ingester, serverOpts)
 	)
@@ -874,27 +1056,250 @@ func startCarbonIngestion(
 		logger.Fatal("no listen address specified for carbon ingester")
 	}
 
+	var tlsListeners []*ingestcarbon.TLSListener
+	listenAndServe := func(server xserver.Server, address string) error {
+		if ingesterCfg.TLS == nil {
+			return server.ListenAndServe()
+		}
+
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		// The server can only configure keep-alive on the TCP connections
+		// it accepts, not on the TLS connections that wrap them.
+		keepAliveListener := tcpKeepAliveListener{
+			Listener:        listener,
+			keepAlive:       ingesterCfg.TCP.KeepAliveOrDefault(),
+			keepAlivePeriod: ingesterCfg.TCP.KeepAlivePeriod,
+		}
+		tlsListener, err := ingestcarbon.NewTLSListener(keepAliveListener, *ingesterCfg.TLS)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		tlsListeners = append(tlsListeners, tlsListener)
+		return server.Serve(tlsListener)
+	}
+
 	logger.Info("starting carbon ingestion server", zap.String("listenAddress", carbonListenAddress))
-	err = carbonServer.ListenAndServe()
+	err = listenAndServe(carbonServer, carbonListenAddress)
 	if err != nil {
 		logger.Fatal("unable to start carbon ingestion server at listen address",
 			zap.String("listenAddress", carbonListenAddress), zap.Error(err))
 	}
 	logger.Info("started carbon ingestion server", zap.String("listenAddress", carbonListenAddress))
+
+	var (
+		ingesters   = []ingestcarbon.Ingester{ingester}
+		servers     = []xserver.Server{carbonServer}
+		packetConns []net.PacketConn
+	)
+	if udpListenAddress := strings.TrimSpace(ingesterCfg.UDPListenAddress); udpListenAddress != "" {
+		logger.Info("starting carbon UDP ingestion", zap.String("listenAddress", udpListenAddress))
+		packetConn, err := net.ListenPacket("udp", udpListenAddress)
+		if err != nil {
+			logger.Fatal("unable to start carbon UDP ingestion at listen address",
+				zap.String("listenAddress", udpListenAddress), zap.Error(err))
+		}
+		go ingester.HandlePacketConn(packetConn)
+		packetConns = append(packetConns, packetConn)
+		logger.Info("started carbon UDP ingestion", zap.String("listenAddress", udpListenAddress))
+	}
+
+	pickleListenAddress := strings.TrimSpace(ingesterCfg.PickleListenAddress)
+	if pickleListenAddress != "" {
+		// The pickle ingester shares the worker pool and metrics scope of the
+		// plaintext ingester.
+		pickleIngester, err := ingestcarbon.NewPickleIngester(downsamplerAndWriter, rules, ingesterOpts)
+		if err != nil {
+			logger.Fatal("unable to create carbon pickle ingester", zap.Error(err))
+		}
+
+		logger.Info("starting carbon pickle ingestion server", zap.String("listenAddress", pickleListenAddress))
+		pickleServer := xserver.NewServer(pickleListenAddress, pickleIngester, serverOpts)
+		err = listenAndServe(pickleServer, pickleListenAddress)
+		if err != nil {
+			logger.Fatal("unable to start carbon pickle ingestion server at listen address",
+				zap.String("listenAddress", pickleListenAddress), zap.Error(err))
+		}
+		logger.Info("started carbon pickle ingestion server", zap.String("listenAddress", pickleListenAddress))
+
+		ingesters = append(ingesters, pickleIngester)
+		servers = append(servers, pickleServer)
+	}
+
+	stopTLSReload := reloadCarbonTLSOnSignal(tlsListeners, logger)
+	return func() error {
+		stopTLSReload()
+
+		// Drain the connections so that the lines already read, including any
+		// buffered batch, are written before the servers close them.
+		ctx, cancel := context.WithTimeout(context.Background(), carbonIngesterShutdownTimeout)
+		defer cancel()
+
+		var multiErr xerrors.MultiError
+		for _, ingester := range ingesters {
+			multiErr = multiErr.Add(ingester.Shutdown(ctx))
+		}
+		for _, server := range servers {
+			server.Close()
+		}
+		for _, packetConn := range packetConns {
+			multiErr = multiErr.Add(packetConn.Close())
+		}
+		return multiErr.FinalError()
+	}
 }
 
-func newDownsamplerAndWriter(storage storage.Storage, downsampler downsample.Downsampler) (ingest.DownsamplerAndWriter, error) {
+// reloadCarbonTLSOnSignal reloads the certificates of the TLS listeners
+// whenever the process receives SIGHUP until the returned function is
+// called, connections accepted after a reload use the new certificates.
+func reloadCarbonTLSOnSignal(
+	tlsListeners []*ingestcarbon.TLSListener,
+	logger *zap.Logger,
+) func() {
+	if len(tlsListeners) == 0 {
+		return func() {}
+	}
+
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			for _, tlsListener := range tlsListeners {
+				if err := tlsListener.Reload(); err != nil {
+					logger.Error("unable to reload carbon TLS certificates, keeping the current certificates",
+						zap.String("listenAddress", tlsListener.Addr().String()), zap.Error(err))
+					continue
+				}
+				logger.Info("reloaded carbon TLS certificates",
+					zap.String("listenAddress", tlsListener.Addr().String()))
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(reloadCh)
+		close(reloadCh)
+	}
+}
+
+// tcpKeepAliveListener configures TCP keep-alive on the connections it
+// accepts.
+type tcpKeepAliveListener struct {
+	net.Listener
+
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+}
+
+func (l tcpKeepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(l.keepAlive)
+		if l.keepAlivePeriod != 0 {
+			tcpConn.SetKeepAlivePeriod(l.keepAlivePeriod)
+		}
+	}
+	return conn, nil
+}
+
+func startBinaryIngestion(
+	cfg *config.BinaryIngestConfiguration,
+	iOpts instrument.Options,
+	tagOptions models.TagOptions,
+	logger *zap.Logger,
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+) {
+	logger.Info("binary ingestion enabled, configuring ingester")
+
+	binaryIOpts := iOpts.SetMetricsScope(
+		iOpts.MetricsScope().SubScope("ingest-binary"))
+	ingester, err := ingestbinary.NewIngester(
+		downsamplerAndWriter, ingestbinary.Options{
+			InstrumentOptions: binaryIOpts,
+			TagOptions:        tagOptions,
+			MaxFrameSize:      cfg.MaxFrameSize,
+		})
+	if err != nil {
+		logger.Fatal("unable to create binary ingester", zap.Error(err))
+	}
+
+	var (
+		serverOpts   = xserver.NewOptions().SetInstrumentOptions(binaryIOpts)
+		binaryServer = xserver.NewServer(cfg.ListenAddress, ingester, serverOpts)
+	)
+	logger.Info("starting binary ingestion server", zap.String("listenAddress", cfg.ListenAddress))
+	err = binaryServer.ListenAndServe()
+	if err != nil {
+		logger.Fatal("unable to start binary ingestion server at listen address",
+			zap.String("listenAddress", cfg.ListenAddress), zap.Error(err))
+	}
+	logger.Info("started binary ingestion server", zap.String("listenAddress", cfg.ListenAddress))
+}
+
+func startOpenTSDBIngestion(
+	cfg *config.OpenTSDBIngestConfiguration,
+	iOpts instrument.Options,
+	tagOptions models.TagOptions,
+	logger *zap.Logger,
+	downsamplerAndWriter ingest.DownsamplerAndWriter,
+) {
+	logger.Info("opentsdb ingestion enabled, configuring ingester")
+
+	openTSDBIOpts := iOpts.SetMetricsScope(
+		iOpts.MetricsScope().SubScope("ingest-opentsdb"))
+	ingester, err := ingestopentsdb.NewIngester(
+		downsamplerAndWriter, ingestopentsdb.Options{
+			InstrumentOptions:   openTSDBIOpts,
+			TagOptions:          tagOptions,
+			MaxLineLength:       cfg.MaxLineLength,
+			TimestampResolution: cfg.TimestampResolution,
+		})
+	if err != nil {
+		logger.Fatal("unable to create opentsdb ingester", zap.Error(err))
+	}
+
+	var (
+		serverOpts     = xserver.NewOptions().SetInstrumentOptions(openTSDBIOpts)
+		openTSDBServer = xserver.NewServer(cfg.ListenAddress, ingester, serverOpts)
+	)
+	logger.Info("starting opentsdb ingestion server", zap.String("listenAddress", cfg.ListenAddress))
+	err = openTSDBServer.ListenAndServe()
+	if err != nil {
+		logger.Fatal("unable to start opentsdb ingestion server at listen address",
+			zap.String("listenAddress", cfg.ListenAddress), zap.Error(err))
+	}
+	logger.Info("started opentsdb ingestion server", zap.String("listenAddress", cfg.ListenAddress))
+}
+
+func newDownsamplerAndWriter(
+	storage storage.Storage,
+	downsampler downsample.Downsampler,
+	opts ingest.Options,
+	workerPoolSize int,
+) (ingest.DownsamplerAndWriter, error) {
+	if workerPoolSize <= 0 {
+		workerPoolSize = defaultDownsamplerAndWriterWorkerPoolSize
+	}
+
 	// Make sure the downsampler and writer gets its own PooledWorkerPool and that its not shared with any other
-	// codepaths because PooledWorkerPools can deadlock if used recursively.
+	// codepaths because PooledWorkerPools can deadlock if used recursively. The pool does not grow on demand so
+	// that the number of concurrent storage writes is bounded by its size, writers block once all the workers
+	// are busy.
 	downAndWriterWorkerPoolOpts := xsync.NewPooledWorkerPoolOptions().
-		SetGrowOnDemand(true).
-		SetKillWorkerProbability(0.001)
+		SetGrowOnDemand(false)
 	downAndWriteWorkerPool, err := xsync.NewPooledWorkerPool(
-		defaultDownsamplerAndWriterWorkerPoolSize, downAndWriterWorkerPoolOpts)
+		workerPoolSize, downAndWriterWorkerPoolOpts)
 	if err != nil {
 		return nil, err
 	}
 	downAndWriteWorkerPool.Init()
 
-	return ingest.NewDownsamplerAndWriter(storage, downsampler, downAndWriteWorkerPool), nil
+	return ingest.NewDownsamplerAndWriter(storage, downsampler, downAndWriteWorkerPool, opts), nil
 }
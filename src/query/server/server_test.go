@@ -22,6 +22,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -31,15 +32,21 @@ import (
 	"testing"
 	"time"
 
+	"github.com/m3db/m3/src/cmd/services/m3coordinator/ingest"
 	"github.com/m3db/m3/src/cmd/services/m3query/config"
 	"github.com/m3db/m3/src/dbnode/client"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote"
 	"github.com/m3db/m3/src/query/api/v1/handler/prometheus/remote/test"
 	rpc "github.com/m3db/m3/src/query/generated/proto/rpcpb"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/storage"
 	"github.com/m3db/m3/src/query/storage/m3"
+	"github.com/m3db/m3/src/query/ts"
+	xclock "github.com/m3db/m3x/clock"
 	xconfig "github.com/m3db/m3x/config"
 	"github.com/m3db/m3x/ident"
 	xtest "github.com/m3db/m3x/test"
+	xtime "github.com/m3db/m3x/time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -322,3 +329,99 @@ writeWorkerPoolPolicy:
 	interruptCh <- fmt.Errorf("interrupt")
 	<-doneCh
 }
+
+// blockingStorage blocks writes until released, recording the peak number
+// of writes in flight at once.
+type blockingStorage struct {
+	storage.Storage
+
+	sync.Mutex
+	release  chan struct{}
+	inFlight int
+	peak     int
+	written  int
+}
+
+func (s *blockingStorage) Write(context.Context, *storage.WriteQuery) error {
+	s.Lock()
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	s.Unlock()
+
+	<-s.release
+
+	s.Lock()
+	s.inFlight--
+	s.written++
+	s.Unlock()
+	return nil
+}
+
+func (s *blockingStorage) stats() (inFlight, peak, written int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.inFlight, s.peak, s.written
+}
+
+type sliceIter struct {
+	values []ingest.IterValue
+	idx    int
+}
+
+func (i *sliceIter) Next() bool {
+	i.idx++
+	return i.idx <= len(i.values)
+}
+
+func (i *sliceIter) Current() ingest.IterValue { return i.values[i.idx-1] }
+func (i *sliceIter) Reset() error              { i.idx = 0; return nil }
+func (i *sliceIter) Error() error              { return nil }
+
+func TestDownsamplerAndWriterBoundsConcurrentWrites(t *testing.T) {
+	const (
+		workerPoolSize = 4
+		numSeries      = 64
+	)
+
+	store := &blockingStorage{release: make(chan struct{})}
+	downsamplerAndWriter, err := newDownsamplerAndWriter(store, nil,
+		ingest.Options{}, workerPoolSize)
+	require.NoError(t, err)
+
+	iter := &sliceIter{}
+	for i := 0; i < numSeries; i++ {
+		tags := models.NewTags(1, nil).AddTag(models.Tag{
+			Name:  []byte("series"),
+			Value: []byte(fmt.Sprintf("%d", i)),
+		})
+		iter.values = append(iter.values, ingest.IterValue{
+			Tags:       tags,
+			Datapoints: ts.Datapoints{{Timestamp: time.Now(), Value: 1}},
+			Unit:       xtime.Second,
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- downsamplerAndWriter.WriteBatch(context.Background(), iter, nil)
+	}()
+
+	// Wait for the writes to start and give the batch time to dispatch more
+	// writes than there are workers if it were able to.
+	require.True(t, xclock.WaitUntil(func() bool {
+		inFlight, _, _ := store.stats()
+		return inFlight > 0
+	}, 5*time.Second))
+	time.Sleep(100 * time.Millisecond)
+	_, peak, _ := store.stats()
+	require.True(t, peak <= workerPoolSize, "peak in-flight writes %d", peak)
+
+	close(store.release)
+	require.NoError(t, <-done)
+
+	_, peak, written := store.stats()
+	require.True(t, peak <= workerPoolSize, "peak in-flight writes %d", peak)
+	require.Equal(t, numSeries, written)
+}
@@ -472,44 +472,85 @@ func (s *m3storage) Close() error {
 	return nil
 }
 
-func (s *m3storage) writeSingle(
-	ctx context.Context,
-	query *storage.WriteQuery,
-	datapoint ts.Datapoint,
-	identID ident.ID,
-	iterator ident.TagIterator,
-) error {
-	var (
-		namespace ClusterNamespace
-		err       error
-	)
+// ValidateAttributes returns an error if there is no cluster namespace
+// for the attributes.
+func (s *m3storage) ValidateAttributes(attributes storage.Attributes) error {
+	_, err := s.clusterNamespace(attributes)
+	return err
+}
+
+func (s *m3storage) clusterNamespace(
+	attributes storage.Attributes,
+) (ClusterNamespace, error) {
+	if attributes.NamespaceID != "" {
+		return s.clusterNamespaceByID(attributes)
+	}
 
-	attributes := query.Attributes
 	switch attributes.MetricsType {
 	case storage.UnaggregatedMetricsType:
-		namespace = s.clusters.UnaggregatedClusterNamespace()
+		return s.clusters.UnaggregatedClusterNamespace(), nil
 	case storage.AggregatedMetricsType:
 		attrs := RetentionResolution{
 			Retention:  attributes.Retention,
 			Resolution: attributes.Resolution,
 		}
-		var exists bool
-		namespace, exists = s.clusters.AggregatedClusterNamespace(attrs)
+		namespace, exists := s.clusters.AggregatedClusterNamespace(attrs)
 		if !exists {
-			err = fmt.Errorf("no configured cluster namespace for: retention=%s, resolution=%s",
+			return nil, fmt.Errorf("no configured cluster namespace for: retention=%s, resolution=%s",
 				attrs.Retention.String(), attrs.Resolution.String())
 		}
+		return namespace, nil
 	default:
 		metricsType := attributes.MetricsType
-		err = fmt.Errorf("invalid write request metrics type: %s (%d)",
+		return nil, fmt.Errorf("invalid write request metrics type: %s (%d)",
 			metricsType.String(), uint(metricsType))
 	}
+}
+
+// clusterNamespaceByID returns the cluster namespace with the namespace ID
+// of the attributes, which must be of the metrics type of the attributes.
+func (s *m3storage) clusterNamespaceByID(
+	attributes storage.Attributes,
+) (ClusterNamespace, error) {
+	for _, namespace := range s.clusters.ClusterNamespaces() {
+		if namespace.NamespaceID().String() != attributes.NamespaceID {
+			continue
+		}
+
+		metricsType := namespace.Options().Attributes().MetricsType
+		if metricsType != attributes.MetricsType {
+			return nil, fmt.Errorf("cluster namespace: %s is %s not %s",
+				attributes.NamespaceID, metricsType.String(),
+				attributes.MetricsType.String())
+		}
+		return namespace, nil
+	}
+
+	return nil, fmt.Errorf("no configured cluster namespace with ID: %s",
+		attributes.NamespaceID)
+}
+
+func (s *m3storage) writeSingle(
+	ctx context.Context,
+	query *storage.WriteQuery,
+	datapoint ts.Datapoint,
+	identID ident.ID,
+	iterator ident.TagIterator,
+) error {
+	namespace, err := s.clusterNamespace(query.Attributes)
 	if err != nil {
 		return err
 	}
 
+	// The annotation of the datapoint takes precedence over the annotation
+	// of the query.
+	annotation := datapoint.Annotation
+	if annotation == nil {
+		annotation = query.Annotation
+	}
+
 	namespaceID := namespace.NamespaceID()
 	session := namespace.Session()
 	return session.WriteTagged(namespaceID, identID, iterator,
-		datapoint.Timestamp, datapoint.Value, query.Unit, query.Annotation)
+		datapoint.Timestamp, datapoint.Value, query.Unit, annotation)
 }
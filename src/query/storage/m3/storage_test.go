@@ -250,6 +250,38 @@ func TestLocalWriteAggregatedSuccess(t *testing.T) {
 	assert.NoError(t, store.Close())
 }
 
+func TestLocalWriteAggregatedByNamespaceID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	store, sessions := setup(t, ctrl)
+
+	// The namespace ID takes precedence over the retention and resolution.
+	writeQuery := newWriteQuery()
+	writeQuery.Attributes = storage.Attributes{
+		MetricsType: storage.AggregatedMetricsType,
+		Retention:   30 * 24 * time.Hour,
+		Resolution:  time.Minute,
+		NamespaceID: "metrics_aggregated_partial_1m:180d",
+	}
+
+	session := sessions.aggregatedPartial6MonthRetention1MinuteResolution
+	session.EXPECT().WriteTagged(ident.NewIDMatcher("metrics_aggregated_partial_1m:180d"),
+		gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Times(len(writeQuery.Datapoints))
+
+	err := store.Write(context.TODO(), writeQuery)
+	assert.NoError(t, err)
+
+	writeQuery.Attributes.NamespaceID = "metrics_aggregated_unknown"
+	err = store.Write(context.TODO(), writeQuery)
+	assert.Error(t, err)
+
+	writeQuery.Attributes.NamespaceID = "metrics_unaggregated"
+	err = store.Write(context.TODO(), writeQuery)
+	assert.Error(t, err)
+	assert.NoError(t, store.Close())
+}
+
 func TestLocalRead(t *testing.T) {
 	ctrl := gomock.NewController(xtest.Reporter{T: t})
 	defer ctrl.Finish()
@@ -163,6 +163,8 @@ type WriteQuery struct {
 	Tags       models.Tags
 	Datapoints ts.Datapoints
 	Unit       xtime.Unit
+	// Annotation is the annotation of every datapoint that does not set
+	// its own annotation.
 	Annotation []byte
 	Attributes Attributes
 }
@@ -220,6 +222,28 @@ type Appender interface {
 	Write(ctx context.Context, query *WriteQuery) error
 }
 
+// Deleter is implemented by storages that support deleting series.
+type Deleter interface {
+	// Delete deletes the datapoints of a series within a time range
+	Delete(ctx context.Context, query *DeleteQuery) error
+}
+
+// DeleteQuery represents the series and time range to delete, the whole
+// series is deleted if neither Start nor End is set.
+type DeleteQuery struct {
+	Tags  models.Tags
+	Start time.Time
+	End   time.Time
+}
+
+// AttributesValidator is implemented by storages that can validate that
+// writes with the given attributes can be stored before writing them.
+type AttributesValidator interface {
+	// ValidateAttributes returns an error if writes with the attributes
+	// cannot be stored
+	ValidateAttributes(attributes Attributes) error
+}
+
 // SearchResults is the result from a search
 type SearchResults struct {
 	Metrics models.Metrics
@@ -274,4 +298,8 @@ type Attributes struct {
 	MetricsType MetricsType
 	Retention   time.Duration
 	Resolution  time.Duration
+
+	// NamespaceID, if set, selects the namespace to write to by its ID
+	// rather than by its metrics type, retention and resolution.
+	NamespaceID string
 }
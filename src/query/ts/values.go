@@ -67,6 +67,10 @@ type Values interface {
 type Datapoint struct {
 	Timestamp time.Time
 	Value     float64
+
+	// Annotation is an optional opaque annotation of the datapoint, such as
+	// an exemplar, nil if the datapoint has none.
+	Annotation []byte
 }
 
 // Datapoints is a list of datapoints.